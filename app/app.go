@@ -3,11 +3,23 @@ package app
 import (
 	"context"
 	"database/sql"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jordanp/goapp/cache"
+	"github.com/jordanp/goapp/jobs"
+	"github.com/jordanp/goapp/mail"
+	"github.com/jordanp/goapp/outbox"
 	"github.com/jordanp/goapp/pkg/auth"
 	"github.com/jordanp/goapp/pkg/log"
 	"github.com/jordanp/goapp/store"
+	"github.com/jordanp/goapp/store/memory"
+	"github.com/jordanp/goapp/webhook"
 	"github.com/pkg/errors"
 )
 
@@ -18,67 +30,272 @@ var (
 )
 
 type Application struct {
-	log log.Logger
-	db  *sql.DB
+	log            log.Logger
+	db             *store.DB
+	purgeTicker    *time.Ticker
+	purgeDone      chan struct{} // Closed by Stop to end the purgeLoop
+	dispatcher     *outbox.Dispatcher
+	deliverer      *webhook.Deliverer
+	worker         *jobs.Worker
+	jobShutdown    time.Duration
+	idempotencyTTL time.Duration
+	mailer         mail.Mailer
+	invitationURL  string
+	invitationTTL  time.Duration
+	trustedProxies []*net.IPNet    // See clientIP
+	changes        *store.Listener // The changes of the users and companies, applied to the caches
 
-	TokenManager auth.TokenManager
-	UserStore    *store.User
-	CompanyStore *store.Company
-	UserCache    *cache.User
+	TokenManager        auth.TokenManager
+	DB                  store.Transactor // The querier of the stores, WithTx composes their methods
+	UserStore           store.UserStore
+	CompanyStore        store.CompanyStore
+	AuditStore          store.AuditStore
+	OutboxStore         store.OutboxStore
+	WebhookStore        store.WebhookStore
+	JobStore            store.JobStore
+	IdempotencyStore    store.IdempotencyStore
+	InvitationStore     store.InvitationStore
+	APIKeyStore         store.APIKeyStore
+	MetadataSchemaStore store.MetadataSchemaStore
+	Importer            store.ImportStore
+	UserCache           *cache.User
 }
 
+// memoryDSN selects the in-memory stores, whose data is lost when the application stops.
+const memoryDSN = "memory://"
+
 func NewApplication(log log.Logger, config *Config) (*Application, error) {
 	tokenManager, err := auth.NewTokenManager(config.secretKey)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to initialize token manager")
 	}
 
-	db, err := NewDBConnection(config.dataSourceName)
-	if err != nil {
+	app := &Application{
+		log: log, TokenManager: tokenManager, jobShutdown: config.jobShutdownTimeout, idempotencyTTL: config.idempotencyTTL,
+		mailer: config.mailer, invitationURL: config.invitationURL, invitationTTL: config.invitationTTL,
+		trustedProxies: config.trustedProxies,
+	}
+	if app.mailer == nil {
+		app.mailer = mail.LogMailer{Log: log.F("component", "mailer")}
+	}
+	if config.dataSourceName == memoryDSN {
+		if len(config.replicaDSNs) > 0 {
+			log.Warn("the in-memory stores don't have replicas, ignoring them")
+		}
+		app.openMemoryStores()
+	} else if err := app.openSQLStores(config); err != nil {
 		return nil, err
 	}
 
-	userStore, err := store.NewUserStore(log.F("component", "userstore"), db)
+	app.UserCache, err = cache.NewUserCache(log.F("component", "usercache"), app.UserStore, app.DB, app.changes)
 	if err != nil {
+		app.changes.Close()
 		return nil, err
 	}
+	app.UserCache.RegisterMetrics(nil, "")
+
+	// admin/admin backdoor/init
+	app.UserStore.Add(context.Background(), app.DB, "admin", "$2y$10$CpVqJK/usJ8K8musmkaM1u3K7agJ0m/YOGQPLuwiBZ1M15cDHbkcu", "admin@goapp", "admin", nil)
+
+	app.worker = jobs.NewWorker(log.F("component", "jobs"), app.JobStore, app.DB, config.jobRetryPolicy, config.eventPollInterval, config.jobWorkers,
+		purgeHandler{app},
+		reencryptHandler{app},
+		sendInvitationHandler{app},
+	)
+	if app.db != nil {
+		app.enqueueReencrypt()
+	}
+	app.purgeLoop(config.softDeleteRetention, time.Hour)
+
+	sinks := append([]outbox.Sink{webhook.Sink{Store: app.WebhookStore, Querier: app.DB}}, config.eventSinks...)
+	app.dispatcher = outbox.NewDispatcher(log.F("component", "outbox"), app.OutboxStore, app.DB, config.eventPollInterval, sinks...)
+	client := &http.Client{Timeout: webhookTimeout}
+	app.deliverer = webhook.NewDeliverer(log.F("component", "webhooks"), app.WebhookStore, app.DB, client, config.webhookRetryPolicy, config.eventPollInterval)
+	return app, nil
+}
 
-	companyStore, err := store.NewCompanyStore(log.F("component", "companystore"), db)
+// replicaCheckInterval is how often the replicas are pinged, the reads of a replica which is
+// down go to the primary in the meantime.
+const replicaCheckInterval = 5 * time.Second
+
+// webhookTimeout bounds every webhook delivery, a webhook which doesn't answer in time is
+// retried.
+const webhookTimeout = 10 * time.Second
+
+func (a *Application) openSQLStores(config *Config) error {
+	if config.piiKeyring == nil {
+		return errors.New("the PII keyring is required by the SQL stores")
+	}
+	db, err := NewDBConnection(config.dataSourceName, config.dbPool)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	// Unlike the primary, the replicas can be down when the app starts.
+	replicas := make([]*store.DB, len(config.replicaDSNs))
+	for k := range config.replicaDSNs {
+		if replicas[k], err = openDB(config.replicaDSNs[k], config.dbPool); err != nil {
+			db.Close()
+			return errors.Wrapf(err, "failed to open replica %d", k)
+		}
 	}
+	db.UseReplicas(a.log.F("component", "replicas"), replicas, replicaCheckInterval)
+	store.RegisterMetrics(nil, "", db)
+	db.LogSlowQueries(a.log.F("component", "db"), config.slowQueryThreshold, config.explainSlowQueries)
+	a.db, a.DB = db, db
 
-	userCache, err := cache.NewUserCache(log.F("component", "usercache"), userStore)
+	// The audit and outbox stores must be created before the stores whose mutations are
+	// audited and publish domain events.
+	if a.AuditStore, err = store.NewAuditStore(a.log.F("component", "auditstore"), db); err != nil {
+		return err
+	}
+	if a.OutboxStore, err = store.NewOutboxStore(a.log.F("component", "outboxstore"), db); err != nil {
+		return err
+	}
+	if a.WebhookStore, err = store.NewWebhookStore(a.log.F("component", "webhookstore"), db); err != nil {
+		return err
+	}
+	if a.JobStore, err = store.NewJobStore(a.log.F("component", "jobstore"), db); err != nil {
+		return err
+	}
+	if a.IdempotencyStore, err = store.NewIdempotencyStore(a.log.F("component", "idempotencystore"), db, config.piiKeyring); err != nil {
+		return err
+	}
+	if a.UserStore, err = store.NewUserStore(a.log.F("component", "userstore"), db, config.piiKeyring); err != nil {
+		return err
+	}
+	if a.CompanyStore, err = store.NewCompanyStore(a.log.F("component", "companystore"), db, config.piiKeyring); err != nil {
+		return err
+	}
+	if a.APIKeyStore, err = store.NewAPIKeyStore(a.log.F("component", "apikeystore"), db); err != nil {
+		return err
+	}
+	if a.MetadataSchemaStore, err = store.NewMetadataSchemaStore(a.log.F("component", "metadataschemastore"), db); err != nil {
+		return err
+	}
+	if a.InvitationStore, err = store.NewInvitationStore(a.log.F("component", "invitationstore"), db, config.piiKeyring); err != nil {
+		return err
+	}
+	a.Importer = store.NewImporter(a.log.F("component", "importer"), db, config.piiKeyring)
+
+	// The changes committed by the other instances are only notified by Postgres.
+	if strings.HasPrefix(config.dataSourceName, sqliteScheme) {
+		a.changes = db.Listen()
+	} else if a.changes, err = store.ListenPostgres(a.log.F("component", "changes"), config.dataSourceName); err != nil {
+		return errors.Wrap(err, "failed to listen to the changes")
+	}
+	return nil
+}
+
+func (a *Application) openMemoryStores() {
+	db := memory.NewDB()
+	a.DB = db
+	a.AuditStore = memory.NewAuditStore(a.log.F("component", "auditstore"), db)
+	a.OutboxStore = memory.NewOutboxStore(a.log.F("component", "outboxstore"), db)
+	a.WebhookStore = memory.NewWebhookStore(a.log.F("component", "webhookstore"), db)
+	a.JobStore = memory.NewJobStore(a.log.F("component", "jobstore"), db)
+	a.IdempotencyStore = memory.NewIdempotencyStore(a.log.F("component", "idempotencystore"), db)
+	a.UserStore = memory.NewUserStore(a.log.F("component", "userstore"), db)
+	a.CompanyStore = memory.NewCompanyStore(a.log.F("component", "companystore"), db)
+	a.InvitationStore = memory.NewInvitationStore(a.log.F("component", "invitationstore"), db)
+	a.APIKeyStore = memory.NewAPIKeyStore(a.log.F("component", "apikeystore"), db)
+	a.MetadataSchemaStore = memory.NewMetadataSchemaStore(a.log.F("component", "metadataschemastore"), db)
+	a.Importer = memory.NewImporter(a.log.F("component", "importer"), db)
+	a.changes = db.Listen()
+}
+
+// sqliteScheme selects the SQLite backend, as in sqlite:///var/lib/goapp.db or sqlite://:memory:.
+// Any other DSN is a Postgres one.
+const sqliteScheme = "sqlite://"
+
+func NewDBConnection(dataSourceName string, pool DBPool) (*store.DB, error) {
+	db, err := openDB(dataSourceName, pool)
 	if err != nil {
 		return nil, err
 	}
 
-	// admin/admin backdoor/init
-	userStore.Add(context.Background(), "admin", "$2y$10$CpVqJK/usJ8K8musmkaM1u3K7agJ0m/YOGQPLuwiBZ1M15cDHbkcu", "admin@goapp", "admin")
-
-	return &Application{
-		log: log, db: db,
-		TokenManager: tokenManager,
-		UserStore:    userStore, CompanyStore: companyStore,
-		UserCache: userCache,
-	}, nil
+	ctx := context.Background()
+	if pool.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, pool.ConnectTimeout)
+		defer cancel()
+	}
+	if err = db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "failed to ping DB")
+	}
+	return db, nil
 }
 
-func NewDBConnection(dataSourceName string) (*sql.DB, error) {
-	db, err := sql.Open("postgres", dataSourceName)
+func openDB(dataSourceName string, pool DBPool) (*store.DB, error) {
+	driverName := store.DriverPostgres
+	if strings.HasPrefix(dataSourceName, sqliteScheme) {
+		driverName = store.DriverSQLite
+		dataSourceName = "file:" + strings.TrimPrefix(dataSourceName, sqliteScheme)
+		if strings.Contains(dataSourceName, "?") {
+			dataSourceName += "&_foreign_keys=1"
+		} else {
+			dataSourceName += "?_foreign_keys=1"
+		}
+	} else if pool.ConnectTimeout > 0 {
+		var err error
+		if dataSourceName, err = withConnectTimeout(dataSourceName, pool.ConnectTimeout); err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := sql.Open(driverName, dataSourceName)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to open DB connection")
 	}
+	if driverName == store.DriverSQLite {
+		// SQLite serializes the writers anyway, and every connection to :memory: has its own DB:
+		// the single connection is kept open, whatever the pool.
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+		db.SetConnMaxLifetime(0)
+		return store.NewDB(driverName, db), nil
+	}
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	if pool.MaxIdleConns > 0 { // Zero would disable the idle connections
+		db.SetMaxIdleConns(pool.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	return store.NewDB(driverName, db), nil
+}
 
-	if err = db.Ping(); err != nil {
-		return nil, errors.Wrap(err, "failed to ping DB")
+// withConnectTimeout sets the connect_timeout of a Postgres DSN, in the URL or in the key/value
+// format, unless it's already set. Postgres counts it in seconds.
+func withConnectTimeout(dataSourceName string, timeout time.Duration) (string, error) {
+	seconds := strconv.Itoa(int(math.Ceil(timeout.Seconds())))
+	if !strings.HasPrefix(dataSourceName, "postgres://") && !strings.HasPrefix(dataSourceName, "postgresql://") {
+		if strings.Contains(dataSourceName, "connect_timeout=") {
+			return dataSourceName, nil
+		}
+		return strings.TrimSpace(dataSourceName + " connect_timeout=" + seconds), nil
 	}
 
-	return db, nil
+	u, err := url.Parse(dataSourceName)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid DSN")
+	}
+	q := u.Query()
+	if q.Get("connect_timeout") == "" {
+		q.Set("connect_timeout", seconds)
+		u.RawQuery = q.Encode()
+	}
+	return u.String(), nil
 }
 
 func (a *Application) Stop() {
 	a.UserCache.Stop()
+	a.changes.Close()
+	if a.purgeTicker != nil {
+		a.purgeTicker.Stop()
+		close(a.purgeDone)
+	}
+	a.worker.Stop(a.jobShutdown)
+	a.dispatcher.Stop()
+	a.deliverer.Stop()
 
 	if a.db != nil {
 		if err := a.db.Close(); err != nil {
@@ -0,0 +1,140 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/middlewares"
+	"github.com/jordanp/goapp/store"
+)
+
+// withAuditInfo attributes the mutations made by the handler to the authenticated user, it
+// must be chained after an authenticator.
+func (a *Application) withAuditInfo(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := store.AuditInfo{RequestID: middlewares.RequestIDFromCtx(r.Context()), ClientIP: a.clientIP(r)}
+		if who := middlewares.WhoFromCtx(r.Context()); who != nil {
+			info.Actor = who.Who()
+		}
+		h(w, r.WithContext(store.WithAuditInfo(r.Context(), info)))
+	}
+}
+
+// clientIP is the peer of the request, unless it's a trusted proxy: X-Forwarded-For is read from
+// the last hop, skipping the trusted proxies. The hops before the first untrusted one are
+// controlled by the client.
+func (a *Application) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !a.trustedProxy(ip) {
+		return ip
+	}
+	forwardedFor := r.Header.Get("X-Forwarded-For")
+	if forwardedFor == "" {
+		return ip
+	}
+	hops := strings.Split(forwardedFor, ",")
+	for k := len(hops) - 1; k >= 0; k-- {
+		ip = strings.TrimSpace(hops[k])
+		if !a.trustedProxy(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+func (a *Application) trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, proxy := range a.trustedProxies {
+		if proxy.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTrustedProxies parses a comma separated list of IPs and CIDRs, see WithTrustedProxies.
+func ParseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, proxy := range strings.Split(list, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip == nil {
+				return nil, fmt.Errorf("invalid proxy '%s'", proxy)
+			} else if ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy '%s'", proxy)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (a *Application) GetAuditEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	query := r.URL.Query()
+	filter := entity.AuditFilter{
+		Actor:      query.Get("actor"),
+		Action:     query.Get("action"),
+		EntityType: query.Get("entity_type"),
+		EntityID:   query.Get("entity_id"),
+	}
+	var err error
+	if filter.Since, err = timeParam(r, "since"); err != nil {
+		WriteBadRequestError(w, "invalid 'since': %s", err)
+		return
+	}
+	if filter.Until, err = timeParam(r, "until"); err != nil {
+		WriteBadRequestError(w, "invalid 'until': %s", err)
+		return
+	}
+	if filter.Limit, err = intParam(r, "limit", 50); err != nil {
+		WriteBadRequestError(w, "invalid 'limit': %s", err)
+		return
+	}
+	if filter.Offset, err = intParam(r, "offset", 0); err != nil {
+		WriteBadRequestError(w, "invalid 'offset': %s", err)
+		return
+	}
+	if err := filter.Validate(); err != nil {
+		WriteBadRequestError(w, "input validation error: %s", err)
+		return
+	}
+
+	// Fetch one more event than requested to know whether there is a next page
+	limit := filter.Limit
+	filter.Limit++
+	events, err := a.AuditStore.List(ctx, a.DB, filter)
+	if err != nil {
+		WriteInternalServerError(w, err)
+		return
+	}
+
+	resp := entity.AuditEvents{Events: events}
+	if len(events) > limit {
+		resp.Events = events[:limit]
+		nextOffset := filter.Offset + limit
+		resp.NextOffset = &nextOffset
+	}
+	if resp.Events == nil {
+		resp.Events = []entity.AuditEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
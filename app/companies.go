@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"net/http"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/jordanp/goapp/entity"
 	pkglog "github.com/jordanp/goapp/pkg/log"
@@ -25,16 +24,36 @@ func (a *Application) CreateCompany(w http.ResponseWriter, r *http.Request) {
 		WriteBadRequestError(w, "input validation error: %s", err)
 		return
 	}
+	if !a.checkMetadata(w, r, entity.MetadataEntityCompany, company.Metadata) {
+		return
+	}
 
 	log = log.F("company", company.Name)
-	userIDs := make([]uuid.UUID, len(company.Users))
+	members := make([]entity.Membership, len(company.Users))
 	for k := range company.Users {
-		userIDs[k] = company.Users[k].ID
+		members[k] = entity.Membership{UserID: company.Users[k].ID, Role: company.Users[k].CompanyRole}
+	}
+	if company.ParentID != nil {
+		log = log.F("parent", company.ParentID)
 	}
-	insertedCompany, err := a.CompanyStore.Add(pkglog.WithLogger(ctx, log), company.Name, userIDs)
+	ctx = pkglog.WithLogger(ctx, log)
+
+	// The company isn't created if it can't be moved under its parent.
+	var insertedCompany entity.Company
+	err := a.DB.WithTx(ctx, func(tx store.Querier) error {
+		var err error
+		if insertedCompany, err = a.CompanyStore.Add(ctx, tx, company.Name, members, company.Metadata); err != nil {
+			return err
+		}
+		if company.ParentID == nil {
+			return nil
+		}
+		insertedCompany, err = a.CompanyStore.Move(ctx, tx, insertedCompany.ID.String(), company.ParentID.String(), 0)
+		return err
+	})
 	if err != nil {
 		switch errors.Cause(err).(type) {
-		case *store.AlreadyExistsError, *store.NotFoundError, *store.DupUserInCompanyError:
+		case *store.AlreadyExistsError, *store.NotFoundError, *store.DupUserInCompanyError, *store.CycleError:
 			WriteUnprocessableEntity(w, err)
 		default:
 			WriteInternalServerError(w, err)
@@ -45,13 +64,47 @@ func (a *Application) CreateCompany(w http.ResponseWriter, r *http.Request) {
 	insertedCompany.Users = company.Users
 	log.Info("company inserted")
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	setETag(w, insertedCompany.Version)
 	json.NewEncoder(w).Encode(insertedCompany)
 }
 
+// GetAllCompanies lists the companies without their members. The clients syncing them with
+// updated_since must overlap their queries, see store.Filter.
+func (a *Application) GetAllCompanies(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var filter store.Filter
+	var err error
+	if filter.IncludeDeleted, err = includeDeleted(r); err != nil {
+		WriteBadRequestError(w, "invalid 'include_deleted': %s", err)
+		return
+	}
+	if filter.UpdatedSince, err = timeParam(r, "updated_since"); err != nil {
+		WriteBadRequestError(w, "invalid 'updated_since': %s", err)
+		return
+	}
+	if filter.Metadata, err = metadataParams(r); err != nil {
+		WriteBadRequestError(w, "invalid metadata filter: %s", err)
+		return
+	}
+
+	companies := []entity.Company{}
+	err = a.CompanyStore.ForEach(ctx, a.DB, filter, func(company entity.Company) error {
+		companies = append(companies, company)
+		return nil
+	})
+	if err != nil {
+		WriteInternalServerError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(entity.Companies{Companies: companies})
+}
+
 func (a *Application) DeleteCompany(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	err := a.CompanyStore.DeleteByID(ctx, mux.Vars(r)["id"]) // Gorilla Mux will match route iff 'id' is not empty
+	err := a.CompanyStore.DeleteByID(ctx, a.DB, mux.Vars(r)["id"]) // Gorilla Mux will match route iff 'id' is not empty
 	if err != nil {
 		switch errors.Cause(err).(type) {
 		case *store.NotFoundError:
@@ -63,10 +116,59 @@ func (a *Application) DeleteCompany(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (a *Application) RestoreCompany(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	company, err := a.CompanyStore.Restore(ctx, a.DB, mux.Vars(r)["id"]) // Gorilla Mux will match route iff 'id' is not empty
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	pkglog.G(ctx).F("id", company.ID).Info("company restored")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	setETag(w, company.Version)
+	json.NewEncoder(w).Encode(company)
+}
+
 func (a *Application) GetCompany(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	company, err := a.CompanyStore.GetByID(ctx, mux.Vars(r)["id"]) // Gorilla Mux will match route iff 'name' is not empty
+	withDeleted, err := includeDeleted(r)
+	if err != nil {
+		WriteBadRequestError(w, "invalid 'include_deleted': %s", err)
+		return
+	}
+
+	withChildren, err := boolParam(r, "include_children")
+	if err != nil {
+		WriteBadRequestError(w, "invalid 'include_children': %s", err)
+		return
+	}
+	withEffectiveMembers, err := boolParam(r, "include_effective_members")
+	if err != nil {
+		WriteBadRequestError(w, "invalid 'include_effective_members': %s", err)
+		return
+	}
+
+	company, err := a.CompanyStore.GetByID(ctx, a.DB, mux.Vars(r)["id"], withDeleted) // Gorilla Mux will match route iff 'name' is not empty
+	if err == nil && withChildren {
+		var descendants []entity.Company
+		if descendants, err = a.CompanyStore.Descendants(ctx, a.DB, company.ID.String(), withDeleted); err == nil {
+			company.Children = entity.Tree(descendants)
+		}
+	}
+	if err == nil && withEffectiveMembers {
+		company.EffectiveMembers, err = a.CompanyStore.EffectiveMembers(ctx, a.DB, company.ID.String(), withDeleted)
+	}
+	if err == nil {
+		company.Quota, err = a.companyQuota(ctx, company.ID.String())
+	}
 	if err != nil {
 		switch errors.Cause(err).(type) {
 		case *store.NotFoundError:
@@ -77,5 +179,51 @@ func (a *Application) GetCompany(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	setETag(w, company.Version)
 	json.NewEncoder(w).Encode(company)
 }
+
+func (a *Application) UpdateCompany(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := pkglog.G(ctx)
+
+	version, ok := ifMatchVersion(r)
+	if !ok {
+		WritePreconditionFailedError(w, "invalid 'If-Match' header")
+		return
+	}
+
+	var patch entity.CompanyPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		WriteBadRequestError(w, "unable to decode json: %s", err)
+		return
+	}
+	if err := patch.Validate(); err != nil {
+		WriteBadRequestError(w, "input validation error: %s", err)
+		return
+	}
+	if patch.Metadata != nil && !a.checkMetadata(w, r, entity.MetadataEntityCompany, patch.Metadata) {
+		return
+	}
+
+	log = log.F("id", mux.Vars(r)["id"], "version", version)
+	updatedCompany, err := a.CompanyStore.Update(pkglog.WithLogger(ctx, log), a.DB, mux.Vars(r)["id"], patch, version)
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		case *store.VersionConflictError:
+			WritePreconditionFailedError(w, err)
+		case *store.AlreadyExistsError:
+			WriteUnprocessableEntity(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	log.Info("company updated")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	setETag(w, updatedCompany.Version)
+	json.NewEncoder(w).Encode(updatedCompany)
+}
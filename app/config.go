@@ -1,18 +1,151 @@
 package app
 
 import (
+	"fmt"
+	"net"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/jordanp/goapp/jobs"
+	"github.com/jordanp/goapp/mail"
+	"github.com/jordanp/goapp/outbox"
+	"github.com/jordanp/goapp/pkg/envelope"
+	"github.com/jordanp/goapp/store"
+	"github.com/jordanp/goapp/webhook"
 )
 
 type Config struct {
-	secretKey      string
-	dataSourceName string
+	secretKey           string
+	dataSourceName      string
+	replicaDSNs         []string
+	dbPool              DBPool
+	slowQueryThreshold  time.Duration
+	explainSlowQueries  bool
+	softDeleteRetention time.Duration
+	eventSinks          []outbox.Sink
+	eventPollInterval   time.Duration
+	webhookRetryPolicy  store.RetryPolicy
+	jobWorkers          int
+	jobShutdownTimeout  time.Duration
+	jobRetryPolicy      store.RetryPolicy
+	piiKeyring          *envelope.Keyring
+	idempotencyTTL      time.Duration
+	mailer              mail.Mailer
+	trustedProxies      []*net.IPNet
+	invitationURL       string
+	invitationTTL       time.Duration
+}
+
+// DBPool tunes the connection pools of the SQL DB and of its replicas. Zero values keep the
+// database/sql defaults, and no connect timeout. It doesn't apply to SQLite, which has a single
+// connection.
+type DBPool struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnectTimeout  time.Duration
+}
+
+type ConfigOption func(*Config)
+
+// WithSoftDeleteRetention sets for how long soft deleted records can be restored before
+// being purged. A zero retention disables the purge of the soft deleted records.
+func WithSoftDeleteRetention(retention time.Duration) ConfigOption {
+	return func(c *Config) { c.softDeleteRetention = retention }
+}
+
+// WithReplicas sets the DSNs of the read replicas of the Postgres DB.
+func WithReplicas(dataSourceNames []string) ConfigOption {
+	return func(c *Config) { c.replicaDSNs = dataSourceNames }
+}
+
+func WithDBPool(pool DBPool) ConfigOption {
+	return func(c *Config) { c.dbPool = pool }
+}
+
+// WithSlowQueryLog logs the SQL queries lasting longer than the threshold, along with their
+// plan if explain is true. A zero threshold disables the log.
+func WithSlowQueryLog(threshold time.Duration, explain bool) ConfigOption {
+	return func(c *Config) { c.slowQueryThreshold, c.explainSlowQueries = threshold, explain }
+}
+
+// WithEventSinks delivers the domain events to the sinks, in addition to the webhooks.
+func WithEventSinks(sinks ...outbox.Sink) ConfigOption {
+	return func(c *Config) { c.eventSinks = append(c.eventSinks, sinks...) }
+}
+
+// WithEventPollInterval sets how often the outbox, the webhook deliveries and the jobs are
+// polled.
+func WithEventPollInterval(interval time.Duration) ConfigOption {
+	return func(c *Config) { c.eventPollInterval = interval }
+}
+
+// WithWebhookRetryPolicy sets the attempts of the webhook deliveries, before they are moved to
+// the dead letters.
+func WithWebhookRetryPolicy(policy store.RetryPolicy) ConfigOption {
+	return func(c *Config) { c.webhookRetryPolicy = policy }
+}
+
+// WithJobWorkers sets how many jobs run at the same time, and for how long the running jobs
+// are waited for when the application stops.
+func WithJobWorkers(workers int, shutdownTimeout time.Duration) ConfigOption {
+	return func(c *Config) { c.jobWorkers, c.jobShutdownTimeout = workers, shutdownTimeout }
+}
+
+// WithJobRetryPolicy sets the attempts of the jobs enqueued without a maximum, before they are
+// moved to the dead jobs, and the delays between them.
+func WithJobRetryPolicy(policy store.RetryPolicy) ConfigOption {
+	return func(c *Config) { c.jobRetryPolicy = policy }
+}
+
+// WithPIIKeyring sets the keys encrypting the personal data of the users, it's required by the
+// SQL stores.
+func WithPIIKeyring(keyring *envelope.Keyring) ConfigOption {
+	return func(c *Config) { c.piiKeyring = keyring }
+}
+
+// WithIdempotencyTTL sets for how long the responses of the requests made with an
+// Idempotency-Key are replayed to their retries.
+func WithIdempotencyTTL(ttl time.Duration) ConfigOption {
+	return func(c *Config) { c.idempotencyTTL = ttl }
 }
 
-func NewConfig(secretKey string, dataSourceName string) *Config {
-	return &Config{secretKey: secretKey, dataSourceName: dataSourceName}
+// WithMailer sets the mailer of the invitations, they are logged without their body by default.
+func WithMailer(mailer mail.Mailer) ConfigOption {
+	return func(c *Config) { c.mailer = mailer }
+}
+
+// WithInvitations sets the page of the frontend accepting the invitations, which is sent
+// their token in the 'token' query parameter, and for how long the invitations can be
+// accepted. The invitees are sent the bare token if acceptURL is empty.
+func WithInvitations(acceptURL string, ttl time.Duration) ConfigOption {
+	return func(c *Config) { c.invitationURL, c.invitationTTL = acceptURL, ttl }
+}
+
+// WithTrustedProxies sets the load balancers and proxies in front of the application, whose
+// X-Forwarded-For header gives the IP of the clients. It's ignored from the other peers.
+func WithTrustedProxies(proxies []*net.IPNet) ConfigOption {
+	return func(c *Config) { c.trustedProxies = proxies }
+}
+
+func NewConfig(secretKey string, dataSourceName string, opts ...ConfigOption) *Config {
+	c := &Config{
+		secretKey:          secretKey,
+		dataSourceName:     dataSourceName,
+		eventPollInterval:  time.Second,
+		webhookRetryPolicy: webhook.DefaultRetryPolicy,
+		jobWorkers:         4,
+		jobShutdownTimeout: 30 * time.Second,
+		jobRetryPolicy:     jobs.DefaultRetryPolicy,
+		idempotencyTTL:     24 * time.Hour,
+		invitationTTL:      7 * 24 * time.Hour,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
 func (c *Config) String() string {
@@ -29,6 +162,23 @@ func (c *Config) String() string {
 	s.WriteString("Config{")
 	s.WriteString("len(secretKey)=" + strconv.Itoa(len(c.secretKey)))
 	s.WriteString(" dataSourceName=" + safeDSN)
+	s.WriteString(" len(replicaDSNs)=" + strconv.Itoa(len(c.replicaDSNs)))
+	s.WriteString(fmt.Sprintf(" dbPool=%+v", c.dbPool))
+	s.WriteString(" slowQueryThreshold=" + c.slowQueryThreshold.String())
+	s.WriteString(" explainSlowQueries=" + strconv.FormatBool(c.explainSlowQueries))
+	s.WriteString(" softDeleteRetention=" + c.softDeleteRetention.String())
+	s.WriteString(" len(eventSinks)=" + strconv.Itoa(len(c.eventSinks)))
+	s.WriteString(" eventPollInterval=" + c.eventPollInterval.String())
+	s.WriteString(fmt.Sprintf(" webhookRetryPolicy=%+v", c.webhookRetryPolicy))
+	s.WriteString(" jobWorkers=" + strconv.Itoa(c.jobWorkers))
+	s.WriteString(" jobShutdownTimeout=" + c.jobShutdownTimeout.String())
+	s.WriteString(fmt.Sprintf(" jobRetryPolicy=%+v", c.jobRetryPolicy))
+	s.WriteString(fmt.Sprintf(" piiKeyring=%v", c.piiKeyring))
+	s.WriteString(" idempotencyTTL=" + c.idempotencyTTL.String())
+	s.WriteString(fmt.Sprintf(" mailer=%T", c.mailer))
+	s.WriteString(" invitationURL=" + c.invitationURL)
+	s.WriteString(" invitationTTL=" + c.invitationTTL.String())
+	s.WriteString(fmt.Sprintf(" trustedProxies=%v", c.trustedProxies))
 	s.WriteString("}")
 	return s.String()
 }
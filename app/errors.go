@@ -4,6 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/store"
 )
 
 type JSONError struct {
@@ -55,3 +60,25 @@ func WriteNotFoundError(w http.ResponseWriter, msgAndArgs ...interface{}) {
 func WriteUnprocessableEntity(w http.ResponseWriter, msgAndArgs ...interface{}) {
 	WriteJSONError(w, http.StatusUnprocessableEntity, msgAndArgs...)
 }
+
+func WritePreconditionFailedError(w http.ResponseWriter, msgAndArgs ...interface{}) {
+	WriteJSONError(w, http.StatusPreconditionFailed, msgAndArgs...)
+}
+
+func WriteConflictError(w http.ResponseWriter, msgAndArgs ...interface{}) {
+	WriteJSONError(w, http.StatusConflict, msgAndArgs...)
+}
+
+// WriteQuotaExceededError answers 429 to the requests exceeding the requests per day of a
+// company, which can be retried the next UTC day, and 403 to the mutations exceeding its other
+// limits.
+func WriteQuotaExceededError(w http.ResponseWriter, err *store.QuotaExceededError) {
+	if err.Quota != entity.QuotaRequestsPerDay {
+		WriteForbiddenError(w, err)
+		return
+	}
+	now := time.Now().UTC()
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	w.Header().Set("Retry-After", strconv.Itoa(int(tomorrow.Sub(now).Seconds())+1))
+	WriteJSONError(w, http.StatusTooManyRequests, err)
+}
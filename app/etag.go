@@ -0,0 +1,32 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ETags are the record versions, which are bumped by every update.
+func setETag(w http.ResponseWriter, version int) {
+	w.Header().Set("ETag", `"`+strconv.Itoa(version)+`"`)
+}
+
+// ifMatchVersion returns the version expected by the If-Match header. A zero version means
+// the header is absent or is "*", i.e. any version matches. ok is false if the header
+// can't match any version.
+func ifMatchVersion(r *http.Request) (version int, ok bool) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return 0, true
+	}
+	// Only a single ETag is supported, weak ETags compare like strong ones.
+	header = strings.TrimPrefix(header, "W/")
+	if len(header) < 2 || header[0] != '"' || header[len(header)-1] != '"' {
+		return 0, false
+	}
+	version, err := strconv.Atoi(header[1 : len(header)-1])
+	if err != nil || version < 1 {
+		return 0, false
+	}
+	return version, true
+}
@@ -0,0 +1,85 @@
+package app
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/jordanp/goapp/entity"
+	pkglog "github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+)
+
+// exportColumns are the CSV columns of the exports. Passwords are never exported, so exported
+// users need one before being imported again.
+var exportColumns = map[string][]string{
+	entity.ImportKindUsers:       {"login", "email", "role"},
+	entity.ImportKindCompanies:   {"name"},
+	entity.ImportKindMemberships: {"company", "user", "role"},
+}
+
+// Export streams the users, companies or memberships which aren't soft deleted, in the formats
+// accepted by Import.
+func (a *Application) Export(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	opts := entity.ImportOptions{
+		Kind:   r.URL.Query().Get("kind"),
+		Format: r.URL.Query().Get("format"),
+		Mode:   entity.ImportModeAtomic,
+	}
+	if opts.Format == "" {
+		opts.Format = entity.ImportFormatCSV
+	}
+	if err := opts.Validate(); err != nil {
+		WriteBadRequestError(w, "input validation error: %s", err)
+		return
+	}
+
+	var write func(record []string, v interface{}) error
+	var flush func() error
+	if opts.Format == entity.ImportFormatCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		csvWriter := csv.NewWriter(w)
+		write = func(record []string, _ interface{}) error { return csvWriter.Write(record) }
+		flush = func() error { csvWriter.Flush(); return csvWriter.Error() }
+		write(exportColumns[opts.Kind], nil)
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		write = func(_ []string, v interface{}) error { return encoder.Encode(v) }
+		flush = func() error { return nil }
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, opts.Kind, opts.Format))
+
+	var err error
+	switch opts.Kind {
+	case entity.ImportKindUsers:
+		err = a.UserStore.ForEach(ctx, a.DB, store.Filter{}, func(user entity.User) error {
+			return write([]string{user.Login, user.Email, user.Role}, struct {
+				Login string `json:"login"`
+				Email string `json:"email"`
+				Role  string `json:"role"`
+			}{user.Login, user.Email, user.Role})
+		})
+	case entity.ImportKindCompanies:
+		err = a.CompanyStore.ForEach(ctx, a.DB, store.Filter{}, func(company entity.Company) error {
+			return write([]string{company.Name}, struct {
+				Name string `json:"name"`
+			}{company.Name})
+		})
+	case entity.ImportKindMemberships:
+		err = a.CompanyStore.ForEachMembership(ctx, a.DB, func(membership entity.ImportMembership) error {
+			return write([]string{membership.Company, membership.User, membership.Role}, membership)
+		})
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		// The status has already been sent along with the first records, the client only
+		// notices the truncated body.
+		pkglog.G(ctx).WithError(err).Error("failed to export")
+	}
+}
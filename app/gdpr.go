@@ -0,0 +1,141 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jordanp/goapp/entity"
+	pkglog "github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/pkg/middlewares"
+	"github.com/jordanp/goapp/store"
+	"github.com/pkg/errors"
+)
+
+// exportAuditBatch is how many audit events are read at once, the maximum of entity.AuditFilter.
+const exportAuditBatch = 500
+
+// ExportUser returns the data held about a user, deleted or not.
+func (a *Application) ExportUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	user, err := a.UserStore.GetByID(ctx, a.DB, mux.Vars(r)["id"], true) // Gorilla Mux will match route iff 'id' is not empty
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+	a.writeUserExport(w, r, user)
+}
+
+// ExportMe returns the data held about the authenticated user.
+func (a *Application) ExportMe(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	user, err := a.UserStore.GetByLogin(ctx, a.DB, middlewares.UserFromCtx(ctx).Login)
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+	user.Password = "" // GetByLogin is the only method returning the password hash
+	a.writeUserExport(w, r, user)
+}
+
+func (a *Application) writeUserExport(w http.ResponseWriter, r *http.Request, user entity.User) {
+	ctx := r.Context()
+
+	export, err := a.exportUser(ctx, user)
+	if err != nil {
+		WriteInternalServerError(w, err)
+		return
+	}
+	pkglog.G(ctx).F("id", user.ID).Info("user exported")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="user-`+user.ID.String()+`.json"`)
+	json.NewEncoder(w).Encode(export)
+}
+
+// exportUser gathers the memberships of the user, the audit events about the user and its
+// current memberships, and the audit events of the mutations the user made.
+func (a *Application) exportUser(ctx context.Context, user entity.User) (entity.UserExport, error) {
+	export := entity.UserExport{ExportedAt: time.Now().UTC(), User: user, Memberships: []entity.Membership{}}
+
+	memberships, err := a.CompanyStore.GetMemberships(ctx, a.DB, user.ID.String())
+	if _, ok := errors.Cause(err).(*store.NotFoundError); err != nil && !ok {
+		return export, err
+	} else if err == nil && memberships != nil {
+		export.Memberships = memberships // The deleted users are left without memberships
+	}
+
+	filters := []entity.AuditFilter{
+		{EntityType: "user", EntityID: user.ID.String()},
+		{Actor: user.Login},
+	}
+	for _, membership := range export.Memberships {
+		filters = append(filters, entity.AuditFilter{EntityType: "membership", EntityID: store.MembershipID(membership.CompanyID.String(), user.ID.String())})
+	}
+	seen := make(map[int64]bool)
+	export.AuditEvents = []entity.AuditEvent{}
+	for _, filter := range filters {
+		filter.Limit = exportAuditBatch
+		for {
+			events, err := a.AuditStore.List(ctx, a.DB, filter)
+			if err != nil {
+				return export, err
+			}
+			for _, event := range events {
+				if !seen[event.ID] {
+					seen[event.ID] = true
+					export.AuditEvents = append(export.AuditEvents, event)
+				}
+			}
+			if len(events) < filter.Limit {
+				break
+			}
+			filter.Offset += filter.Limit
+		}
+	}
+	sort.Slice(export.AuditEvents, func(i, j int) bool { return export.AuditEvents[i].ID > export.AuditEvents[j].ID })
+
+	// The tokens aren't stored, only what they would hold is known
+	access, admin := a.TokenManager.Lifetimes()
+	export.Tokens = []entity.TokenMetadata{{Audience: "access", Claims: []string{"sub", "email", "role"}, Lifetime: access.String()}}
+	if user.Role == "admin" {
+		export.Tokens = append(export.Tokens, entity.TokenMetadata{Audience: "admin", Claims: []string{"sub"}, Lifetime: admin.String()})
+	}
+	return export, nil
+}
+
+// EraseUser anonymizes the user, its memberships and audit events are kept and keep referring
+// to it by ID.
+func (a *Application) EraseUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	user, err := a.UserStore.Erase(ctx, a.DB, mux.Vars(r)["id"]) // Gorilla Mux will match route iff 'id' is not empty
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	pkglog.G(ctx).F("id", user.ID).Info("user erased")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	setETag(w, user.Version)
+	json.NewEncoder(w).Encode(user)
+}
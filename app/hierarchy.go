@@ -0,0 +1,97 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jordanp/goapp/entity"
+	pkglog "github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+	"github.com/pkg/errors"
+)
+
+// MoveCompany moves the company, along with its subtree, under another parent or to the root.
+func (a *Application) MoveCompany(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := pkglog.G(ctx)
+
+	version, ok := ifMatchVersion(r)
+	if !ok {
+		WritePreconditionFailedError(w, "invalid 'If-Match' header")
+		return
+	}
+
+	var move entity.CompanyMove
+	if err := json.NewDecoder(r.Body).Decode(&move); err != nil {
+		WriteBadRequestError(w, "unable to decode json: %s", err)
+		return
+	}
+	var parentID string
+	if move.ParentID != nil {
+		parentID = move.ParentID.String()
+	}
+
+	ID := mux.Vars(r)["id"] // Gorilla Mux will match route iff 'id' is not empty
+	log = log.F("id", ID, "parent", parentID, "version", version)
+	company, err := a.CompanyStore.Move(pkglog.WithLogger(ctx, log), a.DB, ID, parentID, version)
+	if err != nil {
+		switch err := errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			if err.Kind == "company" {
+				WriteNotFoundError(w, err)
+			} else {
+				WriteUnprocessableEntity(w, err)
+			}
+		case *store.VersionConflictError:
+			WritePreconditionFailedError(w, err)
+		case *store.CycleError:
+			WriteUnprocessableEntity(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	log.Info("company moved")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	setETag(w, company.Version)
+	json.NewEncoder(w).Encode(company)
+}
+
+// GetCompanyAncestors lists the ancestors of the company, its parent first.
+func (a *Application) GetCompanyAncestors(w http.ResponseWriter, r *http.Request) {
+	a.getCompanyRelatives(w, r, a.CompanyStore.Ancestors)
+}
+
+// GetCompanyDescendants lists the descendants of the company level by level, each one refers
+// to its parent.
+func (a *Application) GetCompanyDescendants(w http.ResponseWriter, r *http.Request) {
+	a.getCompanyRelatives(w, r, a.CompanyStore.Descendants)
+}
+
+type listRelatives func(ctx context.Context, querier store.Querier, ID string, includeDeleted bool) ([]entity.Company, error)
+
+func (a *Application) getCompanyRelatives(w http.ResponseWriter, r *http.Request, list listRelatives) {
+	ctx := r.Context()
+
+	withDeleted, err := includeDeleted(r)
+	if err != nil {
+		WriteBadRequestError(w, "invalid 'include_deleted': %s", err)
+		return
+	}
+
+	companies, err := list(ctx, a.DB, mux.Vars(r)["id"], withDeleted) // Gorilla Mux will match route iff 'id' is not empty
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(entity.Companies{Companies: companies})
+}
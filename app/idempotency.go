@@ -0,0 +1,125 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	pkglog "github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+	"github.com/pkg/errors"
+)
+
+// maxIdempotencyKeyLength bounds the keys chosen by the clients, UUIDs are expected.
+const maxIdempotencyKeyLength = 255
+
+// maxIdempotentBodySize bounds the request bodies which are read to fingerprint the requests.
+const maxIdempotentBodySize = 1 << 20
+
+// idempotencyLease is how long a request in progress holds its key, so that a key isn't stuck
+// if its request never completed, e.g. when the server crashed. It must outlast the requests: a
+// retry of a request lasting longer runs it again.
+const idempotencyLease = time.Minute
+
+// withIdempotency replays the response of the first request made with an Idempotency-Key to
+// its retries, so that a client can retry a request whose response it didn't get. The key is
+// scoped to the actor, it must be chained after withAuditInfo. A key reused for a different
+// request is a conflict, as is a retry of a request still in progress within idempotencyLease.
+func (a *Application) withIdempotency(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			h(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			WriteBadRequestError(w, "Idempotency-Key is longer than %d characters", maxIdempotencyKeyLength)
+			return
+		}
+		ctx := r.Context()
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodySize))
+		if err != nil {
+			WriteBadRequestError(w, err)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		hash := sha256.New()
+		hash.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+		hash.Write(body)
+		fingerprint := hex.EncodeToString(hash.Sum(nil))
+
+		actor := store.AuditInfoFromCtx(ctx).Actor
+		req, started, err := a.IdempotencyStore.Begin(ctx, a.DB, actor, key, fingerprint, a.idempotencyTTL, idempotencyLease)
+		if err != nil {
+			switch errors.Cause(err).(type) {
+			case *store.NotFoundError:
+				// The request which took the key released it meanwhile, the retry can start over.
+				WriteConflictError(w, "the request with Idempotency-Key '%s' is in progress", key)
+			default:
+				WriteInternalServerError(w, err)
+			}
+			return
+		}
+		if req.Fingerprint != fingerprint {
+			WriteConflictError(w, "Idempotency-Key '%s' was used for a different request", key)
+			return
+		}
+		if !started {
+			if req.StatusCode == 0 {
+				WriteConflictError(w, "the request with Idempotency-Key '%s' is in progress", key)
+				return
+			}
+			for k, v := range req.Header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(req.StatusCode)
+			w.Write(req.Body)
+			return
+		}
+
+		// The response is stored even if the client went away, it's the retry which gets it.
+		storeCtx := pkglog.WithLogger(context.Background(), pkglog.G(ctx))
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+				// Nothing worth replaying, the request can be retried.
+				if err := a.IdempotencyStore.Release(storeCtx, a.DB, actor, key); err != nil {
+					pkglog.G(ctx).WithError(err).Error("failed to release idempotency key")
+				}
+				return
+			}
+			if err := a.IdempotencyStore.Complete(storeCtx, a.DB, actor, key, rec.status, rec.Header(), rec.body.Bytes()); err != nil {
+				pkglog.G(ctx).WithError(err).Error("failed to store idempotent response")
+			}
+		}()
+		h(rec, r)
+	}
+}
+
+// responseRecorder writes the response through, and keeps a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
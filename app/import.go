@@ -0,0 +1,274 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jordanp/goapp/entity"
+	pkglog "github.com/jordanp/goapp/pkg/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxImportSize bounds the size of the request body of an import.
+const maxImportSize = 10 << 20
+
+// importColumns lists, per kind, the CSV columns along with whether they are required.
+var importColumns = map[string]map[string]bool{
+	entity.ImportKindUsers:       {"login": true, "password": true, "email": true, "role": true},
+	entity.ImportKindCompanies:   {"name": true},
+	entity.ImportKindMemberships: {"company": true, "user": true, "role": false},
+}
+
+// Import bulk creates users, companies or memberships from a CSV file with a header line, or
+// from NDJSON. Rows are numbered from 1, not counting the CSV header. Invalid rows are reported
+// instead of failing the whole request.
+func (a *Application) Import(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	opts, err := importOptions(r)
+	if err != nil {
+		WriteBadRequestError(w, err)
+		return
+	}
+	if err := opts.Validate(); err != nil {
+		WriteBadRequestError(w, "input validation error: %s", err)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxImportSize)
+	var rows []entity.ImportRow
+	if opts.Format == entity.ImportFormatCSV {
+		rows, err = parseCSVImport(opts.Kind, body)
+	} else {
+		rows, err = parseNDJSONImport(opts.Kind, body)
+	}
+	if err != nil {
+		WriteBadRequestError(w, "unable to parse %s: %s", opts.Format, err)
+		return
+	}
+
+	if err := a.checkImportMetadata(ctx, opts.Kind, rows); err != nil {
+		WriteInternalServerError(w, err)
+		return
+	}
+	if opts.Kind == entity.ImportKindUsers {
+		hashPasswords(ctx, rows)
+	}
+
+	report, err := a.Importer.Import(ctx, a.DB, opts, rows)
+	if err != nil {
+		WriteInternalServerError(w, err)
+		return
+	}
+
+	pkglog.G(ctx).F("kind", report.Kind, "mode", report.Mode, "dry_run", report.DryRun, "committed", report.Committed,
+		"imported", report.Imported, "failed", report.Failed).Info("import done")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(report)
+}
+
+// importOptions reads the options from the query parameters. The format defaults to the one
+// of the Content-Type and the mode to atomic.
+func importOptions(r *http.Request) (entity.ImportOptions, error) {
+	query := r.URL.Query()
+	opts := entity.ImportOptions{
+		Kind:   query.Get("kind"),
+		Format: query.Get("format"),
+		Mode:   query.Get("mode"),
+	}
+	if opts.Format == "" {
+		opts.Format = formatFromContentType(r.Header.Get("Content-Type"))
+	}
+	if opts.Mode == "" {
+		opts.Mode = entity.ImportModeAtomic
+	}
+
+	if values, ok := query["dry_run"]; ok && values[0] != "" {
+		var err error
+		if opts.DryRun, err = strconv.ParseBool(values[0]); err != nil {
+			return opts, fmt.Errorf("invalid 'dry_run': %s", err)
+		}
+	} else if ok {
+		opts.DryRun = true
+	}
+	return opts, nil
+}
+
+func formatFromContentType(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/csv":
+		return entity.ImportFormatCSV
+	case "application/x-ndjson":
+		return entity.ImportFormatNDJSON
+	}
+	return ""
+}
+
+func parseCSVImport(kind string, body io.Reader) ([]entity.ImportRow, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	columns := importColumns[kind]
+	seen := make(map[string]bool, len(header))
+	for k := range header {
+		header[k] = strings.ToLower(strings.TrimSpace(header[k]))
+		if _, ok := columns[header[k]]; !ok {
+			return nil, fmt.Errorf("unknown column '%s'", header[k])
+		}
+		seen[header[k]] = true
+	}
+	for column, required := range columns {
+		if required && !seen[column] {
+			return nil, fmt.Errorf("missing column '%s'", column)
+		}
+	}
+
+	var rows []entity.ImportRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		fields := make(map[string]string, len(header))
+		for k, column := range header {
+			fields[column] = record[k]
+		}
+		row := entity.ImportRow{Row: len(rows) + 1}
+		switch kind {
+		case entity.ImportKindUsers:
+			row.User = &entity.User{Login: fields["login"], Password: fields["password"], Email: fields["email"], Role: fields["role"]}
+		case entity.ImportKindCompanies:
+			row.Company = &entity.Company{Name: fields["name"]}
+		case entity.ImportKindMemberships:
+			row.Membership = &entity.ImportMembership{Company: fields["company"], User: fields["user"], Role: fields["role"]}
+		}
+		rows = append(rows, validateImportRow(row))
+	}
+	return rows, nil
+}
+
+// parseNDJSONImport decodes one record per line, blank lines are skipped. Lines that can't be
+// decoded are reported as failed rows.
+func parseNDJSONImport(kind string, body io.Reader) ([]entity.ImportRow, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxImportSize)
+
+	var rows []entity.ImportRow
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		row := entity.ImportRow{Row: len(rows) + 1}
+		var err error
+		switch kind {
+		case entity.ImportKindUsers:
+			row.User = &entity.User{}
+			err = json.Unmarshal(line, row.User)
+		case entity.ImportKindCompanies:
+			row.Company = &entity.Company{}
+			err = json.Unmarshal(line, row.Company)
+		case entity.ImportKindMemberships:
+			row.Membership = &entity.ImportMembership{}
+			err = json.Unmarshal(line, row.Membership)
+		}
+		if err != nil {
+			row.Err = fmt.Errorf("unable to decode json: %s", err)
+			rows = append(rows, row)
+			continue
+		}
+		rows = append(rows, validateImportRow(row))
+	}
+	return rows, scanner.Err()
+}
+
+func validateImportRow(row entity.ImportRow) entity.ImportRow {
+	switch {
+	case row.User != nil:
+		row.Err = row.User.Validate()
+	case row.Company != nil:
+		row.Err = row.Company.Validate()
+	case row.Membership != nil:
+		row.Err = row.Membership.Validate()
+	}
+	if row.Err != nil {
+		row.Err = fmt.Errorf("input validation error: %s", row.Err)
+	}
+	return row
+}
+
+// checkImportMetadata reports the valid rows whose metadata doesn't match the schema of the
+// users or companies as failed.
+func (a *Application) checkImportMetadata(ctx context.Context, kind string, rows []entity.ImportRow) error {
+	entityType := map[string]string{entity.ImportKindUsers: entity.MetadataEntityUser, entity.ImportKindCompanies: entity.MetadataEntityCompany}[kind]
+	if entityType == "" {
+		return nil
+	}
+	schema, err := a.metadataSchema(ctx, entityType)
+	if err != nil || schema == nil {
+		return err
+	}
+	for k, row := range rows {
+		if row.Err != nil {
+			continue
+		}
+		var metadata entity.Metadata
+		if row.User != nil {
+			metadata = row.User.Metadata
+		} else {
+			metadata = row.Company.Metadata
+		}
+		if err := schema.Check(metadata); err != nil {
+			rows[k].Err = fmt.Errorf("input validation error: %s", err)
+		}
+	}
+	return nil
+}
+
+// hashPasswords replaces the passwords of the valid rows by their Bcrypt hash. Hashing is
+// purposely slow, hence done concurrently.
+func hashPasswords(ctx context.Context, rows []entity.ImportRow) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, runtime.NumCPU())
+	for k := range rows {
+		if rows[k].Err != nil {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(row *entity.ImportRow) {
+			defer func() { <-sem; wg.Done() }()
+			hashedPassword, err := bcrypt.GenerateFromPassword([]byte(row.User.Password), bcrypt.DefaultCost)
+			if err != nil {
+				pkglog.G(ctx).WithError(err).Error("failed to hash password with Bcrypt")
+				row.Err = errors.New("failed to hash password with Bcrypt")
+				return
+			}
+			row.User.Password = string(hashedPassword)
+		}(&rows[k])
+	}
+	wg.Wait()
+}
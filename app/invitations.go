@@ -0,0 +1,393 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/jobs"
+	"github.com/jordanp/goapp/mail"
+	pkglog "github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/pkg/middlewares"
+	"github.com/jordanp/goapp/store"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// sendInvitationJob emails an invitation. Its token is issued when the job runs, the payload
+// of the jobs is listed by the admins and kept with the dead jobs.
+type sendInvitationJob struct {
+	InvitationID string `json:"invitation_id"`
+	Send         int    `json:"send"` // The sends of the invitation when the job was enqueued
+}
+
+func (sendInvitationJob) JobKind() string { return "send_invitation" }
+
+type sendInvitationHandler struct {
+	app *Application
+}
+
+func (h sendInvitationHandler) NewPayload() jobs.Payload { return &sendInvitationJob{} }
+
+// Run skips the invitations which were resent, revoked, accepted or which expired since the job
+// was enqueued. A retried job issues a new token, the one of the failed attempt may have been
+// sent.
+func (h sendInvitationHandler) Run(ctx context.Context, payload jobs.Payload) error {
+	job := payload.(*sendInvitationJob)
+	token, err := store.NewInvitationToken()
+	if err != nil {
+		return errors.Wrap(err, "failed to generate invitation token")
+	}
+	invitation, err := h.app.InvitationStore.Issue(ctx, h.app.DB, job.InvitationID, job.Send, token)
+	if _, ok := errors.Cause(err).(*store.NotFoundError); ok {
+		pkglog.G(ctx).F("invitation", job.InvitationID).Info("invitation no longer pending, not sent")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	company, err := h.app.CompanyStore.GetByID(ctx, h.app.DB, invitation.CompanyID.String(), true)
+	if err != nil {
+		return err
+	}
+
+	link := token
+	if h.app.invitationURL != "" {
+		link = h.app.invitationURL + "?token=" + token
+	}
+	msg := mail.Message{
+		To:      invitation.Email,
+		Subject: fmt.Sprintf("You are invited to join %s", company.Name),
+		Body: fmt.Sprintf("%s invited you to join %s as %s.\n\nAccept the invitation before %s:\n%s\n",
+			invitation.InvitedBy, company.Name, invitation.Role, invitation.ExpiresAt.Format("2006-01-02 15:04 MST"), link),
+	}
+	if err := h.app.mailer.Send(ctx, msg); err != nil {
+		return errors.Wrap(err, "failed to send invitation")
+	}
+	pkglog.G(ctx).F("invitation", invitation.ID).Info("invitation sent")
+	return nil
+}
+
+// enqueueInvitation sends the invitation, the job is enqueued with querier so that the
+// invitation isn't sent if the transaction creating it fails.
+func (a *Application) enqueueInvitation(ctx context.Context, querier store.Querier, invitation entity.Invitation) error {
+	_, err := jobs.Enqueue(ctx, a.JobStore, querier, sendInvitationJob{InvitationID: invitation.ID.String(), Send: invitation.Sends}, entity.JobOptions{})
+	return err
+}
+
+// CreateInvitation invites an email to join the company, the invitation is sent by a job.
+func (a *Application) CreateInvitation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	companyID := mux.Vars(r)["id"] // Gorilla Mux will match route iff 'id' is not empty
+
+	var invitation entity.Invitation
+	if err := json.NewDecoder(r.Body).Decode(&invitation); err != nil {
+		WriteBadRequestError(w, "unable to decode json: %s", err)
+		return
+	}
+	if err := invitation.Validate(); err != nil {
+		WriteBadRequestError(w, "input validation error: %s", err)
+		return
+	}
+	var err error
+	if invitation.CompanyID, err = uuid.Parse(companyID); err != nil {
+		WriteNotFoundError(w, store.NewNotFoundError("company", companyID))
+		return
+	}
+	invitation.InvitedBy = store.AuditInfoFromCtx(ctx).Actor
+
+	log := pkglog.G(ctx).F("company", companyID, "role", invitation.Role)
+	ctx = pkglog.WithLogger(ctx, log)
+	var inserted entity.Invitation
+	err = a.DB.WithTx(ctx, func(tx store.Querier) error {
+		var err error
+		if inserted, err = a.InvitationStore.Add(ctx, tx, invitation, a.invitationTTL); err != nil {
+			return err
+		}
+		return a.enqueueInvitation(ctx, tx, inserted)
+	})
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		case *store.AlreadyExistsError:
+			WriteUnprocessableEntity(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	log.F("invitation", inserted.ID).Info("invitation created")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(inserted)
+}
+
+// GetInvitations lists the invitations of the company, the latest first.
+func (a *Application) GetInvitations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	filter := entity.InvitationFilter{CompanyID: mux.Vars(r)["id"], Status: r.URL.Query().Get("status")} // Gorilla Mux will match route iff 'id' is not empty
+	var err error
+	if filter.Limit, err = intParam(r, "limit", 50); err != nil {
+		WriteBadRequestError(w, "invalid 'limit': %s", err)
+		return
+	}
+	if filter.Offset, err = intParam(r, "offset", 0); err != nil {
+		WriteBadRequestError(w, "invalid 'offset': %s", err)
+		return
+	}
+	if err := filter.Validate(); err != nil {
+		WriteBadRequestError(w, "input validation error: %s", err)
+		return
+	}
+	if _, err := a.CompanyStore.GetByID(ctx, a.DB, filter.CompanyID, true); err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	// Fetch one more invitation than requested to know whether there is a next page
+	limit := filter.Limit
+	filter.Limit++
+	invitations, err := a.InvitationStore.List(ctx, a.DB, filter)
+	if err != nil {
+		WriteInternalServerError(w, err)
+		return
+	}
+
+	resp := entity.Invitations{Invitations: invitations}
+	if len(invitations) > limit {
+		resp.Invitations = invitations[:limit]
+		nextOffset := filter.Offset + limit
+		resp.NextOffset = &nextOffset
+	}
+	if resp.Invitations == nil {
+		resp.Invitations = []entity.Invitation{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// companyInvitation returns the invitation of the route, or a NotFoundError if it isn't one of
+// the company of the route.
+func (a *Application) companyInvitation(ctx context.Context, querier store.Querier, vars map[string]string) (entity.Invitation, error) {
+	invitation, err := a.InvitationStore.GetByID(ctx, querier, vars["invitationID"])
+	if err == nil && invitation.CompanyID.String() != vars["id"] {
+		return invitation, store.NewNotFoundError("invitation", vars["invitationID"])
+	}
+	return invitation, err
+}
+
+// ResendInvitation sends a pending invitation again with a new token, the previous one can't be
+// used anymore. The expired invitations are sent again with a new expiry.
+func (a *Application) ResendInvitation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r) // Gorilla Mux will match route iff 'id' and 'invitationID' are not empty
+
+	log := pkglog.G(ctx).F("company", vars["id"], "invitation", vars["invitationID"])
+	ctx = pkglog.WithLogger(ctx, log)
+	var invitation entity.Invitation
+	err := a.DB.WithTx(ctx, func(tx store.Querier) error {
+		if _, err := a.companyInvitation(ctx, tx, vars); err != nil {
+			return err
+		}
+		var err error
+		if invitation, err = a.InvitationStore.Resend(ctx, tx, vars["invitationID"], a.invitationTTL); err != nil {
+			return err
+		}
+		return a.enqueueInvitation(ctx, tx, invitation)
+	})
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	log.Info("invitation resent")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(invitation)
+}
+
+// RevokeInvitation cancels a pending invitation, its token can't be used anymore.
+func (a *Application) RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r) // Gorilla Mux will match route iff 'id' and 'invitationID' are not empty
+
+	var invitation entity.Invitation
+	err := a.DB.WithTx(ctx, func(tx store.Querier) error {
+		if _, err := a.companyInvitation(ctx, tx, vars); err != nil {
+			return err
+		}
+		var err error
+		invitation, err = a.InvitationStore.Revoke(ctx, tx, vars["invitationID"])
+		return err
+	})
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	pkglog.G(ctx).F("company", vars["id"], "invitation", vars["invitationID"]).Info("invitation revoked")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(invitation)
+}
+
+// AcceptInvitation creates the account of the invitee, with the invited email, and adds it to
+// the company of the invitation. The invitees who already have an account accept with
+// AcceptInvitationAsMe instead.
+func (a *Application) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := pkglog.G(ctx)
+
+	var req entity.InvitationAcceptance
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteBadRequestError(w, "unable to decode json: %s", err)
+		return
+	}
+	if err := req.Validate(true); err != nil {
+		WriteBadRequestError(w, "input validation error: %s", err)
+		return
+	}
+
+	// The request isn't authenticated, the token is checked before the costly hashing. It's
+	// claimed again below, the invitation may have changed meanwhile.
+	if _, err := a.InvitationStore.GetByToken(ctx, a.DB, req.Token); err != nil {
+		switch err := errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.WithError(err).Error("failed to hash password with Bcrypt")
+		WriteInternalServerError(w, "failed to hash password with Bcrypt")
+		return
+	}
+
+	// The request isn't authenticated, the invitee is the actor of its mutations.
+	info := store.AuditInfoFromCtx(ctx)
+	info.Actor = req.Login
+	ctx = store.WithAuditInfo(ctx, info)
+
+	log = log.F("login", req.Login)
+	ctx = pkglog.WithLogger(ctx, log)
+	var user entity.User
+	var invitation entity.Invitation
+	err = a.DB.WithTx(ctx, func(tx store.Querier) error {
+		var err error
+		if invitation, err = a.InvitationStore.Claim(ctx, tx, req.Token); err != nil {
+			return err
+		}
+		// The invited users have no metadata, whatever the schema of the users
+		if user, err = a.UserStore.Add(ctx, tx, req.Login, string(hashedPassword), invitation.Email, "user", nil); err != nil {
+			return err
+		}
+		membership, err := a.CompanyStore.AddMember(ctx, tx, invitation.CompanyID.String(), user.ID.String(), invitation.Role)
+		if err != nil {
+			return err
+		}
+		user.CompanyRole = membership.Role
+		invitation, err = a.InvitationStore.Accept(ctx, tx, invitation.ID.String(), user.ID.String())
+		return err
+	})
+	if err != nil {
+		switch err := errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		case *store.AlreadyExistsError:
+			WriteUnprocessableEntity(w, err)
+		case *store.QuotaExceededError:
+			WriteQuotaExceededError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	log.F("invitation", invitation.ID, "company", invitation.CompanyID).Info("invitation accepted")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	setETag(w, user.Version)
+	json.NewEncoder(w).Encode(user)
+}
+
+// AcceptInvitationAsMe adds the authenticated user to the company of the invitation. The token
+// proves that the user received the invitation, its email doesn't have to be the invited one.
+func (a *Application) AcceptInvitationAsMe(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req entity.InvitationAcceptance
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteBadRequestError(w, "unable to decode json: %s", err)
+		return
+	}
+	if err := req.Validate(false); err != nil {
+		WriteBadRequestError(w, "input validation error: %s", err)
+		return
+	}
+
+	user, err := a.UserStore.GetByLogin(ctx, a.DB, middlewares.UserFromCtx(ctx).Login)
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	log := pkglog.G(ctx).F("user", user.ID)
+	ctx = pkglog.WithLogger(ctx, log)
+	var membership entity.Membership
+	var invitation entity.Invitation
+	err = a.DB.WithTx(ctx, func(tx store.Querier) error {
+		var err error
+		if invitation, err = a.InvitationStore.Claim(ctx, tx, req.Token); err != nil {
+			return err
+		}
+		if membership, err = a.CompanyStore.AddMember(ctx, tx, invitation.CompanyID.String(), user.ID.String(), invitation.Role); err != nil {
+			return err
+		}
+		invitation, err = a.InvitationStore.Accept(ctx, tx, invitation.ID.String(), user.ID.String())
+		return err
+	})
+	if err != nil {
+		switch err := errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		case *store.DupUserInCompanyError:
+			WriteUnprocessableEntity(w, err)
+		case *store.QuotaExceededError:
+			WriteQuotaExceededError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	log.F("invitation", invitation.ID, "company", invitation.CompanyID).Info("invitation accepted")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(membership)
+}
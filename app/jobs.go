@@ -0,0 +1,84 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/jordanp/goapp/entity"
+	pkglog "github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+	"github.com/pkg/errors"
+)
+
+// GetJobs lists the pending, running and dead jobs, the next to run first. The jobs which
+// succeeded are deleted.
+func (a *Application) GetJobs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	q := r.URL.Query()
+	filter := entity.JobFilter{Status: q.Get("status"), Kind: q.Get("kind")}
+	var err error
+	if filter.Limit, err = intParam(r, "limit", 50); err != nil {
+		WriteBadRequestError(w, "invalid 'limit': %s", err)
+		return
+	}
+	if filter.Offset, err = intParam(r, "offset", 0); err != nil {
+		WriteBadRequestError(w, "invalid 'offset': %s", err)
+		return
+	}
+	if err := filter.Validate(); err != nil {
+		WriteBadRequestError(w, "input validation error: %s", err)
+		return
+	}
+
+	// Fetch one more job than requested to know whether there is a next page
+	limit := filter.Limit
+	filter.Limit++
+	jobs, err := a.JobStore.List(ctx, a.DB, filter)
+	if err != nil {
+		WriteInternalServerError(w, err)
+		return
+	}
+
+	resp := entity.Jobs{Jobs: jobs}
+	if len(jobs) > limit {
+		resp.Jobs = jobs[:limit]
+		nextOffset := filter.Offset + limit
+		resp.NextOffset = &nextOffset
+	}
+	if resp.Jobs == nil {
+		resp.Jobs = []entity.Job{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// RetryJob runs a dead job again, with a fresh budget of attempts.
+func (a *Application) RetryJob(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r) // Gorilla Mux will match route iff 'id' is not empty
+
+	ID, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		WriteNotFoundError(w, "dead job '%s' not found", vars["id"])
+		return
+	}
+	job, err := a.JobStore.Retry(ctx, a.DB, ID)
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		case *store.AlreadyExistsError:
+			WriteUnprocessableEntity(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	pkglog.G(ctx).F("job", ID).Info("dead job retried")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(job)
+}
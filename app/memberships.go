@@ -0,0 +1,130 @@
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jordanp/goapp/entity"
+	pkglog "github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+	"github.com/pkg/errors"
+)
+
+type memberRequest struct {
+	Role string `json:"role"`
+}
+
+// decodeMemberRequest accepts an empty body, in which case the role defaults to member.
+func decodeMemberRequest(r *http.Request) (memberRequest, error) {
+	var req memberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return req, errors.Wrap(err, "unable to decode json")
+	}
+	if err := entity.ValidateMembershipRole(req.Role); err != nil {
+		return req, errors.Wrap(err, "input validation error")
+	}
+	return req, nil
+}
+
+func (a *Application) AddCompanyMember(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r) // Gorilla Mux will match route iff 'id' and 'userID' are not empty
+
+	req, err := decodeMemberRequest(r)
+	if err != nil {
+		WriteBadRequestError(w, err)
+		return
+	}
+
+	log := pkglog.G(ctx).F("company", vars["id"], "user", vars["userID"], "role", req.Role)
+	membership, err := a.CompanyStore.AddMember(pkglog.WithLogger(ctx, log), a.DB, vars["id"], vars["userID"], req.Role)
+	if err != nil {
+		switch err := errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		case *store.DupUserInCompanyError:
+			WriteUnprocessableEntity(w, err)
+		case *store.QuotaExceededError:
+			WriteQuotaExceededError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	log.Info("member added")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(membership)
+}
+
+func (a *Application) UpdateCompanyMember(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r) // Gorilla Mux will match route iff 'id' and 'userID' are not empty
+
+	req, err := decodeMemberRequest(r)
+	if err != nil {
+		WriteBadRequestError(w, err)
+		return
+	}
+	if req.Role == "" {
+		WriteBadRequestError(w, "input validation error: missing or empty 'role'")
+		return
+	}
+
+	log := pkglog.G(ctx).F("company", vars["id"], "user", vars["userID"], "role", req.Role)
+	membership, err := a.CompanyStore.UpdateMember(pkglog.WithLogger(ctx, log), a.DB, vars["id"], vars["userID"], req.Role)
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	log.Info("member updated")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(membership)
+}
+
+func (a *Application) RemoveCompanyMember(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r) // Gorilla Mux will match route iff 'id' and 'userID' are not empty
+
+	log := pkglog.G(ctx).F("company", vars["id"], "user", vars["userID"])
+	err := a.CompanyStore.RemoveMember(pkglog.WithLogger(ctx, log), a.DB, vars["id"], vars["userID"])
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+	log.Info("member removed")
+}
+
+func (a *Application) GetUserCompanies(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	memberships, err := a.CompanyStore.GetMemberships(ctx, a.DB, mux.Vars(r)["id"]) // Gorilla Mux will match route iff 'id' is not empty
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+	if memberships == nil {
+		memberships = []entity.Membership{}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(entity.Memberships{Memberships: memberships})
+}
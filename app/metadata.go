@@ -0,0 +1,107 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jordanp/goapp/entity"
+	pkglog "github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+	"github.com/pkg/errors"
+)
+
+func (a *Application) GetMetadataSchema(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	schema, err := a.MetadataSchemaStore.Get(ctx, a.DB, mux.Vars(r)["entityType"]) // Gorilla Mux will match route iff 'entityType' is not empty
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(schema)
+}
+
+// SetMetadataSchema replaces the schema of the metadata of an entity type with the body, a
+// JSON Schema. The metadata already stored isn't checked against it.
+func (a *Application) SetMetadataSchema(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	entityType := mux.Vars(r)["entityType"] // Gorilla Mux will match route iff 'entityType' is not empty
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, entity.MaxMetadataSchemaSize+1))
+	if err != nil {
+		WriteBadRequestError(w, "unable to read body: %s", err)
+		return
+	}
+	schema := entity.MetadataSchema{EntityType: entityType, Schema: body}
+	if err := schema.Validate(); err != nil {
+		WriteBadRequestError(w, "input validation error: %s", err)
+		return
+	}
+
+	log := pkglog.G(ctx).F("entity_type", entityType)
+	schema, err = a.MetadataSchemaStore.Set(pkglog.WithLogger(ctx, log), a.DB, entityType, schema.Schema)
+	if err != nil {
+		WriteInternalServerError(w, err)
+		return
+	}
+
+	log.Info("metadata schema set")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(schema)
+}
+
+func (a *Application) DeleteMetadataSchema(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	entityType := mux.Vars(r)["entityType"] // Gorilla Mux will match route iff 'entityType' is not empty
+
+	if err := a.MetadataSchemaStore.Delete(ctx, a.DB, entityType); err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	pkglog.G(ctx).F("entity_type", entityType).Info("metadata schema deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// metadataSchema returns the schema of the metadata of the entity type, nil if it has none.
+func (a *Application) metadataSchema(ctx context.Context, entityType string) (*entity.MetadataSchema, error) {
+	schema, err := a.MetadataSchemaStore.Get(ctx, a.DB, entityType)
+	if _, ok := errors.Cause(err).(*store.NotFoundError); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// checkMetadata validates the metadata against the schema of the entity type, if any. It
+// writes the error response unless the metadata is valid.
+func (a *Application) checkMetadata(w http.ResponseWriter, r *http.Request, entityType string, metadata entity.Metadata) bool {
+	schema, err := a.metadataSchema(r.Context(), entityType)
+	if err != nil {
+		WriteInternalServerError(w, err)
+		return false
+	}
+	if schema == nil {
+		return true
+	}
+	if err := schema.Check(metadata); err != nil {
+		WriteBadRequestError(w, "input validation error: %s", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+)
+
+// includeDeleted parses the 'include_deleted' query parameter. A parameter without any
+// value, as in '?include_deleted', is true.
+func includeDeleted(r *http.Request) (bool, error) {
+	return boolParam(r, "include_deleted")
+}
+
+// boolParam parses an optional boolean query parameter, false when absent and true when
+// without any value.
+func boolParam(r *http.Request, name string) (bool, error) {
+	values, ok := r.URL.Query()[name]
+	if !ok {
+		return false, nil
+	}
+	if values[0] == "" {
+		return true, nil
+	}
+	return strconv.ParseBool(values[0])
+}
+
+// intParam parses an optional integer query parameter.
+func intParam(r *http.Request, name string, defaultValue int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// timeParam parses an optional RFC 3339 query parameter, the zero time when absent.
+func timeParam(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// metadataPrefix prefixes the query parameters filtering on the metadata, as in
+// '?metadata.crm_id=42'.
+const metadataPrefix = "metadata."
+
+// metadataParams parses the metadata filters, nil when there is none. The values are JSON
+// scalars, the values which aren't one are strings: 42 and "42" are a number and a string, 4a
+// is a string.
+func metadataParams(r *http.Request) (entity.Metadata, error) {
+	var filter entity.Metadata
+	for name, values := range r.URL.Query() {
+		if !strings.HasPrefix(name, metadataPrefix) {
+			continue
+		}
+		key := strings.TrimPrefix(name, metadataPrefix)
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		if len(values) > 1 {
+			return nil, fmt.Errorf("'%s' is given more than once", name)
+		}
+
+		var value interface{}
+		if err := json.Unmarshal([]byte(values[0]), &value); err != nil {
+			value = values[0]
+		}
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			value = values[0]
+		}
+		if filter == nil {
+			filter = entity.Metadata{}
+		}
+		filter[key] = value
+	}
+	return filter, nil
+}
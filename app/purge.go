@@ -0,0 +1,122 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/jobs"
+	pkglog "github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+	"github.com/pkg/errors"
+)
+
+// purgeJob is the job of the purge, its unique key keeps the instances from purging at the
+// same time. The expired idempotency keys and request counts are always purged, the soft
+// deleted records unless KeepDeleted is true.
+type purgeJob struct {
+	Retention   time.Duration `json:"retention"`
+	KeepDeleted bool          `json:"keep_deleted,omitempty"`
+}
+
+func (purgeJob) JobKind() string { return "purge" }
+
+type purgeHandler struct {
+	app *Application
+}
+
+func (h purgeHandler) NewPayload() jobs.Payload { return &purgeJob{} }
+
+func (h purgeHandler) Run(ctx context.Context, payload jobs.Payload) error {
+	job := payload.(*purgeJob)
+	err := h.app.purgeIdempotencyKeys(ctx)
+	if requestsErr := h.app.purgeRequests(ctx); requestsErr != nil {
+		err = requestsErr
+	}
+	if job.KeepDeleted {
+		return err
+	}
+	if purgeErr := h.app.Purge(ctx, job.Retention); purgeErr != nil {
+		return purgeErr
+	}
+	return err
+}
+
+// purgeLoop enqueues the purge at the frequency, until Stop is called. A zero retention keeps
+// the soft deleted records.
+func (a *Application) purgeLoop(retention, frequency time.Duration) {
+	a.purgeTicker = time.NewTicker(frequency)
+	a.purgeDone = make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-a.purgeTicker.C:
+			case <-a.purgeDone:
+				return
+			}
+			ctx := pkglog.WithLogger(context.Background(), a.log.F("component", "purge"))
+			_, err := jobs.Enqueue(ctx, a.JobStore, a.DB, purgeJob{Retention: retention, KeepDeleted: retention == 0}, entity.JobOptions{UniqueKey: "purge"})
+			if _, ok := errors.Cause(err).(*store.AlreadyExistsError); err != nil && !ok {
+				a.log.WithError(err).Error("failed to enqueue purge")
+			}
+		}
+	}()
+}
+
+// Purge hard deletes the users and companies that have been soft deleted for longer than
+// the retention. Errors are logged, the purge job is retried if either store fails.
+func (a *Application) Purge(ctx context.Context, retention time.Duration) error {
+	log := a.log.F("component", "purge", "retention", retention.String())
+	ctx = pkglog.WithLogger(ctx, log)
+
+	users, userErr := a.UserStore.Purge(ctx, a.DB, retention)
+	if userErr != nil {
+		log.WithError(userErr).Error("failed to purge users")
+	}
+	companies, err := a.CompanyStore.Purge(ctx, a.DB, retention)
+	if err != nil {
+		log.WithError(err).Error("failed to purge companies")
+	}
+
+	if users > 0 || companies > 0 {
+		log.Infof("purged %d users and %d companies", users, companies)
+	}
+	if userErr != nil {
+		return userErr
+	}
+	return err
+}
+
+// purgeIdempotencyKeys deletes the expired idempotency keys, whose responses are no longer
+// replayed.
+func (a *Application) purgeIdempotencyKeys(ctx context.Context) error {
+	log := a.log.F("component", "purge")
+	ctx = pkglog.WithLogger(ctx, log)
+
+	keys, err := a.IdempotencyStore.Purge(ctx, a.DB)
+	if err != nil {
+		log.WithError(err).Error("failed to purge idempotency keys")
+		return err
+	}
+	if keys > 0 {
+		log.Infof("purged %d idempotency keys", keys)
+	}
+	return nil
+}
+
+// purgeRequests deletes the request counts of the companies before today, only the current day
+// counts against the requests per day.
+func (a *Application) purgeRequests(ctx context.Context) error {
+	log := a.log.F("component", "purge")
+	ctx = pkglog.WithLogger(ctx, log)
+
+	counts, err := a.CompanyStore.PurgeRequests(ctx, a.DB, time.Now().UTC())
+	if err != nil {
+		log.WithError(err).Error("failed to purge request counts")
+		return err
+	}
+	if counts > 0 {
+		log.Infof("purged %d request counts", counts)
+	}
+	return nil
+}
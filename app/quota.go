@@ -0,0 +1,209 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jordanp/goapp/entity"
+	pkglog "github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/pkg/middlewares"
+	"github.com/jordanp/goapp/store"
+	"github.com/pkg/errors"
+)
+
+func (a *Application) companyQuota(ctx context.Context, ID string) (*entity.CompanyQuota, error) {
+	quota, err := a.CompanyStore.GetQuota(ctx, a.DB, ID)
+	if err != nil {
+		return nil, err
+	}
+	return &quota, nil
+}
+
+// SetCompanyLimits replaces the limits of the company, the limits left out are unlimited. It
+// returns the quota of the company, whose usage may exceed the new limits.
+func (a *Application) SetCompanyLimits(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ID := mux.Vars(r)["id"] // Gorilla Mux will match route iff 'id' is not empty
+
+	var limits entity.CompanyLimits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		WriteBadRequestError(w, "unable to decode json: %s", err)
+		return
+	}
+	if err := limits.Validate(); err != nil {
+		WriteBadRequestError(w, "input validation error: %s", err)
+		return
+	}
+
+	log := pkglog.G(ctx).F("id", ID)
+	ctx = pkglog.WithLogger(ctx, log)
+	var quota entity.CompanyQuota
+	err := a.DB.WithTx(ctx, func(tx store.Querier) error {
+		if _, err := a.CompanyStore.SetLimits(ctx, tx, ID, limits); err != nil {
+			return err
+		}
+		var err error
+		quota, err = a.CompanyStore.GetQuota(ctx, tx, ID)
+		return err
+	})
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	log.Info("company limits set")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(quota)
+}
+
+// CreateAPIKey generates a key of the company, which is only returned by this handler.
+func (a *Application) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	companyID := mux.Vars(r)["id"] // Gorilla Mux will match route iff 'id' is not empty
+
+	var apiKey entity.APIKey
+	if err := json.NewDecoder(r.Body).Decode(&apiKey); err != nil {
+		WriteBadRequestError(w, "unable to decode json: %s", err)
+		return
+	}
+	if err := apiKey.Validate(); err != nil {
+		WriteBadRequestError(w, "input validation error: %s", err)
+		return
+	}
+	key, err := store.NewAPIKey()
+	if err != nil {
+		WriteInternalServerError(w, err)
+		return
+	}
+
+	log := pkglog.G(ctx).F("company", companyID, "name", apiKey.Name)
+	inserted, err := a.APIKeyStore.Add(pkglog.WithLogger(ctx, log), a.DB, companyID, apiKey.Name, key)
+	if err != nil {
+		switch err := errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		case *store.QuotaExceededError:
+			WriteQuotaExceededError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	log.F("id", inserted.ID).Info("api key created")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(inserted)
+}
+
+func (a *Application) GetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	companyID := mux.Vars(r)["id"] // Gorilla Mux will match route iff 'id' is not empty
+
+	if _, err := a.CompanyStore.GetByID(ctx, a.DB, companyID, true); err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+	keys, err := a.APIKeyStore.List(ctx, a.DB, companyID)
+	if err != nil {
+		WriteInternalServerError(w, err)
+		return
+	}
+	if keys == nil {
+		keys = []entity.APIKey{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(entity.APIKeys{APIKeys: keys})
+}
+
+func (a *Application) DeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r) // Gorilla Mux will match route iff 'id' and 'keyID' are not empty
+
+	if err := a.APIKeyStore.DeleteByID(ctx, a.DB, vars["id"], vars["keyID"]); err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	pkglog.G(ctx).F("company", vars["id"], "id", vars["keyID"]).Info("api key deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ctxAPIKey struct{}
+
+// apiKeyFromCtx returns the API key authenticating the request, set by withAPIKey.
+func apiKeyFromCtx(ctx context.Context) entity.APIKey {
+	return ctx.Value(ctxAPIKey{}).(entity.APIKey)
+}
+
+// withAPIKey authenticates the requests made with the X-API-Key header, and counts them against
+// the requests per day of the company of the key. The key is the actor of the audited mutations.
+func (a *Application) withAPIKey(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			WriteUnauthorizedError(w, "missing 'X-API-Key' header")
+			return
+		}
+
+		apiKey, err := a.APIKeyStore.Authenticate(ctx, a.DB, key)
+		if err == nil {
+			err = a.CompanyStore.CountRequest(ctx, a.DB, apiKey.CompanyID.String())
+		}
+		if err != nil {
+			switch err := errors.Cause(err).(type) {
+			case *store.NotFoundError:
+				WriteUnauthorizedError(w, "invalid API key")
+			case *store.QuotaExceededError:
+				WriteQuotaExceededError(w, err)
+			default:
+				WriteInternalServerError(w, err)
+			}
+			return
+		}
+
+		info := store.AuditInfo{Actor: "api_key:" + apiKey.ID.String(), RequestID: middlewares.RequestIDFromCtx(ctx), ClientIP: a.clientIP(r)}
+		ctx = store.WithAuditInfo(context.WithValue(ctx, ctxAPIKey{}, apiKey), info)
+		h(w, r.WithContext(pkglog.WithLogger(ctx, pkglog.G(ctx).F("api_key", apiKey.ID))))
+	}
+}
+
+// GetAPICompany returns the company of the API key along with its quota.
+func (a *Application) GetAPICompany(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	company, err := a.CompanyStore.GetByID(ctx, a.DB, apiKeyFromCtx(ctx).CompanyID.String(), false)
+	if err == nil {
+		company.Quota, err = a.companyQuota(ctx, company.ID.String())
+	}
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	setETag(w, company.Version)
+	json.NewEncoder(w).Encode(company)
+}
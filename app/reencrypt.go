@@ -0,0 +1,53 @@
+package app
+
+import (
+	"context"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/jobs"
+	pkglog "github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+	"github.com/pkg/errors"
+)
+
+// reencryptBatch is how many users are encrypted per transaction.
+const reencryptBatch = 100
+
+// reencryptJob encrypts the users with the current master key, after a rotation or after the
+// upgrade encrypting the personal data. It's enqueued whenever the application starts, and has
+// nothing to do most of the time.
+type reencryptJob struct{}
+
+func (reencryptJob) JobKind() string { return "reencrypt_users" }
+
+type reencryptHandler struct {
+	app *Application
+}
+
+func (h reencryptHandler) NewPayload() jobs.Payload { return &reencryptJob{} }
+
+func (h reencryptHandler) Run(ctx context.Context, payload jobs.Payload) error {
+	var total int
+	for ctx.Err() == nil {
+		n, err := h.app.UserStore.Reencrypt(ctx, h.app.DB, reencryptBatch)
+		if err != nil {
+			return err
+		}
+		total += n
+		if n < reencryptBatch {
+			break
+		}
+	}
+	if total > 0 {
+		pkglog.G(ctx).Infof("reencrypted %d users", total)
+	}
+	return ctx.Err()
+}
+
+func (a *Application) enqueueReencrypt() {
+	ctx := pkglog.WithLogger(context.Background(), a.log.F("component", "reencrypt"))
+	_, err := jobs.Enqueue(ctx, a.JobStore, a.DB, reencryptJob{}, entity.JobOptions{UniqueKey: "reencrypt_users"})
+	if _, ok := errors.Cause(err).(*store.AlreadyExistsError); err != nil && !ok {
+		a.log.WithError(err).Error("failed to enqueue reencryption")
+	}
+}
@@ -0,0 +1,20 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/jordanp/goapp/store"
+)
+
+// readYourWritesHeader makes all the reads of a request go to the primary DB. Clients set it
+// on the requests following a mutation, which the replicas may not have replicated yet.
+const readYourWritesHeader = "X-Read-Your-Writes"
+
+// withReadYourWrites sends the reads of the request to the primary DB if the client asks for
+// it, or once the request has committed a mutation.
+func (a *Application) withReadYourWrites(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		primary := r.Header.Get(readYourWritesHeader) == "true"
+		h(w, r.WithContext(store.WithReadYourWrites(r.Context(), primary)))
+	}
+}
@@ -12,26 +12,73 @@ import (
 
 func (a *Application) Routes() http.Handler {
 	r := mux.NewRouter()
-	r.Use(func(h http.Handler) http.Handler { return middlewares.With(middlewares.WithRecover)(h.ServeHTTP) })
+	r.Use(func(h http.Handler) http.Handler {
+		return middlewares.With(middlewares.WithRecover, a.withReadYourWrites)(h.ServeHTTP)
+	})
 	r.HandleFunc("/status", handlers.Status(VERSION))
 	r.Handle("/metrics", promhttp.Handler())
 	r.HandleFunc("/token/access", a.GetAccessToken()).Methods(http.MethodPost)
 	r.HandleFunc("/token/admin", a.GetAdminToken()).Methods(http.MethodPost)
+	r.HandleFunc("/invitations/accept", a.withAuditInfo(a.AcceptInvitation)).Methods(http.MethodPost)
 
 	admin := r.PathPrefix("/admin").Subrouter()
 	adminOnly := middlewares.MakeAuthenticator(a.TokenManager, "admin")
-	admin.Use(func(h http.Handler) http.Handler { return middlewares.With(adminOnly)(h.ServeHTTP) })
-	admin.HandleFunc("/users/new", a.CreateUser).Methods(http.MethodPost)
+	admin.Use(func(h http.Handler) http.Handler { return middlewares.With(adminOnly, a.withAuditInfo)(h.ServeHTTP) })
+	admin.HandleFunc("/users/new", a.withIdempotency(a.CreateUser)).Methods(http.MethodPost)
 	admin.HandleFunc("/users/all", a.GetAllUsers).Methods(http.MethodGet)
+	admin.HandleFunc("/users/{id}", a.GetUser).Methods(http.MethodGet)
+	admin.HandleFunc("/users/{id}", a.UpdateUser).Methods(http.MethodPatch)
 	admin.HandleFunc("/users/{id}", a.DeleteUser).Methods(http.MethodDelete)
-	admin.HandleFunc("/companies/new", a.CreateCompany).Methods(http.MethodPost)
+	admin.HandleFunc("/users/{id}/restore", a.RestoreUser).Methods(http.MethodPost)
+	admin.HandleFunc("/users/{id}/companies", a.GetUserCompanies).Methods(http.MethodGet)
+	admin.HandleFunc("/users/{id}/export", a.ExportUser).Methods(http.MethodGet)
+	admin.HandleFunc("/users/{id}/erase", a.EraseUser).Methods(http.MethodPost)
+	admin.HandleFunc("/companies/new", a.withIdempotency(a.CreateCompany)).Methods(http.MethodPost)
+	admin.HandleFunc("/companies/all", a.GetAllCompanies).Methods(http.MethodGet)
 	admin.HandleFunc("/companies/{id}", a.GetCompany).Methods(http.MethodGet)
+	admin.HandleFunc("/companies/{id}", a.UpdateCompany).Methods(http.MethodPatch)
 	admin.HandleFunc("/companies/{id}", a.DeleteCompany).Methods(http.MethodDelete)
+	admin.HandleFunc("/companies/{id}/restore", a.RestoreCompany).Methods(http.MethodPost)
+	admin.HandleFunc("/companies/{id}/move", a.MoveCompany).Methods(http.MethodPost)
+	admin.HandleFunc("/companies/{id}/ancestors", a.GetCompanyAncestors).Methods(http.MethodGet)
+	admin.HandleFunc("/companies/{id}/descendants", a.GetCompanyDescendants).Methods(http.MethodGet)
+	admin.HandleFunc("/companies/{id}/limits", a.SetCompanyLimits).Methods(http.MethodPut)
+	admin.HandleFunc("/companies/{id}/api-keys", a.CreateAPIKey).Methods(http.MethodPost)
+	admin.HandleFunc("/companies/{id}/api-keys", a.GetAPIKeys).Methods(http.MethodGet)
+	admin.HandleFunc("/companies/{id}/api-keys/{keyID}", a.DeleteAPIKey).Methods(http.MethodDelete)
+	admin.HandleFunc("/companies/{id}/invitations", a.CreateInvitation).Methods(http.MethodPost)
+	admin.HandleFunc("/companies/{id}/invitations", a.GetInvitations).Methods(http.MethodGet)
+	admin.HandleFunc("/companies/{id}/invitations/{invitationID}/resend", a.ResendInvitation).Methods(http.MethodPost)
+	admin.HandleFunc("/companies/{id}/invitations/{invitationID}", a.RevokeInvitation).Methods(http.MethodDelete)
+	admin.HandleFunc("/companies/{id}/members/{userID}", a.AddCompanyMember).Methods(http.MethodPost)
+	admin.HandleFunc("/companies/{id}/members/{userID}", a.UpdateCompanyMember).Methods(http.MethodPatch)
+	admin.HandleFunc("/companies/{id}/members/{userID}", a.RemoveCompanyMember).Methods(http.MethodDelete)
+	admin.HandleFunc("/metadata-schemas/{entityType}", a.GetMetadataSchema).Methods(http.MethodGet)
+	admin.HandleFunc("/metadata-schemas/{entityType}", a.SetMetadataSchema).Methods(http.MethodPut)
+	admin.HandleFunc("/metadata-schemas/{entityType}", a.DeleteMetadataSchema).Methods(http.MethodDelete)
+	admin.HandleFunc("/search", a.Search).Methods(http.MethodGet)
+	admin.HandleFunc("/audit", a.GetAuditEvents).Methods(http.MethodGet)
+	admin.HandleFunc("/import", a.Import).Methods(http.MethodPost)
+	admin.HandleFunc("/export", a.Export).Methods(http.MethodGet)
+	admin.HandleFunc("/webhooks/new", a.CreateWebhook).Methods(http.MethodPost)
+	admin.HandleFunc("/webhooks/all", a.GetAllWebhooks).Methods(http.MethodGet)
+	admin.HandleFunc("/webhooks/{id}", a.GetWebhook).Methods(http.MethodGet)
+	admin.HandleFunc("/webhooks/{id}", a.DeleteWebhook).Methods(http.MethodDelete)
+	admin.HandleFunc("/webhooks/{id}/deliveries", a.GetWebhookDeliveries).Methods(http.MethodGet)
+	admin.HandleFunc("/webhooks/{id}/deliveries/{deliveryID}/replay", a.ReplayWebhookDelivery).Methods(http.MethodPost)
+	admin.HandleFunc("/jobs/all", a.GetJobs).Methods(http.MethodGet)
+	admin.HandleFunc("/jobs/{id}/retry", a.RetryJob).Methods(http.MethodPost)
 
 	user := r.PathPrefix("/users").Subrouter()
 	userOnly := middlewares.MakeAuthenticator(a.TokenManager, "access")
-	user.Use(func(h http.Handler) http.Handler { return middlewares.With(userOnly)(h.ServeHTTP) })
+	user.Use(func(h http.Handler) http.Handler { return middlewares.With(userOnly, a.withAuditInfo)(h.ServeHTTP) })
 	user.HandleFunc("/me", a.Me).Methods(http.MethodGet)
+	user.HandleFunc("/me/export", a.ExportMe).Methods(http.MethodGet)
+	user.HandleFunc("/me/invitations/accept", a.AcceptInvitationAsMe).Methods(http.MethodPost)
+
+	api := r.PathPrefix("/api").Subrouter()
+	api.Use(func(h http.Handler) http.Handler { return a.withAPIKey(h.ServeHTTP) })
+	api.HandleFunc("/company", a.GetAPICompany).Methods(http.MethodGet)
 
 	logger := middlewares.MakeLogger(a.log, log.RequestAll)
 	cors := middlewares.MakeCORS()
@@ -0,0 +1,49 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/jordanp/goapp/entity"
+)
+
+func (a *Application) Search(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	q := entity.SearchQuery{Query: strings.TrimSpace(r.URL.Query().Get("q"))}
+	var err error
+	if q.Limit, err = intParam(r, "limit", 20); err != nil {
+		WriteBadRequestError(w, "invalid 'limit': %s", err)
+		return
+	}
+	if err := q.Validate(); err != nil {
+		WriteBadRequestError(w, "input validation error: %s", err)
+		return
+	}
+
+	users, err := a.UserStore.Search(ctx, a.DB, q)
+	if err != nil {
+		WriteInternalServerError(w, err)
+		return
+	}
+	companies, err := a.CompanyStore.Search(ctx, a.DB, q)
+	if err != nil {
+		WriteInternalServerError(w, err)
+		return
+	}
+
+	// Both lists are already ranked, merge them and keep the best matches overall.
+	results := append(users, companies...)
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Rank > results[j].Rank })
+	if len(results) > q.Limit {
+		results = results[:q.Limit]
+	}
+	if results == nil {
+		results = []entity.SearchResult{}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(entity.SearchResults{Results: results})
+}
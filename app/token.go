@@ -46,7 +46,7 @@ func (a *Application) getToken(tokenGen func(login, email, role string) (string,
 		}
 
 		log = log.F("login", creds.Login)
-		user, err := a.UserStore.GetByLogin(pkglog.WithLogger(ctx, log), creds.Login)
+		user, err := a.UserStore.GetByLogin(pkglog.WithLogger(ctx, log), a.DB, creds.Login)
 		if err != nil {
 			fake := []byte("$2y$10$LoxBCn5Q1tNROmao8acYE..b3m4Yvw83HjnE4m6oum.At0FX2ICUW")
 			bcrypt.CompareHashAndPassword(fake, []byte(creds.Password)) // Avoid timing attack
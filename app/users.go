@@ -13,10 +13,27 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// GetAllUsers lists the users. The clients syncing them with updated_since must overlap their
+// queries, see store.Filter.
 func (a *Application) GetAllUsers(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	users, err := a.UserStore.GetAll(ctx)
+	var filter store.Filter
+	var err error
+	if filter.IncludeDeleted, err = includeDeleted(r); err != nil {
+		WriteBadRequestError(w, "invalid 'include_deleted': %s", err)
+		return
+	}
+	if filter.UpdatedSince, err = timeParam(r, "updated_since"); err != nil {
+		WriteBadRequestError(w, "invalid 'updated_since': %s", err)
+		return
+	}
+	if filter.Metadata, err = metadataParams(r); err != nil {
+		WriteBadRequestError(w, "invalid metadata filter: %s", err)
+		return
+	}
+
+	users, err := a.UserStore.GetAll(ctx, a.DB, filter)
 	if err != nil {
 		WriteInternalServerError(w, err)
 		return
@@ -28,7 +45,22 @@ func (a *Application) GetAllUsers(w http.ResponseWriter, r *http.Request) {
 func (a *Application) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	err := a.UserStore.DeleteByID(ctx, mux.Vars(r)["id"]) // Gorilla Mux will match route iff 'id' is not empty
+	err := a.UserStore.DeleteByID(ctx, a.DB, mux.Vars(r)["id"]) // Gorilla Mux will match route iff 'id' is not empty
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+}
+
+func (a *Application) RestoreUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	user, err := a.UserStore.Restore(ctx, a.DB, mux.Vars(r)["id"]) // Gorilla Mux will match route iff 'id' is not empty
 	if err != nil {
 		switch errors.Cause(err).(type) {
 		case *store.NotFoundError:
@@ -38,21 +70,41 @@ func (a *Application) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+
+	pkglog.G(ctx).F("id", user.ID).Info("user restored")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	setETag(w, user.Version)
+	json.NewEncoder(w).Encode(user)
+}
+
+// createUserRequest is a user, which is added to the company of CompanyID with its CompanyRole
+// when CompanyID is set.
+type createUserRequest struct {
+	entity.User
+	CompanyID string `json:"company_id"`
 }
 
 func (a *Application) CreateUser(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	log := pkglog.G(ctx)
 
-	var user entity.User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+	var req createUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		WriteBadRequestError(w, "unable to decode json: %s", err)
 		return
 	}
+	user := req.User
 	if err := user.Validate(); err != nil {
 		WriteBadRequestError(w, "input validation error: %s", err)
 		return
 	}
+	if err := entity.ValidateMembershipRole(user.CompanyRole); err != nil {
+		WriteBadRequestError(w, "input validation error: %s", err)
+		return
+	}
+	if !a.checkMetadata(w, r, entity.MetadataEntityUser, user.Metadata) {
+		return
+	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -62,11 +114,31 @@ func (a *Application) CreateUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log = log.F("login", user.Login, "email", user.Email, "role", user.Role)
-	insertedUser, err := a.UserStore.Add(pkglog.WithLogger(ctx, log), user.Login, string(hashedPassword), user.Email, user.Role)
+	if req.CompanyID != "" {
+		log = log.F("company", req.CompanyID, "company_role", user.CompanyRole)
+	}
+	ctx = pkglog.WithLogger(ctx, log)
+
+	// The user isn't created if it can't be added to the company.
+	var insertedUser entity.User
+	err = a.DB.WithTx(ctx, func(tx store.Querier) error {
+		var err error
+		if insertedUser, err = a.UserStore.Add(ctx, tx, user.Login, string(hashedPassword), user.Email, user.Role, user.Metadata); err != nil {
+			return err
+		}
+		if req.CompanyID == "" {
+			return nil
+		}
+		membership, err := a.CompanyStore.AddMember(ctx, tx, req.CompanyID, insertedUser.ID.String(), user.CompanyRole)
+		insertedUser.CompanyRole = membership.Role
+		return err
+	})
 	if err != nil {
-		switch errors.Cause(err).(type) {
-		case *store.AlreadyExistsError:
+		switch err := errors.Cause(err).(type) {
+		case *store.AlreadyExistsError, *store.NotFoundError:
 			WriteUnprocessableEntity(w, err)
+		case *store.QuotaExceededError:
+			WriteQuotaExceededError(w, err)
 		default:
 			WriteInternalServerError(w, err)
 		}
@@ -75,9 +147,89 @@ func (a *Application) CreateUser(w http.ResponseWriter, r *http.Request) {
 
 	log.Info("user inserted")
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	setETag(w, insertedUser.Version)
 	json.NewEncoder(w).Encode(insertedUser)
 }
 
+func (a *Application) GetUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	withDeleted, err := includeDeleted(r)
+	if err != nil {
+		WriteBadRequestError(w, "invalid 'include_deleted': %s", err)
+		return
+	}
+
+	user, err := a.UserStore.GetByID(ctx, a.DB, mux.Vars(r)["id"], withDeleted) // Gorilla Mux will match route iff 'id' is not empty
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	setETag(w, user.Version)
+	json.NewEncoder(w).Encode(user)
+}
+
+func (a *Application) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := pkglog.G(ctx)
+
+	version, ok := ifMatchVersion(r)
+	if !ok {
+		WritePreconditionFailedError(w, "invalid 'If-Match' header")
+		return
+	}
+
+	var patch entity.UserPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		WriteBadRequestError(w, "unable to decode json: %s", err)
+		return
+	}
+	if err := patch.Validate(); err != nil {
+		WriteBadRequestError(w, "input validation error: %s", err)
+		return
+	}
+	if patch.Metadata != nil && !a.checkMetadata(w, r, entity.MetadataEntityUser, patch.Metadata) {
+		return
+	}
+
+	if patch.Password != nil {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(*patch.Password), bcrypt.DefaultCost)
+		if err != nil {
+			log.WithError(err).Error("failed to hash password with Bcrypt")
+			WriteInternalServerError(w, "failed to hash password with Bcrypt")
+			return
+		}
+		*patch.Password = string(hashedPassword)
+	}
+
+	log = log.F("id", mux.Vars(r)["id"], "version", version)
+	updatedUser, err := a.UserStore.Update(pkglog.WithLogger(ctx, log), a.DB, mux.Vars(r)["id"], patch, version)
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		case *store.VersionConflictError:
+			WritePreconditionFailedError(w, err)
+		case *store.AlreadyExistsError:
+			WriteUnprocessableEntity(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	log.Info("user updated")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	setETag(w, updatedUser.Version)
+	json.NewEncoder(w).Encode(updatedUser)
+}
+
 func (a *Application) Me(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	user := middlewares.UserFromCtx(ctx)
@@ -0,0 +1,173 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/jordanp/goapp/entity"
+	pkglog "github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+	"github.com/pkg/errors"
+)
+
+// CreateWebhook generates the secret of the webhook if the request doesn't set one. The secret
+// is only returned by this handler.
+func (a *Application) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := pkglog.G(ctx)
+
+	var webhook entity.Webhook
+	if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+		WriteBadRequestError(w, "unable to decode json: %s", err)
+		return
+	}
+	if err := webhook.Validate(); err != nil {
+		WriteBadRequestError(w, "input validation error: %s", err)
+		return
+	}
+	if webhook.Secret == "" {
+		var err error
+		if webhook.Secret, err = store.NewWebhookSecret(); err != nil {
+			WriteInternalServerError(w, err)
+			return
+		}
+	}
+
+	log = log.F("url", webhook.URL, "events", webhook.Events)
+	insertedWebhook, err := a.WebhookStore.Add(pkglog.WithLogger(ctx, log), a.DB, webhook.URL, webhook.Events, webhook.Secret)
+	if err != nil {
+		WriteInternalServerError(w, err)
+		return
+	}
+
+	log.F("id", insertedWebhook.ID).Info("webhook registered")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(insertedWebhook)
+}
+
+func (a *Application) GetAllWebhooks(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	webhooks, err := a.WebhookStore.GetAll(ctx, a.DB)
+	if err != nil {
+		WriteInternalServerError(w, err)
+		return
+	}
+	for k := range webhooks {
+		webhooks[k].Secret = ""
+	}
+	if webhooks == nil {
+		webhooks = []entity.Webhook{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(entity.Webhooks{Webhooks: webhooks})
+}
+
+func (a *Application) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	webhook, err := a.WebhookStore.GetByID(ctx, a.DB, mux.Vars(r)["id"]) // Gorilla Mux will match route iff 'id' is not empty
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+	webhook.Secret = ""
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(webhook)
+}
+
+func (a *Application) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	err := a.WebhookStore.DeleteByID(ctx, a.DB, mux.Vars(r)["id"]) // Gorilla Mux will match route iff 'id' is not empty
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+	pkglog.G(ctx).F("id", mux.Vars(r)["id"]).Info("webhook deleted")
+}
+
+// GetWebhookDeliveries is the delivery log of a webhook, most recent first.
+func (a *Application) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	filter := entity.DeliveryFilter{Status: r.URL.Query().Get("status")}
+	var err error
+	if filter.Limit, err = intParam(r, "limit", 50); err != nil {
+		WriteBadRequestError(w, "invalid 'limit': %s", err)
+		return
+	}
+	if filter.Offset, err = intParam(r, "offset", 0); err != nil {
+		WriteBadRequestError(w, "invalid 'offset': %s", err)
+		return
+	}
+	if err := filter.Validate(); err != nil {
+		WriteBadRequestError(w, "input validation error: %s", err)
+		return
+	}
+
+	// Fetch one more delivery than requested to know whether there is a next page
+	limit := filter.Limit
+	filter.Limit++
+	deliveries, err := a.WebhookStore.ListDeliveries(ctx, a.DB, mux.Vars(r)["id"], filter)
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	resp := entity.WebhookDeliveries{Deliveries: deliveries}
+	if len(deliveries) > limit {
+		resp.Deliveries = deliveries[:limit]
+		nextOffset := filter.Offset + limit
+		resp.NextOffset = &nextOffset
+	}
+	if resp.Deliveries == nil {
+		resp.Deliveries = []entity.WebhookDelivery{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ReplayWebhookDelivery attempts a delivery again, whatever its status, with a fresh budget of
+// attempts.
+func (a *Application) ReplayWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r) // Gorilla Mux will match route iff 'id' and 'deliveryID' are not empty
+
+	deliveryID, err := strconv.ParseInt(vars["deliveryID"], 10, 64)
+	if err != nil {
+		WriteNotFoundError(w, "delivery '%s' not found", vars["deliveryID"])
+		return
+	}
+	delivery, err := a.WebhookStore.Replay(ctx, a.DB, vars["id"], deliveryID)
+	if err != nil {
+		switch errors.Cause(err).(type) {
+		case *store.NotFoundError:
+			WriteNotFoundError(w, err)
+		default:
+			WriteInternalServerError(w, err)
+		}
+		return
+	}
+
+	pkglog.G(ctx).F("webhook", vars["id"], "delivery", deliveryID).Info("webhook delivery replayed")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(delivery)
+}
@@ -9,75 +9,185 @@ import (
 	"github.com/jordanp/goapp/entity"
 	"github.com/jordanp/goapp/pkg/log"
 	"github.com/jordanp/goapp/store"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+// resyncRetryInterval is how often a failed resync is retried.
+const resyncRetryInterval = 5 * time.Second
+
+// User caches the users by login. It's loaded from the store when created, then the users
+// whose changes are received from the listener are read again. It's loaded again from the
+// store when the listener may have missed changes.
 type User struct {
-	log          log.Logger
-	store        *store.User
-	updateTicker *time.Ticker
+	log      log.Logger
+	store    store.UserStore
+	querier  store.Querier
+	listener *store.Listener
+	stop     chan struct{}
+	done     chan struct{}
 
 	sync.RWMutex
-	users map[string]entity.User
+	users      map[string]entity.User
+	logins     map[string]string // The logins of the users, by ID
+	staleSince time.Time         // Zero while in sync with the store
 }
 
-func NewUserCache(log log.Logger, store *store.User) (*User, error) {
+// NewUserCache fails if the users can't be loaded. The listener is closed by the caller, once
+// the cache is stopped.
+func NewUserCache(log log.Logger, store store.UserStore, querier store.Querier, listener *store.Listener) (*User, error) {
 	c := &User{
-		log:   log,
-		store: store,
-		users: make(map[string]entity.User),
+		log:      log,
+		store:    store,
+		querier:  querier,
+		listener: listener,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		users:    make(map[string]entity.User),
+		logins:   make(map[string]string),
 	}
 
-	if err := c.updateLoop(15 * time.Second); err != nil {
-		return nil, err
+	if err := c.Update(); err != nil {
+		return nil, fmt.Errorf("unable to update User cache from Store: %s", err)
 	}
+	go c.listen()
 
 	return c, nil
 }
 
-func (cache *User) updateLoop(updateFrequency time.Duration) error {
-	errorMsg := "unable to update User cache from Store: %s"
-	if err := cache.Update(); err != nil {
-		return fmt.Errorf(errorMsg, err)
-	}
+func (cache *User) listen() {
+	defer close(cache.done)
+	ticker := time.NewTicker(resyncRetryInterval)
+	defer ticker.Stop()
+	resync := false
 
-	cache.updateTicker = time.NewTicker(updateFrequency)
-	go func() {
-		for range cache.updateTicker.C {
-			if err := cache.Update(); err != nil {
-				cache.log.Errorf(errorMsg, err)
+	for {
+		select {
+		case change, ok := <-cache.listener.C:
+			if !ok {
+				return
 			}
+			switch {
+			case change.Action == store.ChangeDisconnected:
+				cache.markStale()
+			case change.Action == store.ChangeResync:
+				resync = true
+			case change.EntityType == "user" && !resync:
+				if err := cache.refresh(change.EntityID); err != nil {
+					cache.log.WithError(err).Errorf("unable to update user %s in User cache", change.EntityID)
+					resync = true
+				}
+			}
+		case <-ticker.C:
+		case <-cache.stop:
+			return
 		}
-	}()
 
-	return nil
+		if resync {
+			if err := cache.Update(); err != nil {
+				cache.log.Errorf("unable to update User cache from Store: %s", err)
+				cache.markStale()
+				continue
+			}
+			resync = false
+		}
+	}
 }
 
 func (cache *User) Stop() {
-	if cache.updateTicker != nil {
-		cache.updateTicker.Stop()
-	}
+	close(cache.stop)
+	<-cache.done
+}
+
+// reads go to the primary DB, since the replicas may lag behind the notified changes.
+func (cache *User) context() context.Context {
+	return store.WithReadYourWrites(context.Background(), true)
 }
 
+// Update loads all the users from the store.
 func (cache *User) Update() error {
-	users, err := cache.store.GetAll(context.Background())
+	users, err := cache.store.GetAll(cache.context(), cache.querier, store.Filter{})
 	if err != nil {
 		return err
 	}
 
 	m := make(map[string]entity.User, len(users))
+	logins := make(map[string]string, len(users))
 	for _, user := range users {
 		m[user.Login] = user
+		logins[user.ID.String()] = user.Login
 	}
 
 	cache.Lock()
 	cache.users = m
+	cache.logins = logins
+	cache.staleSince = time.Time{}
 	cache.Unlock()
 	return nil
 }
 
+// refresh reads the user from the store again, it's removed if it's been deleted.
+func (cache *User) refresh(ID string) error {
+	user, err := cache.store.GetByID(cache.context(), cache.querier, ID, false)
+	if _, ok := errors.Cause(err).(*store.NotFoundError); ok {
+		cache.Lock()
+		delete(cache.users, cache.logins[ID])
+		delete(cache.logins, ID)
+		cache.Unlock()
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	cache.Lock()
+	if login, ok := cache.logins[ID]; ok && login != user.Login {
+		delete(cache.users, login)
+	}
+	cache.users[user.Login] = user
+	cache.logins[ID] = user.Login
+	cache.Unlock()
+	return nil
+}
+
+func (cache *User) markStale() {
+	cache.Lock()
+	if cache.staleSince.IsZero() {
+		cache.staleSince = time.Now()
+	}
+	cache.Unlock()
+}
+
+// Staleness returns how long the cache has possibly been out of sync with the store, zero if
+// it's in sync.
+func (cache *User) Staleness() time.Duration {
+	cache.RLock()
+	defer cache.RUnlock()
+	if cache.staleSince.IsZero() {
+		return 0
+	}
+	return time.Since(cache.staleSince)
+}
+
 func (cache *User) GetByLogin(login string) entity.User {
 	cache.RLock()
 	CDNs := cache.users[login]
 	cache.RUnlock()
 	return CDNs
 }
+
+// RegisterMetrics registers the staleness gauge of the cache with the default registerer if
+// promReg is nil.
+func (cache *User) RegisterMetrics(promReg prometheus.Registerer, namespace string) {
+	if promReg == nil {
+		promReg = prometheus.DefaultRegisterer
+	}
+	promReg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   "cache",
+		Name:        "staleness_seconds",
+		Help:        "How long the cache has possibly been out of sync with the DB, 0 when it's in sync.",
+		ConstLabels: prometheus.Labels{"cache": "user"},
+	}, func() float64 {
+		return cache.Staleness().Seconds()
+	}))
+}
@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+	"github.com/jordanp/goapp/store/memory"
+	"github.com/stretchr/testify/require"
+)
+
+// waitFor polls the cache until fn returns true.
+func waitFor(t *testing.T, fn func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatal("the cache wasn't updated")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestUserCache(t *testing.T) {
+	logger, _ := log.NewTest()
+	db := memory.NewDB()
+	users := memory.NewUserStore(logger, db)
+	ctx := context.Background()
+	bob, err := users.Add(ctx, db, "bob", "password", "bob@goapp", "user", nil)
+	require.NoError(t, err)
+
+	listener := db.Listen()
+	defer listener.Close()
+	cache, err := NewUserCache(logger, users, db, listener)
+	require.NoError(t, err)
+	defer cache.Stop()
+	require.Equal(t, bob.ID, cache.GetByLogin("bob").ID)
+
+	alice, err := users.Add(ctx, db, "alice", "password", "alice@goapp", "user", nil)
+	require.NoError(t, err)
+	waitFor(t, func() bool { return cache.GetByLogin("alice").ID == alice.ID })
+
+	login := "robert"
+	_, err = users.Update(ctx, db, bob.ID.String(), entity.UserPatch{Login: &login}, 0)
+	require.NoError(t, err)
+	waitFor(t, func() bool { return cache.GetByLogin("robert").ID == bob.ID })
+	require.Equal(t, entity.User{}, cache.GetByLogin("bob"))
+
+	require.NoError(t, users.DeleteByID(ctx, db, alice.ID.String()))
+	waitFor(t, func() bool { return cache.GetByLogin("alice").ID != alice.ID })
+	require.Equal(t, time.Duration(0), cache.Staleness())
+}
+
+func TestUserCacheResync(t *testing.T) {
+	logger, _ := log.NewTest()
+	db := memory.NewDB()
+	users := memory.NewUserStore(logger, db)
+	var hub store.ChangeHub
+	listener := hub.Listen()
+	defer listener.Close()
+	cache, err := NewUserCache(logger, users, db, listener)
+	require.NoError(t, err)
+	defer cache.Stop()
+
+	// The changes missed while the listener is disconnected are read on resync
+	hub.Publish(store.Change{Action: store.ChangeDisconnected})
+	waitFor(t, func() bool { return cache.Staleness() > 0 })
+	bob, err := users.Add(context.Background(), db, "bob", "password", "bob@goapp", "user", nil)
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, entity.User{}, cache.GetByLogin("bob"))
+	require.True(t, cache.Staleness() >= 10*time.Millisecond)
+
+	hub.Publish(store.Change{Action: store.ChangeResync})
+	waitFor(t, func() bool { return cache.GetByLogin("bob").ID == bob.ID })
+	require.Equal(t, time.Duration(0), cache.Staleness())
+}
@@ -3,9 +3,13 @@ package main
 import (
 	"flag"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/jordanp/goapp/app"
+	"github.com/jordanp/goapp/mail"
+	"github.com/jordanp/goapp/outbox"
+	"github.com/jordanp/goapp/pkg/envelope"
 	"github.com/jordanp/goapp/pkg/graceful"
 	pkglog "github.com/jordanp/goapp/pkg/log"
 )
@@ -13,11 +17,71 @@ import (
 // export VERSION=$(git describe --tags --always --dirty)
 func main() {
 	secretKey := flag.String("secretKey", os.Getenv("SECRET_KEY"), "JWT secret key")
-	sqlDSN := flag.String("sqlDSN", os.Getenv("SQL_DSN"), "SQL connection string")
+	sqlDSN := flag.String("sqlDSN", os.Getenv("SQL_DSN"), "Postgres connection string, sqlite://<path> for SQLite, or memory:// to keep the data in memory")
+	sqlReplicaDSNs := flag.String("sqlReplicaDSNs", os.Getenv("SQL_REPLICA_DSNS"), "Comma separated connection strings of the Postgres read replicas")
+	var dbPool app.DBPool
+	flag.IntVar(&dbPool.MaxOpenConns, "dbMaxOpenConns", 20, "Maximum number of open connections to the DB, 0 for unlimited")
+	flag.IntVar(&dbPool.MaxIdleConns, "dbMaxIdleConns", 10, "Maximum number of idle connections to the DB")
+	flag.DurationVar(&dbPool.ConnMaxLifetime, "dbConnMaxLifetime", 30*time.Minute, "How long a DB connection can be reused, 0 for ever")
+	flag.DurationVar(&dbPool.ConnectTimeout, "dbConnectTimeout", 5*time.Second, "Maximum wait for a DB connection to be established, 0 for no timeout")
+	slowQueryThreshold := flag.Duration("slowQueryThreshold", 500*time.Millisecond, "Log the SQL queries lasting longer, 0 to disable the log")
+	explainSlowQueries := flag.Bool("explainSlowQueries", false, "Log the plan of the slow SQL queries")
+	logEvents := flag.Bool("logEvents", false, "Log the domain events")
+	eventWebhookURL := flag.String("eventWebhookURL", os.Getenv("EVENT_WEBHOOK_URL"), "URL the domain events are posted to")
+	jobWorkers := flag.Int("jobWorkers", 4, "Number of jobs run at the same time")
+	jobShutdownTimeout := flag.Duration("jobShutdownTimeout", 30*time.Second, "Maximum wait for the running jobs when stopping, the unfinished ones run again later")
+	piiMasterKeys := flag.String("piiMasterKeys", os.Getenv("PII_MASTER_KEYS"), "Comma separated 'ID:base64 key' master keys encrypting the personal data, the first one is current, the others are kept until the data is reencrypted")
+	piiIndexKey := flag.String("piiIndexKey", os.Getenv("PII_INDEX_KEY"), "Base64 key of the blind indexes of the personal data, it must never change")
+	softDeleteRetention := flag.Duration("softDeleteRetention", 30*24*time.Hour, "How long deleted users and companies can be restored, 0 to keep them forever")
+	idempotencyTTL := flag.Duration("idempotencyTTL", 24*time.Hour, "How long the responses of the requests made with an Idempotency-Key are replayed to their retries")
+	invitationURL := flag.String("invitationURL", os.Getenv("INVITATION_URL"), "URL of the page accepting the invitations, which is given their token in the 'token' query parameter")
+	invitationTTL := flag.Duration("invitationTTL", 7*24*time.Hour, "How long the invitations can be accepted")
+	smtpAddr := flag.String("smtpAddr", os.Getenv("SMTP_ADDR"), "host:port of the SMTP server sending the emails, they are logged without their body if it's empty")
+	smtpUser := flag.String("smtpUser", os.Getenv("SMTP_USER"), "SMTP username, empty to send without authentication")
+	smtpPassword := flag.String("smtpPassword", os.Getenv("SMTP_PASSWORD"), "SMTP password")
+	mailFrom := flag.String("mailFrom", os.Getenv("MAIL_FROM"), "Sender address of the emails")
+	trustedProxies := flag.String("trustedProxies", os.Getenv("TRUSTED_PROXIES"), "Comma separated IPs and CIDRs of the load balancers in front of the app, whose X-Forwarded-For gives the client IP")
+	logMailBodies := flag.Bool("logMailBodies", false, "Log the body of the emails when there is no SMTP server, with their secrets, for the development only")
 	flag.Parse()
 
 	log := pkglog.New("mygoapp", app.VERSION, pkglog.DebugLevel)
-	config := app.NewConfig(*secretKey, *sqlDSN)
+	opts := []app.ConfigOption{
+		app.WithDBPool(dbPool),
+		app.WithSlowQueryLog(*slowQueryThreshold, *explainSlowQueries),
+		app.WithSoftDeleteRetention(*softDeleteRetention),
+		app.WithJobWorkers(*jobWorkers, *jobShutdownTimeout),
+		app.WithIdempotencyTTL(*idempotencyTTL),
+		app.WithInvitations(*invitationURL, *invitationTTL),
+	}
+	if *logEvents {
+		opts = append(opts, app.WithEventSinks(outbox.LogSink{Log: log.F("component", "events")}))
+	}
+	if *eventWebhookURL != "" {
+		opts = append(opts, app.WithEventSinks(outbox.NewWebhookSink(*eventWebhookURL, 5*time.Second)))
+	}
+	if *smtpAddr != "" {
+		opts = append(opts, app.WithMailer(mail.SMTPMailer{Addr: *smtpAddr, From: *mailFrom, Username: *smtpUser, Password: *smtpPassword}))
+	} else if *logMailBodies {
+		opts = append(opts, app.WithMailer(mail.LogMailer{Log: log.F("component", "mailer"), Bodies: true}))
+	}
+	if *piiMasterKeys != "" {
+		keyring, err := envelope.ParseKeyring(*piiMasterKeys, *piiIndexKey)
+		if err != nil {
+			log.WithError(err).Fatal("invalid PII keys")
+		}
+		opts = append(opts, app.WithPIIKeyring(keyring))
+	}
+	if *trustedProxies != "" {
+		proxies, err := app.ParseTrustedProxies(*trustedProxies)
+		if err != nil {
+			log.WithError(err).Fatal("invalid trusted proxies")
+		}
+		opts = append(opts, app.WithTrustedProxies(proxies))
+	}
+	if *sqlReplicaDSNs != "" {
+		opts = append(opts, app.WithReplicas(strings.Split(*sqlReplicaDSNs, ",")))
+	}
+	config := app.NewConfig(*secretKey, *sqlDSN, opts...)
 	log.Infof("starting application with: %s", config)
 	app, err := app.NewApplication(log, config)
 	if err != nil {
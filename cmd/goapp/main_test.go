@@ -11,15 +11,21 @@ import (
 	"net/http/httptest"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jordanp/goapp/app"
 	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/mail"
 	"github.com/jordanp/goapp/pkg/auth"
+	"github.com/jordanp/goapp/pkg/envelope"
 	"github.com/jordanp/goapp/pkg/handlers"
 	"github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+	"github.com/jordanp/goapp/webhook"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -41,6 +47,8 @@ type ApplicationTestSuite struct {
 	suite.Suite
 	app        *app.Application
 	testServer *httptest.Server
+	events     *eventRecorder
+	mails      *mailRecorder
 
 	fixtures struct {
 		u []entity.User
@@ -57,32 +65,132 @@ func TestMainApplication(t *testing.T) {
 
 func (t *ApplicationTestSuite) SetupSuite() {
 	log := log.New("mygoapp", "test", log.ErrorLevel)
-	app, err := app.NewApplication(log, app.NewConfig(os.Getenv("SECRET_KEY"), os.Getenv("SQL_DSN")))
+	t.events = &eventRecorder{}
+	t.mails = &mailRecorder{}
+	keyring, err := envelope.NewKeyring("test", map[string][]byte{"test": bytes.Repeat([]byte{1}, envelope.KeySize)}, bytes.Repeat([]byte{2}, envelope.KeySize))
+	t.Require().NoError(err)
+	proxies, err := app.ParseTrustedProxies("127.0.0.1, 10.0.0.0/8")
+	t.Require().NoError(err)
+	config := app.NewConfig(getenv("SECRET_KEY", "test"), getenv("SQL_DSN", "memory://"),
+		app.WithPIIKeyring(keyring),
+		app.WithEventSinks(t.events),
+		app.WithEventPollInterval(10*time.Millisecond),
+		app.WithWebhookRetryPolicy(store.RetryPolicy{MaxAttempts: 2, BaseDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond}),
+		app.WithMailer(t.mails),
+		app.WithInvitations("https://goapp/invitations", time.Hour),
+		app.WithTrustedProxies(proxies),
+	)
+	app, err := app.NewApplication(log, config)
 	t.Require().NoError(err)
 	t.app = app
 	t.testServer = httptest.NewServer(t.app.Routes())
 }
 
+// The suite runs against the in-memory stores unless SQL_DSN is set.
+func getenv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
 func (t *ApplicationTestSuite) SetupTest() {
 	t.Require().NoError(t.app.UserStore.DeleteAll())
 	t.Require().NoError(t.app.CompanyStore.DeleteAll())
+	t.Require().NoError(t.app.AuditStore.DeleteAll())
+	t.Require().NoError(t.app.OutboxStore.DeleteAll())
+	t.Require().NoError(t.app.WebhookStore.DeleteAll())
+	t.Require().NoError(t.app.JobStore.DeleteAll())
+	t.Require().NoError(t.app.IdempotencyStore.DeleteAll())
+	t.Require().NoError(t.app.InvitationStore.DeleteAll())
+	t.Require().NoError(t.app.APIKeyStore.DeleteAll())
+	t.Require().NoError(t.app.MetadataSchemaStore.DeleteAll())
 	ctx := context.Background()
 
 	for _, u := range fixtures.u {
-		_, err := t.app.UserStore.Add(ctx, u.Login, u.Password, u.Email, u.Role)
+		_, err := t.app.UserStore.Add(ctx, t.app.DB, u.Login, u.Password, u.Email, u.Role, nil)
 		t.Require().NoError(err)
 	}
-	t.fixtures.u, _ = t.app.UserStore.GetAll(context.Background())
+	t.fixtures.u, _ = t.app.UserStore.GetAll(context.Background(), t.app.DB, store.Filter{})
 
-	c, err := t.app.CompanyStore.Add(ctx, "company1", []uuid.UUID{t.fixtures.u[2].ID, t.fixtures.u[3].ID})
+	members := []entity.Membership{{UserID: t.fixtures.u[2].ID, Role: entity.MembershipRoleOwner}, {UserID: t.fixtures.u[3].ID}}
+	c, err := t.app.CompanyStore.Add(ctx, t.app.DB, "company1", members, nil)
 	t.Require().NoError(err)
 	t.fixtures.c = []entity.Company{c}
 
-	c, err = t.app.CompanyStore.Add(ctx, "company2", nil)
+	c, err = t.app.CompanyStore.Add(ctx, t.app.DB, "company2", nil, nil)
 	t.Require().NoError(err)
 	t.fixtures.c = append(t.fixtures.c, c)
 }
 
+// eventRecorder is the sink of the domain events of the suite. The events of the previous tests
+// aren't cleared, the tests look for the events of their own entities.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []entity.DomainEvent
+}
+
+func (r *eventRecorder) Deliver(ctx context.Context, event entity.DomainEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	return nil
+}
+
+func (r *eventRecorder) list() []entity.DomainEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]entity.DomainEvent(nil), r.events...)
+}
+
+// waitForEvent returns the first event delivered matching fn.
+func (t *ApplicationTestSuite) waitForEvent(fn func(entity.DomainEvent) bool) entity.DomainEvent {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, event := range t.events.list() {
+			if fn(event) {
+				return event
+			}
+		}
+	}
+	t.FailNow("the domain event wasn't delivered")
+	return entity.DomainEvent{}
+}
+
+// mailRecorder is the mailer of the suite, like eventRecorder the mails of the previous tests
+// aren't cleared.
+type mailRecorder struct {
+	mu    sync.Mutex
+	mails []mail.Message
+}
+
+func (r *mailRecorder) Send(ctx context.Context, msg mail.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mails = append(r.mails, msg)
+	return nil
+}
+
+// waitForInvitation returns the token of the nth invitation sent to the address, from 1.
+func (t *ApplicationTestSuite) waitForInvitation(to string, nth int) string {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		t.mails.mu.Lock()
+		var sent []mail.Message
+		for _, msg := range t.mails.mails {
+			if msg.To == to {
+				sent = append(sent, msg)
+			}
+		}
+		t.mails.mu.Unlock()
+		if len(sent) >= nth {
+			i := strings.Index(sent[nth-1].Body, "https://goapp/invitations?token=")
+			t.Require().NotEqual(-1, i)
+			return strings.Fields(sent[nth-1].Body[i+len("https://goapp/invitations?token="):])[0]
+		}
+	}
+	t.FailNow("the invitation wasn't sent")
+	return ""
+}
+
 func (t *ApplicationTestSuite) TearDownSuite() {
 	t.testServer.Close()
 	t.app.Stop()
@@ -97,10 +205,18 @@ func (t *ApplicationTestSuite) TestStatus() {
 }
 
 func (t *ApplicationTestSuite) TestMetrics() {
-	var resp []byte
-	t.get("/metrics", nil, http.StatusOK, &resp)
-	t.Require().Contains(string(resp), "request_duration_seconds")
-	t.Require().Contains(string(resp), "go_memstats")
+	// The metrics of the SQL queries don't fit in the bodies kept by doRequest, they are read whole
+	resp, err := httpClient.Get(t.testServer.URL + "/metrics")
+	t.Require().NoError(err)
+	defer resp.Body.Close()
+	t.Require().Equal(http.StatusOK, resp.StatusCode)
+	metrics, err := ioutil.ReadAll(resp.Body)
+	t.Require().NoError(err)
+	t.Require().Contains(string(metrics), "request_duration_seconds")
+	t.Require().Contains(string(metrics), "go_memstats")
+	if _, ok := t.app.DB.(*store.DB); ok {
+		t.Require().Contains(string(metrics), `db_in_use_connections{db="primary"}`)
+	}
 }
 
 func (t *ApplicationTestSuite) TestUnauthorized() {
@@ -109,6 +225,8 @@ func (t *ApplicationTestSuite) TestUnauthorized() {
 	t.post("/admin/users/new", nil, nil, http.StatusUnauthorized, nil)
 	t.post("/admin/companies/new", nil, nil, http.StatusUnauthorized, nil)
 	t.get("/users/me", nil, http.StatusUnauthorized, nil)
+	t.get("/admin/search?q=admin", nil, http.StatusUnauthorized, nil)
+	t.get("/admin/audit", nil, http.StatusUnauthorized, nil)
 }
 
 func (t *ApplicationTestSuite) TestCreateCompany() {
@@ -164,6 +282,191 @@ func (t *ApplicationTestSuite) TestCreateCompanyWithDuplicateUsers() {
 	t.Require().Equal("duplicate user '"+t.fixtures.u[0].ID.String()+"' in company", err.Message)
 }
 
+func (t *ApplicationTestSuite) TestCompanyMembers() {
+	company1, company2, user := t.fixtures.c[0].ID.String(), t.fixtures.c[1].ID.String(), t.fixtures.u[2].ID.String()
+
+	var memberships entity.Memberships
+	t.get("/admin/users/"+user+"/companies", t.adminHeader("ut"), http.StatusOK, &memberships)
+	t.Require().Len(memberships.Memberships, 1)
+	t.Require().Equal(entity.MembershipRoleOwner, memberships.Memberships[0].Role)
+	t.Require().Equal("company1", memberships.Memberships[0].Company.Name)
+
+	var membership entity.Membership
+	t.post("/admin/companies/"+company2+"/members/"+user, t.adminHeader("ut"), nil, http.StatusOK, &membership)
+	t.Require().Equal(entity.MembershipRoleMember, membership.Role)
+	var err app.JSONError
+	t.post("/admin/companies/"+company2+"/members/"+user, t.adminHeader("ut"), nil, http.StatusUnprocessableEntity, &err)
+	t.Require().Equal("duplicate user '"+user+"' in company", err.Message)
+	t.post("/admin/companies/"+company2+"/members/"+uuid.New().String(), t.adminHeader("ut"), nil, http.StatusNotFound, nil)
+	t.post("/admin/companies/"+uuid.New().String()+"/members/"+user, t.adminHeader("ut"), nil, http.StatusNotFound, nil)
+	t.post("/admin/companies/"+company2+"/members/"+t.fixtures.u[3].ID.String(), t.adminHeader("ut"), map[string]string{"role": "boss"}, http.StatusBadRequest, nil)
+
+	t.patch("/admin/companies/"+company2+"/members/"+user, t.adminHeader("ut"), map[string]string{"role": "admin"}, http.StatusOK, &membership)
+	t.Require().Equal(entity.MembershipRoleAdmin, membership.Role)
+	t.get("/admin/users/"+user+"/companies", t.adminHeader("ut"), http.StatusOK, &memberships)
+	t.Require().Len(memberships.Memberships, 2)
+
+	var company entity.Company
+	t.get("/admin/companies/"+company2, t.adminHeader("ut"), http.StatusOK, &company)
+	t.Require().Len(company.Users, 1)
+	t.Require().Equal(entity.MembershipRoleAdmin, company.Users[0].CompanyRole)
+
+	t.delete("/admin/companies/"+company1+"/members/"+user, t.adminHeader("ut"), http.StatusOK, nil)
+	t.delete("/admin/companies/"+company1+"/members/"+user, t.adminHeader("ut"), http.StatusNotFound, &err)
+	t.Require().Equal("member '"+user+"' not found", err.Message)
+	t.get("/admin/companies/"+company1, t.adminHeader("ut"), http.StatusOK, &company)
+	t.Require().Len(company.Users, 1)
+
+	t.get("/admin/users/"+uuid.New().String()+"/companies", t.adminHeader("ut"), http.StatusNotFound, nil)
+}
+
+func (t *ApplicationTestSuite) TestQuotas() {
+	company1, company2 := t.fixtures.c[0].ID.String(), t.fixtures.c[1].ID.String()
+
+	var company entity.Company
+	t.get("/admin/companies/"+company1, t.adminHeader("ut"), http.StatusOK, &company)
+	t.Require().NotNil(company.Quota)
+	t.Require().Nil(company.Quota.Limits.MaxMembers)
+	t.Require().Equal(2, company.Quota.Usage.Members)
+
+	var err app.JSONError
+	t.put("/admin/companies/"+company1+"/limits", t.adminHeader("ut"), map[string]int{"max_members": -1}, http.StatusBadRequest, &err)
+	t.Require().Equal("input validation error: 'max_members' must be positive", err.Message)
+	t.put("/admin/companies/"+uuid.New().String()+"/limits", t.adminHeader("ut"), map[string]int{}, http.StatusNotFound, nil)
+
+	var quota entity.CompanyQuota
+	limits := map[string]int{"max_members": 2, "max_api_keys": 1, "requests_per_day": 2}
+	t.put("/admin/companies/"+company1+"/limits", t.adminHeader("ut"), limits, http.StatusOK, &quota)
+	t.Require().Equal(2, *quota.Limits.MaxMembers)
+	t.Require().Equal(1, *quota.Limits.MaxAPIKeys)
+	t.Require().Equal(2, *quota.Limits.RequestsPerDay)
+
+	// The members
+	t.post("/admin/companies/"+company1+"/members/"+t.fixtures.u[1].ID.String(), t.adminHeader("ut"), nil, http.StatusForbidden, &err)
+	t.Require().Equal("company '"+company1+"' exceeded its quota of 2 members", err.Message)
+	t.post("/admin/companies/"+company2+"/members/"+t.fixtures.u[1].ID.String(), t.adminHeader("ut"), nil, http.StatusOK, nil)
+	t.delete("/admin/companies/"+company1+"/members/"+t.fixtures.u[3].ID.String(), t.adminHeader("ut"), http.StatusOK, nil)
+	t.post("/admin/companies/"+company1+"/members/"+t.fixtures.u[1].ID.String(), t.adminHeader("ut"), nil, http.StatusOK, nil)
+
+	// The API keys
+	var apiKey entity.APIKey
+	t.post("/admin/companies/"+company1+"/api-keys", t.adminHeader("ut"), map[string]string{}, http.StatusBadRequest, nil)
+	t.post("/admin/companies/"+uuid.New().String()+"/api-keys", t.adminHeader("ut"), map[string]string{"name": "ci"}, http.StatusNotFound, nil)
+	t.post("/admin/companies/"+company1+"/api-keys", t.adminHeader("ut"), map[string]string{"name": "ci"}, http.StatusCreated, &apiKey)
+	t.Require().NotEmpty(apiKey.Key)
+	t.Require().Equal(apiKey.Key[:len(apiKey.Prefix)], apiKey.Prefix)
+	t.post("/admin/companies/"+company1+"/api-keys", t.adminHeader("ut"), map[string]string{"name": "cd"}, http.StatusForbidden, &err)
+	t.Require().Equal("company '"+company1+"' exceeded its quota of 1 api keys", err.Message)
+
+	var apiKeys entity.APIKeys
+	t.get("/admin/companies/"+company1+"/api-keys", t.adminHeader("ut"), http.StatusOK, &apiKeys)
+	t.Require().Len(apiKeys.APIKeys, 1)
+	t.Require().Equal(apiKey.ID, apiKeys.APIKeys[0].ID)
+	t.Require().Empty(apiKeys.APIKeys[0].Key)
+	t.get("/admin/companies/"+uuid.New().String()+"/api-keys", t.adminHeader("ut"), http.StatusNotFound, nil)
+
+	// The requests per day
+	t.get("/api/company", nil, http.StatusUnauthorized, nil)
+	t.get("/api/company", map[string]string{"X-API-Key": "unknown"}, http.StatusUnauthorized, nil)
+	for i := 1; i <= 2; i++ {
+		t.get("/api/company", map[string]string{"X-API-Key": apiKey.Key}, http.StatusOK, &company)
+		t.Require().Equal(company1, company.ID.String())
+		t.Require().Equal(i, company.Quota.Usage.RequestsToday)
+	}
+	t.get("/api/company", map[string]string{"X-API-Key": apiKey.Key}, http.StatusTooManyRequests, &err)
+	t.Require().Equal("company '"+company1+"' exceeded its quota of 2 requests per day", err.Message)
+
+	t.get("/admin/companies/"+company1, t.adminHeader("ut"), http.StatusOK, &company)
+	t.Require().Equal(entity.CompanyUsage{Members: 2, APIKeys: 1, RequestsToday: 2}, company.Quota.Usage)
+
+	// Lifting the limits
+	t.put("/admin/companies/"+company1+"/limits", t.adminHeader("ut"), map[string]int{"max_api_keys": 2}, http.StatusOK, &quota)
+	t.Require().Nil(quota.Limits.RequestsPerDay)
+	t.get("/api/company", map[string]string{"X-API-Key": apiKey.Key}, http.StatusOK, nil)
+
+	t.delete("/admin/companies/"+company1+"/api-keys/"+apiKey.ID.String(), t.adminHeader("ut"), http.StatusNoContent, nil)
+	t.delete("/admin/companies/"+company1+"/api-keys/"+apiKey.ID.String(), t.adminHeader("ut"), http.StatusNotFound, nil)
+	t.get("/api/company", map[string]string{"X-API-Key": apiKey.Key}, http.StatusUnauthorized, nil)
+}
+
+func (t *ApplicationTestSuite) TestCompanyHierarchy() {
+	holding := t.fixtures.c[0]
+	var subsidiary, department entity.Company
+	t.post("/admin/companies/new", t.adminHeader("ut"), entity.Company{Name: "subsidiary", ParentID: &holding.ID}, http.StatusOK, &subsidiary)
+	t.Require().Equal(holding.ID, *subsidiary.ParentID)
+	t.post("/admin/companies/new", t.adminHeader("ut"), entity.Company{Name: "department", ParentID: &subsidiary.ID}, http.StatusOK, &department)
+	unknown := uuid.New()
+	t.post("/admin/companies/new", t.adminHeader("ut"), entity.Company{Name: "orphan", ParentID: &unknown}, http.StatusUnprocessableEntity, nil)
+
+	var companies entity.Companies
+	t.get("/admin/companies/"+department.ID.String()+"/ancestors", t.adminHeader("ut"), http.StatusOK, &companies)
+	t.Require().Len(companies.Companies, 2)
+	t.Require().Equal(subsidiary.ID, companies.Companies[0].ID)
+	t.Require().Equal(holding.ID, companies.Companies[1].ID)
+	t.get("/admin/companies/"+holding.ID.String()+"/descendants", t.adminHeader("ut"), http.StatusOK, &companies)
+	t.Require().Len(companies.Companies, 2)
+	t.Require().Equal(subsidiary.ID, companies.Companies[0].ID)
+	t.Require().Equal(department.ID, companies.Companies[1].ID)
+
+	var company entity.Company
+	t.get("/admin/companies/"+holding.ID.String()+"?include_children", t.adminHeader("ut"), http.StatusOK, &company)
+	t.Require().Len(company.Children, 1)
+	t.Require().Equal("subsidiary", company.Children[0].Name)
+	t.Require().Len(company.Children[0].Children, 1)
+	t.Require().Equal("department", company.Children[0].Children[0].Name)
+	t.Require().Empty(company.EffectiveMembers)
+
+	// The members of the ancestors are members of the department, with their nearest role
+	owner, member, newcomer := t.fixtures.u[2].ID.String(), t.fixtures.u[3].ID.String(), t.fixtures.u[1].ID.String()
+	t.post("/admin/companies/"+department.ID.String()+"/members/"+newcomer, t.adminHeader("ut"), nil, http.StatusOK, nil)
+	t.post("/admin/companies/"+subsidiary.ID.String()+"/members/"+member, t.adminHeader("ut"), map[string]string{"role": "admin"}, http.StatusOK, nil)
+	t.get("/admin/companies/"+department.ID.String()+"?include_effective_members=true", t.adminHeader("ut"), http.StatusOK, &company)
+	t.Require().Len(company.Users, 1)
+	t.Require().Len(company.EffectiveMembers, 3)
+	t.Require().Equal(newcomer, company.EffectiveMembers[0].ID.String())
+	t.Require().Nil(company.EffectiveMembers[0].InheritedFrom)
+	t.Require().Equal(member, company.EffectiveMembers[1].ID.String())
+	t.Require().Equal(entity.MembershipRoleAdmin, company.EffectiveMembers[1].CompanyRole)
+	t.Require().Equal(subsidiary.ID, *company.EffectiveMembers[1].InheritedFrom)
+	t.Require().Equal(owner, company.EffectiveMembers[2].ID.String())
+	t.Require().Equal(holding.ID, *company.EffectiveMembers[2].InheritedFrom)
+	t.get("/admin/companies/"+department.ID.String()+"?include_children=maybe", t.adminHeader("ut"), http.StatusBadRequest, nil)
+
+	// A company can't be moved under itself or its descendants
+	var err app.JSONError
+	path := "/admin/companies/" + holding.ID.String() + "/move"
+	t.post(path, t.adminHeader("ut"), entity.CompanyMove{ParentID: &department.ID}, http.StatusUnprocessableEntity, &err)
+	t.Require().Contains(err.Message, "can't be moved under")
+	t.post(path, t.adminHeader("ut"), entity.CompanyMove{ParentID: &holding.ID}, http.StatusUnprocessableEntity, nil)
+	t.post(path, t.adminHeader("ut"), entity.CompanyMove{ParentID: &unknown}, http.StatusUnprocessableEntity, nil)
+	t.post("/admin/companies/"+unknown.String()+"/move", t.adminHeader("ut"), entity.CompanyMove{}, http.StatusNotFound, nil)
+
+	path = "/admin/companies/" + department.ID.String() + "/move"
+	t.post(path, t.ifMatchHeader(department.Version), entity.CompanyMove{ParentID: &t.fixtures.c[1].ID}, http.StatusOK, &company)
+	t.Require().Equal(t.fixtures.c[1].ID, *company.ParentID)
+	t.post(path, t.ifMatchHeader(department.Version), entity.CompanyMove{}, http.StatusPreconditionFailed, nil)
+	var root entity.Company
+	t.post(path, t.ifMatchHeader(company.Version), entity.CompanyMove{}, http.StatusOK, &root)
+	t.Require().Nil(root.ParentID)
+	t.get("/admin/companies/"+department.ID.String()+"/ancestors", t.adminHeader("ut"), http.StatusOK, &companies)
+	t.Require().Empty(companies.Companies)
+
+	var events entity.AuditEvents
+	t.get("/admin/audit?entity_type=company&entity_id="+department.ID.String(), t.adminHeader("ut"), http.StatusOK, &events)
+	t.Require().Equal(entity.AuditActionMove, events.Events[0].Action)
+
+	// The subtrees of the soft deleted companies are hidden
+	t.post(path, t.adminHeader("ut"), entity.CompanyMove{ParentID: &subsidiary.ID}, http.StatusOK, nil)
+	t.delete("/admin/companies/"+subsidiary.ID.String(), t.adminHeader("ut"), http.StatusOK, nil)
+	t.get("/admin/companies/"+holding.ID.String()+"/descendants", t.adminHeader("ut"), http.StatusOK, &companies)
+	t.Require().Empty(companies.Companies)
+	t.get("/admin/companies/"+holding.ID.String()+"/descendants?include_deleted", t.adminHeader("ut"), http.StatusOK, &companies)
+	t.Require().Len(companies.Companies, 2)
+	t.get("/admin/companies/"+department.ID.String()+"/ancestors", t.adminHeader("ut"), http.StatusOK, &companies)
+	t.Require().Empty(companies.Companies)
+	t.get("/admin/companies/"+subsidiary.ID.String()+"/descendants", t.adminHeader("ut"), http.StatusNotFound, nil)
+}
+
 func (t *ApplicationTestSuite) TestDeleteCompany() {
 	t.delete("/admin/companies/"+t.fixtures.c[0].ID.String(), t.adminHeader("ut"), http.StatusOK, nil)
 	t.delete("/admin/companies/"+t.fixtures.c[0].ID.String(), t.adminHeader("ut"), http.StatusNotFound, nil)
@@ -172,6 +475,517 @@ func (t *ApplicationTestSuite) TestDeleteCompany() {
 	t.Require().Contains(string(resp), "company 'malformatedUUID' not found")
 }
 
+func (t *ApplicationTestSuite) TestUpdateCompany() {
+	path := "/admin/companies/" + t.fixtures.c[0].ID.String()
+	t.patch(path, t.ifMatchHeader(1), map[string]string{}, http.StatusBadRequest, nil)
+
+	var company entity.Company
+	t.patch(path, t.ifMatchHeader(1), map[string]string{"name": "renamed"}, http.StatusOK, &company)
+	t.Require().Equal("renamed", company.Name)
+	t.Require().Equal(2, company.Version)
+	t.Require().True(company.UpdatedAt.After(company.CreatedAt))
+
+	var err app.JSONError
+	t.patch(path, t.ifMatchHeader(1), map[string]string{"name": "conflict"}, http.StatusPreconditionFailed, &err)
+	t.Require().Equal("company '"+t.fixtures.c[0].ID.String()+"' has been modified, current version is 2", err.Message)
+	t.patch(path, t.ifMatchHeader(2), map[string]string{"name": t.fixtures.c[1].Name}, http.StatusUnprocessableEntity, nil)
+	t.patch(path, t.adminHeader("ut"), map[string]string{"name": "any version"}, http.StatusOK, &company)
+	t.Require().Equal(3, company.Version)
+
+	t.patch("/admin/companies/00000000-0000-0000-0000-000000000000", t.adminHeader("ut"), map[string]string{"name": "foo"}, http.StatusNotFound, nil)
+	t.patch("/admin/companies/malformatedUUID", t.ifMatchHeader(1), map[string]string{"name": "foo"}, http.StatusNotFound, nil)
+}
+
+func (t *ApplicationTestSuite) TestUpdateUser() {
+	path := "/admin/users/" + t.fixtures.u[1].ID.String()
+	var user entity.User
+	t.get(path, t.adminHeader("ut"), http.StatusOK, &user)
+	t.Require().Equal(1, user.Version)
+	t.Require().Empty(user.Password)
+
+	t.patch(path, t.ifMatchHeader(1), map[string]string{"password": "newpass", "email": "new@goapp"}, http.StatusOK, &user)
+	t.Require().Equal("new@goapp", user.Email)
+	t.Require().Equal(2, user.Version)
+	t.post("/token/access", nil, entity.UserCredentials{Login: "user", Password: "newpass"}, http.StatusOK, nil)
+
+	t.patch(path, t.ifMatchHeader(1), map[string]string{"role": "admin"}, http.StatusPreconditionFailed, nil)
+	t.patch(path, t.ifMatchHeader(2), map[string]string{"login": "admin"}, http.StatusUnprocessableEntity, nil)
+	headers := t.adminHeader("ut")
+	headers["If-Match"] = "not-an-etag"
+	t.patch(path, headers, map[string]string{"role": "admin"}, http.StatusPreconditionFailed, nil)
+}
+
+func (t *ApplicationTestSuite) TestRestoreCompany() {
+	path := "/admin/companies/" + t.fixtures.c[0].ID.String()
+	t.delete(path, t.adminHeader("ut"), http.StatusOK, nil)
+	t.get(path, t.adminHeader("ut"), http.StatusNotFound, nil)
+	t.patch(path, t.adminHeader("ut"), map[string]string{"name": "foo"}, http.StatusNotFound, nil)
+
+	var deleted, restored, company entity.Company
+	t.get(path+"?include_deleted", t.adminHeader("ut"), http.StatusOK, &deleted)
+	t.Require().NotNil(deleted.DeletedAt)
+	t.get(path+"?include_deleted=nope", t.adminHeader("ut"), http.StatusBadRequest, nil)
+
+	t.post(path+"/restore", t.adminHeader("ut"), nil, http.StatusOK, &restored)
+	t.Require().Nil(restored.DeletedAt)
+	t.post(path+"/restore", t.adminHeader("ut"), nil, http.StatusNotFound, nil)
+	t.get(path, t.adminHeader("ut"), http.StatusOK, &company)
+	t.Require().Len(company.Users, 2)
+}
+
+func (t *ApplicationTestSuite) TestRestoreUser() {
+	path := "/admin/users/" + t.fixtures.u[2].ID.String()
+	t.delete(path, t.adminHeader("ut"), http.StatusOK, nil)
+	t.get(path, t.adminHeader("ut"), http.StatusNotFound, nil)
+	t.post("/token/access", nil, entity.UserCredentials{Login: t.fixtures.u[2].Login, Password: "admin"}, http.StatusUnauthorized, nil)
+
+	var users entity.Users
+	t.get("/admin/users/all", t.adminHeader("ut"), http.StatusOK, &users)
+	t.Require().Len(users.Users, len(fixtures.u)-1)
+	t.get("/admin/users/all?include_deleted=true", t.adminHeader("ut"), http.StatusOK, &users)
+	t.Require().Len(users.Users, len(fixtures.u))
+
+	// Deleted members are hidden but not removed from their companies
+	var company entity.Company
+	t.get("/admin/companies/"+t.fixtures.c[0].ID.String(), t.adminHeader("ut"), http.StatusOK, &company)
+	t.Require().Len(company.Users, 1)
+	t.get("/admin/companies/"+t.fixtures.c[0].ID.String()+"?include_deleted", t.adminHeader("ut"), http.StatusOK, &company)
+	t.Require().Len(company.Users, 2)
+
+	var user entity.User
+	t.post(path+"/restore", t.adminHeader("ut"), nil, http.StatusOK, &user)
+	t.Require().Nil(user.DeletedAt)
+	t.post("/token/access", nil, entity.UserCredentials{Login: t.fixtures.u[2].Login, Password: "admin"}, http.StatusOK, nil)
+}
+
+func (t *ApplicationTestSuite) TestPurge() {
+	var child entity.Company
+	t.post("/admin/companies/new", t.adminHeader("ut"), entity.Company{Name: "child", ParentID: &t.fixtures.c[1].ID}, http.StatusOK, &child)
+	t.delete("/admin/users/"+t.fixtures.u[2].ID.String(), t.adminHeader("ut"), http.StatusOK, nil)
+	t.delete("/admin/companies/"+t.fixtures.c[1].ID.String(), t.adminHeader("ut"), http.StatusOK, nil)
+
+	t.app.Purge(context.Background(), time.Hour)
+	t.get("/admin/users/"+t.fixtures.u[2].ID.String()+"?include_deleted", t.adminHeader("ut"), http.StatusOK, nil)
+
+	t.app.Purge(context.Background(), 0)
+	t.get("/admin/users/"+t.fixtures.u[2].ID.String()+"?include_deleted", t.adminHeader("ut"), http.StatusNotFound, nil)
+	t.get("/admin/companies/"+t.fixtures.c[1].ID.String()+"?include_deleted", t.adminHeader("ut"), http.StatusNotFound, nil)
+	t.post("/admin/companies/"+t.fixtures.c[1].ID.String()+"/restore", t.adminHeader("ut"), nil, http.StatusNotFound, nil)
+
+	// The children of the purged companies become root companies, their moves are audited
+	var company entity.Company
+	t.get("/admin/companies/"+child.ID.String(), t.adminHeader("ut"), http.StatusOK, &company)
+	t.Require().Nil(company.ParentID)
+	t.Require().Equal(child.Version+1, company.Version)
+	var events entity.AuditEvents
+	t.get("/admin/audit?entity_type=company&entity_id="+child.ID.String(), t.adminHeader("ut"), http.StatusOK, &events)
+	t.Require().Equal(entity.AuditActionMove, events.Events[0].Action)
+}
+
+func (t *ApplicationTestSuite) TestUpdatedSince() {
+	var user entity.User
+	t.patch("/admin/users/"+t.fixtures.u[1].ID.String(), t.adminHeader("ut"), map[string]string{"role": "user"}, http.StatusOK, &user)
+	t.Require().True(user.UpdatedAt.After(user.CreatedAt))
+	since := user.UpdatedAt.Format(time.RFC3339Nano)
+	t.delete("/admin/users/"+t.fixtures.u[2].ID.String(), t.adminHeader("ut"), http.StatusOK, nil)
+
+	var users entity.Users
+	t.get("/admin/users/all?updated_since="+since, t.adminHeader("ut"), http.StatusOK, &users)
+	t.Require().Len(users.Users, 1)
+	t.Require().Equal(user.ID, users.Users[0].ID)
+	t.Require().Equal(time.UTC, users.Users[0].UpdatedAt.Location())
+	t.get("/admin/users/all?include_deleted&updated_since="+since, t.adminHeader("ut"), http.StatusOK, &users)
+	t.Require().Len(users.Users, 2)
+	t.Require().Equal(t.fixtures.u[2].ID, users.Users[1].ID)
+
+	var companies entity.Companies
+	t.get("/admin/companies/all", t.adminHeader("ut"), http.StatusOK, &companies)
+	t.Require().Len(companies.Companies, 2)
+	var company entity.Company
+	t.patch("/admin/companies/"+t.fixtures.c[1].ID.String(), t.adminHeader("ut"), map[string]string{"name": "renamed"}, http.StatusOK, &company)
+	t.get("/admin/companies/all?updated_since="+company.UpdatedAt.Format(time.RFC3339Nano), t.adminHeader("ut"), http.StatusOK, &companies)
+	t.Require().Len(companies.Companies, 1)
+	t.Require().Equal("renamed", companies.Companies[0].Name)
+
+	t.get("/admin/users/all?updated_since=yesterday", t.adminHeader("ut"), http.StatusBadRequest, nil)
+	t.get("/admin/companies/all?updated_since=yesterday", t.adminHeader("ut"), http.StatusBadRequest, nil)
+}
+
+func (t *ApplicationTestSuite) TestExportUser() {
+	member := t.fixtures.u[2]
+	t.post("/admin/companies/"+t.fixtures.c[1].ID.String()+"/members/"+member.ID.String(), t.adminHeader("ut"), nil, http.StatusOK, nil)
+	var export entity.UserExport
+	t.get("/admin/users/"+member.ID.String()+"/export", t.adminHeader("ut"), http.StatusOK, &export)
+	t.Require().Equal(member.ID, export.User.ID)
+	t.Require().Equal("user1@company1", export.User.Email)
+	t.Require().Empty(export.User.Password)
+	t.Require().Len(export.Memberships, 2)
+	t.Require().Len(export.AuditEvents, 2)
+	t.Require().Equal("membership", export.AuditEvents[0].EntityType)
+	t.Require().Equal("user", export.AuditEvents[1].EntityType)
+	t.Require().Equal([]entity.TokenMetadata{{Audience: "access", Claims: []string{"sub", "email", "role"}, Lifetime: "5m0s"}}, export.Tokens)
+
+	// The mutations made by the user are exported as well
+	t.patch("/admin/users/"+t.fixtures.u[1].ID.String(), t.adminHeader("admin"), map[string]string{"role": "user"}, http.StatusOK, nil)
+	var self entity.UserExport
+	t.get("/users/me/export", t.userHeader(t.fixtures.u[0]), http.StatusOK, &self)
+	t.Require().Equal(t.fixtures.u[0].ID, self.User.ID)
+	t.Require().Empty(self.User.Password)
+	t.Require().Empty(self.Memberships)
+	t.Require().Len(self.AuditEvents, 2)
+	t.Require().Equal(t.fixtures.u[1].ID.String(), self.AuditEvents[0].EntityID)
+	t.Require().Len(self.Tokens, 2)
+
+	t.get("/admin/users/"+uuid.New().String()+"/export", t.adminHeader("ut"), http.StatusNotFound, nil)
+	t.get("/users/me/export", t.userHeader(entity.User{Login: "unknown"}), http.StatusNotFound, nil)
+}
+
+func (t *ApplicationTestSuite) TestEraseUser() {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+	var hook entity.Webhook
+	t.post("/admin/webhooks/new", t.adminHeader("ut"), map[string]interface{}{"url": receiver.URL, "events": []string{"user.*"}}, http.StatusOK, &hook)
+	hookPath := "/admin/webhooks/" + hook.ID.String()
+
+	var user entity.User
+	body := map[string]string{"login": "forgotten", "password": "pass", "email": "forgotten@goapp", "role": "user", "company_id": t.fixtures.c[0].ID.String()}
+	headers := t.adminHeader("ut")
+	headers["Idempotency-Key"] = "forgotten"
+	t.post("/admin/users/new", headers, body, http.StatusOK, &user)
+	path := "/admin/users/" + user.ID.String()
+	t.patch(path, t.adminHeader("forgotten"), map[string]interface{}{"email": "forgotten2@goapp", "metadata": map[string]string{"note": "remember me"}}, http.StatusOK, nil)
+	var invitation entity.Invitation
+	invitationsPath := "/admin/companies/" + t.fixtures.c[1].ID.String() + "/invitations"
+	t.post(invitationsPath, t.adminHeader("ut"), entity.Invitation{Email: "forgotten2@goapp"}, http.StatusCreated, &invitation)
+	var deliveries entity.WebhookDeliveries
+	for deadline := time.Now().Add(5 * time.Second); len(deliveries.Deliveries) < 2; time.Sleep(10 * time.Millisecond) {
+		t.Require().True(time.Now().Before(deadline), "the user events weren't enqueued")
+		t.get(hookPath+"/deliveries", t.adminHeader("ut"), http.StatusOK, &deliveries)
+	}
+
+	var erased entity.User
+	t.post(path+"/erase", t.adminHeader("ut"), nil, http.StatusOK, &erased)
+	t.Require().Equal("erased-"+user.ID.String(), erased.Login)
+	t.Require().Equal("erased-"+user.ID.String()+"@erased.invalid", erased.Email)
+	t.Require().NotNil(erased.DeletedAt)
+	t.Require().NotNil(erased.ErasedAt)
+	t.post("/token/access", nil, entity.UserCredentials{Login: "forgotten", Password: "pass"}, http.StatusUnauthorized, nil)
+
+	// The audit trail and the memberships are kept, without the personal data
+	var events entity.AuditEvents
+	t.get("/admin/audit?entity_type=user&entity_id="+user.ID.String(), t.adminHeader("ut"), http.StatusOK, &events)
+	t.Require().Len(events.Events, 3)
+	t.Require().Equal(entity.AuditActionErase, events.Events[0].Action)
+	t.Require().Nil(events.Events[0].Before)
+	for _, event := range events.Events {
+		t.Require().NotContains(string(event.Before)+string(event.After), "forgotten")
+		t.Require().NotContains(string(event.Before)+string(event.After), "remember me")
+	}
+	t.get("/admin/audit?actor=forgotten", t.adminHeader("ut"), http.StatusOK, &events)
+	t.Require().Empty(events.Events)
+	t.get("/admin/audit?actor="+erased.Login, t.adminHeader("ut"), http.StatusOK, &events)
+	t.Require().Len(events.Events, 1)
+	var company entity.Company
+	t.get("/admin/companies/"+t.fixtures.c[0].ID.String()+"?include_deleted", t.adminHeader("ut"), http.StatusOK, &company)
+	t.Require().Len(company.Users, 3)
+
+	// So are its domain events, its invitations are revoked and its idempotent responses deleted
+	t.get(hookPath+"/deliveries", t.adminHeader("ut"), http.StatusOK, &deliveries)
+	for _, delivery := range deliveries.Deliveries {
+		t.Require().NotContains(string(delivery.Payload), "forgotten")
+		t.Require().NotContains(string(delivery.Payload), "remember me")
+	}
+	var invitations entity.Invitations
+	t.get(invitationsPath, t.adminHeader("ut"), http.StatusOK, &invitations)
+	t.Require().Len(invitations.Invitations, 1)
+	t.Require().Equal(store.ErasedEmail(user.ID.String()), invitations.Invitations[0].Email)
+	t.Require().Equal(entity.InvitationStatusRevoked, invitations.Invitations[0].Status)
+	_, started, err := t.app.IdempotencyStore.Begin(context.Background(), t.app.DB, "ut", "forgotten", "other", time.Minute, time.Minute)
+	t.Require().NoError(err)
+	t.Require().True(started)
+
+	// The erased users can't be restored, their login and email are free
+	t.post(path+"/restore", t.adminHeader("ut"), nil, http.StatusNotFound, nil)
+	t.post(path+"/erase", t.adminHeader("ut"), nil, http.StatusNotFound, nil)
+	t.post("/admin/users/new", t.adminHeader("ut"), entity.User{Login: "forgotten", Password: "pass", Email: "forgotten2@goapp", Role: "user"}, http.StatusOK, nil)
+
+	// The deleted users can be erased too
+	deleted := "/admin/users/" + t.fixtures.u[3].ID.String()
+	t.delete(deleted, t.adminHeader("ut"), http.StatusOK, nil)
+	t.post(deleted+"/erase", t.adminHeader("ut"), nil, http.StatusOK, &erased)
+	t.Require().Equal("erased-"+t.fixtures.u[3].ID.String(), erased.Login)
+	t.post("/admin/users/"+uuid.New().String()+"/erase", t.adminHeader("ut"), nil, http.StatusNotFound, nil)
+}
+
+func (t *ApplicationTestSuite) TestAudit() {
+	var user entity.User
+	t.post("/admin/users/new", t.adminHeader("auditor"), entity.User{Login: "audited", Password: "pass", Email: "audited@goapp", Role: "user"}, http.StatusOK, &user)
+	path := "/admin/users/" + user.ID.String()
+	// The X-Forwarded-For hops before the first untrusted proxy are controlled by the client
+	forwarded := t.adminHeader("auditor")
+	forwarded["X-Forwarded-For"] = "6.6.6.6, 1.2.3.4, 10.0.0.1"
+	t.patch(path, forwarded, map[string]string{"email": "new@goapp"}, http.StatusOK, nil)
+	t.delete(path, t.adminHeader("auditor"), http.StatusOK, nil)
+
+	var events entity.AuditEvents
+	t.get("/admin/audit?entity_type=user&entity_id="+user.ID.String(), t.adminHeader("ut"), http.StatusOK, &events)
+	t.Require().Len(events.Events, 3)
+	t.Require().Nil(events.NextOffset)
+	deleted, updated, created := events.Events[0], events.Events[1], events.Events[2]
+	t.Require().Equal(entity.AuditActionDelete, deleted.Action)
+	t.Require().Equal(entity.AuditActionUpdate, updated.Action)
+	t.Require().Equal(entity.AuditActionCreate, created.Action)
+	t.Require().Equal("auditor", deleted.Actor)
+	t.Require().Len(deleted.RequestID, 36)
+	t.Require().NotEqual(deleted.RequestID, created.RequestID)
+	t.Require().Equal("127.0.0.1", deleted.ClientIP)
+	t.Require().Equal("1.2.3.4", updated.ClientIP)
+	t.Require().Nil(created.Before)
+	t.Require().Contains(string(created.After), `"login":"audited"`)
+	t.Require().NotContains(string(created.After), "password")
+	// The emails are only stored sealed
+	t.Require().Contains(string(created.After), `"email":"`+store.RedactedEmail+`"`)
+	t.Require().NotContains(string(updated.Before)+string(updated.After), "@goapp")
+	t.Require().Contains(string(deleted.After), "deleted_at")
+
+	var page1, page2, creates entity.AuditEvents
+	t.get("/admin/audit?actor=auditor&limit=2", t.adminHeader("ut"), http.StatusOK, &page1)
+	t.Require().Len(page1.Events, 2)
+	t.Require().Equal(2, *page1.NextOffset)
+	t.get("/admin/audit?actor=auditor&limit=2&offset=2", t.adminHeader("ut"), http.StatusOK, &page2)
+	t.Require().Len(page2.Events, 1)
+	t.Require().Nil(page2.NextOffset)
+	t.get("/admin/audit?actor=auditor&action=create&since="+time.Now().Add(-time.Minute).Format(time.RFC3339), t.adminHeader("ut"), http.StatusOK, &creates)
+	t.Require().Len(creates.Events, 1)
+
+	t.get("/admin/audit?limit=1000", t.adminHeader("ut"), http.StatusBadRequest, nil)
+	t.get("/admin/audit?since=yesterday", t.adminHeader("ut"), http.StatusBadRequest, nil)
+}
+
+func (t *ApplicationTestSuite) TestDomainEvents() {
+	// The user rolled back along with its membership isn't published
+	body := map[string]string{"login": "rolledback", "password": "test", "email": "rolledback", "role": "user", "company_id": uuid.New().String()}
+	t.post("/admin/users/new", t.adminHeader("ut"), body, http.StatusUnprocessableEntity, nil)
+	t.delete("/admin/companies/"+t.fixtures.c[0].ID.String(), t.adminHeader("ut"), http.StatusOK, nil)
+
+	deleted := t.waitForEvent(func(event entity.DomainEvent) bool {
+		return event.Type == entity.EventCompanyDeleted && event.EntityID == t.fixtures.c[0].ID.String()
+	})
+	t.Require().Len(deleted.RequestID, 36)
+	t.Require().Equal(1, deleted.Attempts)
+	t.Require().Contains(string(deleted.Payload), "deleted_at")
+
+	// The fixtures were published before
+	for _, user := range t.fixtures.u {
+		created := t.waitForEvent(func(event entity.DomainEvent) bool {
+			return event.Type == entity.EventUserCreated && event.EntityID == user.ID.String()
+		})
+		t.Require().True(created.ID < deleted.ID)
+	}
+	for _, event := range t.events.list() {
+		t.Require().NotContains(string(event.Payload), `"login":"rolledback"`)
+	}
+}
+
+func (t *ApplicationTestSuite) TestWebhooks() {
+	type request struct {
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan request, 100)
+	var failing int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		requests <- request{r.Header, body}
+	}))
+	defer receiver.Close()
+	// receive returns the first delivery of an event of the entity
+	receive := func(eventType, entityID string) (request, entity.DomainEvent) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case req := <-requests:
+				var event entity.DomainEvent
+				t.Require().NoError(json.Unmarshal(req.body, &event))
+				if event.Type == eventType && event.EntityID == entityID {
+					return req, event
+				}
+			case <-timeout:
+				t.FailNow("the webhook wasn't called", "%s %s", eventType, entityID)
+			}
+		}
+	}
+
+	t.post("/admin/webhooks/new", t.adminHeader("ut"), map[string]interface{}{"url": "ftp://localhost", "events": []string{"*"}}, http.StatusBadRequest, nil)
+	t.post("/admin/webhooks/new", t.adminHeader("ut"), map[string]interface{}{"url": receiver.URL, "events": []string{"user.exploded"}}, http.StatusBadRequest, nil)
+
+	var hook entity.Webhook
+	body := map[string]interface{}{"url": receiver.URL, "events": []string{"company.*", entity.EventMembershipCreated}}
+	t.post("/admin/webhooks/new", t.adminHeader("ut"), body, http.StatusOK, &hook)
+	t.Require().Len(hook.Secret, 64)
+	path := "/admin/webhooks/" + hook.ID.String()
+	var got entity.Webhook
+	t.get(path, t.adminHeader("ut"), http.StatusOK, &got)
+	t.Require().Empty(got.Secret)
+	t.Require().Equal(hook.Events, got.Events)
+	var all entity.Webhooks
+	t.get("/admin/webhooks/all", t.adminHeader("ut"), http.StatusOK, &all)
+	t.Require().Len(all.Webhooks, 1)
+
+	// The deliveries are signed
+	var company entity.Company
+	t.post("/admin/companies/new", t.adminHeader("ut"), entity.Company{Name: "hooked"}, http.StatusOK, &company)
+	req, event := receive(entity.EventCompanyCreated, company.ID.String())
+	t.Require().Equal(hook.ID.String(), req.header.Get(webhook.HeaderWebhookID))
+	t.Require().Equal(entity.EventCompanyCreated, req.header.Get(webhook.HeaderEvent))
+	t.Require().NoError(webhook.Verify(hook.Secret, req.header.Get(webhook.HeaderTimestamp), req.header.Get(webhook.HeaderSignature), req.body, time.Minute))
+	t.Require().Error(webhook.Verify("wrong", req.header.Get(webhook.HeaderTimestamp), req.header.Get(webhook.HeaderSignature), req.body, time.Minute))
+	t.Require().Contains(string(event.Payload), `"name":"hooked"`)
+
+	// A delivery failing for the last time is a dead letter, until it's replayed
+	atomic.StoreInt32(&failing, 1)
+	t.post("/admin/companies/"+company.ID.String()+"/members/"+t.fixtures.u[1].ID.String(), t.adminHeader("ut"), nil, http.StatusOK, nil)
+	var dead entity.WebhookDeliveries
+	for deadline := time.Now().Add(5 * time.Second); len(dead.Deliveries) == 0; time.Sleep(10 * time.Millisecond) {
+		t.Require().True(time.Now().Before(deadline), "the delivery wasn't dead lettered")
+		t.get(path+"/deliveries?status=dead", t.adminHeader("ut"), http.StatusOK, &dead)
+	}
+	t.Require().Len(dead.Deliveries, 1)
+	t.Require().Equal(entity.EventMembershipCreated, dead.Deliveries[0].EventType)
+	t.Require().Equal(2, dead.Deliveries[0].Attempts)
+	t.Require().Equal(http.StatusInternalServerError, dead.Deliveries[0].ResponseStatus)
+
+	atomic.StoreInt32(&failing, 0)
+	var replayed entity.WebhookDelivery
+	t.post(fmt.Sprintf("%s/deliveries/%d/replay", path, dead.Deliveries[0].ID), t.adminHeader("ut"), nil, http.StatusOK, &replayed)
+	t.Require().Equal(entity.DeliveryStatusPending, replayed.Status)
+	receive(entity.EventMembershipCreated, company.ID.String()+":"+t.fixtures.u[1].ID.String())
+
+	var log entity.WebhookDeliveries
+	t.get(path+"/deliveries?limit=1", t.adminHeader("ut"), http.StatusOK, &log)
+	t.Require().Len(log.Deliveries, 1)
+	t.Require().Equal(dead.Deliveries[0].ID, log.Deliveries[0].ID)
+	t.Require().NotNil(log.NextOffset)
+	t.post(path+"/deliveries/999999/replay", t.adminHeader("ut"), nil, http.StatusNotFound, nil)
+	t.get(path+"/deliveries?status=lost", t.adminHeader("ut"), http.StatusBadRequest, nil)
+
+	t.delete(path, t.adminHeader("ut"), http.StatusOK, nil)
+	t.get(path, t.adminHeader("ut"), http.StatusNotFound, nil)
+	t.get(path+"/deliveries", t.adminHeader("ut"), http.StatusNotFound, nil)
+}
+
+// waitForJobs polls the jobs until fn returns true.
+func (t *ApplicationTestSuite) waitForJobs(fn func([]entity.Job) bool) []entity.Job {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		var resp entity.Jobs
+		t.get("/admin/jobs/all", t.adminHeader("ut"), http.StatusOK, &resp)
+		if fn(resp.Jobs) {
+			return resp.Jobs
+		}
+	}
+	t.FailNow("the jobs didn't run")
+	return nil
+}
+
+func (t *ApplicationTestSuite) TestJobs() {
+	ctx := context.Background()
+	t.get("/admin/jobs/all?status=done", t.adminHeader("ut"), http.StatusBadRequest, nil)
+
+	// The purge runs as a job, which is deleted once it succeeded
+	t.Require().NoError(t.app.UserStore.DeleteByID(ctx, t.app.DB, t.fixtures.u[0].ID.String()))
+	_, err := t.app.JobStore.Enqueue(ctx, t.app.DB, "purge", []byte(`{"retention":0}`), entity.JobOptions{UniqueKey: "purge"})
+	t.Require().NoError(err)
+	t.waitForJobs(func(jobs []entity.Job) bool { return len(jobs) == 0 })
+	_, err = t.app.UserStore.GetByID(ctx, t.app.DB, t.fixtures.u[0].ID.String(), true)
+	t.Require().IsType(&store.NotFoundError{}, err)
+
+	// The jobs without a handler are dead right away, they can be retried
+	job, err := t.app.JobStore.Enqueue(ctx, t.app.DB, "unknown", []byte(`{}`), entity.JobOptions{})
+	t.Require().NoError(err)
+	jobs := t.waitForJobs(func(jobs []entity.Job) bool { return len(jobs) == 1 && jobs[0].Status == entity.JobStatusDead })
+	t.Require().Equal(job.ID, jobs[0].ID)
+	t.Require().Equal("no handler for the job kind", jobs[0].LastError)
+
+	var resp entity.Jobs
+	t.get("/admin/jobs/all?status=dead&kind=unknown&limit=1", t.adminHeader("ut"), http.StatusOK, &resp)
+	t.Require().Len(resp.Jobs, 1)
+	t.Require().Nil(resp.NextOffset)
+	path := fmt.Sprintf("/admin/jobs/%d/retry", job.ID)
+	var retried entity.Job
+	t.post(path, t.adminHeader("ut"), nil, http.StatusOK, &retried)
+	t.Require().Equal(0, retried.Attempts)
+	t.waitForJobs(func(jobs []entity.Job) bool {
+		return len(jobs) == 1 && jobs[0].Attempts == 1 && jobs[0].Status == entity.JobStatusDead
+	})
+
+	t.post("/admin/jobs/x/retry", t.adminHeader("ut"), nil, http.StatusNotFound, nil)
+	t.post("/admin/jobs/0/retry", t.adminHeader("ut"), nil, http.StatusNotFound, nil)
+	t.post(path, nil, nil, http.StatusUnauthorized, nil)
+}
+
+func (t *ApplicationTestSuite) TestImport() {
+	users := []byte("login,password,email,role\nimported1,pass,imported1@goapp,user\nimported2,,imported2@goapp,user\nuser,pass,other@goapp,user\n")
+	var report entity.ImportReport
+	t.post("/admin/import?kind=users&format=csv", t.adminHeader("ut"), users, http.StatusOK, &report)
+	t.Require().Equal(3, report.Total)
+	t.Require().Equal(1, report.Imported)
+	t.Require().Equal(2, report.Failed)
+	t.Require().False(report.Committed)
+	t.Require().Equal(2, report.Errors[0].Row)
+	t.Require().Equal(3, report.Errors[1].Row)
+	var results entity.SearchResults
+	t.get("/admin/search?q=imported1", t.adminHeader("ut"), http.StatusOK, &results)
+	t.Require().Empty(results.Results)
+
+	t.post("/admin/import?kind=users&format=csv&mode=best_effort&dry_run", t.adminHeader("ut"), users, http.StatusOK, &report)
+	t.Require().Equal(1, report.Imported)
+	t.Require().False(report.Committed)
+
+	t.post("/admin/import?kind=users&format=csv&mode=best_effort", t.adminHeader("ut"), users, http.StatusOK, &report)
+	t.Require().Equal(1, report.Imported)
+	t.Require().True(report.Committed)
+	t.post("/token/access", nil, entity.UserCredentials{Login: "imported1", Password: "pass"}, http.StatusOK, nil)
+
+	companies := []byte("{\"name\": \"imported\"}\n\n{\"name\": \"company1\"}\nnot json\n")
+	t.post("/admin/import?kind=companies&format=ndjson&mode=best_effort", t.adminHeader("ut"), companies, http.StatusOK, &report)
+	t.Require().Equal(3, report.Total)
+	t.Require().Equal(1, report.Imported)
+	t.Require().Equal([]int{2, 3}, []int{report.Errors[0].Row, report.Errors[1].Row})
+
+	memberships := []byte("company,user,role\nimported,imported1,owner\nimported,user,\n")
+	t.post("/admin/import?kind=memberships&format=csv", t.adminHeader("ut"), memberships, http.StatusOK, &report)
+	t.Require().Equal(2, report.Imported)
+	t.Require().True(report.Committed)
+	var memberOf entity.Memberships
+	t.get("/admin/users/"+t.fixtures.u[1].ID.String()+"/companies", t.adminHeader("ut"), http.StatusOK, &memberOf)
+	t.Require().Len(memberOf.Memberships, 1)
+	t.Require().Equal(entity.MembershipRoleMember, memberOf.Memberships[0].Role)
+
+	t.post("/admin/import?kind=users&format=csv", t.adminHeader("ut"), []byte("login,unknown\n"), http.StatusBadRequest, nil)
+	t.post("/admin/import?kind=groups&format=csv", t.adminHeader("ut"), users, http.StatusBadRequest, nil)
+	t.post("/admin/import?kind=users", t.adminHeader("ut"), users, http.StatusBadRequest, nil)
+}
+
+func (t *ApplicationTestSuite) TestExport() {
+	var resp []byte
+	t.get("/admin/export?kind=memberships&format=csv", t.adminHeader("ut"), http.StatusOK, &resp)
+	t.Require().Equal("company,user,role\ncompany1,user1Company1,owner\ncompany1,user2Company1,member\n", string(bytes.TrimRight(resp, "\x00")))
+
+	t.get("/admin/export?kind=users&format=ndjson", t.adminHeader("ut"), http.StatusOK, &resp)
+	lines := strings.Split(strings.TrimSpace(string(bytes.TrimRight(resp, "\x00"))), "\n")
+	t.Require().Len(lines, len(t.fixtures.u))
+	t.Require().NotContains(lines[0], "password")
+	var user entity.User
+	t.Require().NoError(json.Unmarshal([]byte(lines[0]), &user))
+	t.Require().Equal(t.fixtures.u[0].Login, user.Login)
+
+	t.get("/admin/export?kind=companies&format=xml", t.adminHeader("ut"), http.StatusBadRequest, nil)
+}
+
 func (t *ApplicationTestSuite) TestListAllUsers() {
 	var resp []byte
 	t.get("/admin/users/all", t.userHeader(entity.User{}), http.StatusUnauthorized, &resp)
@@ -202,6 +1016,252 @@ func (t *ApplicationTestSuite) TestCreateUser() {
 	t.Require().Contains(string(resp), "login 'test' already exists")
 }
 
+func (t *ApplicationTestSuite) TestMetadata() {
+	const schema = `{"type": "object", "required": ["crm_id"], "properties": {"crm_id": {"type": "string"}, "cost_center": {"type": "integer"}}}`
+
+	var err app.JSONError
+	t.put("/admin/metadata-schemas/user", t.adminHeader("ut"), []byte(`{"type": "date"}`), http.StatusBadRequest, &err)
+	t.Require().Equal("input validation error: invalid schema at '/type': unknown type 'date'", err.Message)
+	t.put("/admin/metadata-schemas/device", t.adminHeader("ut"), []byte(schema), http.StatusBadRequest, nil)
+	t.get("/admin/metadata-schemas/user", t.adminHeader("ut"), http.StatusNotFound, nil)
+
+	var metadataSchema entity.MetadataSchema
+	t.put("/admin/metadata-schemas/user", t.adminHeader("ut"), []byte(schema), http.StatusOK, &metadataSchema)
+	t.Require().Equal("user", metadataSchema.EntityType)
+	t.get("/admin/metadata-schemas/user", t.adminHeader("ut"), http.StatusOK, &metadataSchema)
+	t.Require().JSONEq(schema, string(metadataSchema.Schema))
+
+	// The users are validated against the schema
+	user := entity.User{Login: "crm", Password: "crm", Email: "crm@goapp", Role: "user"}
+	t.post("/admin/users/new", t.adminHeader("ut"), user, http.StatusBadRequest, &err)
+	t.Require().Equal("input validation error: 'metadata' doesn't match the user schema: missing required property 'crm_id'", err.Message)
+	user.Metadata = entity.Metadata{"crm_id": "CRM-1", "cost_center": 1.5}
+	t.post("/admin/users/new", t.adminHeader("ut"), user, http.StatusBadRequest, &err)
+	t.Require().Equal("input validation error: 'metadata' doesn't match the user schema: /cost_center: expected integer but got number", err.Message)
+	user.Metadata = entity.Metadata{"crm_id": "CRM-1", "note": strings.Repeat("a", entity.MaxMetadataSize)}
+	t.post("/admin/users/new", t.adminHeader("ut"), user, http.StatusBadRequest, &err)
+	t.Require().Equal(fmt.Sprintf("input validation error: 'metadata' must be at most %d bytes", entity.MaxMetadataSize), err.Message)
+
+	var created entity.User
+	user.Metadata = entity.Metadata{"crm_id": "CRM-1", "cost_center": 120}
+	t.post("/admin/users/new", t.adminHeader("ut"), user, http.StatusOK, &created)
+	t.Require().Equal(entity.Metadata{"crm_id": "CRM-1", "cost_center": float64(120)}, created.Metadata)
+	path := "/admin/users/" + created.ID.String()
+	var updated entity.User
+	t.patch(path, t.adminHeader("ut"), map[string]interface{}{"metadata": map[string]int{"cost_center": 130}}, http.StatusBadRequest, nil)
+	t.patch(path, t.adminHeader("ut"), map[string]interface{}{"metadata": map[string]string{"crm_id": "CRM-2"}}, http.StatusOK, &updated)
+	t.Require().Equal(entity.Metadata{"crm_id": "CRM-2"}, updated.Metadata)
+
+	// The listings filter on the metadata
+	var users entity.Users
+	t.get("/admin/users/all?metadata.crm_id=CRM-2", t.adminHeader("ut"), http.StatusOK, &users)
+	t.Require().Len(users.Users, 1)
+	t.Require().Equal(created.ID, users.Users[0].ID)
+	t.get("/admin/users/all?metadata.crm_id=CRM-1", t.adminHeader("ut"), http.StatusOK, &users)
+	t.Require().Empty(users.Users)
+	t.get("/admin/users/all?metadata.=1", t.adminHeader("ut"), http.StatusBadRequest, nil)
+
+	// The companies have no schema
+	company1 := t.fixtures.c[0].ID.String()
+	var company entity.Company
+	t.patch("/admin/companies/"+company1, t.adminHeader("ut"), map[string]interface{}{"metadata": map[string]interface{}{"tier": "gold", "seats": 10}}, http.StatusOK, &company)
+	t.Require().Equal(t.fixtures.c[0].Name, company.Name)
+	t.Require().Equal(entity.Metadata{"tier": "gold", "seats": float64(10)}, company.Metadata)
+
+	var companies entity.Companies
+	t.get("/admin/companies/all?metadata.tier=gold&metadata.seats=10", t.adminHeader("ut"), http.StatusOK, &companies)
+	t.Require().Len(companies.Companies, 1)
+	t.Require().Equal(company1, companies.Companies[0].ID.String())
+	t.get("/admin/companies/all?metadata.seats=%2210%22", t.adminHeader("ut"), http.StatusOK, &companies)
+	t.Require().Empty(companies.Companies)
+
+	t.delete("/admin/metadata-schemas/user", t.adminHeader("ut"), http.StatusNoContent, nil)
+	t.delete("/admin/metadata-schemas/user", t.adminHeader("ut"), http.StatusNotFound, nil)
+	t.patch(path, t.adminHeader("ut"), map[string]interface{}{"metadata": map[string]int{"cost_center": 130}}, http.StatusOK, nil)
+}
+
+func (t *ApplicationTestSuite) TestIdempotency() {
+	headers := t.adminHeader("ut")
+	headers["Idempotency-Key"] = "create-retried"
+	user := entity.User{Login: "retried", Password: "pass", Email: "retried@goapp", Role: "user"}
+	var first, replayed entity.User
+	t.post("/admin/users/new", headers, user, http.StatusOK, &first)
+	t.post("/admin/users/new", headers, user, http.StatusOK, &replayed)
+	t.Require().Equal(first.ID, replayed.ID)
+	t.Require().Equal(first.CreatedAt, replayed.CreatedAt)
+
+	// A key is scoped to the actor, and only replays the request it was used for
+	var conflict app.JSONError
+	user.Login = "other"
+	t.post("/admin/users/new", headers, user, http.StatusConflict, &conflict)
+	t.Require().Contains(conflict.Message, "used for a different request")
+	t.post("/admin/companies/new", headers, entity.Company{Name: "retried"}, http.StatusConflict, nil)
+	otherHeaders := t.adminHeader("other")
+	otherHeaders["Idempotency-Key"] = "create-retried"
+	t.post("/admin/companies/new", otherHeaders, entity.Company{Name: "retried"}, http.StatusOK, nil)
+
+	// The client errors are replayed as well
+	headers["Idempotency-Key"] = "create-duplicate"
+	duplicate := entity.Company{Name: t.fixtures.c[0].Name}
+	var rejected, rejectedAgain app.JSONError
+	t.post("/admin/companies/new", headers, duplicate, http.StatusUnprocessableEntity, &rejected)
+	t.post("/admin/companies/new", headers, duplicate, http.StatusUnprocessableEntity, &rejectedAgain)
+	t.Require().Equal(rejected, rejectedAgain)
+
+	headers["Idempotency-Key"] = strings.Repeat("k", 256)
+	t.post("/admin/users/new", headers, user, http.StatusBadRequest, nil)
+
+	// An expired key can be used again
+	ctx := context.Background()
+	_, started, err := t.app.IdempotencyStore.Begin(ctx, t.app.DB, "ut", "expired", "a", 0, time.Minute)
+	t.Require().NoError(err)
+	t.Require().True(started)
+	req, started, err := t.app.IdempotencyStore.Begin(ctx, t.app.DB, "ut", "expired", "b", time.Hour, time.Minute)
+	t.Require().NoError(err)
+	t.Require().True(started)
+	t.Require().Equal("b", req.Fingerprint)
+
+	// So can the key of a request in progress after its lease, whose response is kept
+	_, started, err = t.app.IdempotencyStore.Begin(ctx, t.app.DB, "ut", "expired", "b", time.Hour, time.Minute)
+	t.Require().NoError(err)
+	t.Require().False(started)
+	_, started, err = t.app.IdempotencyStore.Begin(ctx, t.app.DB, "ut", "expired", "b", time.Hour, 0)
+	t.Require().NoError(err)
+	t.Require().True(started)
+	t.Require().NoError(t.app.IdempotencyStore.Complete(ctx, t.app.DB, "ut", "expired", http.StatusCreated, nil, []byte("first")))
+	t.Require().NoError(t.app.IdempotencyStore.Complete(ctx, t.app.DB, "ut", "expired", http.StatusOK, nil, []byte("second")))
+	req, started, err = t.app.IdempotencyStore.Begin(ctx, t.app.DB, "ut", "expired", "b", time.Hour, 0)
+	t.Require().NoError(err)
+	t.Require().False(started)
+	t.Require().Equal(http.StatusCreated, req.StatusCode)
+	t.Require().Equal("first", string(req.Body))
+	t.Require().NoError(t.app.IdempotencyStore.Release(ctx, t.app.DB, "ut", "expired"))
+	purged, err := t.app.IdempotencyStore.Purge(ctx, t.app.DB)
+	t.Require().NoError(err)
+	t.Require().Zero(purged)
+}
+
+func (t *ApplicationTestSuite) TestInvitations() {
+	path := "/admin/companies/" + t.fixtures.c[1].ID.String() + "/invitations"
+	t.post(path, nil, entity.Invitation{Email: "new@goapp"}, http.StatusUnauthorized, nil)
+	t.post(path, t.adminHeader("ut"), entity.Invitation{Email: "new"}, http.StatusBadRequest, nil)
+	t.post(path, t.adminHeader("ut"), entity.Invitation{Email: "new@goapp", Role: "boss"}, http.StatusBadRequest, nil)
+	t.post("/admin/companies/"+uuid.New().String()+"/invitations", t.adminHeader("ut"), entity.Invitation{Email: "new@goapp"}, http.StatusNotFound, nil)
+
+	var invitation entity.Invitation
+	t.post(path, t.adminHeader("ut"), entity.Invitation{Email: "new@goapp", Role: entity.MembershipRoleAdmin}, http.StatusCreated, &invitation)
+	t.Require().Equal(entity.InvitationStatusPending, invitation.Status)
+	t.Require().Equal("ut", invitation.InvitedBy)
+	t.Require().Equal(1, invitation.Sends)
+	t.Require().WithinDuration(time.Now().Add(time.Hour), invitation.ExpiresAt, time.Minute)
+	t.post(path, t.adminHeader("ut"), entity.Invitation{Email: "new@goapp"}, http.StatusUnprocessableEntity, nil)
+	first := t.waitForInvitation("new@goapp", 1)
+
+	// Resending replaces the token
+	invitationPath := path + "/" + invitation.ID.String()
+	var resent entity.Invitation
+	t.post(invitationPath+"/resend", t.adminHeader("ut"), nil, http.StatusOK, &resent)
+	t.Require().Equal(2, resent.Sends)
+	token := t.waitForInvitation("new@goapp", 2)
+	t.Require().NotEqual(first, token)
+	for _, job := range t.waitForJobs(func([]entity.Job) bool { return true }) {
+		t.Require().NotContains(string(job.Payload), token)
+	}
+	accept := entity.InvitationAcceptance{Token: first, Login: "newbie", Password: "secret"}
+	t.post("/invitations/accept", nil, accept, http.StatusNotFound, nil)
+	t.post("/admin/companies/"+t.fixtures.c[0].ID.String()+"/invitations/"+invitation.ID.String()+"/resend", t.adminHeader("ut"), nil, http.StatusNotFound, nil)
+
+	// The invitee without an account creates it along with its membership
+	accept.Token = token
+	t.post("/invitations/accept", nil, entity.InvitationAcceptance{Token: token}, http.StatusBadRequest, nil)
+	t.post("/invitations/accept", nil, entity.InvitationAcceptance{Token: token, Login: "user", Password: "secret"}, http.StatusUnprocessableEntity, nil)
+	var user entity.User
+	t.post("/invitations/accept", nil, accept, http.StatusOK, &user)
+	t.Require().Equal("newbie", user.Login)
+	t.Require().Equal("new@goapp", user.Email)
+	t.Require().Equal(entity.MembershipRoleAdmin, user.CompanyRole)
+	t.post("/invitations/accept", nil, accept, http.StatusNotFound, nil)
+	t.post(invitationPath+"/resend", t.adminHeader("ut"), nil, http.StatusNotFound, nil)
+
+	var accepted entity.Invitations
+	t.get(path+"?status=accepted", t.adminHeader("ut"), http.StatusOK, &accepted)
+	t.Require().Len(accepted.Invitations, 1)
+	t.Require().Equal(user.ID, *accepted.Invitations[0].UserID)
+
+	// The invitee with an account joins with it
+	t.post(path, t.adminHeader("ut"), entity.Invitation{Email: "someone@goapp"}, http.StatusCreated, &invitation)
+	token = t.waitForInvitation("someone@goapp", 1)
+	var membership entity.Membership
+	t.post("/users/me/invitations/accept", t.userHeader(t.fixtures.u[1]), entity.InvitationAcceptance{Token: token}, http.StatusOK, &membership)
+	t.Require().Equal(t.fixtures.u[1].ID, membership.UserID)
+	t.Require().Equal(t.fixtures.c[1].ID, membership.CompanyID)
+	t.Require().Equal(entity.MembershipRoleMember, membership.Role)
+
+	// The revoked invitations can't be accepted
+	t.post(path, t.adminHeader("ut"), entity.Invitation{Email: "gone@goapp"}, http.StatusCreated, &invitation)
+	token = t.waitForInvitation("gone@goapp", 1)
+	invitationPath = path + "/" + invitation.ID.String()
+	t.delete("/admin/companies/"+t.fixtures.c[0].ID.String()+"/invitations/"+invitation.ID.String(), t.adminHeader("ut"), http.StatusNotFound, nil)
+	var revoked entity.Invitation
+	t.delete(invitationPath, t.adminHeader("ut"), http.StatusOK, &revoked)
+	t.Require().Equal(entity.InvitationStatusRevoked, revoked.Status)
+	t.delete(invitationPath, t.adminHeader("ut"), http.StatusNotFound, nil)
+	t.post("/users/me/invitations/accept", t.userHeader(t.fixtures.u[2]), entity.InvitationAcceptance{Token: token}, http.StatusNotFound, nil)
+
+	var page entity.Invitations
+	t.get(path+"?limit=2", t.adminHeader("ut"), http.StatusOK, &page)
+	t.Require().Len(page.Invitations, 2)
+	t.Require().Equal(invitation.ID, page.Invitations[0].ID)
+	t.Require().NotNil(page.NextOffset)
+	t.get(path+"?status=pending", t.adminHeader("ut"), http.StatusOK, &page)
+	t.Require().Empty(page.Invitations)
+	t.get(path+"?status=lost", t.adminHeader("ut"), http.StatusBadRequest, nil)
+	t.get("/admin/companies/"+uuid.New().String()+"/invitations", t.adminHeader("ut"), http.StatusNotFound, nil)
+}
+
+func (t *ApplicationTestSuite) TestCreateUserInCompany() {
+	var err app.JSONError
+	notfoundID := uuid.New()
+	body := map[string]string{"login": "test", "password": "test", "email": "test", "role": "user", "company_id": notfoundID.String(), "company_role": "admin"}
+	t.post("/admin/users/new", t.adminHeader("ut"), body, http.StatusUnprocessableEntity, &err)
+	t.Require().Equal("company '"+notfoundID.String()+"' not found", err.Message)
+
+	// The user has been rolled back along with the membership
+	var user entity.User
+	body["company_id"] = t.fixtures.c[1].ID.String()
+	t.post("/admin/users/new", t.adminHeader("ut"), body, http.StatusOK, &user)
+	t.Require().Equal("admin", user.CompanyRole)
+
+	var company entity.Company
+	t.get("/admin/companies/"+t.fixtures.c[1].ID.String(), t.adminHeader("ut"), http.StatusOK, &company)
+	t.Require().Len(company.Users, 1)
+	t.Require().Equal(user.ID, company.Users[0].ID)
+	t.Require().Equal("admin", company.Users[0].CompanyRole)
+}
+
+func (t *ApplicationTestSuite) TestSearch() {
+	var err app.JSONError
+	t.get("/admin/search?q=", t.adminHeader("ut"), http.StatusBadRequest, &err)
+	t.Require().Contains(err.Message, "missing or empty 'q'")
+	t.get("/admin/search?q=foo&limit=0", t.adminHeader("ut"), http.StatusBadRequest, nil)
+
+	var results entity.SearchResults
+	t.get("/admin/search?q=company1", t.adminHeader("ut"), http.StatusOK, &results)
+	t.Require().NotEmpty(results.Results)
+	t.Require().Equal(entity.SearchKindCompany, results.Results[0].Kind)
+	t.Require().Equal(t.fixtures.c[0].ID, results.Results[0].ID)
+	t.Require().Equal("<mark>company1</mark>", results.Results[0].Highlight)
+
+	t.get("/admin/search?q=user1Company1", t.adminHeader("ut"), http.StatusOK, &results)
+	t.Require().NotEmpty(results.Results)
+	t.Require().Equal(entity.SearchKindUser, results.Results[0].Kind)
+	t.Require().Equal("user1Company1", results.Results[0].Label)
+	t.Require().Contains(results.Results[0].Highlight, "<mark>")
+
+	t.get("/admin/search?q=zzzzzz", t.adminHeader("ut"), http.StatusOK, &results)
+	t.Require().Empty(results.Results)
+}
+
 func (t *ApplicationTestSuite) TestGetAdminToken() {
 	t.post("/token/admin", nil, nil, http.StatusBadRequest, nil)
 	t.post("/token/admin", nil, entity.UserCredentials{}, http.StatusBadRequest, nil)
@@ -235,6 +1295,12 @@ func (t *ApplicationTestSuite) userHeader(user entity.User) map[string]string {
 	return map[string]string{"Authorization": "Bearer " + accessToken}
 }
 
+func (t *ApplicationTestSuite) ifMatchHeader(version int) map[string]string {
+	headers := t.adminHeader("ut")
+	headers["If-Match"] = fmt.Sprintf(`"%d"`, version)
+	return headers
+}
+
 func (t *ApplicationTestSuite) options(path string, expectedStatusCode int) {
 	headers := map[string]string{"Origin": "http://test.com", "Access-control-request-method": "POST"}
 	t.Require().NoError(t.doRequest("OPTIONS", path, headers, nil, expectedStatusCode, nil))
@@ -252,6 +1318,14 @@ func (t *ApplicationTestSuite) post(path string, headers map[string]string, body
 	t.Require().NoError(t.doRequest(http.MethodPost, path, headers, body, expectedStatusCode, result))
 }
 
+func (t *ApplicationTestSuite) put(path string, headers map[string]string, body interface{}, expectedStatusCode int, result interface{}) {
+	t.Require().NoError(t.doRequest(http.MethodPut, path, headers, body, expectedStatusCode, result))
+}
+
+func (t *ApplicationTestSuite) patch(path string, headers map[string]string, body interface{}, expectedStatusCode int, result interface{}) {
+	t.Require().NoError(t.doRequest(http.MethodPatch, path, headers, body, expectedStatusCode, result))
+}
+
 func (t *ApplicationTestSuite) doRequest(method string, path string, headers map[string]string, body interface{}, expectedStatusCode int, result interface{}) error {
 	var r io.Reader
 	switch v := body.(type) {
@@ -0,0 +1,61 @@
+package entity
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	AuditActionCreate  = "create"
+	AuditActionUpdate  = "update"
+	AuditActionDelete  = "delete"
+	AuditActionRestore = "restore"
+	AuditActionPurge   = "purge"
+	AuditActionErase   = "erase"
+	AuditActionMove    = "move"
+)
+
+type AuditEvent struct {
+	ID         int64           `json:"id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Actor      string          `json:"actor"`
+	Action     string          `json:"action"`
+	EntityType string          `json:"entity_type"`
+	EntityID   string          `json:"entity_id"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	RequestID  string          `json:"request_id,omitempty"`
+	ClientIP   string          `json:"client_ip,omitempty"`
+}
+
+type AuditEvents struct {
+	Events []AuditEvent `json:"events"`
+	// NextOffset is only set when there are more events to fetch.
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+// AuditFilter selects audit events, the zero value of a field doesn't filter anything.
+type AuditFilter struct {
+	Actor      string
+	Action     string
+	EntityType string
+	EntityID   string
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+	Offset     int
+}
+
+func (f AuditFilter) Validate() error {
+	if f.Limit < 1 || f.Limit > 500 {
+		return errors.New("'limit' must be between 1 and 500")
+	}
+	if f.Offset < 0 {
+		return errors.New("'offset' must be positive")
+	}
+	if !f.Since.IsZero() && !f.Until.IsZero() && f.Until.Before(f.Since) {
+		return errors.New("'until' is before 'since'")
+	}
+	return nil
+}
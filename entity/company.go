@@ -8,15 +8,93 @@ import (
 )
 
 type Company struct {
-	ID        uuid.UUID `json:"id"`
-	Name      string    `json:"name"`
-	Users     []User    `json:"users,omitempty"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        uuid.UUID  `json:"id"`
+	Name      string     `json:"name"`
+	ParentID  *uuid.UUID `json:"parent_id,omitempty"`
+	Users     []User     `json:"users,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	Version   int        `json:"version"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	Metadata  Metadata   `json:"metadata,omitempty"`
+	// Children and EffectiveMembers are only loaded on demand.
+	Children         []Company         `json:"children,omitempty"`
+	EffectiveMembers []EffectiveMember `json:"effective_members,omitempty"`
+	// Quota is only loaded by the endpoints returning a single company.
+	Quota *CompanyQuota `json:"quota,omitempty"`
+}
+
+// EffectiveMember is a member of a company, or of one of its ancestors: the members of a
+// parent company are members of its subsidiaries. The nearest membership of a user prevails.
+type EffectiveMember struct {
+	User
+	// InheritedFrom is the ancestor the membership comes from, it's nil for the members of the
+	// company itself.
+	InheritedFrom *uuid.UUID `json:"inherited_from,omitempty"`
+}
+
+// CompanyMove moves a company in the tree of the companies, along with its subtree. A nil
+// ParentID makes it a root company.
+type CompanyMove struct {
+	ParentID *uuid.UUID `json:"parent_id"`
+}
+
+// Tree nests the companies under their parent, the companies whose parent isn't listed are the
+// roots returned. The order of the companies is kept.
+func Tree(companies []Company) []Company {
+	children := make(map[uuid.UUID][]Company)
+	listed := make(map[uuid.UUID]bool, len(companies))
+	for _, company := range companies {
+		listed[company.ID] = true
+	}
+	var roots []Company
+	for _, company := range companies {
+		if company.ParentID != nil && listed[*company.ParentID] {
+			children[*company.ParentID] = append(children[*company.ParentID], company)
+		} else {
+			roots = append(roots, company)
+		}
+	}
+
+	var nest func(companies []Company) []Company
+	nest = func(companies []Company) []Company {
+		for k := range companies {
+			companies[k].Children = nest(children[companies[k].ID])
+		}
+		return companies
+	}
+	return nest(roots)
 }
 
 func (c Company) Validate() error {
 	if c.Name == "" {
 		return errors.New("missing or empty 'name'")
 	}
-	return nil
+	for _, user := range c.Users {
+		if err := ValidateMembershipRole(user.CompanyRole); err != nil {
+			return err
+		}
+	}
+	return c.Metadata.Validate()
+}
+
+type Companies struct {
+	Companies []Company `json:"companies"`
+}
+
+// CompanyPatch holds the fields of a partial company update. Nil fields are left untouched, the
+// metadata is replaced as a whole.
+type CompanyPatch struct {
+	Name     *string  `json:"name"`
+	Metadata Metadata `json:"metadata"`
+}
+
+func (p CompanyPatch) Validate() error {
+	if p.Name == nil && p.Metadata == nil {
+		return errors.New("nothing to update")
+	}
+	if p.Name != nil && *p.Name == "" {
+		return errors.New("empty 'name'")
+	}
+	return p.Metadata.Validate()
 }
@@ -0,0 +1,64 @@
+package entity
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// The types of the domain events, named after the entity and the action of the mutation.
+const (
+	EventUserCreated       = "user.created"
+	EventUserUpdated       = "user.updated"
+	EventUserDeleted       = "user.deleted"
+	EventUserRestored      = "user.restored"
+	EventUserPurged        = "user.purged"
+	EventUserErased        = "user.erased"
+	EventCompanyCreated    = "company.created"
+	EventCompanyUpdated    = "company.updated"
+	EventCompanyDeleted    = "company.deleted"
+	EventCompanyRestored   = "company.restored"
+	EventCompanyPurged     = "company.purged"
+	EventCompanyMoved      = "company.moved"
+	EventMembershipCreated = "membership.created"
+	EventMembershipUpdated = "membership.updated"
+	EventMembershipDeleted = "membership.deleted"
+)
+
+var eventTypes = map[[2]string]string{
+	{"user", AuditActionCreate}:       EventUserCreated,
+	{"user", AuditActionUpdate}:       EventUserUpdated,
+	{"user", AuditActionDelete}:       EventUserDeleted,
+	{"user", AuditActionRestore}:      EventUserRestored,
+	{"user", AuditActionPurge}:        EventUserPurged,
+	{"user", AuditActionErase}:        EventUserErased,
+	{"company", AuditActionCreate}:    EventCompanyCreated,
+	{"company", AuditActionUpdate}:    EventCompanyUpdated,
+	{"company", AuditActionDelete}:    EventCompanyDeleted,
+	{"company", AuditActionRestore}:   EventCompanyRestored,
+	{"company", AuditActionPurge}:     EventCompanyPurged,
+	{"company", AuditActionMove}:      EventCompanyMoved,
+	{"membership", AuditActionCreate}: EventMembershipCreated,
+	{"membership", AuditActionUpdate}: EventMembershipUpdated,
+	{"membership", AuditActionDelete}: EventMembershipDeleted,
+}
+
+// EventType returns the type of the domain event published by an audited mutation, if any.
+func EventType(entityType, action string) (string, bool) {
+	eventType, ok := eventTypes[[2]string{entityType, action}]
+	return eventType, ok
+}
+
+// DomainEvent tells the other systems about a committed mutation. Payload is the entity after
+// the mutation, or before it when it's hard deleted, without its personal data: the consumers
+// read the emails from the API.
+type DomainEvent struct {
+	ID         int64           `json:"id"`
+	Type       string          `json:"type"`
+	EntityType string          `json:"entity_type"`
+	EntityID   string          `json:"entity_id"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Payload    json.RawMessage `json:"payload"`
+	RequestID  string          `json:"request_id,omitempty"`
+	// Attempts counts the deliveries, including the current one.
+	Attempts int `json:"attempts"`
+}
@@ -0,0 +1,17 @@
+package entity
+
+import "time"
+
+// IdempotentRequest is a request made with an Idempotency-Key header. Its response is replayed
+// to the retries of the request until it expires.
+type IdempotentRequest struct {
+	Actor       string `json:"actor"`
+	Key         string `json:"key"`
+	Fingerprint string `json:"fingerprint"`
+	// StatusCode is 0 while the request is in progress.
+	StatusCode int                 `json:"status_code"`
+	Header     map[string][]string `json:"header"`
+	Body       []byte              `json:"body"`
+	CreatedAt  time.Time           `json:"created_at"`
+	ExpiresAt  time.Time           `json:"expires_at"`
+}
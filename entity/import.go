@@ -0,0 +1,92 @@
+package entity
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	ImportKindUsers       = "users"
+	ImportKindCompanies   = "companies"
+	ImportKindMemberships = "memberships"
+
+	ImportFormatCSV    = "csv"
+	ImportFormatNDJSON = "ndjson"
+
+	// ImportModeAtomic imports all the rows or none of them
+	ImportModeAtomic = "atomic"
+	// ImportModeBestEffort imports the valid rows and skips the others
+	ImportModeBestEffort = "best_effort"
+)
+
+type ImportOptions struct {
+	Kind   string
+	Format string
+	Mode   string
+	DryRun bool
+}
+
+func (o ImportOptions) Validate() error {
+	switch o.Kind {
+	case ImportKindUsers, ImportKindCompanies, ImportKindMemberships:
+	default:
+		return fmt.Errorf("'kind' must be one of '%s', '%s' or '%s'", ImportKindUsers, ImportKindCompanies, ImportKindMemberships)
+	}
+	switch o.Format {
+	case ImportFormatCSV, ImportFormatNDJSON:
+	default:
+		return fmt.Errorf("'format' must be either '%s' or '%s'", ImportFormatCSV, ImportFormatNDJSON)
+	}
+	switch o.Mode {
+	case ImportModeAtomic, ImportModeBestEffort:
+	default:
+		return fmt.Errorf("'mode' must be either '%s' or '%s'", ImportModeAtomic, ImportModeBestEffort)
+	}
+	return nil
+}
+
+// ImportMembership references the company and the user by their name and login, which
+// unlike their IDs are known before the import.
+type ImportMembership struct {
+	Company string `json:"company"`
+	User    string `json:"user"`
+	Role    string `json:"role"`
+}
+
+func (m ImportMembership) Validate() error {
+	if m.Company == "" {
+		return errors.New("missing or empty 'company'")
+	}
+	if m.User == "" {
+		return errors.New("missing or empty 'user'")
+	}
+	return ValidateMembershipRole(m.Role)
+}
+
+// ImportRow holds one of User, Company or Membership depending on the kind of import. Err is
+// set instead when the row couldn't be parsed or validated.
+type ImportRow struct {
+	Row        int
+	User       *User
+	Company    *Company
+	Membership *ImportMembership
+	Err        error
+}
+
+type ImportError struct {
+	Row     int    `json:"row"`
+	Message string `json:"message"`
+}
+
+type ImportReport struct {
+	Kind   string `json:"kind"`
+	Mode   string `json:"mode"`
+	DryRun bool   `json:"dry_run"`
+	// Committed is false for dry runs and failed atomic imports, in which case nothing
+	// has been imported, even the rows counted as imported.
+	Committed bool          `json:"committed"`
+	Total     int           `json:"total"`
+	Imported  int           `json:"imported"`
+	Failed    int           `json:"failed"`
+	Errors    []ImportError `json:"errors"`
+}
@@ -0,0 +1,102 @@
+package entity
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// InvitationStatusPending invitations can be accepted until they expire.
+	InvitationStatusPending = "pending"
+	// InvitationStatusExpired invitations are pending ones past their expiry, they can be resent.
+	InvitationStatusExpired  = "expired"
+	InvitationStatusAccepted = "accepted"
+	InvitationStatusRevoked  = "revoked"
+)
+
+// Invitation invites an email address to join a company. It's accepted with the single-use
+// token sent to the address, which isn't stored.
+type Invitation struct {
+	ID        uuid.UUID `json:"id"`
+	CompanyID uuid.UUID `json:"company_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	Status    string    `json:"status"`
+	InvitedBy string    `json:"invited_by"`
+	// Sends counts the times the invitation was sent, each send has a new token.
+	Sends int `json:"sends"`
+	// UserID is the user who accepted the invitation.
+	UserID    *uuid.UUID `json:"user_id,omitempty"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// Validate accepts an empty role, which stands for MembershipRoleMember.
+func (i Invitation) Validate() error {
+	if i.Email == "" {
+		return errors.New("missing or empty 'email'")
+	}
+	if !strings.Contains(i.Email, "@") {
+		return errors.New("invalid 'email'")
+	}
+	return ValidateMembershipRole(i.Role)
+}
+
+type Invitations struct {
+	Invitations []Invitation `json:"invitations"`
+	// NextOffset is only set when there are more invitations to fetch.
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+// InvitationFilter selects the invitations of a company, an empty status selects all of them.
+type InvitationFilter struct {
+	CompanyID string
+	Status    string
+	Limit     int
+	Offset    int
+}
+
+func (f InvitationFilter) Validate() error {
+	switch f.Status {
+	case "", InvitationStatusPending, InvitationStatusExpired, InvitationStatusAccepted, InvitationStatusRevoked:
+	default:
+		return fmt.Errorf("invalid 'status' '%s'", f.Status)
+	}
+	if f.Limit < 1 || f.Limit > 500 {
+		return errors.New("'limit' must be between 1 and 500")
+	}
+	if f.Offset < 0 {
+		return errors.New("'offset' must be positive")
+	}
+	return nil
+}
+
+// InvitationAcceptance accepts an invitation. The invitee without an account sets its login
+// and password, the user account is created with the invited email.
+type InvitationAcceptance struct {
+	Token    string `json:"token"`
+	Login    string `json:"login,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// Validate checks the acceptance of an invitation, with a new account if newAccount is true.
+func (a InvitationAcceptance) Validate(newAccount bool) error {
+	if a.Token == "" {
+		return errors.New("missing or empty 'token'")
+	}
+	if !newAccount {
+		return nil
+	}
+	if a.Login == "" {
+		return errors.New("missing or empty 'login'")
+	}
+	if a.Password == "" {
+		return errors.New("missing or empty 'password'")
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package entity
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// JobStatusPending jobs run once RunAt is reached.
+	JobStatusPending = "pending"
+	// JobStatusRunning jobs are claimed by a worker until RunAt, they are pending again after.
+	JobStatusRunning = "running"
+	// JobStatusDead jobs ran out of attempts, they only run again when retried.
+	JobStatusDead = "dead"
+)
+
+// Job is a unit of deferred work, run by the handler of its kind. The jobs which succeed are
+// deleted.
+type Job struct {
+	ID          int64           `json:"id"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	UniqueKey   string          `json:"unique_key,omitempty"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// JobOptions are the options of an enqueued job.
+type JobOptions struct {
+	// RunAt delays the job, it runs as soon as possible if zero.
+	RunAt time.Time
+	// UniqueKey prevents the job from being enqueued while a job with the same key is pending
+	// or running. It's ignored if empty.
+	UniqueKey   string
+	MaxAttempts int
+}
+
+type Jobs struct {
+	Jobs []Job `json:"jobs"`
+	// NextOffset is only set when there are more jobs to fetch.
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+// JobFilter selects the jobs, an empty status or kind selects all of them.
+type JobFilter struct {
+	Status string
+	Kind   string
+	Limit  int
+	Offset int
+}
+
+func (f JobFilter) Validate() error {
+	switch f.Status {
+	case "", JobStatusPending, JobStatusRunning, JobStatusDead:
+	default:
+		return fmt.Errorf("invalid 'status' '%s'", f.Status)
+	}
+	if f.Limit < 1 || f.Limit > 500 {
+		return errors.New("'limit' must be between 1 and 500")
+	}
+	if f.Offset < 0 {
+		return errors.New("'offset' must be positive")
+	}
+	return nil
+}
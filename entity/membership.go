@@ -0,0 +1,36 @@
+package entity
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	MembershipRoleOwner  = "owner"
+	MembershipRoleAdmin  = "admin"
+	MembershipRoleMember = "member"
+)
+
+type Membership struct {
+	CompanyID uuid.UUID `json:"company_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+	Company   *Company  `json:"company,omitempty"`
+}
+
+type Memberships struct {
+	Memberships []Membership `json:"memberships"`
+}
+
+// ValidateMembershipRole accepts an empty role, which stands for MembershipRoleMember.
+func ValidateMembershipRole(role string) error {
+	switch role {
+	case "", MembershipRoleOwner, MembershipRoleAdmin, MembershipRoleMember:
+		return nil
+	default:
+		return fmt.Errorf("invalid role '%s', must be one of '%s', '%s' or '%s'", role, MembershipRoleOwner, MembershipRoleAdmin, MembershipRoleMember)
+	}
+}
@@ -0,0 +1,93 @@
+package entity
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jordanp/goapp/pkg/jsonschema"
+)
+
+const (
+	// MaxMetadataSize is the maximum size of the metadata of a user or company, encoded as JSON.
+	MaxMetadataSize = 8 << 10
+	// MaxMetadataKeys is the maximum number of top level keys of the metadata.
+	MaxMetadataKeys = 64
+	// MaxMetadataSchemaSize is the maximum size of a metadata schema.
+	MaxMetadataSchemaSize = 64 << 10
+)
+
+// The entity types whose metadata is validated by a schema.
+const (
+	MetadataEntityUser    = "user"
+	MetadataEntityCompany = "company"
+)
+
+// Metadata holds the attributes attached to a user or company by the integrations, such as an
+// external CRM ID. It's a JSON object, validated against the schema of its entity type if any.
+type Metadata map[string]interface{}
+
+func (m Metadata) Validate() error {
+	if len(m) > MaxMetadataKeys {
+		return fmt.Errorf("'metadata' must have at most %d keys", MaxMetadataKeys)
+	}
+	for key := range m {
+		if key == "" {
+			return errors.New("empty key in 'metadata'")
+		}
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("invalid 'metadata': %s", err)
+	}
+	if len(b) > MaxMetadataSize {
+		return fmt.Errorf("'metadata' must be at most %d bytes", MaxMetadataSize)
+	}
+	return nil
+}
+
+// MetadataSchema is the JSON Schema the metadata of an entity type is validated against, when
+// it's created or updated. The metadata stored before the schema isn't checked again.
+type MetadataSchema struct {
+	EntityType string          `json:"entity_type"`
+	Schema     json.RawMessage `json:"schema"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+}
+
+func ValidateMetadataEntityType(entityType string) error {
+	switch entityType {
+	case MetadataEntityUser, MetadataEntityCompany:
+		return nil
+	}
+	return fmt.Errorf("the entity type must be '%s' or '%s'", MetadataEntityUser, MetadataEntityCompany)
+}
+
+func (s MetadataSchema) Validate() error {
+	if err := ValidateMetadataEntityType(s.EntityType); err != nil {
+		return err
+	}
+	if len(s.Schema) == 0 {
+		return errors.New("missing or empty 'schema'")
+	}
+	if len(s.Schema) > MaxMetadataSchemaSize {
+		return fmt.Errorf("'schema' must be at most %d bytes", MaxMetadataSchemaSize)
+	}
+	_, err := jsonschema.Compile(s.Schema)
+	return err
+}
+
+// Check validates the metadata against the schema, which must be valid.
+func (s MetadataSchema) Check(metadata Metadata) error {
+	schema, err := jsonschema.Compile(s.Schema)
+	if err != nil {
+		return err
+	}
+	if metadata == nil {
+		metadata = Metadata{}
+	}
+	if err := schema.Validate(map[string]interface{}(metadata)); err != nil {
+		return fmt.Errorf("'metadata' doesn't match the %s schema: %s", s.EntityType, err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package entity
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	QuotaMembers        = "members"
+	QuotaAPIKeys        = "api_keys"
+	QuotaRequestsPerDay = "requests_per_day"
+)
+
+// CompanyLimits are the limits of the plan of a company, a nil limit is unlimited. A limit
+// lowered under the current usage only prevents the usage from growing.
+type CompanyLimits struct {
+	MaxMembers     *int `json:"max_members"`
+	MaxAPIKeys     *int `json:"max_api_keys"`
+	RequestsPerDay *int `json:"requests_per_day"`
+}
+
+func (l CompanyLimits) Validate() error {
+	names := []string{"max_members", "max_api_keys", "requests_per_day"}
+	for i, limit := range []*int{l.MaxMembers, l.MaxAPIKeys, l.RequestsPerDay} {
+		if limit != nil && *limit < 0 {
+			return fmt.Errorf("'%s' must be positive", names[i])
+		}
+	}
+	return nil
+}
+
+// CompanyUsage is the usage of a company counted against its limits. The requests are counted
+// per UTC day.
+type CompanyUsage struct {
+	Members       int `json:"members"`
+	APIKeys       int `json:"api_keys"`
+	RequestsToday int `json:"requests_today"`
+}
+
+type CompanyQuota struct {
+	Limits CompanyLimits `json:"limits"`
+	Usage  CompanyUsage  `json:"usage"`
+}
+
+// APIKey authenticates the requests made on behalf of a company, which count against its
+// requests per day. The key is only returned when it's created, Prefix tells the keys apart.
+type APIKey struct {
+	ID        uuid.UUID `json:"id"`
+	CompanyID uuid.UUID `json:"company_id"`
+	Name      string    `json:"name"`
+	Key       string    `json:"key,omitempty"`
+	Prefix    string    `json:"prefix"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (k APIKey) Validate() error {
+	if k.Name == "" {
+		return errors.New("missing or empty 'name'")
+	}
+	return nil
+}
+
+type APIKeys struct {
+	APIKeys []APIKey `json:"api_keys"`
+}
@@ -0,0 +1,39 @@
+package entity
+
+import (
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+const (
+	SearchKindUser    = "user"
+	SearchKindCompany = "company"
+)
+
+type SearchResult struct {
+	Kind      string    `json:"kind"`
+	ID        uuid.UUID `json:"id"`
+	Label     string    `json:"label"`
+	Highlight string    `json:"highlight"`
+	Rank      float64   `json:"rank"`
+}
+
+type SearchResults struct {
+	Results []SearchResult `json:"results"`
+}
+
+type SearchQuery struct {
+	Query string
+	Limit int
+}
+
+func (q SearchQuery) Validate() error {
+	if q.Query == "" {
+		return errors.New("missing or empty 'q'")
+	}
+	if q.Limit < 1 || q.Limit > 100 {
+		return errors.New("'limit' must be between 1 and 100")
+	}
+	return nil
+}
@@ -3,3 +3,11 @@ package entity
 type Token struct {
 	Token string `json:"token"`
 }
+
+// TokenMetadata describes the tokens issued to a user. The tokens aren't stored, they carry
+// the personal claims until they expire.
+type TokenMetadata struct {
+	Audience string   `json:"audience"`
+	Claims   []string `json:"claims"`
+	Lifetime string   `json:"lifetime"`
+}
@@ -8,12 +8,20 @@ import (
 )
 
 type User struct {
-	ID        uuid.UUID `json:"id"`
-	Login     string    `json:"login"`
-	Password  string    `json:"password,omitempty"`
-	Email     string    `json:"email"`
-	Role      string    `json:"role,omitempty"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        uuid.UUID  `json:"id"`
+	Login     string     `json:"login"`
+	Password  string     `json:"password,omitempty"`
+	Email     string     `json:"email"`
+	Role      string     `json:"role,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	Version   int        `json:"version"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// ErasedAt is set once the personal data of the user has been anonymized.
+	ErasedAt *time.Time `json:"erased_at,omitempty"`
+	// CompanyRole is the membership role of the user, when listed as a company member.
+	CompanyRole string   `json:"company_role,omitempty"`
+	Metadata    Metadata `json:"metadata,omitempty"`
 }
 
 func (u User) Validate() error {
@@ -29,13 +37,51 @@ func (u User) Validate() error {
 	if u.Role == "" {
 		return errors.New("missing or empty 'role'")
 	}
-	return nil
+	return u.Metadata.Validate()
+}
+
+// UserPatch holds the fields of a partial user update. Nil fields are left untouched, the
+// metadata is replaced as a whole.
+type UserPatch struct {
+	Login    *string  `json:"login"`
+	Password *string  `json:"password"`
+	Email    *string  `json:"email"`
+	Role     *string  `json:"role"`
+	Metadata Metadata `json:"metadata"`
+}
+
+func (p UserPatch) Validate() error {
+	if p.Login == nil && p.Password == nil && p.Email == nil && p.Role == nil && p.Metadata == nil {
+		return errors.New("nothing to update")
+	}
+	if p.Login != nil && *p.Login == "" {
+		return errors.New("empty 'login'")
+	}
+	if p.Password != nil && *p.Password == "" {
+		return errors.New("empty 'password'")
+	}
+	if p.Email != nil && *p.Email == "" {
+		return errors.New("empty 'email'")
+	}
+	if p.Role != nil && *p.Role == "" {
+		return errors.New("empty 'role'")
+	}
+	return p.Metadata.Validate()
 }
 
 type Users struct {
 	Users []User `json:"users"`
 }
 
+// UserExport is the data held about a user, exported at their request.
+type UserExport struct {
+	ExportedAt  time.Time       `json:"exported_at"`
+	User        User            `json:"user"`
+	Memberships []Membership    `json:"memberships"`
+	AuditEvents []AuditEvent    `json:"audit_events"`
+	Tokens      []TokenMetadata `json:"tokens"`
+}
+
 type UserCredentials struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
@@ -0,0 +1,126 @@
+package entity
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Webhook subscribes an endpoint to the domain events matching its filters: an event type, a
+// whole entity as in "company.*", or "*" for every event. The deliveries are signed with the
+// secret, which is only returned when the webhook is created.
+type Webhook struct {
+	ID        uuid.UUID `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Webhooks struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+// minSecretLength applies to the secrets chosen by the clients.
+const minSecretLength = 32
+
+// Validate accepts an empty secret, one is generated then.
+func (w Webhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("'url' must be an absolute http(s) URL")
+	}
+	if len(w.Events) == 0 {
+		return errors.New("missing or empty 'events'")
+	}
+	for _, filter := range w.Events {
+		if !validEventFilter(filter) {
+			return fmt.Errorf("invalid event filter '%s'", filter)
+		}
+	}
+	if w.Secret != "" && len(w.Secret) < minSecretLength {
+		return fmt.Errorf("'secret' must be at least %d characters long", minSecretLength)
+	}
+	return nil
+}
+
+func validEventFilter(filter string) bool {
+	if filter == "*" {
+		return true
+	}
+	for _, eventType := range eventTypes {
+		if filter == eventType || filter == strings.SplitN(eventType, ".", 2)[0]+".*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches returns true if the event type matches one of the filters of the webhook.
+func (w Webhook) Matches(eventType string) bool {
+	for _, filter := range w.Events {
+		if filter == "*" || filter == eventType ||
+			(strings.HasSuffix(filter, ".*") && strings.HasPrefix(eventType, strings.TrimSuffix(filter, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// DeliveryStatusPending deliveries are attempted until they succeed or run out of attempts.
+	DeliveryStatusPending   = "pending"
+	DeliveryStatusDelivered = "delivered"
+	// DeliveryStatusDead deliveries ran out of attempts, they are only retried when replayed.
+	DeliveryStatusDead = "dead"
+)
+
+// WebhookDelivery is the delivery of a domain event to a webhook. Payload is the body posted
+// to the webhook.
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	WebhookID      uuid.UUID       `json:"webhook_id"`
+	EventID        int64           `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	LastError      string          `json:"last_error,omitempty"`
+	ResponseStatus int             `json:"response_status,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+}
+
+type WebhookDeliveries struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+	// NextOffset is only set when there are more deliveries to fetch.
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+// DeliveryFilter selects the deliveries of a webhook, an empty status selects all of them.
+type DeliveryFilter struct {
+	Status string
+	Limit  int
+	Offset int
+}
+
+func (f DeliveryFilter) Validate() error {
+	switch f.Status {
+	case "", DeliveryStatusPending, DeliveryStatusDelivered, DeliveryStatusDead:
+	default:
+		return fmt.Errorf("invalid 'status' '%s'", f.Status)
+	}
+	if f.Limit < 1 || f.Limit > 500 {
+		return errors.New("'limit' must be between 1 and 500")
+	}
+	if f.Offset < 0 {
+		return errors.New("'offset' must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+// Package jobs runs the deferred work enqueued in the job store, outside of the HTTP handlers.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+	"github.com/pkg/errors"
+)
+
+// Payload is the payload of the jobs of a kind, it's stored as JSON.
+type Payload interface {
+	JobKind() string
+}
+
+// Handler runs the jobs of the kind of its payloads.
+type Handler interface {
+	// NewPayload returns a pointer to a zero payload, the payload of a job is unmarshaled into.
+	NewPayload() Payload
+	// Run returns an error for the job to be retried. The context is canceled when the worker
+	// is stopped, the job then runs again later.
+	Run(ctx context.Context, payload Payload) error
+}
+
+// Enqueue adds a job running payload, see JobStore.Enqueue. The job runs MaxAttempts times at
+// most, or as many times as the policy of the worker allows if it's zero.
+func Enqueue(ctx context.Context, jobStore store.JobStore, querier store.Querier, payload Payload, opts entity.JobOptions) (entity.Job, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return entity.Job{}, errors.Wrap(err, "failed to marshal job payload")
+	}
+	return jobStore.Enqueue(ctx, querier, payload.JobKind(), b, opts)
+}
+
+// lease hides the claimed jobs from the other workers, it must exceed the duration of the
+// longest job or it may run twice at the same time.
+const lease = 15 * time.Minute
+
+// DefaultRetryPolicy gives up on a job after about 4 hours.
+var DefaultRetryPolicy = store.RetryPolicy{MaxAttempts: 10, BaseDelay: 10 * time.Second, MaxDelay: time.Hour}
+
+// Worker polls the job store and runs up to concurrency jobs at the same time. A job whose
+// handler fails, or panics, is retried, the delay doubling from the BaseDelay of the policy up
+// to its MaxDelay. It's moved to the dead jobs once it ran out of attempts, or right away if
+// it has no handler.
+type Worker struct {
+	log         log.Logger
+	store       store.JobStore
+	querier     store.Querier
+	policy      store.RetryPolicy
+	concurrency int
+	handlers    map[string]Handler
+
+	stopping chan struct{}
+	freed    chan struct{} // Signaled when a job returns, so that another one is claimed
+	cancel   context.CancelFunc
+	done     chan struct{}
+	running  sync.WaitGroup
+}
+
+// NewWorker starts polling the jobs every pollInterval, until Stop is called.
+func NewWorker(log log.Logger, jobStore store.JobStore, querier store.Querier, policy store.RetryPolicy, pollInterval time.Duration, concurrency int, handlers ...Handler) *Worker {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Worker{
+		log:         log,
+		store:       jobStore,
+		querier:     querier,
+		policy:      policy,
+		concurrency: concurrency,
+		handlers:    make(map[string]Handler, len(handlers)),
+		stopping:    make(chan struct{}),
+		freed:       make(chan struct{}, 1),
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+	for _, h := range handlers {
+		w.handlers[h.NewPayload().JobKind()] = h
+	}
+
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		slots := make(chan struct{}, concurrency)
+		for {
+			w.claim(ctx, slots)
+			select {
+			case <-ticker.C:
+			case <-w.freed:
+			case <-w.stopping:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+// Stop stops claiming jobs, and waits for the running ones for up to timeout. Their context is
+// canceled after the timeout, those which don't succeed are released to run again later.
+func (w *Worker) Stop(timeout time.Duration) {
+	close(w.stopping)
+	<-w.done
+
+	finished := make(chan struct{})
+	go func() {
+		w.running.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(timeout):
+		w.log.Warn("canceling the running jobs")
+	}
+	w.cancel()
+	<-finished
+}
+
+// claim claims a job for every free slot, and runs them.
+func (w *Worker) claim(ctx context.Context, slots chan struct{}) {
+	ctx = log.WithLogger(ctx, w.log)
+	free := cap(slots) - len(slots)
+	if free == 0 {
+		return
+	}
+	jobs, err := w.store.Claim(ctx, w.querier, free, lease)
+	if err != nil {
+		return // Logged by the store
+	}
+	for _, job := range jobs {
+		slots <- struct{}{}
+		w.running.Add(1)
+		go func(job entity.Job) {
+			defer func() {
+				<-slots
+				w.running.Done()
+				select {
+				case w.freed <- struct{}{}:
+				default:
+				}
+			}()
+			w.run(ctx, job)
+		}(job)
+	}
+}
+
+func (w *Worker) run(ctx context.Context, job entity.Job) {
+	logger := w.log.F("job_id", job.ID, "job_kind", job.Kind, "attempt", job.Attempts)
+	ctx = log.WithLogger(ctx, logger)
+	// The job is acknowledged even if the worker is stopping
+	ackCtx := log.WithLogger(context.Background(), logger)
+
+	h, ok := w.handlers[job.Kind]
+	if !ok {
+		logger.Error("no handler for job, moved to the dead jobs")
+		w.store.Fail(ackCtx, w.querier, job.ID, "no handler for the job kind", 0, true)
+		return
+	}
+	payload := h.NewPayload()
+	if err := json.Unmarshal(job.Payload, payload); err != nil {
+		logger.WithError(err).Error("invalid job payload, moved to the dead jobs")
+		w.store.Fail(ackCtx, w.querier, job.ID, "invalid payload: "+err.Error(), 0, true)
+		return
+	}
+
+	err := runHandler(ctx, h, payload)
+	if err == nil {
+		w.store.Complete(ackCtx, w.querier, job.ID)
+		return
+	}
+	if ctx.Err() != nil {
+		logger.WithError(err).Warn("job interrupted, released")
+		w.store.Release(ackCtx, w.querier, job.ID)
+		return
+	}
+
+	maxAttempts := job.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = w.policy.MaxAttempts
+	}
+	dead := job.Attempts >= maxAttempts
+	delay := w.retryDelay(job.Attempts)
+	if dead {
+		logger.WithError(err).Error("job failed for the last time, moved to the dead jobs")
+	} else {
+		logger.F("delay", delay.String()).WithError(err).Warn("job failed")
+	}
+	w.store.Fail(ackCtx, w.querier, job.ID, err.Error(), delay, dead)
+}
+
+// runHandler turns the panics of the handler into errors.
+func runHandler(ctx context.Context, h Handler, payload Payload) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return h.Run(ctx, payload)
+}
+
+// retryDelay doubles from the BaseDelay of the policy after every failed attempt, up to its
+// MaxDelay.
+func (w *Worker) retryDelay(attempts int) time.Duration {
+	delay := w.policy.BaseDelay
+	for k := 1; k < attempts && delay < w.policy.MaxDelay; k++ {
+		delay *= 2
+	}
+	if delay > w.policy.MaxDelay {
+		return w.policy.MaxDelay
+	}
+	return delay
+}
@@ -0,0 +1,134 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+	"github.com/jordanp/goapp/store/memory"
+	"github.com/stretchr/testify/require"
+)
+
+type countJob struct {
+	Fail int `json:"fail"` // The number of attempts failing
+}
+
+func (countJob) JobKind() string { return "count" }
+
+type countHandler struct {
+	runs  int32
+	block chan struct{} // Blocks the job until it's closed or the context is canceled
+}
+
+func (h *countHandler) NewPayload() Payload { return &countJob{} }
+
+func (h *countHandler) Run(ctx context.Context, payload Payload) error {
+	runs := atomic.AddInt32(&h.runs, 1)
+	if h.block != nil {
+		select {
+		case <-h.block:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	switch fail := payload.(*countJob).Fail; {
+	case fail < 0:
+		panic("boom")
+	case int(runs) <= fail:
+		return errors.New("failed")
+	}
+	return nil
+}
+
+var testPolicy = store.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+func newWorker(t *testing.T, h *countHandler) (*memory.Job, *memory.DB, *Worker) {
+	logger, _ := log.NewTest()
+	db := memory.NewDB()
+	jobs := memory.NewJobStore(logger, db)
+	return jobs, db, NewWorker(logger, jobs, db, testPolicy, time.Millisecond, 2, h)
+}
+
+// waitForJob polls the jobs until fn returns true.
+func waitForJob(t *testing.T, jobs store.JobStore, querier store.Querier, fn func([]entity.Job) bool) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		list, err := jobs.List(context.Background(), querier, entity.JobFilter{Limit: 10})
+		require.NoError(t, err)
+		if fn(list) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected jobs %+v", list)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWorker(t *testing.T) {
+	h := &countHandler{}
+	jobs, db, w := newWorker(t, h)
+	defer w.Stop(time.Second)
+	ctx := context.Background()
+
+	// The job succeeds on its second attempt, and is deleted
+	_, err := Enqueue(ctx, jobs, db, countJob{Fail: 1}, entity.JobOptions{})
+	require.NoError(t, err)
+	waitForJob(t, jobs, db, func(list []entity.Job) bool { return len(list) == 0 })
+	require.Equal(t, int32(2), atomic.LoadInt32(&h.runs))
+
+	// The panics fail the job, which runs out of attempts
+	dead, err := Enqueue(ctx, jobs, db, countJob{Fail: -1}, entity.JobOptions{MaxAttempts: 2})
+	require.NoError(t, err)
+	waitForJob(t, jobs, db, func(list []entity.Job) bool { return len(list) == 1 && list[0].Status == entity.JobStatusDead })
+	list, err := jobs.List(ctx, db, entity.JobFilter{Limit: 10})
+	require.NoError(t, err)
+	require.Equal(t, dead.ID, list[0].ID)
+	require.Equal(t, 2, list[0].Attempts)
+	require.Equal(t, "panic: boom", list[0].LastError)
+
+	// The jobs without a handler are dead right away
+	unknown, err := jobs.Enqueue(ctx, db, "unknown", []byte(`{}`), entity.JobOptions{})
+	require.NoError(t, err)
+	waitForJob(t, jobs, db, func(list []entity.Job) bool {
+		for _, job := range list {
+			if job.ID == unknown.ID {
+				return job.Status == entity.JobStatusDead && job.Attempts == 1 && job.LastError == "no handler for the job kind"
+			}
+		}
+		return false
+	})
+}
+
+func TestWorkerStop(t *testing.T) {
+	h := &countHandler{block: make(chan struct{})}
+	jobs, db, w := newWorker(t, h)
+	ctx := context.Background()
+	_, err := Enqueue(ctx, jobs, db, countJob{}, entity.JobOptions{})
+	require.NoError(t, err)
+	waitForJob(t, jobs, db, func(list []entity.Job) bool { return len(list) == 1 && list[0].Status == entity.JobStatusRunning })
+
+	// The running job is waited for
+	time.AfterFunc(10*time.Millisecond, func() { close(h.block) })
+	w.Stop(time.Second)
+	waitForJob(t, jobs, db, func(list []entity.Job) bool { return len(list) == 0 })
+
+	// It's released if it doesn't return in time
+	h = &countHandler{block: make(chan struct{})}
+	jobs, db, w = newWorker(t, h)
+	job, err := Enqueue(ctx, jobs, db, countJob{}, entity.JobOptions{})
+	require.NoError(t, err)
+	waitForJob(t, jobs, db, func(list []entity.Job) bool { return len(list) == 1 && list[0].Status == entity.JobStatusRunning })
+	w.Stop(10 * time.Millisecond)
+	list, err := jobs.List(ctx, db, entity.JobFilter{Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.Equal(t, job.ID, list[0].ID)
+	require.Equal(t, entity.JobStatusPending, list[0].Status)
+	require.Equal(t, 0, list[0].Attempts)
+}
@@ -0,0 +1,72 @@
+// Package mail sends the emails of the application, such as the invitations.
+package mail
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+
+	"github.com/jordanp/goapp/pkg/log"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends the messages. A message which failed may be sent again.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// LogMailer logs the messages instead of sending them. Their bodies hold secrets, such as the
+// invitation tokens, they are only logged with Bodies, which is meant for the development.
+type LogMailer struct {
+	Log    log.Logger
+	Bodies bool
+}
+
+func (m LogMailer) Send(ctx context.Context, msg Message) error {
+	log := m.Log.F("to", msg.To, "subject", msg.Subject)
+	if m.Bodies {
+		log = log.F("body", msg.Body)
+	}
+	log.Info("email")
+	return nil
+}
+
+// SMTPMailer sends the messages through an SMTP server, authenticating if Username is set.
+type SMTPMailer struct {
+	Addr     string // host:port
+	From     string
+	Username string
+	Password string
+}
+
+func (m SMTPMailer) Send(ctx context.Context, msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	for _, header := range []string{msg.To, msg.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return fmt.Errorf("invalid header '%s'", header)
+		}
+	}
+
+	body := "From: " + m.From + "\r\n" +
+		"To: " + msg.To + "\r\n" +
+		"Subject: " + msg.Subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.Replace(msg.Body, "\n", "\r\n", -1)
+	// net/smtp doesn't take a context, a send can't be canceled.
+	return smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, []byte(body))
+}
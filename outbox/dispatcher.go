@@ -0,0 +1,131 @@
+// Package outbox delivers the domain events written to the outbox by the stores.
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+)
+
+const (
+	// lease hides the claimed events from the other dispatchers, it must exceed the time taken
+	// to deliver a batch or its events may be delivered twice, see batchSize.
+	lease           = 5 * time.Minute
+	deliveryTimeout = 10 * time.Second
+	maxRetryDelay   = time.Hour
+)
+
+// Dispatcher polls the outbox and delivers the events to every sink, at least once. An event
+// is retried with an exponential backoff until all the sinks accept it, so a sink may get it
+// again after it accepted it. The events are delivered in order, unless they are retried.
+type Dispatcher struct {
+	log     log.Logger
+	store   store.OutboxStore
+	querier store.Querier
+	sinks   []Sink
+	batch   int
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewDispatcher starts polling the outbox every pollInterval, until Stop is called.
+func NewDispatcher(log log.Logger, outboxStore store.OutboxStore, querier store.Querier, pollInterval time.Duration, sinks ...Sink) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{
+		log:     log,
+		store:   outboxStore,
+		querier: querier,
+		sinks:   sinks,
+		batch:   batchSize(len(sinks)),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(d.done)
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			d.dispatch(ctx)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return d
+}
+
+// batchSize returns how many events are claimed at once for the sinks, at least one: every sink
+// can time out on every event of a batch within half the lease.
+func batchSize(sinks int) int {
+	if sinks < 1 {
+		sinks = 1
+	}
+	if n := int(lease / deliveryTimeout / 2 / time.Duration(sinks)); n > 1 {
+		return n
+	}
+	return 1
+}
+
+// Stop cancels the deliveries in progress and waits for the dispatcher to return. The events
+// which were claimed but not delivered are claimed again once their lease expires.
+func (d *Dispatcher) Stop() {
+	d.cancel()
+	<-d.done
+}
+
+// dispatch delivers the events due for delivery, batch after batch.
+func (d *Dispatcher) dispatch(ctx context.Context) {
+	ctx = log.WithLogger(ctx, d.log)
+	for ctx.Err() == nil {
+		events, err := d.store.Claim(ctx, d.querier, d.batch, lease)
+		if err != nil {
+			return // Logged by the store
+		}
+		for _, event := range events {
+			d.deliver(ctx, event)
+		}
+		if len(events) < d.batch {
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, event entity.DomainEvent) {
+	logger := d.log.F("event_id", event.ID, "event_type", event.Type, "attempt", event.Attempts)
+	for _, sink := range d.sinks {
+		sinkCtx, cancel := context.WithTimeout(ctx, deliveryTimeout)
+		err := sink.Deliver(sinkCtx, event)
+		cancel()
+		if err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			return // Stopped, the event is claimed again once its lease expires
+		}
+
+		delay := retryDelay(event.Attempts)
+		logger.F("delay", delay.String()).WithError(err).Warn("failed to deliver domain event")
+		d.store.Nack(ctx, d.querier, event.ID, delay, err.Error())
+		return
+	}
+	d.store.Ack(ctx, d.querier, event.ID)
+}
+
+// retryDelay doubles from a second after every failed attempt, up to maxRetryDelay.
+func retryDelay(attempts int) time.Duration {
+	if attempts > 12 {
+		return maxRetryDelay
+	}
+	delay := time.Second << uint(attempts-1)
+	if delay > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return delay
+}
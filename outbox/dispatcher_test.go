@@ -0,0 +1,73 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store/memory"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDispatcherRetries(t *testing.T) {
+	logger, _ := log.NewTest()
+	db := memory.NewDB()
+	outboxStore := memory.NewOutboxStore(logger, db)
+	users := memory.NewUserStore(logger, db)
+	user, err := users.Add(context.Background(), db, "login", "password", "email", "user", nil)
+	require.NoError(t, err)
+
+	// The webhook fails the first delivery. The requests are checked by the test goroutine, the
+	// handler only passes them on.
+	type request struct {
+		eventType string
+		body      []byte
+	}
+	received := make(chan request, 10)
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- request{eventType: r.Header.Get("X-Event-Type"), body: body}
+	}))
+	defer server.Close()
+
+	dispatcher := NewDispatcher(logger, outboxStore, db, 10*time.Millisecond, NewWebhookSink(server.URL, time.Second))
+	defer dispatcher.Stop()
+
+	select {
+	case req := <-received:
+		var event entity.DomainEvent
+		require.NoError(t, json.Unmarshal(req.body, &event))
+		require.Equal(t, event.Type, req.eventType)
+		require.Equal(t, entity.EventUserCreated, event.Type)
+		require.Equal(t, user.ID.String(), event.EntityID)
+		require.Equal(t, 2, event.Attempts)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the event wasn't retried")
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	require.Equal(t, 15, batchSize(0))
+	require.Equal(t, 15, batchSize(1))
+	require.Equal(t, 5, batchSize(3))
+	require.Equal(t, 1, batchSize(100))
+}
+
+func TestRetryDelay(t *testing.T) {
+	require.Equal(t, time.Second, retryDelay(1))
+	require.Equal(t, 4*time.Second, retryDelay(3))
+	require.Equal(t, maxRetryDelay, retryDelay(13))
+	require.Equal(t, maxRetryDelay, retryDelay(100))
+}
@@ -0,0 +1,79 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+)
+
+// Sink delivers the domain events to another system. It may get the same event several times,
+// the ID of the event tells the duplicates apart.
+type Sink interface {
+	Deliver(ctx context.Context, event entity.DomainEvent) error
+}
+
+// LogSink logs the events.
+type LogSink struct {
+	Log log.Logger
+}
+
+func (s LogSink) Deliver(ctx context.Context, event entity.DomainEvent) error {
+	s.Log.F("event_id", event.ID, "event_type", event.Type, "entity_id", event.EntityID, "request_id", event.RequestID).Info("domain event")
+	return nil
+}
+
+// WebhookSink posts the events as JSON to the URL, which must answer with a 2xx status.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewWebhookSink(url string, timeout time.Duration) *WebhookSink {
+	return &WebhookSink{URL: url, Client: &http.Client{Timeout: timeout}}
+}
+
+func (s *WebhookSink) Deliver(ctx context.Context, event entity.DomainEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-ID", strconv.FormatInt(event.ID, 10))
+	req.Header.Set("X-Event-Type", event.Type)
+
+	resp, err := s.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body) // So that the connection is reused
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ChanSink sends the events to the channel, for the tests and the in-process consumers.
+type ChanSink chan entity.DomainEvent
+
+func (s ChanSink) Deliver(ctx context.Context, event entity.DomainEvent) error {
+	select {
+	case s <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -15,6 +15,9 @@ type TokenManager interface {
 
 	ParseAdminToken(signedString string) (AdminUser, error)
 	GenerateAdminToken(user AdminUser) (string, error)
+
+	// Lifetimes returns how long the access and admin tokens are valid.
+	Lifetimes() (access, admin time.Duration)
 }
 
 type tokenManager struct {
@@ -62,6 +65,10 @@ func newAdminTokenClaims(login string) *adminTokenClaims {
 	return &a
 }
 
+func (t *tokenManager) Lifetimes() (access, admin time.Duration) {
+	return t.accessTokenDuration, t.adminTokenDuration
+}
+
 func (t *tokenManager) GenerateAccessToken(user User) (string, error) {
 	jot := newAccessTokenClaims(user.Login, user.Email, user.Role)
 	t.fillGenericClaims(jot.JWT, t.accessTokenDuration)
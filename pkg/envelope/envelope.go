@@ -0,0 +1,196 @@
+// Package envelope encrypts small values, such as the personal data of the users, with envelope
+// encryption: every record has its own AES-256-GCM data key, stored along with the record once
+// wrapped by a master key. Rotating the master key only rewraps the data keys.
+//
+// The encrypted values can't be compared by the DB, blind indexes stand in for them in the
+// lookups and the unique constraints.
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// KeySize is the size of the master keys, of the data keys and of the blind index key.
+const KeySize = 32
+
+// Keyring holds the master keys, and the key of the blind indexes.
+type Keyring struct {
+	current  string
+	masters  map[string]cipher.AEAD
+	indexKey []byte
+}
+
+// NewKeyring returns a keyring wrapping the new data keys with the master key of ID current.
+// The other master keys unwrap the data keys they wrapped, until those are rewrapped with the
+// current key. The blind indexes can't be recomputed, indexKey must never change.
+func NewKeyring(current string, masterKeys map[string][]byte, indexKey []byte) (*Keyring, error) {
+	if _, ok := masterKeys[current]; !ok {
+		return nil, errors.Errorf("missing current master key '%s'", current)
+	}
+	if len(indexKey) != KeySize {
+		return nil, errors.Errorf("the blind index key must be %d bytes long", KeySize)
+	}
+	k := &Keyring{current: current, masters: make(map[string]cipher.AEAD, len(masterKeys)), indexKey: indexKey}
+	for ID, key := range masterKeys {
+		if ID == "" || strings.ContainsAny(ID, ":,") {
+			return nil, errors.Errorf("invalid master key ID '%s'", ID)
+		}
+		if len(key) != KeySize {
+			return nil, errors.Errorf("master key '%s' must be %d bytes long", ID, KeySize)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		k.masters[ID] = aead
+	}
+	return k, nil
+}
+
+// ParseKeyring parses the master keys, in the "ID:base64 key,..." format, the first one being
+// the current key, and the base64 blind index key.
+func ParseKeyring(masterKeys, indexKey string) (*Keyring, error) {
+	var current string
+	keys := make(map[string][]byte)
+	for _, masterKey := range strings.Split(masterKeys, ",") {
+		parts := strings.SplitN(strings.TrimSpace(masterKey), ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("the master keys must be in the 'ID:base64 key' format")
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid master key '%s'", parts[0])
+		}
+		if _, ok := keys[parts[0]]; ok {
+			return nil, errors.Errorf("duplicate master key '%s'", parts[0])
+		}
+		if current == "" {
+			current = parts[0]
+		}
+		keys[parts[0]] = key
+	}
+	index, err := base64.StdEncoding.DecodeString(indexKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid blind index key")
+	}
+	return NewKeyring(current, keys, index)
+}
+
+// Current returns the ID of the master key wrapping the new data keys.
+func (k *Keyring) Current() string {
+	return k.current
+}
+
+// String doesn't reveal the keys.
+func (k *Keyring) String() string {
+	return fmt.Sprintf("Keyring{current=%s len(masterKeys)=%d}", k.current, len(k.masters))
+}
+
+// BlindIndex returns the HMAC-SHA256 of value, equal values have equal indexes.
+func (k *Keyring) BlindIndex(value string) []byte {
+	mac := hmac.New(sha256.New, k.indexKey)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// DataKey encrypts the values of a record. It's stored wrapped by a master key.
+type DataKey struct {
+	MasterKeyID string
+	Wrapped     []byte
+	key         []byte
+	aead        cipher.AEAD
+}
+
+// NewDataKey generates a data key, wrapped by the current master key.
+func (k *Keyring) NewDataKey() (DataKey, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return DataKey{}, errors.Wrap(err, "failed to generate data key")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return DataKey{}, err
+	}
+	wrapped, err := seal(k.masters[k.current], key, []byte(k.current))
+	if err != nil {
+		return DataKey{}, err
+	}
+	return DataKey{MasterKeyID: k.current, Wrapped: wrapped, key: key, aead: aead}, nil
+}
+
+// Unwrap decrypts a data key wrapped by the master key of ID masterKeyID.
+func (k *Keyring) Unwrap(masterKeyID string, wrapped []byte) (DataKey, error) {
+	master, ok := k.masters[masterKeyID]
+	if !ok {
+		return DataKey{}, errors.Errorf("unknown master key '%s'", masterKeyID)
+	}
+	key, err := open(master, wrapped, []byte(masterKeyID))
+	if err != nil {
+		return DataKey{}, errors.Wrap(err, "failed to unwrap data key")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return DataKey{}, err
+	}
+	return DataKey{MasterKeyID: masterKeyID, Wrapped: wrapped, key: key, aead: aead}, nil
+}
+
+// Rewrap wraps the data key with the current master key, the values it encrypted are left as is.
+func (k *Keyring) Rewrap(masterKeyID string, wrapped []byte) (DataKey, error) {
+	dataKey, err := k.Unwrap(masterKeyID, wrapped)
+	if err != nil || masterKeyID == k.current {
+		return dataKey, err
+	}
+	if dataKey.Wrapped, err = seal(k.masters[k.current], dataKey.key, []byte(k.current)); err != nil {
+		return DataKey{}, err
+	}
+	dataKey.MasterKeyID = k.current
+	return dataKey, nil
+}
+
+// Seal encrypts and authenticates plaintext, along with additionalData which isn't encrypted.
+// The same additionalData must be given to Open.
+func (dk DataKey) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	return seal(dk.aead, plaintext, additionalData)
+}
+
+// Open decrypts a ciphertext returned by Seal.
+func (dk DataKey) Open(ciphertext, additionalData []byte) ([]byte, error) {
+	plaintext, err := open(dk.aead, ciphertext, additionalData)
+	return plaintext, errors.Wrap(err, "failed to decrypt value")
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid AES key")
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal prepends the random nonce to the ciphertext.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "failed to generate nonce")
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce := ciphertext[:aead.NonceSize()]
+	return aead.Open(nil, nonce, ciphertext[aead.NonceSize():], additionalData)
+}
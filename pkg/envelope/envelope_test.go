@@ -0,0 +1,70 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func key(b byte) []byte {
+	return bytes.Repeat([]byte{b}, KeySize)
+}
+
+func TestEnvelope(t *testing.T) {
+	old, err := NewKeyring("k1", map[string][]byte{"k1": key(1)}, key(9))
+	require.NoError(t, err)
+	dataKey, err := old.NewDataKey()
+	require.NoError(t, err)
+	require.Equal(t, "k1", dataKey.MasterKeyID)
+	ciphertext, err := dataKey.Seal([]byte("bob@goapp"), []byte("email"))
+	require.NoError(t, err)
+	require.NotContains(t, string(ciphertext), "bob@goapp")
+
+	// The additional data must match
+	_, err = dataKey.Open(ciphertext, []byte("login"))
+	require.Error(t, err)
+
+	// The rotated keyring unwraps the data keys of the previous master key, and rewraps them
+	rotated, err := NewKeyring("k2", map[string][]byte{"k1": key(1), "k2": key(2)}, key(9))
+	require.NoError(t, err)
+	rewrapped, err := rotated.Rewrap(dataKey.MasterKeyID, dataKey.Wrapped)
+	require.NoError(t, err)
+	require.Equal(t, "k2", rewrapped.MasterKeyID)
+	unwrapped, err := rotated.Unwrap(rewrapped.MasterKeyID, rewrapped.Wrapped)
+	require.NoError(t, err)
+	plaintext, err := unwrapped.Open(ciphertext, []byte("email"))
+	require.NoError(t, err)
+	require.Equal(t, "bob@goapp", string(plaintext))
+
+	_, err = old.Unwrap(rewrapped.MasterKeyID, rewrapped.Wrapped)
+	require.EqualError(t, err, "unknown master key 'k2'")
+	_, err = rotated.Unwrap("k1", rewrapped.Wrapped)
+	require.Error(t, err)
+
+	// The blind indexes only depend on the index key
+	require.Equal(t, old.BlindIndex("bob@goapp"), rotated.BlindIndex("bob@goapp"))
+	require.NotEqual(t, old.BlindIndex("bob@goapp"), old.BlindIndex("Bob@goapp"))
+}
+
+func TestParseKeyring(t *testing.T) {
+	b64 := base64.StdEncoding.EncodeToString
+	k, err := ParseKeyring("k2:"+b64(key(2))+", k1:"+b64(key(1)), b64(key(9)))
+	require.NoError(t, err)
+	require.Equal(t, "k2", k.Current())
+	require.Equal(t, "Keyring{current=k2 len(masterKeys)=2}", k.String())
+
+	for _, tc := range []struct {
+		masterKeys, indexKey, err string
+	}{
+		{"", b64(key(9)), "the master keys must be in the 'ID:base64 key' format"},
+		{"k1:" + b64(key(1)) + ",k1:" + b64(key(2)), b64(key(9)), "duplicate master key 'k1'"},
+		{"k1:" + b64([]byte("short")), b64(key(9)), "master key 'k1' must be 32 bytes long"},
+		{"k1:" + b64(key(1)), b64([]byte("short")), "the blind index key must be 32 bytes long"},
+		{":" + b64(key(1)), b64(key(9)), "invalid master key ID ''"},
+	} {
+		_, err := ParseKeyring(tc.masterKeys, tc.indexKey)
+		require.EqualError(t, err, tc.err, tc.masterKeys)
+	}
+}
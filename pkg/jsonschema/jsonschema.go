@@ -0,0 +1,374 @@
+// Package jsonschema validates the JSON documents against a subset of JSON Schema (draft 7):
+// the types, the properties of the objects, the items of the arrays, the enums, and the bounds
+// of the strings, numbers, arrays and objects. The schemas using other keywords, such as $ref,
+// are rejected rather than partially enforced.
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Schema is a compiled schema. The documents it validates are decoded by encoding/json into
+// an interface{}: objects are map[string]interface{} and numbers are float64.
+type Schema struct {
+	never                bool // The false schema, which no document is valid against
+	types                []string
+	properties           map[string]*Schema
+	required             []string
+	additionalProperties *Schema
+	items                *Schema
+	enum                 []interface{}
+	pattern              *regexp.Regexp
+	minimum, maximum     *float64
+	exclusiveMinimum     *float64
+	exclusiveMaximum     *float64
+	minLength, maxLength *int
+	minItems, maxItems   *int
+	minProps, maxProps   *int
+}
+
+// ValidationError tells where the document isn't valid, Path is the JSON pointer of the
+// invalid value, empty for the document itself.
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// annotations are the keywords which don't constrain the documents.
+var annotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true, "default": true, "examples": true,
+}
+
+var types = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true, "number": true, "integer": true, "string": true,
+}
+
+// Compile parses the schema, it fails if the schema isn't valid or uses unsupported keywords.
+func Compile(raw []byte) (*Schema, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, fmt.Errorf("invalid schema: %s", err)
+	}
+	return compile(v, "")
+}
+
+func compile(v interface{}, path string) (*Schema, error) {
+	switch v := v.(type) {
+	case bool:
+		return &Schema{never: !v}, nil
+	case map[string]interface{}:
+		s := &Schema{}
+		// The keywords are compiled in order, so that the errors are deterministic
+		keywords := make([]string, 0, len(v))
+		for keyword := range v {
+			keywords = append(keywords, keyword)
+		}
+		sort.Strings(keywords)
+		for _, keyword := range keywords {
+			if err := s.compileKeyword(keyword, v[keyword], path); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	}
+	return nil, schemaError(path, "a schema must be an object or a boolean")
+}
+
+func (s *Schema) compileKeyword(keyword string, value interface{}, path string) error {
+	var err error
+	switch keyword {
+	case "type":
+		s.types, err = compileTypes(value, path+"/type")
+	case "properties":
+		props, ok := value.(map[string]interface{})
+		if !ok {
+			return schemaError(path+"/properties", "must be an object")
+		}
+		s.properties = make(map[string]*Schema, len(props))
+		for name, prop := range props {
+			if s.properties[name], err = compile(prop, path+"/properties/"+escape(name)); err != nil {
+				return err
+			}
+		}
+	case "required":
+		s.required, err = compileStrings(value, path+"/required")
+	case "additionalProperties":
+		s.additionalProperties, err = compile(value, path+"/additionalProperties")
+	case "items":
+		s.items, err = compile(value, path+"/items")
+	case "enum":
+		enum, ok := value.([]interface{})
+		if !ok || len(enum) == 0 {
+			return schemaError(path+"/enum", "must be a non empty array")
+		}
+		s.enum = enum
+	case "const":
+		s.enum = []interface{}{value}
+	case "pattern":
+		pattern, ok := value.(string)
+		if !ok {
+			return schemaError(path+"/pattern", "must be a string")
+		}
+		if s.pattern, err = regexp.Compile(pattern); err != nil {
+			return schemaError(path+"/pattern", "invalid regular expression: %s", err)
+		}
+	case "minimum":
+		s.minimum, err = compileNumber(value, path+"/minimum")
+	case "maximum":
+		s.maximum, err = compileNumber(value, path+"/maximum")
+	case "exclusiveMinimum":
+		s.exclusiveMinimum, err = compileNumber(value, path+"/exclusiveMinimum")
+	case "exclusiveMaximum":
+		s.exclusiveMaximum, err = compileNumber(value, path+"/exclusiveMaximum")
+	case "minLength":
+		s.minLength, err = compileCount(value, path+"/minLength")
+	case "maxLength":
+		s.maxLength, err = compileCount(value, path+"/maxLength")
+	case "minItems":
+		s.minItems, err = compileCount(value, path+"/minItems")
+	case "maxItems":
+		s.maxItems, err = compileCount(value, path+"/maxItems")
+	case "minProperties":
+		s.minProps, err = compileCount(value, path+"/minProperties")
+	case "maxProperties":
+		s.maxProps, err = compileCount(value, path+"/maxProperties")
+	default:
+		if !annotations[keyword] {
+			return schemaError(path, "unsupported keyword '%s'", keyword)
+		}
+	}
+	return err
+}
+
+func compileTypes(value interface{}, path string) ([]string, error) {
+	if t, ok := value.(string); ok {
+		value = []interface{}{t}
+	}
+	names, err := compileStrings(value, path)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if !types[name] {
+			return nil, schemaError(path, "unknown type '%s'", name)
+		}
+	}
+	return names, nil
+}
+
+func compileStrings(value interface{}, path string) ([]string, error) {
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, schemaError(path, "must be an array of strings")
+	}
+	strs := make([]string, 0, len(values))
+	for _, v := range values {
+		str, ok := v.(string)
+		if !ok {
+			return nil, schemaError(path, "must be an array of strings")
+		}
+		strs = append(strs, str)
+	}
+	return strs, nil
+}
+
+func compileNumber(value interface{}, path string) (*float64, error) {
+	n, ok := value.(float64)
+	if !ok {
+		return nil, schemaError(path, "must be a number")
+	}
+	return &n, nil
+}
+
+func compileCount(value interface{}, path string) (*int, error) {
+	n, ok := value.(float64)
+	if !ok || n < 0 || n != math.Trunc(n) {
+		return nil, schemaError(path, "must be a non negative integer")
+	}
+	count := int(n)
+	return &count, nil
+}
+
+func schemaError(path, format string, args ...interface{}) error {
+	if path == "" {
+		return fmt.Errorf("invalid schema: "+format, args...)
+	}
+	return fmt.Errorf("invalid schema at '%s': "+format, append([]interface{}{path}, args...)...)
+}
+
+// escape escapes a property name in a JSON pointer.
+func escape(name string) string {
+	return strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+}
+
+// Validate returns a *ValidationError for the first invalid value of the document, the
+// properties of the objects are checked in order.
+func (s *Schema) Validate(doc interface{}) error {
+	if err := s.validate(doc, ""); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Schema) validate(v interface{}, path string) *ValidationError {
+	if s.never {
+		return &ValidationError{path, "no value is allowed"}
+	}
+	if len(s.types) > 0 && !s.hasType(v) {
+		return &ValidationError{path, fmt.Sprintf("expected %s but got %s", strings.Join(s.types, " or "), typeOf(v))}
+	}
+	if s.enum != nil && !s.inEnum(v) {
+		return &ValidationError{path, "value is not one of the allowed values"}
+	}
+
+	switch v := v.(type) {
+	case string:
+		return s.validateString(v, path)
+	case float64:
+		return s.validateNumber(v, path)
+	case []interface{}:
+		return s.validateArray(v, path)
+	case map[string]interface{}:
+		return s.validateObject(v, path)
+	}
+	return nil
+}
+
+func (s *Schema) hasType(v interface{}) bool {
+	actual := typeOf(v)
+	for _, t := range s.types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Schema) inEnum(v interface{}) bool {
+	for _, allowed := range s.enum {
+		if reflect.DeepEqual(v, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Schema) validateString(v, path string) *ValidationError {
+	length := len([]rune(v))
+	if s.minLength != nil && length < *s.minLength {
+		return &ValidationError{path, fmt.Sprintf("must be at least %d characters long", *s.minLength)}
+	}
+	if s.maxLength != nil && length > *s.maxLength {
+		return &ValidationError{path, fmt.Sprintf("must be at most %d characters long", *s.maxLength)}
+	}
+	if s.pattern != nil && !s.pattern.MatchString(v) {
+		return &ValidationError{path, fmt.Sprintf("must match the pattern '%s'", s.pattern)}
+	}
+	return nil
+}
+
+func (s *Schema) validateNumber(v float64, path string) *ValidationError {
+	if s.minimum != nil && v < *s.minimum {
+		return &ValidationError{path, fmt.Sprintf("must be greater than or equal to %v", *s.minimum)}
+	}
+	if s.maximum != nil && v > *s.maximum {
+		return &ValidationError{path, fmt.Sprintf("must be less than or equal to %v", *s.maximum)}
+	}
+	if s.exclusiveMinimum != nil && v <= *s.exclusiveMinimum {
+		return &ValidationError{path, fmt.Sprintf("must be greater than %v", *s.exclusiveMinimum)}
+	}
+	if s.exclusiveMaximum != nil && v >= *s.exclusiveMaximum {
+		return &ValidationError{path, fmt.Sprintf("must be less than %v", *s.exclusiveMaximum)}
+	}
+	return nil
+}
+
+func (s *Schema) validateArray(v []interface{}, path string) *ValidationError {
+	if s.minItems != nil && len(v) < *s.minItems {
+		return &ValidationError{path, fmt.Sprintf("must have at least %d items", *s.minItems)}
+	}
+	if s.maxItems != nil && len(v) > *s.maxItems {
+		return &ValidationError{path, fmt.Sprintf("must have at most %d items", *s.maxItems)}
+	}
+	if s.items == nil {
+		return nil
+	}
+	for k, item := range v {
+		if err := s.items.validate(item, fmt.Sprintf("%s/%d", path, k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateObject(v map[string]interface{}, path string) *ValidationError {
+	if s.minProps != nil && len(v) < *s.minProps {
+		return &ValidationError{path, fmt.Sprintf("must have at least %d properties", *s.minProps)}
+	}
+	if s.maxProps != nil && len(v) > *s.maxProps {
+		return &ValidationError{path, fmt.Sprintf("must have at most %d properties", *s.maxProps)}
+	}
+	for _, name := range s.required {
+		if _, ok := v[name]; !ok {
+			return &ValidationError{path, fmt.Sprintf("missing required property '%s'", name)}
+		}
+	}
+
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		prop, ok := s.properties[name]
+		if !ok {
+			prop = s.additionalProperties
+		}
+		if prop == nil {
+			continue
+		}
+		if err := prop.validate(v[name], path+"/"+escape(name)); err != nil {
+			if !ok && prop.never {
+				err.Message = "additional property is not allowed"
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// typeOf returns the JSON Schema type of a decoded value, the numbers without a fractional
+// part are integers.
+func typeOf(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
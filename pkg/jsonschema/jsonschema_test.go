@@ -0,0 +1,80 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const crmSchema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"type": "object",
+	"required": ["crm_id"],
+	"properties": {
+		"crm_id": {"type": "string", "pattern": "^CRM-[0-9]+$"},
+		"cost_center": {"type": "integer", "minimum": 100, "maximum": 999},
+		"tier": {"enum": ["gold", "silver"]},
+		"tags": {"type": "array", "items": {"type": "string", "maxLength": 8}, "maxItems": 2},
+		"a/b": {"type": ["string", "null"]}
+	},
+	"additionalProperties": false
+}`
+
+func validate(t *testing.T, schema *Schema, doc string) error {
+	var v interface{}
+	require.NoError(t, json.Unmarshal([]byte(doc), &v))
+	return schema.Validate(v)
+}
+
+func TestValidate(t *testing.T) {
+	schema, err := Compile([]byte(crmSchema))
+	require.NoError(t, err)
+
+	assert.NoError(t, validate(t, schema, `{"crm_id": "CRM-1"}`))
+	assert.NoError(t, validate(t, schema, `{"crm_id": "CRM-1", "cost_center": 120, "tier": "gold", "tags": ["a", "b"], "a/b": null}`))
+
+	for doc, msg := range map[string]string{
+		`[]`:                                     "expected object but got array",
+		`{}`:                                     "missing required property 'crm_id'",
+		`{"crm_id": 1}`:                          "/crm_id: expected string but got integer",
+		`{"crm_id": "1"}`:                        "/crm_id: must match the pattern '^CRM-[0-9]+$'",
+		`{"crm_id": "CRM-1", "cost_center": 12}`: "/cost_center: must be greater than or equal to 100",
+		`{"crm_id": "CRM-1", "cost_center": 1.5}`:      "/cost_center: expected integer but got number",
+		`{"crm_id": "CRM-1", "tier": "bronze"}`:        "/tier: value is not one of the allowed values",
+		`{"crm_id": "CRM-1", "tags": ["a", "b", "c"]}`: "/tags: must have at most 2 items",
+		`{"crm_id": "CRM-1", "tags": ["abcdefghi"]}`:   "/tags/0: must be at most 8 characters long",
+		`{"crm_id": "CRM-1", "a/b": 1}`:                "/a~1b: expected string or null but got integer",
+		`{"crm_id": "CRM-1", "unknown": true}`:         "/unknown: additional property is not allowed",
+	} {
+		err := validate(t, schema, doc)
+		if assert.Error(t, err, doc) {
+			assert.IsType(t, &ValidationError{}, err)
+			assert.Equal(t, msg, err.Error(), doc)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	schema, err := Compile([]byte(`true`))
+	require.NoError(t, err)
+	assert.NoError(t, validate(t, schema, `{"any": 1}`))
+	schema, err = Compile([]byte(`{"additionalProperties": {"type": "number"}}`))
+	require.NoError(t, err)
+	assert.NoError(t, validate(t, schema, `{"a": 1.5}`))
+	assert.EqualError(t, validate(t, schema, `{"a": "1"}`), "/a: expected number but got string")
+
+	for schema, msg := range map[string]string{
+		`{`:                           "invalid schema: unexpected end of JSON input",
+		`"object"`:                    "invalid schema: a schema must be an object or a boolean",
+		`{"$ref": "#/definitions/a"}`: "invalid schema: unsupported keyword '$ref'",
+		`{"type": "date"}`:            "invalid schema at '/type': unknown type 'date'",
+		`{"properties": {"a": {"maxLength": -1}}}`: "invalid schema at '/properties/a/maxLength': must be a non negative integer",
+		`{"pattern": "("}`:                         "invalid schema at '/pattern': invalid regular expression: error parsing regexp: missing closing ): `(`",
+		`{"enum": []}`:                             "invalid schema at '/enum': must be a non empty array",
+	} {
+		_, err := Compile([]byte(schema))
+		assert.EqualError(t, err, msg, schema)
+	}
+}
@@ -50,6 +50,12 @@ func MakeAuthenticator(t auth.TokenManager, kind string) Middleware {
 	}
 }
 
+// WhoFromCtx returns the authenticated user, or nil outside of an authenticator middleware.
+func WhoFromCtx(ctx context.Context) auth.Who {
+	who, _ := ctx.Value(ctxUser{}).(auth.Who)
+	return who
+}
+
 func AdminUserFromCtx(ctx context.Context) auth.AdminUser {
 	return ctx.Value(ctxUser{}).(auth.AdminUser)
 }
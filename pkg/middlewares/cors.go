@@ -9,8 +9,9 @@ import (
 func MakeCORS() Middleware {
 	cors := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"POST", "GET", "DELETE"},
-		AllowedHeaders:   []string{"Origin", "Accept", "Content-Type", "Authorization"},
+		AllowedMethods:   []string{"POST", "GET", "PATCH", "DELETE"},
+		AllowedHeaders:   []string{"Origin", "Accept", "Content-Type", "Authorization", "If-Match"},
+		ExposedHeaders:   []string{"ETag"},
 		MaxAge:           3600,
 		AllowCredentials: true,
 	})
@@ -1,6 +1,7 @@
 package middlewares
 
 import (
+	"context"
 	"errors"
 	"io"
 	"io/ioutil"
@@ -11,11 +12,15 @@ import (
 	pkglog "github.com/jordanp/goapp/pkg/log"
 )
 
+type ctxRequestID struct{}
+
 func MakeLogger(log pkglog.Logger, logRequest func(statusCode int) bool) Middleware {
 	return func(h http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
-			log := log.F("requestID", uuid.New().String())
+			requestID := uuid.New().String()
+			log := log.F("requestID", requestID)
 			ctx := pkglog.WithLogger(r.Context(), log)
+			ctx = context.WithValue(ctx, ctxRequestID{}, requestID)
 
 			httpFields := map[string]interface{}{
 				"host":          r.Host,
@@ -62,6 +67,12 @@ func MakeLogger(log pkglog.Logger, logRequest func(statusCode int) bool) Middlew
 	}
 }
 
+// RequestIDFromCtx returns the ID generated by the logger middleware, or "" outside of it.
+func RequestIDFromCtx(ctx context.Context) string {
+	requestID, _ := ctx.Value(ctxRequestID{}).(string)
+	return requestID
+}
+
 type readCounterCloser struct {
 	r   io.ReadCloser
 	n   int64
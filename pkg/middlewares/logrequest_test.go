@@ -10,7 +10,7 @@ import (
 )
 
 func handler(w http.ResponseWriter, r *http.Request) {
-	pkglog.G(r.Context()).Info("some log")
+	pkglog.G(r.Context()).F("requestID2", RequestIDFromCtx(r.Context())).Info("some log")
 	w.Header().Set("Content-type", "application/json")
 	w.WriteHeader(422)
 	w.Write([]byte(`{"a": "b"}`))
@@ -30,6 +30,7 @@ func TestNewLogger(t *testing.T) {
 	entries := hook.AllEntries()
 	require.Equal(t, "some log", entries[0].Message)
 	require.Len(t, entries[0].Data["requestID"], 36)
+	require.Equal(t, entries[0].Data["requestID"], entries[0].Data["requestID2"])
 
 	require.Equal(t, pkglog.InfoLevel, entries[1].Level)
 	require.Equal(t, "422 GET "+srv.Listener.Addr().String()+"/", entries[1].Message)
@@ -0,0 +1,74 @@
+// Package textsearch is a simple stand-in for the full-text and trigram search of Postgres,
+// for the stores backed by other DBs.
+package textsearch
+
+import "strings"
+
+// Match tells whether every word of the query appears, case insensitively, in the fields. The
+// rank is the share of the best matching field covered by the query words, between 0 and 1.
+// The highlight is the space separated fields, with the words surrounded by <mark> tags.
+func Match(query string, fields ...string) (rank float64, highlight string, ok bool) {
+	words := strings.Fields(strings.ToLower(query))
+	text := strings.Join(fields, " ")
+	lower := strings.ToLower(text)
+	if len(words) == 0 {
+		return 0, "", false
+	}
+	for _, word := range words {
+		if !strings.Contains(lower, word) {
+			return 0, "", false
+		}
+	}
+
+	for _, field := range fields {
+		if len(field) == 0 {
+			continue
+		}
+		var matched int
+		for _, word := range words {
+			if strings.Contains(strings.ToLower(field), word) {
+				matched += len(word)
+			}
+		}
+		if r := float64(matched) / float64(len(field)); r > rank {
+			rank = r
+		}
+	}
+	if rank > 1 {
+		rank = 1
+	}
+	return rank, mark(text, lower, words), true
+}
+
+// mark surrounds the occurrences of the words with <mark> tags, like ts_headline.
+func mark(text, lower string, words []string) string {
+	if len(lower) != len(text) { // Lowercasing changed the byte offsets
+		return text
+	}
+
+	marked := make([]bool, len(text))
+	for _, word := range words {
+		for i := 0; ; {
+			j := strings.Index(lower[i:], word)
+			if j < 0 {
+				break
+			}
+			for k := i + j; k < i+j+len(word); k++ {
+				marked[k] = true
+			}
+			i += j + 1
+		}
+	}
+
+	var b strings.Builder
+	for k := 0; k < len(text); k++ {
+		if marked[k] && (k == 0 || !marked[k-1]) {
+			b.WriteString("<mark>")
+		}
+		b.WriteByte(text[k])
+		if marked[k] && (k == len(text)-1 || !marked[k+1]) {
+			b.WriteString("</mark>")
+		}
+	}
+	return b.String()
+}
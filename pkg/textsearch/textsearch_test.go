@@ -0,0 +1,28 @@
+package textsearch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	rank, highlight, ok := Match("company1", "company1")
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, rank)
+	assert.Equal(t, "<mark>company1</mark>", highlight)
+
+	rank, highlight, ok = Match("Company1 USER1", "user1Company1", "user1@company1")
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, rank)
+	assert.Equal(t, "<mark>user1Company1</mark> <mark>user1</mark>@<mark>company1</mark>", highlight)
+
+	rank, _, ok = Match("user", "user1Company1", "user1@company1")
+	assert.True(t, ok)
+	assert.InDelta(t, 4.0/13, rank, 0.001)
+
+	_, _, ok = Match("user zzz", "user1Company1")
+	assert.False(t, ok)
+	_, _, ok = Match(" ", "user1Company1")
+	assert.False(t, ok)
+}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/pkg/errors"
+)
+
+type APIKey struct {
+	log log.Logger
+	db  *DB
+}
+
+// NewAPIKeyStore must be called after NewCompanyStore, the keys belong to the companies.
+func NewAPIKeyStore(log log.Logger, db *DB) (*APIKey, error) {
+	if _, err := db.Exec(createTableAPIKeys); err != nil {
+		return nil, errors.Wrap(err, "failed to create api_keys table")
+	}
+	return &APIKey{log: log, db: db}, nil
+}
+
+// NewAPIKey returns a random key, which is only returned to the client creating it.
+func NewAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// HashAPIKey returns the hash of the key which is stored, the key is random enough not to need
+// a salt.
+func HashAPIKey(key string) []byte {
+	h := sha256.Sum256([]byte(key))
+	return h[:]
+}
+
+// APIKeyPrefix returns the beginning of the key which is stored, to tell the keys apart.
+func APIKeyPrefix(key string) string {
+	if len(key) < 8 {
+		return key
+	}
+	return key[:8]
+}
+
+// apiKeyDest returns the scan destinations of the apiKeyColumns.
+func apiKeyDest(key *entity.APIKey) []interface{} {
+	return []interface{}{&key.ID, &key.CompanyID, &key.Name, &key.Prefix, utcTime{&key.CreatedAt}}
+}
+
+// Add creates a key of the company, unless it exceeds its maximum of API keys.
+func (s *APIKey) Add(ctx context.Context, querier Querier, companyID, name, key string) (entity.APIKey, error) {
+	var apiKey entity.APIKey
+	err := WithTx(ctx, querier, func(tx *Tx) error {
+		err := getOne(ctx, tx, insertAPIKey, []interface{}{companyID, name, HashAPIKey(key), APIKeyPrefix(key)}, apiKeyDest(&apiKey)...)
+		if err == ErrNoRows {
+			return NewNotFoundError("company", companyID)
+		} else if err != nil {
+			return err
+		}
+		if err := checkUsage(ctx, tx, companyID, entity.QuotaAPIKeys); err != nil {
+			return err
+		}
+		return recordEvent(ctx, tx, entity.AuditActionCreate, "api_key", apiKey.ID.String(), nil, apiKey)
+	})
+	apiKey.Key = key
+	return apiKey, err
+}
+
+// List returns the keys of the company, the oldest first.
+func (s *APIKey) List(ctx context.Context, querier Querier, companyID string) ([]entity.APIKey, error) {
+	rows, err := reader(ctx, querier).QueryContext(ctx, selectAPIKeys, companyID)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to select api keys in DB")
+		return nil, ErrGenericDBFailure
+	}
+	defer rows.Close()
+
+	keys := []entity.APIKey{}
+	for rows.Next() {
+		var key entity.APIKey
+		if err := rows.Scan(apiKeyDest(&key)...); err != nil {
+			log.G(ctx).WithError(err).Error("failed to scan api key in DB")
+			return nil, ErrGenericDBFailure
+		}
+		keys = append(keys, key)
+	}
+	if err = rows.Err(); err != nil {
+		log.G(ctx).WithError(err).Error("failed to loop through api keys")
+		return nil, ErrGenericDBFailure
+	}
+	return keys, nil
+}
+
+// Authenticate returns the API key, unless it doesn't exist or its company is soft deleted. It
+// reads from the primary, the keys must authenticate as soon as they are created.
+func (s *APIKey) Authenticate(ctx context.Context, querier Querier, key string) (entity.APIKey, error) {
+	var apiKey entity.APIKey
+	err := getOne(ctx, querier, selectAPIKeyByHash, []interface{}{HashAPIKey(key)}, apiKeyDest(&apiKey)...)
+	if err == ErrNoRows {
+		return apiKey, NewNotFoundError("api key", "key")
+	}
+	return apiKey, err
+}
+
+// DeleteByID deletes a key of the company, it doesn't authenticate anymore.
+func (s *APIKey) DeleteByID(ctx context.Context, querier Querier, companyID, ID string) error {
+	return WithTx(ctx, querier, func(tx *Tx) error {
+		var apiKey entity.APIKey
+		err := getOne(ctx, tx, deleteAPIKey, []interface{}{ID, companyID}, apiKeyDest(&apiKey)...)
+		if err == ErrNoRows {
+			return NewNotFoundError("api key", ID)
+		} else if err != nil {
+			return err
+		}
+		return recordEvent(ctx, tx, entity.AuditActionDelete, "api_key", ID, apiKey, nil)
+	})
+}
+
+func (s *APIKey) DeleteAll() error {
+	if _, err := s.db.Exec(deleteAllAPIKeys); err != nil {
+		return errors.Wrap(err, "failed to truncate api_keys table")
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package store
+
+// Only the hash of the keys is stored, prefix is the beginning of the key.
+const createTableAPIKeys = `
+CREATE TABLE IF NOT EXISTS api_keys (
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	company_id UUID NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	key_hash BYTEA NOT NULL,
+	prefix TEXT NOT NULL,
+	created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	CONSTRAINT unq_api_key UNIQUE (key_hash)
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_company_id ON api_keys (company_id)`
+
+// apiKeyColumns must be kept in sync with apiKeyDest
+const apiKeyColumns = `id, company_id, name, prefix, created_at`
+
+// Soft deleted companies can't have new keys, in which case no row is inserted.
+const insertAPIKey = `
+INSERT INTO api_keys (company_id, name, key_hash, prefix)
+SELECT id, $2, $3, $4 FROM companies WHERE id = $1 AND deleted_at IS NULL
+RETURNING ` + apiKeyColumns
+
+const selectAPIKeys = `
+SELECT ` + apiKeyColumns + ` FROM api_keys WHERE company_id = $1 ORDER BY created_at, id`
+
+// The keys of the soft deleted companies don't authenticate anymore.
+const selectAPIKeyByHash = `
+SELECT k.id, k.company_id, k.name, k.prefix, k.created_at
+FROM api_keys k JOIN companies c ON c.id = k.company_id
+WHERE k.key_hash = $1 AND c.deleted_at IS NULL`
+
+const deleteAPIKey = `
+DELETE FROM api_keys WHERE id = $1 AND company_id = $2
+RETURNING ` + apiKeyColumns
+
+const deleteAllAPIKeys = `
+TRUNCATE TABLE api_keys
+`
@@ -0,0 +1,282 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/pkg/errors"
+)
+
+type Audit struct {
+	log log.Logger
+	db  *DB
+}
+
+type ctxAuditInfo struct{}
+
+// AuditInfo tells who is responsible for the mutations made with a context.
+type AuditInfo struct {
+	Actor     string
+	RequestID string
+	ClientIP  string
+}
+
+// WithAuditInfo returns a new context, the mutations made with it will be attributed to info.
+func WithAuditInfo(ctx context.Context, info AuditInfo) context.Context {
+	return context.WithValue(ctx, ctxAuditInfo{}, info)
+}
+
+// AuditInfoFromCtx returns the audit info of the context. Mutations made without audit info,
+// like the purge of soft deleted records, are attributed to the "system" actor.
+func AuditInfoFromCtx(ctx context.Context) AuditInfo {
+	info, _ := ctx.Value(ctxAuditInfo{}).(AuditInfo)
+	if info.Actor == "" {
+		info.Actor = "system"
+	}
+	return info
+}
+
+// NewAuditStore must be called before the stores whose mutations are audited.
+func NewAuditStore(log log.Logger, db *DB) (*Audit, error) {
+	if _, err := db.Exec(createTableAuditEvents); err != nil {
+		return nil, errors.Wrap(err, "failed to create audit_events table")
+	}
+	return &Audit{log: log, db: db}, nil
+}
+
+// recordEvent must be called within the transaction of the mutation it describes. before
+// and after are JSON snapshots of the record, nil when it doesn't exist, their personal data is
+// redacted. The domain event of the mutation is published along with the audit event, and the
+// listeners of the changes are notified.
+func recordEvent(ctx context.Context, querier Querier, action, entityType, entityID string, before, after interface{}) error {
+	info := AuditInfoFromCtx(ctx)
+	before, after = WithoutPII(before), WithoutPII(after)
+	beforeJSON, err := snapshot(before)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to marshal audit snapshot")
+		return ErrGenericDBFailure
+	}
+	afterJSON, err := snapshot(after)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to marshal audit snapshot")
+		return ErrGenericDBFailure
+	}
+
+	_, err = querier.ExecContext(ctx, insertAuditEvent, info.Actor, action, entityType, entityID, beforeJSON, afterJSON, info.RequestID, info.ClientIP)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to insert audit event in DB")
+		return ErrGenericDBFailure
+	}
+	if err = publishEvent(ctx, querier, action, entityType, entityID, before, after); err != nil {
+		return err
+	}
+	return notifyChange(ctx, querier, action, entityType, entityID)
+}
+
+// snapshot returns nil for a nil value so that the column is NULL rather than 'null'. The JSON
+// is returned as a string since pq would encode a []byte as a bytea.
+func snapshot(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// redactEvents replaces the fields of the snapshots of an entity with placeholders, and renames
+// the actor of the events it made, so that the audit trail keeps no personal data once the entity
+// is erased. It must be called within the transaction of the erasure.
+func redactEvents(ctx context.Context, querier Querier, entityType, entityID string, placeholders map[string]interface{}, actor, redactedActor string) error {
+	rows, err := querier.QueryContext(ctx, selectAuditSnapshots, entityType, entityID)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to select audit snapshots in DB")
+		return ErrGenericDBFailure
+	}
+	defer rows.Close()
+
+	type snapshots struct {
+		ID            int64
+		before, after []byte
+	}
+	var events []snapshots
+	for rows.Next() {
+		var event snapshots
+		if err = rows.Scan(&event.ID, &event.before, &event.after); err != nil {
+			log.G(ctx).WithError(err).Error("failed to scan audit snapshots in DB")
+			return ErrGenericDBFailure
+		}
+		events = append(events, event)
+	}
+	if err = rows.Err(); err != nil {
+		log.G(ctx).WithError(err).Error("failed to loop through audit snapshots")
+		return ErrGenericDBFailure
+	}
+	rows.Close() // The connection is busy until the rows are closed
+
+	for _, event := range events {
+		before, err := redactSnapshot(event.before, placeholders)
+		if err != nil {
+			log.G(ctx).F("id", event.ID).WithError(err).Error("failed to redact audit snapshot")
+			return ErrGenericDBFailure
+		}
+		after, err := redactSnapshot(event.after, placeholders)
+		if err != nil {
+			log.G(ctx).F("id", event.ID).WithError(err).Error("failed to redact audit snapshot")
+			return ErrGenericDBFailure
+		}
+		if _, err = querier.ExecContext(ctx, updateAuditSnapshots, event.ID, before, after); err != nil {
+			log.G(ctx).F("id", event.ID).WithError(err).Error("failed to update audit snapshots in DB")
+			return ErrGenericDBFailure
+		}
+	}
+
+	if _, err = querier.ExecContext(ctx, renameAuditActor, actor, redactedActor); err != nil {
+		log.G(ctx).WithError(err).Error("failed to rename audit actor in DB")
+		return ErrGenericDBFailure
+	}
+	return nil
+}
+
+// redactPayloads replaces the JSON payloads returned by the query, as id and payload, with the
+// ones returned by redact. update sets the payload $2 of the row $1. It must be called within the
+// transaction of the erasure, what names the payloads in the logs.
+func redactPayloads(ctx context.Context, querier Querier, what, query string, args []interface{}, update string, redact func([]byte) (interface{}, error)) error {
+	rows, err := querier.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.G(ctx).WithError(err).Errorf("failed to select %s in DB", what)
+		return ErrGenericDBFailure
+	}
+	defer rows.Close()
+
+	type row struct {
+		ID      int64
+		payload []byte
+	}
+	var payloads []row
+	for rows.Next() {
+		var r row
+		if err = rows.Scan(&r.ID, &r.payload); err != nil {
+			log.G(ctx).WithError(err).Errorf("failed to scan %s in DB", what)
+			return ErrGenericDBFailure
+		}
+		payloads = append(payloads, r)
+	}
+	if err = rows.Err(); err != nil {
+		log.G(ctx).WithError(err).Errorf("failed to loop through %s", what)
+		return ErrGenericDBFailure
+	}
+	rows.Close() // The connection is busy until the rows are closed
+
+	for _, r := range payloads {
+		payload, err := redact(r.payload)
+		if err != nil {
+			log.G(ctx).F("id", r.ID).WithError(err).Errorf("failed to redact %s", what)
+			return ErrGenericDBFailure
+		}
+		if _, err = querier.ExecContext(ctx, update, r.ID, payload); err != nil {
+			log.G(ctx).F("id", r.ID).WithError(err).Errorf("failed to update %s in DB", what)
+			return ErrGenericDBFailure
+		}
+	}
+	return nil
+}
+
+// redactSnapshot replaces the fields of a JSON snapshot which are in placeholders, a NULL
+// snapshot is left as is. See snapshot.
+func redactSnapshot(b []byte, placeholders map[string]interface{}) (interface{}, error) {
+	if b == nil {
+		return nil, nil
+	}
+	var fields map[string]json.RawMessage // The other fields are kept verbatim
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	for field, placeholder := range placeholders {
+		if _, ok := fields[field]; !ok {
+			continue
+		}
+		value, err := json.Marshal(placeholder)
+		if err != nil {
+			return nil, err
+		}
+		fields[field] = value
+	}
+	return snapshot(fields)
+}
+
+// List returns the events matching the filter, most recent first.
+func (s *Audit) List(ctx context.Context, querier Querier, filter entity.AuditFilter) ([]entity.AuditEvent, error) {
+	querier = reader(ctx, querier)
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.Actor != "" {
+		where("actor = $%d", filter.Actor)
+	}
+	if filter.Action != "" {
+		where("action = $%d", filter.Action)
+	}
+	if filter.EntityType != "" {
+		where("entity_type = $%d", filter.EntityType)
+	}
+	if filter.EntityID != "" {
+		where("entity_id = $%d", filter.EntityID)
+	}
+	if !filter.Since.IsZero() {
+		where("created_at >= $%d", filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		where("created_at < $%d", filter.Until.UTC())
+	}
+
+	query := selectAuditEvents
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, filter.Limit, filter.Offset)
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+	rows, err := querier.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to list audit events in DB")
+		return nil, ErrGenericDBFailure
+	}
+	defer rows.Close()
+
+	var events []entity.AuditEvent
+	for rows.Next() {
+		var event entity.AuditEvent
+		var before, after []byte
+		err = rows.Scan(&event.ID, utcTime{&event.CreatedAt}, &event.Actor, &event.Action, &event.EntityType, &event.EntityID, &before, &after, &event.RequestID, &event.ClientIP)
+		if err != nil {
+			log.G(ctx).WithError(err).Error("failed to scan audit event in DB")
+			return nil, ErrGenericDBFailure
+		}
+		event.Before, event.After = before, after // NULL snapshots are scanned as nil and omitted
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.G(ctx).WithError(err).Error("failed to loop through audit events")
+		return nil, ErrGenericDBFailure
+	}
+
+	return events, nil
+}
+
+func (s *Audit) DeleteAll() error {
+	if _, err := s.db.Exec(deleteAllAuditEvents); err != nil {
+		return errors.Wrap(err, "failed to truncate audit_events table")
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package store
+
+// entity_id isn't a foreign key since events must outlive the records they describe.
+const createTableAuditEvents = `
+CREATE TABLE IF NOT EXISTS audit_events (
+	id BIGSERIAL PRIMARY KEY,
+	created_at timestamp WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	actor TEXT NOT NULL,
+	action TEXT NOT NULL,
+	entity_type TEXT NOT NULL,
+	entity_id TEXT NOT NULL,
+	before JSONB,
+	after JSONB,
+	request_id TEXT NOT NULL,
+	client_ip TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_entity ON audit_events (entity_type, entity_id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor ON audit_events (actor);
+CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON audit_events (created_at);
+
+-- The timestamps were stored in UTC without time zone, they are converted once.
+DO $$
+BEGIN
+	IF (SELECT data_type FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'audit_events' AND column_name = 'created_at') = 'timestamp without time zone' THEN
+		ALTER TABLE audit_events
+			ALTER COLUMN created_at TYPE timestamptz USING created_at AT TIME ZONE 'UTC';
+	END IF;
+END
+$$;
+`
+
+const insertAuditEvent = `
+INSERT INTO audit_events (actor, action, entity_type, entity_id, before, after, request_id, client_ip)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+`
+
+const selectAuditEvents = `
+SELECT id, created_at, actor, action, entity_type, entity_id, before, after, request_id, client_ip FROM audit_events`
+
+// The snapshots of an entity, which are redacted when its personal data is erased.
+const selectAuditSnapshots = `
+SELECT id, before, after FROM audit_events WHERE entity_type = $1 AND entity_id = $2 FOR UPDATE`
+
+const updateAuditSnapshots = `
+UPDATE audit_events SET before = $2, after = $3 WHERE id = $1
+`
+
+const renameAuditActor = `
+UPDATE audit_events SET actor = $2 WHERE actor = $1
+`
+
+const deleteAllAuditEvents = `
+TRUNCATE TABLE audit_events
+`
@@ -4,86 +4,144 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"time"
 
-	"github.com/google/uuid"
 	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/envelope"
 	"github.com/jordanp/goapp/pkg/log"
-	"github.com/lib/pq"
 	"github.com/pkg/errors"
 )
 
 type Company struct {
-	log log.Logger
-	db  *sql.DB
+	log     log.Logger
+	db      *DB
+	keyring *envelope.Keyring // Decrypts the members
 }
 
 // https://medium.com/@beld_pro/postgres-with-golang-3b788d86f2ef
 // The store must return human friendly, safe error messages. Failure details must be logged but never
 // returned to the caller.
 
-func NewCompanyStore(log log.Logger, db *sql.DB) (*Company, error) {
+func NewCompanyStore(log log.Logger, db *DB, keyring *envelope.Keyring) (*Company, error) {
 	// Exec executes a query without returning any rows.
 	if _, err := db.Exec(createTableCompanies); err != nil {
 		return nil, errors.Wrap(err, "failed to create companies table")
 	}
-	return &Company{log: log, db: db}, nil
+	if _, err := db.Exec(createTableCompanyLimits); err != nil {
+		return nil, errors.Wrap(err, "failed to create company_limits table")
+	}
+	return &Company{log: log, db: db, keyring: keyring}, nil
+}
+
+// companyDest returns the scan destinations of the companyColumns.
+func companyDest(company *entity.Company) []interface{} {
+	return []interface{}{
+		&company.ID, &company.Name, utcTime{&company.CreatedAt}, utcTime{&company.UpdatedAt}, &company.Version, nullUTCTime{&company.DeletedAt},
+		&company.ParentID, metadataColumn{&company.Metadata},
+	}
 }
 
-func (s *Company) Add(ctx context.Context, name string, userIDs []uuid.UUID) (entity.Company, error) {
+// Add creates the company along with its members, whose CompanyID is ignored.
+func (s *Company) Add(ctx context.Context, querier Querier, name string, members []entity.Membership, metadata entity.Metadata) (entity.Company, error) {
 	var company entity.Company
+	err := WithTx(ctx, querier, func(tx *Tx) error {
+		var err error
+		company, err = addCompany(ctx, tx, name, members, metadata)
+		return err
+	})
+	return company, err
+}
 
-	tx, err := s.db.Begin()
+func addCompany(ctx context.Context, querier Querier, name string, members []entity.Membership, metadata entity.Metadata) (entity.Company, error) {
+	var company entity.Company
+	if metadata == nil {
+		metadata = entity.Metadata{}
+	}
+	metadataJSON, err := metadataArg(metadata)
 	if err != nil {
-		log.G(ctx).WithError(err).Error("failed to begin transaction")
+		log.G(ctx).WithError(err).Error("failed to marshal company metadata")
 		return company, ErrGenericDBFailure
 	}
-
-	if err := tx.QueryRowContext(ctx, insertCompany, name).Scan(&company.ID, &company.Name, &company.CreatedAt); err != nil {
-		tx.Rollback()
-		if err, ok := err.(*pq.Error); ok && err.Code == ErrUniqViolation && err.Constraint == "unq_name" {
+	if err := querier.QueryRowContext(ctx, insertCompany, name, metadataJSON).Scan(companyDest(&company)...); err != nil {
+		if code, constraint, _ := violation(err); code == ErrUniqViolation && constraint == "unq_name" {
 			return company, NewAlreadyExistsError("company", name)
 		}
 		log.G(ctx).WithError(err).Error("failed to insert company in DB")
 		return company, ErrGenericDBFailure
 	}
 
-	for k := range userIDs {
-		if err := addUserInCompany(ctx, tx, userIDs[k], company.ID); err != nil {
-			tx.Rollback()
+	insertedMembers := make([]entity.Membership, len(members))
+	for k := range members {
+		var err error
+		insertedMembers[k], err = addUserInCompany(ctx, querier, members[k].UserID, company.ID, members[k].Role)
+		if err != nil {
 			return company, err
 		}
 	}
-	if err := tx.Commit(); err != nil {
-		log.G(ctx).WithError(err).Error("failed to commit transaction")
-		return company, ErrGenericDBFailure
-	}
 
-	return company, nil
+	after := struct {
+		entity.Company
+		Members []entity.Membership `json:"members"`
+	}{company, insertedMembers}
+	return company, recordEvent(ctx, querier, entity.AuditActionCreate, "company", company.ID.String(), nil, after)
 }
 
-func (s *Company) DeleteByID(ctx context.Context, ID string) error {
-	filter := map[string]interface{}{"ID": ID}
-	querySuffix, parsedArgs := buildWhere(filter)
-	err := deleteOne(ctx, s.db, deleteCompany+querySuffix, parsedArgs)
-	if err == ErrNoRows {
-		return NewNotFoundError("company", ID)
+// ForEach calls fn for every company, ordered by name, until fn returns an error. The
+// members of the companies aren't loaded.
+func (s *Company) ForEach(ctx context.Context, querier Querier, filter Filter, fn func(entity.Company) error) error {
+	querier = reader(ctx, querier)
+	querySuffix, parsedArgs := filter.where()
+	rows, err := querier.QueryContext(ctx, selectCompany+querySuffix+" ORDER BY name", parsedArgs...)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to list companies in DB")
+		return ErrGenericDBFailure
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var company entity.Company
+		if err = rows.Scan(companyDest(&company)...); err != nil {
+			log.G(ctx).WithError(err).Error("failed to scan company in DB")
+			return ErrGenericDBFailure
+		}
+		if err = fn(company); err != nil {
+			return err
+		}
 	}
-	return err // Either nil or ErrGenericDBFailure
+
+	if err = rows.Err(); err != nil {
+		log.G(ctx).WithError(err).Error("failed to loop through companies list")
+		return ErrGenericDBFailure
+	}
+	return nil
 }
 
-func (s *Company) GetByID(ctx context.Context, ID string) (entity.Company, error) {
-	var company entity.Company
-	filter := map[string]interface{}{"id": ID}
-	querySuffix, parsedArgs := buildWhere(filter)
-	err := getOne(ctx, s.db, selectCompany+querySuffix, parsedArgs, &company.ID, &company.Name, &company.CreatedAt)
-	if err != nil {
+// DeleteByID soft deletes the company. It can be restored, along with its members, until it's purged.
+func (s *Company) DeleteByID(ctx context.Context, querier Querier, ID string) error {
+	return WithTx(ctx, querier, func(tx *Tx) error {
+		var before, after entity.Company
+		err := getOne(ctx, tx, selectCompanyForUpdate, []interface{}{ID}, companyDest(&before)...)
 		if err == ErrNoRows {
-			return company, NewNotFoundError("company", ID)
+			return NewNotFoundError("company", ID)
+		} else if err != nil {
+			return err
+		}
+		if err := getOne(ctx, tx, deleteCompany, []interface{}{ID}, companyDest(&after)...); err != nil {
+			return err
 		}
+		return recordEvent(ctx, tx, entity.AuditActionDelete, "company", ID, before, after)
+	})
+}
+
+// GetByID returns the company and its members. includeDeleted applies to both.
+func (s *Company) GetByID(ctx context.Context, querier Querier, ID string, includeDeleted bool) (entity.Company, error) {
+	querier = reader(ctx, querier)
+	company, err := lookupCompany(ctx, querier, ID, includeDeleted)
+	if err != nil {
 		return company, err
 	}
 
-	rows, err := s.db.QueryContext(ctx, selectCompanyUsers, ID)
+	rows, err := querier.QueryContext(ctx, selectCompanyUsers, ID, includeDeleted)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("failed to get company in DB")
 		return company, ErrGenericDBFailure
@@ -91,11 +149,16 @@ func (s *Company) GetByID(ctx context.Context, ID string) (entity.Company, error
 	defer rows.Close()
 
 	for rows.Next() {
-		var user entity.User
-		if err = rows.Scan(&user.ID, &user.Login, &user.Email, &user.Role, &user.CreatedAt); err != nil {
+		var sealed sealedUser
+		if err = rows.Scan(append(sealed.dest(), &sealed.CompanyRole)...); err != nil {
 			log.G(ctx).WithError(err).Error("failed to scan company users in DB")
 			return company, ErrGenericDBFailure
 		}
+		user, err := sealed.open(s.keyring)
+		if err != nil {
+			log.G(ctx).F("id", sealed.ID).WithError(err).Error("failed to decrypt company user")
+			return company, ErrGenericDBFailure
+		}
 		company.Users = append(company.Users, user)
 	}
 
@@ -107,6 +170,75 @@ func (s *Company) GetByID(ctx context.Context, ID string) (entity.Company, error
 	return company, nil
 }
 
+// Update applies the non nil fields of the patch. If version isn't zero, the update only
+// succeeds if it matches the current version of the company.
+func (s *Company) Update(ctx context.Context, querier Querier, ID string, patch entity.CompanyPatch, version int) (entity.Company, error) {
+	var before, after entity.Company
+	err := WithTx(ctx, querier, func(tx *Tx) error {
+		err := getOne(ctx, tx, selectCompanyForUpdate, []interface{}{ID}, companyDest(&before)...)
+		if err == ErrNoRows {
+			return NewNotFoundError("company", ID)
+		} else if err != nil {
+			return err
+		}
+		if version != 0 && version != before.Version {
+			return NewVersionConflictError("company", ID, before.Version)
+		}
+
+		metadata, err := metadataArg(patch.Metadata)
+		if err != nil {
+			log.G(ctx).WithError(err).Error("failed to marshal company metadata")
+			return ErrGenericDBFailure
+		}
+		err = tx.QueryRowContext(ctx, updateCompany, ID, patch.Name, metadata).Scan(companyDest(&after)...)
+		if err != nil {
+			if code, constraint, _ := violation(err); code == ErrUniqViolation && constraint == "unq_name" {
+				return NewAlreadyExistsError("company", *patch.Name)
+			}
+			log.G(ctx).WithError(err).Error("failed to update company in DB")
+			return ErrGenericDBFailure
+		}
+		return recordEvent(ctx, tx, entity.AuditActionUpdate, "company", ID, before, after)
+	})
+	return after, err
+}
+
+func (s *Company) Restore(ctx context.Context, querier Querier, ID string) (entity.Company, error) {
+	var before, after entity.Company
+	err := WithTx(ctx, querier, func(tx *Tx) error {
+		err := getOne(ctx, tx, selectDeletedCompanyForUpdate, []interface{}{ID}, companyDest(&before)...)
+		if err == ErrNoRows {
+			return NewNotFoundError("deleted company", ID)
+		} else if err != nil {
+			return err
+		}
+		if err := getOne(ctx, tx, restoreCompany, []interface{}{ID}, companyDest(&after)...); err != nil {
+			return err
+		}
+		return recordEvent(ctx, tx, entity.AuditActionRestore, "company", ID, before, after)
+	})
+	return after, err
+}
+
+// Purge hard deletes the companies that have been soft deleted for longer than the retention.
+// Their children become root companies, see detachPurgedChildren.
+func (s *Company) Purge(ctx context.Context, querier Querier, retention time.Duration) (int64, error) {
+	var n int64
+	err := WithTx(ctx, querier, func(tx *Tx) error {
+		if err := detachPurgedChildren(ctx, tx, retention); err != nil {
+			return err
+		}
+		var err error
+		n, err = purge(ctx, tx, purgeCompanies, "company", retention, func(rows *sql.Rows) (string, interface{}, error) {
+			var company entity.Company
+			err := rows.Scan(companyDest(&company)...)
+			return company.ID.String(), company, err
+		})
+		return err
+	})
+	return n, err
+}
+
 func (s *Company) DeleteAll() error {
 	if _, err := s.db.Exec(deleteAllCompanies); err != nil {
 		return errors.Wrap(err, "failed to truncate companies table")
@@ -114,24 +246,9 @@ func (s *Company) DeleteAll() error {
 	return nil
 }
 
-func addUserInCompany(ctx context.Context, querier Querier, userID, companyID uuid.UUID) error {
-	_, err := querier.ExecContext(ctx, insertUserInCompany, companyID, userID)
-	if err == nil {
-		return nil
-	}
-
-	if err, ok := err.(*pq.Error); ok {
-		if err.Code == ErrFKViolation && err.Constraint == "users_companies_user_id_fkey" {
-			return NewNotFoundError("user", userID.String())
-		} else if err.Code == ErrFKViolation && err.Constraint == "users_companies_company_id_fkey" {
-			return NewNotFoundError("company", companyID.String())
-		} else if err.Code == ErrUniqViolation && err.Constraint == "unq_set" {
-			return NewDupUserInCompanyError(userID.String())
-		}
-	}
-
-	log.G(ctx).WithError(err).Error("failed to insert user in company")
-	return ErrGenericDBFailure
+func (s *Company) Search(ctx context.Context, querier Querier, q entity.SearchQuery) ([]entity.SearchResult, error) {
+	querier = reader(ctx, querier)
+	return search(ctx, querier, entity.SearchKindCompany, searchCompanies, q)
 }
 
 type DupUserInCompanyError struct {
@@ -10,40 +10,246 @@ CREATE TABLE IF NOT EXISTS companies (
     CONSTRAINT unq_name UNIQUE(name)
 );
 
+ALTER TABLE companies ADD COLUMN IF NOT EXISTS updated_at timestamp WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL;
+ALTER TABLE companies ADD COLUMN IF NOT EXISTS version INTEGER DEFAULT 1 NOT NULL;
+ALTER TABLE companies ADD COLUMN IF NOT EXISTS deleted_at timestamp WITHOUT TIME ZONE;
+ALTER TABLE companies ADD COLUMN IF NOT EXISTS parent_id UUID REFERENCES companies(id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS idx_companies_parent_id ON companies (parent_id);
+
+-- The attributes of the integrations, validated against the schema of the companies. The GIN
+-- index serves the containment filters of the listings.
+ALTER TABLE companies ADD COLUMN IF NOT EXISTS metadata JSONB DEFAULT '{}' NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_companies_metadata ON companies USING GIN (metadata jsonb_path_ops);
+
 CREATE TABLE IF NOT EXISTS users_companies (
 	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     company_id UUID references companies(id) ON DELETE CASCADE,
 	user_id UUID references users(id) ON DELETE CASCADE,
     CONSTRAINT unq_set UNIQUE(company_id,user_id)
-)`
+);
+
+ALTER TABLE users_companies ADD COLUMN IF NOT EXISTS role TEXT DEFAULT 'member' NOT NULL
+	CONSTRAINT chk_role CHECK (role IN ('owner', 'admin', 'member'));
+ALTER TABLE users_companies ADD COLUMN IF NOT EXISTS created_at timestamp WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_users_companies_user_id ON users_companies (user_id);
+
+-- The timestamps were stored in UTC without time zone, they are converted once.
+DO $$
+BEGIN
+	IF (SELECT data_type FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'companies' AND column_name = 'created_at') = 'timestamp without time zone' THEN
+		ALTER TABLE companies
+			ALTER COLUMN created_at TYPE timestamptz USING created_at AT TIME ZONE 'UTC',
+			ALTER COLUMN updated_at TYPE timestamptz USING updated_at AT TIME ZONE 'UTC',
+			ALTER COLUMN deleted_at TYPE timestamptz USING deleted_at AT TIME ZONE 'UTC';
+		ALTER TABLE users_companies
+			ALTER COLUMN created_at TYPE timestamptz USING created_at AT TIME ZONE 'UTC';
+	END IF;
+END
+$$;
+
+-- set_updated_at is created along with the users table.
+DROP TRIGGER IF EXISTS trg_companies_updated_at ON companies;
+CREATE TRIGGER trg_companies_updated_at BEFORE UPDATE ON companies FOR EACH ROW
+	WHEN ((OLD.name, OLD.version, OLD.deleted_at, OLD.parent_id, OLD.metadata)
+		IS DISTINCT FROM (NEW.name, NEW.version, NEW.deleted_at, NEW.parent_id, NEW.metadata))
+	EXECUTE PROCEDURE set_updated_at();
+CREATE INDEX IF NOT EXISTS idx_companies_updated_at ON companies (updated_at);
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX IF NOT EXISTS idx_companies_fts ON companies USING GIN (to_tsvector('simple', name));
+CREATE INDEX IF NOT EXISTS idx_companies_name_trgm ON companies USING GIN (name gin_trgm_ops)`
+
+// companyColumns must be kept in sync with companyDest
+const companyColumns = `id, name, created_at, updated_at, version, deleted_at, parent_id, metadata`
 
 const deleteAllCompanies = `
 TRUNCATE TABLE companies CASCADE
 `
 
 const insertCompany = `
-INSERT INTO companies (name)
-VALUES ($1)
-RETURNING id, name, created_at
-`
+INSERT INTO companies (name, metadata)
+VALUES ($1, $2)
+RETURNING ` + companyColumns
 
 const selectCompany = `
-SELECT id, name, created_at FROM companies`
+SELECT ` + companyColumns + ` FROM companies`
 
+// Memberships are kept when a company is soft deleted, so that restoring it is lossless.
 const deleteCompany = `
-DELETE FROM companies
+UPDATE companies SET deleted_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+WHERE id = $1
+RETURNING ` + companyColumns
+
+const restoreCompany = `
+UPDATE companies SET deleted_at = NULL, updated_at = CURRENT_TIMESTAMP
+WHERE id = $1
+RETURNING ` + companyColumns
+
+// The children of the companies purged with the retention $1, in seconds, which aren't purged
+// themselves.
+const selectPurgedCompanyChildrenForUpdate = `
+SELECT ` + companyColumns + ` FROM companies
+WHERE parent_id IN (SELECT id FROM companies WHERE deleted_at < CURRENT_TIMESTAMP - make_interval(secs => $1))
+AND (deleted_at IS NULL OR deleted_at >= CURRENT_TIMESTAMP - make_interval(secs => $1))
+ORDER BY name, id
+FOR UPDATE`
+
+const purgeCompanies = `
+DELETE FROM companies WHERE deleted_at < CURRENT_TIMESTAMP - make_interval(secs => $1)
+RETURNING ` + companyColumns
+
+// The row locks serialize the concurrent mutations of a company, which are audited with
+// the snapshot read by these queries.
+const selectCompanyForUpdate = `
+SELECT ` + companyColumns + ` FROM companies WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`
+
+const selectDeletedCompanyForUpdate = `
+SELECT ` + companyColumns + ` FROM companies WHERE id = $1 AND deleted_at IS NOT NULL FOR UPDATE`
+
+// The metadata $3 is replaced as a whole.
+const updateCompany = `
+UPDATE companies SET
+	name = COALESCE($2, name),
+	metadata = COALESCE($3, metadata),
+	updated_at = CURRENT_TIMESTAMP,
+	version = version + 1
+WHERE id = $1
+RETURNING ` + companyColumns
+
+// The company is moved along with its subtree. $2 is the new parent, NULL for a root company.
+const updateCompanyParent = `
+UPDATE companies SET
+	parent_id = $2,
+	updated_at = CURRENT_TIMESTAMP,
+	version = version + 1
+WHERE id = $1
+RETURNING ` + companyColumns
+
+// The chain of the company up to its root is locked, so that the concurrent moves can't make
+// a cycle: the moves whose chains overlap deadlock, and the retried one sees the other.
+const selectCompanyChainForUpdate = `
+SELECT id FROM companies WHERE id IN (
+	WITH RECURSIVE chain (id, parent_id) AS (
+		SELECT id, parent_id FROM companies WHERE id = $1
+		UNION
+		SELECT c.id, c.parent_id FROM companies c JOIN chain ON c.id = chain.parent_id
+	)
+	SELECT id FROM chain
+) FOR UPDATE`
+
+// The ancestors of the company, its parent first. $2 tells whether soft deleted companies must
+// be listed, the chain stops at the first one otherwise.
+const selectCompanyAncestors = `
+WITH RECURSIVE ancestors AS (
+	SELECT p.id, p.name, p.created_at, p.updated_at, p.version, p.deleted_at, p.parent_id, p.metadata, 1 AS depth
+	FROM companies c JOIN companies p ON p.id = c.parent_id
+	WHERE c.id = $1 AND ($2 OR p.deleted_at IS NULL)
+	UNION ALL
+	SELECT p.id, p.name, p.created_at, p.updated_at, p.version, p.deleted_at, p.parent_id, p.metadata, a.depth + 1
+	FROM ancestors a JOIN companies p ON p.id = a.parent_id
+	WHERE $2 OR p.deleted_at IS NULL
+)
+SELECT ` + companyColumns + ` FROM ancestors ORDER BY depth
 `
 
+// The descendants of the company, level by level. $2 tells whether soft deleted companies must
+// be listed, their subtrees are hidden otherwise.
+const selectCompanyDescendants = `
+WITH RECURSIVE descendants AS (
+	SELECT id, name, created_at, updated_at, version, deleted_at, parent_id, metadata, 1 AS depth
+	FROM companies
+	WHERE parent_id = $1 AND ($2 OR deleted_at IS NULL)
+	UNION ALL
+	SELECT c.id, c.name, c.created_at, c.updated_at, c.version, c.deleted_at, c.parent_id, c.metadata, d.depth + 1
+	FROM descendants d JOIN companies c ON c.parent_id = d.id
+	WHERE $2 OR c.deleted_at IS NULL
+)
+SELECT ` + companyColumns + ` FROM descendants ORDER BY depth, name
+`
+
+// The members of the company and of its ancestors, the nearest first. $2 tells whether soft
+// deleted companies and users must be listed.
+const selectCompanyEffectiveUsers = `
+WITH RECURSIVE chain AS (
+	SELECT id, parent_id, 0 AS depth FROM companies WHERE id = $1
+	UNION ALL
+	SELECT c.id, c.parent_id, chain.depth + 1
+	FROM chain JOIN companies c ON c.id = chain.parent_id
+	WHERE $2 OR c.deleted_at IS NULL
+)
+SELECT u.id, u.login, u.email, u.pii, u.data_key, u.master_key_id, u.role, u.created_at, u.updated_at, u.version, u.deleted_at, u.erased_at, u.metadata,
+	uc.role, uc.company_id
+FROM chain
+JOIN users_companies uc ON uc.company_id = chain.id
+JOIN users u ON uc.user_id = u.id
+WHERE $2 OR u.deleted_at IS NULL
+ORDER BY chain.depth, uc.created_at
+`
+
+// membershipColumns must be kept in sync with membershipDest
+const membershipColumns = `company_id, user_id, role, created_at`
+
+// Soft deleted users can't join a company, in which case no row is inserted.
 const insertUserInCompany = `
-INSERT INTO users_companies (company_id, user_id)
-VALUES ($1, $2)
+INSERT INTO users_companies (company_id, user_id, role)
+SELECT $1, id, $3 FROM users WHERE id = $2 AND deleted_at IS NULL
+RETURNING ` + membershipColumns
+
+const selectMembershipForUpdate = `
+SELECT ` + membershipColumns + ` FROM users_companies WHERE company_id = $1 AND user_id = $2 FOR UPDATE`
+
+const updateMembership = `
+UPDATE users_companies SET role = $3
+WHERE company_id = $1 AND user_id = $2
+RETURNING ` + membershipColumns
+
+const deleteMembership = `
+DELETE FROM users_companies
+WHERE company_id = $1 AND user_id = $2
+RETURNING ` + membershipColumns
+
+// Memberships of soft deleted companies are hidden.
+const selectUserMemberships = `
+SELECT uc.company_id, uc.user_id, uc.role, uc.created_at,
+	c.id, c.name, c.created_at, c.updated_at, c.version, c.deleted_at, c.parent_id, c.metadata
+FROM users_companies uc
+JOIN companies c ON uc.company_id = c.id
+WHERE uc.user_id = $1 AND c.deleted_at IS NULL
+ORDER BY c.name
+`
+
+// Memberships are exported with the company name and the user login, as expected by the import.
+const selectMembershipsExport = `
+SELECT c.name, u.login, uc.role FROM users_companies uc
+JOIN companies c ON uc.company_id = c.id
+JOIN users u ON uc.user_id = u.id
+WHERE c.deleted_at IS NULL AND u.deleted_at IS NULL
+ORDER BY c.name, u.login
 `
 
+const selectUserExists = `
+SELECT id FROM users WHERE id = $1 AND deleted_at IS NULL
+`
+
+// $2 tells whether soft deleted users must be listed.
 const selectCompanyUsers = `
-SELECT u.id, u.login, u.email, u.role, u.created_at FROM companies c
+SELECT u.id, u.login, u.email, u.pii, u.data_key, u.master_key_id, u.role, u.created_at, u.updated_at, u.version, u.deleted_at, u.erased_at, u.metadata,
+	uc.role
+FROM companies c
 JOIN users_companies uc ON uc.company_id = c.id
 JOIN users u ON uc.user_id = u.id
-WHERE c.id = $1
+WHERE c.id = $1 AND ($2 OR u.deleted_at IS NULL)
+`
+
+const searchCompanies = `
+SELECT id, name,
+	ts_headline('simple', name, query, 'StartSel=<mark>, StopSel=</mark>, HighlightAll=true'),
+	ts_rank(to_tsvector('simple', name), query) + similarity(name, $1) AS rank
+FROM companies, plainto_tsquery('simple', $1) query
+WHERE deleted_at IS NULL AND (to_tsvector('simple', name) @@ query OR name % $1)
+ORDER BY rank DESC
+LIMIT $2
 `
 
 // docker exec -i -t e32a07615cec psql -h localhost -U myuser --dbname=myuser
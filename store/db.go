@@ -0,0 +1,241 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite3_goapp"
+)
+
+// DB is the connection pool of the stores. The queries of the stores are written for
+// Postgres, DB translates them for the other drivers. DB and its transactions instrument the
+// queries, see RegisterMetrics and LogSlowQueries.
+type DB struct {
+	*sql.DB
+	driverName  string
+	queries     sync.Map // Translated queries, keyed by their Postgres version
+	instr       *instrumentation
+	retryPolicy RetryPolicy
+	changes     ChangeHub // The listeners of the changes, unless the driver notifies them
+
+	replicas    []*replica
+	nextReplica uint32 // Accessed atomically
+	stopChecks  chan struct{}
+}
+
+// NewDB wraps a connection pool opened with one of the Driver* drivers.
+func NewDB(driverName string, db *sql.DB) *DB {
+	return &DB{DB: db, driverName: driverName, instr: &instrumentation{}, retryPolicy: DefaultRetryPolicy}
+}
+
+var (
+	placeholders = regexp.MustCompile(`\$(\d+)`)
+	forUpdate    = regexp.MustCompile(`\s+FOR UPDATE`)
+	jsonContains = regexp.MustCompile(`(\w+) @> (\$\d+)::jsonb`)
+)
+
+// translate returns the query for the driver of the DB. The queries which can't be translated
+// with the common rules below have a hand written equivalent in sqliteQueries.
+func (db *DB) translate(query string) string {
+	if db.driverName != DriverSQLite {
+		return query
+	}
+	if translated, ok := db.queries.Load(query); ok {
+		return translated.(string)
+	}
+
+	translated, ok := sqliteQueries[query]
+	if !ok {
+		translated = query
+	}
+	// The JSON containment is done by json_contains, see MetadataContains.
+	translated = jsonContains.ReplaceAllString(translated, "json_contains($1, $2)")
+	// SQLite binds $1 by order of appearance, ?1 is the positional parameter.
+	translated = placeholders.ReplaceAllString(translated, "?$1")
+	// Writers are serialized by SQLite, there is no row lock.
+	translated = forUpdate.ReplaceAllString(translated, "")
+	// CURRENT_TIMESTAMP has a one second precision in SQLite.
+	translated = strings.Replace(translated, "CURRENT_TIMESTAMP", sqliteNow, -1)
+
+	db.queries.Store(query, translated)
+	return translated
+}
+
+// translateArgs formats the times given to SQLite like the stored timestamps, which SQLite
+// compares as text.
+func (db *DB) translateArgs(args []interface{}) []interface{} {
+	if db.driverName != DriverSQLite {
+		return args
+	}
+	var translated []interface{}
+	for k, arg := range args {
+		if t, ok := arg.(time.Time); ok {
+			if translated == nil {
+				translated = append([]interface{}(nil), args...)
+			}
+			translated[k] = t.UTC().Format(sqliteTimeFormat)
+		}
+	}
+	if translated == nil {
+		return args
+	}
+	return translated
+}
+
+func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	result, err := db.DB.Exec(db.translate(query), db.translateArgs(args)...)
+	db.observe(context.Background(), query, args, start, err)
+	return result, err
+}
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	result, err := db.DB.ExecContext(ctx, db.translate(query), db.translateArgs(args)...)
+	db.observe(ctx, query, args, start, err)
+	return result, err
+}
+
+// QueryContext retries the idempotent queries failing with a transient error.
+func (db *DB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	var rows *sql.Rows
+	err := db.retry(ctx, queryName(query), func() (bool, error) {
+		start := time.Now()
+		var err error
+		rows, err = db.DB.QueryContext(ctx, db.translate(query), db.translateArgs(args)...)
+		db.observe(ctx, query, args, start, err)
+		return idempotent(query) && isTransient(err), err
+	})
+	return rows, err
+}
+
+// QueryRowContext retries the idempotent queries failing with a transient error, when the
+// row is scanned.
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *Row {
+	row := &Row{ctx: ctx, db: db, query: query, args: args, run: func() (*sql.Rows, error) {
+		return db.DB.QueryContext(ctx, db.translate(query), db.translateArgs(args)...)
+	}}
+	row.start = time.Now()
+	row.rows, row.err = row.run()
+	return row
+}
+
+func (db *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
+	tx, err := db.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, db: db}, nil
+}
+
+// WithTx implements Transactor, see the WithTx function.
+func (db *DB) WithTx(ctx context.Context, fn func(tx Querier) error) error {
+	return WithTx(ctx, db, func(tx *Tx) error {
+		return fn(tx)
+	})
+}
+
+// Tx is a transaction of a DB, its queries are translated like those of the DB. They aren't
+// retried on their own, WithTx retries the whole transaction.
+type Tx struct {
+	*sql.Tx
+	db        *DB
+	transient bool     // Set once a query fails with a transient error
+	changes   []Change // Published once committed, unless the driver notifies them
+}
+
+// note records whether the transaction failed because of a transient error.
+func (tx *Tx) note(err error) {
+	if isTransient(err) {
+		tx.transient = true
+	}
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	result, err := tx.Tx.ExecContext(ctx, tx.db.translate(query), tx.db.translateArgs(args)...)
+	tx.db.observe(ctx, query, args, start, err)
+	tx.note(err)
+	return result, err
+}
+
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := tx.Tx.QueryContext(ctx, tx.db.translate(query), tx.db.translateArgs(args)...)
+	tx.db.observe(ctx, query, args, start, err)
+	tx.note(err)
+	return rows, err
+}
+
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *Row {
+	row := &Row{ctx: ctx, db: tx.db, tx: tx, query: query, args: args, run: func() (*sql.Rows, error) {
+		return tx.Tx.QueryContext(ctx, tx.db.translate(query), tx.db.translateArgs(args)...)
+	}}
+	row.start = time.Now()
+	row.rows, row.err = row.run()
+	return row
+}
+
+// Row is the result of QueryRowContext, like sql.Row. The query is instrumented once scanned,
+// since the errors of some drivers are only reported by the first row.
+type Row struct {
+	ctx   context.Context
+	db    *DB
+	tx    *Tx // Nil outside of a transaction
+	query string
+	args  []interface{}
+	run   func() (*sql.Rows, error)
+
+	start time.Time
+	rows  *sql.Rows
+	err   error
+}
+
+// Scan copies the columns of the first row into dest, it returns ErrNoRows if there is none.
+func (r *Row) Scan(dest ...interface{}) error {
+	attempted := false
+	return r.db.retry(r.ctx, queryName(r.query), func() (bool, error) {
+		if attempted {
+			r.start = time.Now()
+			r.rows, r.err = r.run()
+		}
+		attempted = true
+
+		err := r.scan(dest...)
+		if err == sql.ErrNoRows {
+			r.db.observe(r.ctx, r.query, r.args, r.start, nil)
+		} else {
+			r.db.observe(r.ctx, r.query, r.args, r.start, err)
+		}
+		if r.tx != nil {
+			r.tx.note(err)
+			return false, err
+		}
+		return idempotent(r.query) && isTransient(err), err
+	})
+}
+
+func (r *Row) scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	defer r.rows.Close()
+
+	if !r.rows.Next() {
+		if err := r.rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	if err := r.rows.Scan(dest...); err != nil {
+		return err
+	}
+	return r.rows.Close()
+}
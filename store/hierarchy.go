@@ -0,0 +1,209 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+)
+
+// Move makes parentID the parent of the company, or makes it a root company if parentID is
+// empty. Its subtree moves along. It returns a CycleError if the parent is the company or one
+// of its descendants. If version isn't zero, the move only succeeds if it matches the current
+// version of the company.
+func (s *Company) Move(ctx context.Context, querier Querier, ID, parentID string, version int) (entity.Company, error) {
+	var before, after entity.Company
+	err := WithTx(ctx, querier, func(tx *Tx) error {
+		err := getOne(ctx, tx, selectCompanyForUpdate, []interface{}{ID}, companyDest(&before)...)
+		if err == ErrNoRows {
+			return NewNotFoundError("company", ID)
+		} else if err != nil {
+			return err
+		}
+		if version != 0 && version != before.Version {
+			return NewVersionConflictError("company", ID, before.Version)
+		}
+
+		var parent *uuid.UUID
+		if parentID != "" {
+			var p entity.Company
+			err := getOne(ctx, tx, selectCompanyForUpdate, []interface{}{parentID}, companyDest(&p)...)
+			if err == ErrNoRows {
+				return NewNotFoundError("parent company", parentID)
+			} else if err != nil {
+				return err
+			}
+			chain, err := listIDs(ctx, tx, selectCompanyChainForUpdate, p.ID)
+			if err != nil {
+				return err
+			}
+			for _, id := range chain {
+				if id == before.ID {
+					return NewCycleError(ID, parentID)
+				}
+			}
+			parent = &p.ID
+		}
+
+		if err := getOne(ctx, tx, updateCompanyParent, []interface{}{ID, parent}, companyDest(&after)...); err != nil {
+			return err
+		}
+		return recordEvent(ctx, tx, entity.AuditActionMove, "company", ID, before, after)
+	})
+	return after, err
+}
+
+// detachPurgedChildren makes root companies of the children of the companies about to be
+// purged, unless they are purged as well, and audits their moves. The foreign key would set
+// their parent to NULL without a trace.
+func detachPurgedChildren(ctx context.Context, tx *Tx, retention time.Duration) error {
+	children, err := listCompanies(ctx, tx, selectPurgedCompanyChildrenForUpdate, retention.Seconds())
+	if err != nil {
+		return err
+	}
+	for _, before := range children {
+		var after entity.Company
+		if err := getOne(ctx, tx, updateCompanyParent, []interface{}{before.ID, nil}, companyDest(&after)...); err != nil {
+			return err
+		}
+		if err := recordEvent(ctx, tx, entity.AuditActionMove, "company", before.ID.String(), before, after); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ancestors returns the ancestors of the company, its parent first. Unless includeDeleted is
+// true, the company must not be soft deleted and the ancestors stop at the first soft deleted
+// one.
+func (s *Company) Ancestors(ctx context.Context, querier Querier, ID string, includeDeleted bool) ([]entity.Company, error) {
+	querier = reader(ctx, querier)
+	if _, err := lookupCompany(ctx, querier, ID, includeDeleted); err != nil {
+		return nil, err
+	}
+	return listCompanies(ctx, querier, selectCompanyAncestors, ID, includeDeleted)
+}
+
+// Descendants returns the descendants of the company level by level, each level ordered by
+// name. Unless includeDeleted is true, the company must not be soft deleted and the subtrees of
+// the soft deleted descendants are left out.
+func (s *Company) Descendants(ctx context.Context, querier Querier, ID string, includeDeleted bool) ([]entity.Company, error) {
+	querier = reader(ctx, querier)
+	if _, err := lookupCompany(ctx, querier, ID, includeDeleted); err != nil {
+		return nil, err
+	}
+	return listCompanies(ctx, querier, selectCompanyDescendants, ID, includeDeleted)
+}
+
+// EffectiveMembers returns the members of the company and the ones inherited from its
+// ancestors, the nearest first. includeDeleted applies to the companies and to the users.
+func (s *Company) EffectiveMembers(ctx context.Context, querier Querier, ID string, includeDeleted bool) ([]entity.EffectiveMember, error) {
+	querier = reader(ctx, querier)
+	company, err := lookupCompany(ctx, querier, ID, includeDeleted)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := querier.QueryContext(ctx, selectCompanyEffectiveUsers, ID, includeDeleted)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to select effective members in DB")
+		return nil, ErrGenericDBFailure
+	}
+	defer rows.Close()
+
+	members := []entity.EffectiveMember{}
+	seen := make(map[uuid.UUID]bool)
+	for rows.Next() {
+		var sealed sealedUser
+		var companyID uuid.UUID
+		if err = rows.Scan(append(sealed.dest(), &sealed.CompanyRole, &companyID)...); err != nil {
+			log.G(ctx).WithError(err).Error("failed to scan effective member in DB")
+			return nil, ErrGenericDBFailure
+		}
+		if seen[sealed.ID] {
+			continue // The nearest membership prevails
+		}
+		seen[sealed.ID] = true
+		user, err := sealed.open(s.keyring)
+		if err != nil {
+			log.G(ctx).F("id", sealed.ID).WithError(err).Error("failed to decrypt effective member")
+			return nil, ErrGenericDBFailure
+		}
+		member := entity.EffectiveMember{User: user}
+		if companyID != company.ID {
+			member.InheritedFrom = &companyID
+		}
+		members = append(members, member)
+	}
+	if err = rows.Err(); err != nil {
+		log.G(ctx).WithError(err).Error("failed to loop through effective members")
+		return nil, ErrGenericDBFailure
+	}
+	return members, nil
+}
+
+// lookupCompany returns the company, or a NotFoundError unless it exists and isn't soft
+// deleted when includeDeleted is false.
+func lookupCompany(ctx context.Context, querier Querier, ID string, includeDeleted bool) (entity.Company, error) {
+	filter := map[string]interface{}{"id": ID, "deleted_at": nil}
+	if includeDeleted {
+		delete(filter, "deleted_at")
+	}
+	querySuffix, parsedArgs := buildWhere(filter)
+	var company entity.Company
+	err := getOne(ctx, querier, selectCompany+querySuffix, parsedArgs, companyDest(&company)...)
+	if err == ErrNoRows {
+		return company, NewNotFoundError("company", ID)
+	}
+	return company, err
+}
+
+func listCompanies(ctx context.Context, querier Querier, query string, args ...interface{}) ([]entity.Company, error) {
+	rows, err := querier.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to select companies in DB")
+		return nil, ErrGenericDBFailure
+	}
+	defer rows.Close()
+
+	companies := []entity.Company{}
+	for rows.Next() {
+		var company entity.Company
+		if err := rows.Scan(companyDest(&company)...); err != nil {
+			log.G(ctx).WithError(err).Error("failed to scan company in DB")
+			return nil, ErrGenericDBFailure
+		}
+		companies = append(companies, company)
+	}
+	if err = rows.Err(); err != nil {
+		log.G(ctx).WithError(err).Error("failed to loop through companies")
+		return nil, ErrGenericDBFailure
+	}
+	return companies, nil
+}
+
+func listIDs(ctx context.Context, querier Querier, query string, args ...interface{}) ([]uuid.UUID, error) {
+	rows, err := querier.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to select IDs in DB")
+		return nil, ErrGenericDBFailure
+	}
+	defer rows.Close()
+
+	var IDs []uuid.UUID
+	for rows.Next() {
+		var ID uuid.UUID
+		if err := rows.Scan(&ID); err != nil {
+			log.G(ctx).WithError(err).Error("failed to scan ID in DB")
+			return nil, ErrGenericDBFailure
+		}
+		IDs = append(IDs, ID)
+	}
+	if err = rows.Err(); err != nil {
+		log.G(ctx).WithError(err).Error("failed to loop through IDs")
+		return nil, ErrGenericDBFailure
+	}
+	return IDs, nil
+}
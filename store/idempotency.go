@@ -0,0 +1,198 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/envelope"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// idempotencyBodyAdditionalData binds the sealed bodies of the responses to their column.
+var idempotencyBodyAdditionalData = []byte("idempotency_keys.body")
+
+// Idempotency stores the responses sealed with the keyring, they may hold personal data. Their
+// master keys must be kept until the idempotency keys expire.
+type Idempotency struct {
+	log     log.Logger
+	db      *DB
+	keyring *envelope.Keyring
+}
+
+func NewIdempotencyStore(log log.Logger, db *DB, keyring *envelope.Keyring) (*Idempotency, error) {
+	if _, err := db.Exec(createTableIdempotencyKeys); err != nil {
+		return nil, errors.Wrap(err, "failed to create idempotency_keys table")
+	}
+	return &Idempotency{log: log, db: db, keyring: keyring}, nil
+}
+
+// sealedResponse is the response of an idempotent request as stored, with its body sealed.
+type sealedResponse struct {
+	header, body []byte
+	dataKey      []byte
+	masterKeyID  sql.NullString // Not set for the bodies stored before the encryption
+}
+
+// idempotentRequestDest returns the scan destinations of the idempotencyColumns.
+func idempotentRequestDest(req *entity.IdempotentRequest, resp *sealedResponse) []interface{} {
+	return []interface{}{
+		&req.Actor, &req.Key, &req.Fingerprint, &req.StatusCode, &resp.header, &resp.body, &resp.dataKey, &resp.masterKeyID,
+		utcTime{&req.CreatedAt}, utcTime{&req.ExpiresAt},
+	}
+}
+
+// open returns the body of the response decrypted.
+func (r sealedResponse) open(keyring *envelope.Keyring) ([]byte, error) {
+	if !r.masterKeyID.Valid {
+		return r.body, nil
+	}
+	dataKey, err := keyring.Unwrap(r.masterKeyID.String, r.dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return dataKey.Open(r.body, idempotencyBodyAdditionalData)
+}
+
+// Begin takes the key of the actor for a request with the fingerprint, until the ttl expires.
+// started is false if the key was already taken, the request returned is the one which took it.
+// The key of a request still in progress after the lease is taken again. It returns a
+// NotFoundError if the key was released while it was being taken.
+func (s *Idempotency) Begin(ctx context.Context, querier Querier, actor, key, fingerprint string, ttl, lease time.Duration) (req entity.IdempotentRequest, started bool, err error) {
+	if _, err := querier.ExecContext(ctx, deleteExpiredIdempotencyKey, actor, key, lease.Seconds()); err != nil {
+		log.G(ctx).WithError(err).Error("failed to delete expired idempotency key in DB")
+		return req, false, ErrGenericDBFailure
+	}
+
+	var resp sealedResponse
+	err = getOne(ctx, querier, insertIdempotencyKey, []interface{}{actor, key, fingerprint, ttl.Seconds()}, idempotentRequestDest(&req, &resp)...)
+	if err == nil {
+		started = true
+	} else if err == ErrNoRows {
+		err = getOne(ctx, querier, selectIdempotencyKey, []interface{}{actor, key}, idempotentRequestDest(&req, &resp)...)
+		if err == ErrNoRows {
+			return req, false, NewNotFoundError("idempotency key", key) // Released meanwhile
+		}
+	}
+	if err != nil {
+		return req, false, err
+	}
+	if err := json.Unmarshal(resp.header, &req.Header); err != nil {
+		log.G(ctx).WithError(err).Error("failed to decode idempotent response header")
+		return req, false, ErrGenericDBFailure
+	}
+	if req.Body, err = resp.open(s.keyring); err != nil {
+		log.G(ctx).WithError(err).Error("failed to decrypt idempotent response body")
+		return req, false, ErrGenericDBFailure
+	}
+	return req, started, nil
+}
+
+// Complete stores the response of the request which took the key, it's replayed to the retries
+// until the key expires. The first response stored is kept, in case the lease of the request
+// ran out and a retry took the key.
+func (s *Idempotency) Complete(ctx context.Context, querier Querier, actor, key string, statusCode int, header map[string][]string, body []byte) error {
+	h, err := json.Marshal(header)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode idempotent response header")
+	}
+	dataKey, err := s.keyring.NewDataKey()
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to create idempotent response data key")
+		return ErrGenericDBFailure
+	}
+	sealed, err := dataKey.Seal(body, idempotencyBodyAdditionalData)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to encrypt idempotent response body")
+		return ErrGenericDBFailure
+	}
+	if _, err := querier.ExecContext(ctx, completeIdempotencyKey, actor, key, statusCode, string(h), sealed, dataKey.Wrapped, dataKey.MasterKeyID); err != nil {
+		log.G(ctx).WithError(err).Error("failed to update idempotency key in DB")
+		return ErrGenericDBFailure
+	}
+	return nil
+}
+
+// Release frees the key of a request in progress, so that it can be retried. It's meant for the
+// requests which failed without a response worth replaying.
+func (s *Idempotency) Release(ctx context.Context, querier Querier, actor, key string) error {
+	if _, err := querier.ExecContext(ctx, releaseIdempotencyKey, actor, key); err != nil {
+		log.G(ctx).WithError(err).Error("failed to delete idempotency key in DB")
+		return ErrGenericDBFailure
+	}
+	return nil
+}
+
+// eraseIdempotentResponses deletes the keys of the requests made by the actor, and of the
+// responses which mention ID, so that the personal data of an erased user isn't replayed. Their
+// requests run again if they're retried. It must be called within the transaction of the erasure.
+func eraseIdempotentResponses(ctx context.Context, querier Querier, keyring *envelope.Keyring, actor, ID string) error {
+	if _, err := querier.ExecContext(ctx, deleteActorIdempotencyKeys, actor); err != nil {
+		log.G(ctx).WithError(err).Error("failed to delete idempotency keys in DB")
+		return ErrGenericDBFailure
+	}
+
+	// The bodies are sealed, they're all opened: the keys expire within a day.
+	rows, err := querier.QueryContext(ctx, selectIdempotentResponsesForUpdate)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to select idempotent responses in DB")
+		return ErrGenericDBFailure
+	}
+	defer rows.Close()
+	var keys [][2]string
+	for rows.Next() {
+		var actor, key string
+		var resp sealedResponse
+		if err = rows.Scan(&actor, &key, &resp.body, &resp.dataKey, &resp.masterKeyID); err != nil {
+			log.G(ctx).WithError(err).Error("failed to scan idempotent response in DB")
+			return ErrGenericDBFailure
+		}
+		body, err := resp.open(keyring)
+		if err != nil {
+			log.G(ctx).F("actor", actor, "key", key).WithError(err).Error("failed to decrypt idempotent response body")
+			return ErrGenericDBFailure
+		}
+		if bytes.Contains(body, []byte(ID)) {
+			keys = append(keys, [2]string{actor, key})
+		}
+	}
+	if err = rows.Err(); err != nil {
+		log.G(ctx).WithError(err).Error("failed to loop through idempotent responses")
+		return ErrGenericDBFailure
+	}
+	rows.Close() // The connection is busy until the rows are closed
+
+	for _, key := range keys {
+		if _, err := querier.ExecContext(ctx, deleteIdempotencyKey, key[0], key[1]); err != nil {
+			log.G(ctx).WithError(err).Error("failed to delete idempotency key in DB")
+			return ErrGenericDBFailure
+		}
+	}
+	return nil
+}
+
+// Purge deletes the expired keys and returns how many were.
+func (s *Idempotency) Purge(ctx context.Context, querier Querier) (int64, error) {
+	res, err := querier.ExecContext(ctx, purgeIdempotencyKeys)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to purge idempotency keys in DB")
+		return 0, ErrGenericDBFailure
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to count purged idempotency keys")
+		return 0, ErrGenericDBFailure
+	}
+	return n, nil
+}
+
+func (s *Idempotency) DeleteAll() error {
+	if _, err := s.db.Exec(deleteAllIdempotencyKeys); err != nil {
+		return errors.Wrap(err, "failed to truncate idempotency_keys table")
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package store
+
+// The keys are scoped to the actor which made the request. status_code is 0 while the request
+// is in progress.
+const createTableIdempotencyKeys = `
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	actor TEXT NOT NULL,
+	idempotency_key TEXT NOT NULL,
+	fingerprint TEXT NOT NULL,
+	status_code INTEGER DEFAULT 0 NOT NULL,
+	header JSONB DEFAULT '{}' NOT NULL,
+	body BYTEA DEFAULT '' NOT NULL,
+	created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	expires_at timestamptz NOT NULL,
+	PRIMARY KEY (actor, idempotency_key)
+);
+
+-- The bodies of the responses hold personal data, they are sealed with a data key.
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS data_key BYTEA;
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS master_key_id TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys (expires_at)`
+
+// idempotencyColumns must be kept in sync with idempotentRequestDest
+const idempotencyColumns = `actor, idempotency_key, fingerprint, status_code, header, body, data_key, master_key_id, created_at, expires_at`
+
+// The key of an expired request, or of a request in progress for longer than the lease $3 in
+// seconds, is deleted before being taken again.
+const deleteExpiredIdempotencyKey = `
+DELETE FROM idempotency_keys WHERE actor = $1 AND idempotency_key = $2 AND (
+	expires_at <= CURRENT_TIMESTAMP OR
+	(status_code = 0 AND created_at <= CURRENT_TIMESTAMP - make_interval(secs => $3))
+)
+`
+
+// A key isn't inserted if it's taken, no row is returned then. $4 is the time to live of the
+// key, in seconds.
+const insertIdempotencyKey = `
+INSERT INTO idempotency_keys (actor, idempotency_key, fingerprint, expires_at)
+VALUES ($1, $2, $3, CURRENT_TIMESTAMP + make_interval(secs => $4))
+ON CONFLICT (actor, idempotency_key) DO NOTHING
+RETURNING ` + idempotencyColumns
+
+const selectIdempotencyKey = `
+SELECT ` + idempotencyColumns + ` FROM idempotency_keys WHERE actor = $1 AND idempotency_key = $2
+`
+
+const completeIdempotencyKey = `
+UPDATE idempotency_keys SET status_code = $3, header = $4, body = $5, data_key = $6, master_key_id = $7
+WHERE actor = $1 AND idempotency_key = $2 AND status_code = 0
+`
+
+// Only the requests in progress are released, a response is kept once stored.
+const releaseIdempotencyKey = `
+DELETE FROM idempotency_keys WHERE actor = $1 AND idempotency_key = $2 AND status_code = 0
+`
+
+const purgeIdempotencyKeys = `
+DELETE FROM idempotency_keys WHERE expires_at <= CURRENT_TIMESTAMP
+`
+
+// The responses of the requests made by an erased user, or which mention it, are deleted. See
+// eraseIdempotentResponses.
+const deleteActorIdempotencyKeys = `
+DELETE FROM idempotency_keys WHERE actor = $1
+`
+
+const selectIdempotentResponsesForUpdate = `
+SELECT actor, idempotency_key, body, data_key, master_key_id FROM idempotency_keys WHERE status_code <> 0
+FOR UPDATE`
+
+const deleteIdempotencyKey = `
+DELETE FROM idempotency_keys WHERE actor = $1 AND idempotency_key = $2
+`
+
+const deleteAllIdempotencyKeys = `
+TRUNCATE TABLE idempotency_keys
+`
@@ -0,0 +1,136 @@
+package store
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/envelope"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// Importer bulk imports users, companies and memberships. Imported records are audited just
+// like the ones created through the API.
+type Importer struct {
+	log     log.Logger
+	db      *DB
+	keyring *envelope.Keyring // Encrypts the users, like the user store
+}
+
+func NewImporter(log log.Logger, db *DB, keyring *envelope.Keyring) *Importer {
+	return &Importer{log: log, db: db, keyring: keyring}
+}
+
+// Import inserts the rows within a savepoint. Every row is tried, so that the report lists all
+// the failing rows, but the savepoint is only kept if it isn't a dry run and either the mode is
+// best effort or no row failed. Passwords of the users must already be hashed.
+func (s *Importer) Import(ctx context.Context, querier Querier, opts entity.ImportOptions, rows []entity.ImportRow) (entity.ImportReport, error) {
+	report := entity.ImportReport{
+		Kind:   opts.Kind,
+		Mode:   opts.Mode,
+		DryRun: opts.DryRun,
+		Total:  len(rows),
+		Errors: []entity.ImportError{},
+	}
+
+	// The savepoint rolls the import back without the enclosing transaction of the querier.
+	err := WithTx(ctx, querier, func(tx *Tx) error {
+		// The transaction may be retried
+		report.Imported, report.Failed, report.Errors = 0, 0, []entity.ImportError{}
+		if _, err := tx.ExecContext(ctx, savepointImport); err != nil {
+			log.G(ctx).WithError(err).Error("failed to create import savepoint")
+			return ErrGenericDBFailure
+		}
+
+		for _, row := range rows {
+			rowErr := row.Err
+			if rowErr == nil {
+				var err error
+				if rowErr, err = s.importRow(ctx, tx, row); err != nil {
+					return err
+				}
+			}
+			if rowErr != nil {
+				report.Failed++
+				report.Errors = append(report.Errors, entity.ImportError{Row: row.Row, Message: rowErr.Error()})
+				continue
+			}
+			report.Imported++
+		}
+
+		report.Committed = !opts.DryRun && (opts.Mode != entity.ImportModeAtomic || report.Failed == 0)
+		if !report.Committed {
+			if _, err := tx.ExecContext(ctx, rollbackToSavepointImport); err != nil {
+				log.G(ctx).WithError(err).Error("failed to roll back import")
+				return ErrGenericDBFailure
+			}
+		}
+		if _, err := tx.ExecContext(ctx, releaseSavepointImport); err != nil {
+			log.G(ctx).WithError(err).Error("failed to release import savepoint")
+			return ErrGenericDBFailure
+		}
+		return nil
+	})
+	if err != nil {
+		report.Committed = false
+		return report, err
+	}
+	return report, nil
+}
+
+// importRow returns the error of the row in rowErr, err is only set when the transaction
+// can't be used anymore.
+func (s *Importer) importRow(ctx context.Context, tx *Tx, row entity.ImportRow) (rowErr error, err error) {
+	if _, err := tx.ExecContext(ctx, savepointImportRow); err != nil {
+		log.G(ctx).WithError(err).Error("failed to create import savepoint")
+		return nil, ErrGenericDBFailure
+	}
+
+	switch {
+	case row.User != nil:
+		_, rowErr = addUser(ctx, tx, s.keyring, row.User.Login, row.User.Password, row.User.Email, row.User.Role, row.User.Metadata)
+	case row.Company != nil:
+		_, rowErr = addCompany(ctx, tx, row.Company.Name, nil, row.Company.Metadata)
+	case row.Membership != nil:
+		rowErr = importMembership(ctx, tx, *row.Membership)
+	default:
+		rowErr = errors.New("empty row")
+	}
+
+	if rowErr != nil {
+		if _, err := tx.ExecContext(ctx, rollbackToSavepointImportRow); err != nil {
+			log.G(ctx).WithError(err).Error("failed to roll back to import savepoint")
+			return nil, ErrGenericDBFailure
+		}
+		return rowErr, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, releaseSavepointImportRow); err != nil {
+		log.G(ctx).WithError(err).Error("failed to release import savepoint")
+		return nil, ErrGenericDBFailure
+	}
+	return nil, nil
+}
+
+func importMembership(ctx context.Context, querier Querier, m entity.ImportMembership) error {
+	var companyID, userID uuid.UUID
+	err := getOne(ctx, querier, selectCompanyIDByName, []interface{}{m.Company}, &companyID)
+	if err == ErrNoRows {
+		return NewNotFoundError("company", m.Company)
+	} else if err != nil {
+		return err
+	}
+	err = getOne(ctx, querier, selectUserIDByLogin, []interface{}{m.User}, &userID)
+	if err == ErrNoRows {
+		return NewNotFoundError("user", m.User)
+	} else if err != nil {
+		return err
+	}
+
+	membership, err := addUserInCompany(ctx, querier, userID, companyID, m.Role)
+	if err != nil {
+		return err
+	}
+	return recordEvent(ctx, querier, entity.AuditActionCreate, "membership", MembershipID(companyID.String(), userID.String()), nil, membership)
+}
@@ -0,0 +1,20 @@
+package store
+
+// The import is rolled back to its savepoint, and each row is imported within a nested
+// savepoint so that a failing row doesn't abort the whole transaction.
+const (
+	savepointImport              = `SAVEPOINT import`
+	rollbackToSavepointImport    = `ROLLBACK TO SAVEPOINT import`
+	releaseSavepointImport       = `RELEASE SAVEPOINT import`
+	savepointImportRow           = `SAVEPOINT import_row`
+	rollbackToSavepointImportRow = `ROLLBACK TO SAVEPOINT import_row`
+	releaseSavepointImportRow    = `RELEASE SAVEPOINT import_row`
+)
+
+const selectCompanyIDByName = `
+SELECT id FROM companies WHERE name = $1 AND deleted_at IS NULL
+`
+
+const selectUserIDByLogin = `
+SELECT id FROM users WHERE login = $1 AND deleted_at IS NULL
+`
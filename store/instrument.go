@@ -0,0 +1,305 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// queryNames names the queries in the metrics and in the slow query log. The queries built at
+// runtime are named after the longest query they start with.
+var queryNames = map[string]string{
+	createTableAuditEvents:        "createTableAuditEvents",
+	insertAuditEvent:              "insertAuditEvent",
+	selectAuditEvents:             "selectAuditEvents",
+	selectAuditSnapshots:          "selectAuditSnapshots",
+	updateAuditSnapshots:          "updateAuditSnapshots",
+	renameAuditActor:              "renameAuditActor",
+	deleteAllAuditEvents:          "deleteAllAuditEvents",
+	createTableOutbox:             "createTableOutbox",
+	insertOutboxEvent:             "insertOutboxEvent",
+	claimOutboxEvents:             "claimOutboxEvents",
+	ackOutboxEvent:                "ackOutboxEvent",
+	nackOutboxEvent:               "nackOutboxEvent",
+	deleteAllOutboxEvents:         "deleteAllOutboxEvents",
+	pgNotifyChange:                "pgNotifyChange",
+	createTableWebhooks:           "createTableWebhooks",
+	insertWebhook:                 "insertWebhook",
+	selectWebhooks:                "selectWebhooks",
+	deleteWebhook:                 "deleteWebhook",
+	deleteAllWebhooks:             "deleteAllWebhooks",
+	insertWebhookDelivery:         "insertWebhookDelivery",
+	claimWebhookDeliveries:        "claimWebhookDeliveries",
+	markDeliveryDelivered:         "markDeliveryDelivered",
+	markDeliveryFailed:            "markDeliveryFailed",
+	selectWebhookDeliveries:       "selectWebhookDeliveries",
+	replayWebhookDelivery:         "replayWebhookDelivery",
+	createTableJobs:               "createTableJobs",
+	insertJob:                     "insertJob",
+	claimJobs:                     "claimJobs",
+	deleteJob:                     "deleteJob",
+	failJob:                       "failJob",
+	releaseJob:                    "releaseJob",
+	selectJobs:                    "selectJobs",
+	retryJob:                      "retryJob",
+	deleteAllJobs:                 "deleteAllJobs",
+	createTableIdempotencyKeys:    "createTableIdempotencyKeys",
+	deleteExpiredIdempotencyKey:   "deleteExpiredIdempotencyKey",
+	insertIdempotencyKey:          "insertIdempotencyKey",
+	selectIdempotencyKey:          "selectIdempotencyKey",
+	completeIdempotencyKey:        "completeIdempotencyKey",
+	releaseIdempotencyKey:         "releaseIdempotencyKey",
+	purgeIdempotencyKeys:          "purgeIdempotencyKeys",
+	deleteAllIdempotencyKeys:      "deleteAllIdempotencyKeys",
+	createTableCompanies:          "createTableCompanies",
+	deleteAllCompanies:            "deleteAllCompanies",
+	insertCompany:                 "insertCompany",
+	selectCompany:                 "selectCompany",
+	deleteCompany:                 "deleteCompany",
+	restoreCompany:                "restoreCompany",
+	purgeCompanies:                "purgeCompanies",
+	selectCompanyForUpdate:        "selectCompanyForUpdate",
+	selectDeletedCompanyForUpdate: "selectDeletedCompanyForUpdate",
+	updateCompany:                 "updateCompany",
+	updateCompanyParent:           "updateCompanyParent",
+	selectCompanyChainForUpdate:   "selectCompanyChainForUpdate",
+	selectCompanyAncestors:        "selectCompanyAncestors",
+	selectCompanyDescendants:      "selectCompanyDescendants",
+	selectCompanyEffectiveUsers:   "selectCompanyEffectiveUsers",
+	insertUserInCompany:           "insertUserInCompany",
+	selectMembershipForUpdate:     "selectMembershipForUpdate",
+	updateMembership:              "updateMembership",
+	deleteMembership:              "deleteMembership",
+	selectUserMemberships:         "selectUserMemberships",
+	selectMembershipsExport:       "selectMembershipsExport",
+	selectUserExists:              "selectUserExists",
+	selectCompanyUsers:            "selectCompanyUsers",
+	searchCompanies:               "searchCompanies",
+	savepointImport:               "savepointImport",
+	rollbackToSavepointImport:     "rollbackToSavepointImport",
+	releaseSavepointImport:        "releaseSavepointImport",
+	savepointImportRow:            "savepointImportRow",
+	rollbackToSavepointImportRow:  "rollbackToSavepointImportRow",
+	releaseSavepointImportRow:     "releaseSavepointImportRow",
+	selectCompanyIDByName:         "selectCompanyIDByName",
+	selectUserIDByLogin:           "selectUserIDByLogin",
+	createTableUsers:              "createTableUsers",
+	insertUser:                    "insertUser",
+	deleteUser:                    "deleteUser",
+	restoreUser:                   "restoreUser",
+	purgeUsers:                    "purgeUsers",
+	selectUserForUpdate:           "selectUserForUpdate",
+	selectDeletedUserForUpdate:    "selectDeletedUserForUpdate",
+	selectUser:                    "selectUser",
+	selectUserWithPassword:        "selectUserWithPassword",
+	updateUser:                    "updateUser",
+	deleteAllUsers:                "deleteAllUsers",
+	searchUsers:                   "searchUsers",
+	selectUsersToReencrypt:        "selectUsersToReencrypt",
+	reencryptUser:                 "reencryptUser",
+	selectUserToEraseForUpdate:    "selectUserToEraseForUpdate",
+	eraseUser:                     "eraseUser",
+
+	createTableInvitations:            "createTableInvitations",
+	insertInvitation:                  "insertInvitation",
+	selectInvitations:                 "selectInvitations",
+	selectInvitationForUpdate:         "selectInvitationForUpdate",
+	selectInvitationToAccept:          "selectInvitationToAccept",
+	selectInvitationToAcceptForUpdate: "selectInvitationToAcceptForUpdate",
+	resendInvitation:                  "resendInvitation",
+	issueInvitationToken:              "issueInvitationToken",
+	revokeInvitation:                  "revokeInvitation",
+	acceptInvitation:                  "acceptInvitation",
+	deleteAllInvitations:              "deleteAllInvitations",
+
+	createTableCompanyLimits:     "createTableCompanyLimits",
+	upsertCompanyLimits:          "upsertCompanyLimits",
+	selectCompanyLimitsForUpdate: "selectCompanyLimitsForUpdate",
+	countCompanyMembers:          "countCompanyMembers",
+	countCompanyAPIKeys:          "countCompanyAPIKeys",
+	selectCompanyQuota:           "selectCompanyQuota",
+	countCompanyRequest:          "countCompanyRequest",
+	purgeCompanyRequests:         "purgeCompanyRequests",
+	createTableAPIKeys:           "createTableAPIKeys",
+	insertAPIKey:                 "insertAPIKey",
+	selectAPIKeys:                "selectAPIKeys",
+	selectAPIKeyByHash:           "selectAPIKeyByHash",
+	deleteAPIKey:                 "deleteAPIKey",
+	deleteAllAPIKeys:             "deleteAllAPIKeys",
+
+	createTableMetadataSchemas:    "createTableMetadataSchemas",
+	upsertMetadataSchema:          "upsertMetadataSchema",
+	selectMetadataSchema:          "selectMetadataSchema",
+	selectMetadataSchemaForUpdate: "selectMetadataSchemaForUpdate",
+	deleteMetadataSchema:          "deleteMetadataSchema",
+	deleteAllMetadataSchemas:      "deleteAllMetadataSchemas",
+
+	selectUsersToIndex: "selectUsersToIndex",
+	indexUserEmail:     "indexUserEmail",
+
+	selectOutboxPayloadsForUpdate:      "selectOutboxPayloadsForUpdate",
+	updateOutboxPayload:                "updateOutboxPayload",
+	selectDeliveryPayloadsForUpdate:    "selectDeliveryPayloadsForUpdate",
+	updateDeliveryPayload:              "updateDeliveryPayload",
+	eraseUserInvitations:               "eraseUserInvitations",
+	renameInviter:                      "renameInviter",
+	deleteActorIdempotencyKeys:         "deleteActorIdempotencyKeys",
+	selectIdempotentResponsesForUpdate: "selectIdempotentResponsesForUpdate",
+	deleteIdempotencyKey:               "deleteIdempotencyKey",
+
+	selectPurgedCompanyChildrenForUpdate: "selectPurgedCompanyChildrenForUpdate",
+}
+
+// unnamedQuery is the name of the queries which aren't in queryNames.
+const unnamedQuery = "other"
+
+var namedQueries sync.Map // Names of the queries, keyed by the queries
+
+func queryName(query string) string {
+	if name, ok := namedQueries.Load(query); ok {
+		return name.(string)
+	}
+
+	name, ok := queryNames[query]
+	if !ok {
+		name = unnamedQuery
+		prefixLen := 0
+		for prefix, prefixName := range queryNames {
+			if len(prefix) > prefixLen && strings.HasPrefix(query, prefix) {
+				name, prefixLen = prefixName, len(prefix)
+			}
+		}
+	}
+	namedQueries.Store(query, name)
+	return name
+}
+
+// instrumentation is shared by a DB and its replicas.
+type instrumentation struct {
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+	retries  *prometheus.CounterVec
+
+	log                log.Logger
+	slowQueryThreshold time.Duration
+	explain            bool
+}
+
+// LogSlowQueries logs the queries lasting longer than the threshold, along with the type of
+// their arguments but not their values. If explain is true, the plans of the slow queries are
+// logged as well. It must be called before the DB is used.
+func (db *DB) LogSlowQueries(log log.Logger, threshold time.Duration, explain bool) {
+	db.instr.log = log
+	db.instr.slowQueryThreshold = threshold
+	db.instr.explain = explain
+}
+
+// observe instruments a query executed with args since start. err is the error of the
+// query, if any.
+func (db *DB) observe(ctx context.Context, query string, args []interface{}, start time.Time, err error) {
+	duration := time.Since(start)
+	name := queryName(query)
+	if db.instr.duration != nil {
+		db.instr.duration.WithLabelValues(name).Observe(duration.Seconds())
+		if err != nil {
+			db.instr.errors.WithLabelValues(name).Inc()
+		}
+	}
+
+	if db.instr.slowQueryThreshold <= 0 || duration < db.instr.slowQueryThreshold {
+		return
+	}
+	logger := log.G(ctx)
+	if logger == log.L {
+		logger = db.instr.log
+	}
+	logger = logger.F("query", name, "duration", duration.String(), "args", redact(args))
+	if err != nil {
+		logger = logger.F("error", err)
+	}
+	logger.Warn("slow query")
+
+	if db.instr.explain && explainable(query) {
+		go db.explain(logger, query, args)
+	}
+}
+
+// redact replaces the arguments of a query with their type, they may hold personal data or
+// password hashes.
+func redact(args []interface{}) []string {
+	redacted := make([]string, len(args))
+	for k, arg := range args {
+		if arg == nil {
+			redacted[k] = "NULL"
+		} else {
+			redacted[k] = fmt.Sprintf("%T", arg)
+		}
+	}
+	return redacted
+}
+
+func explainable(query string) bool {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "SELECT", "INSERT", "UPDATE", "DELETE", "WITH":
+		return true
+	}
+	return false
+}
+
+// explainTimeout bounds the EXPLAIN of the slow queries, which run in the background.
+const explainTimeout = 5 * time.Second
+
+// explain logs the plan of the query. Neither Postgres nor SQLite execute the query.
+func (db *DB) explain(logger log.Logger, query string, args []interface{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), explainTimeout)
+	defer cancel()
+
+	explain := "EXPLAIN "
+	if db.driverName == DriverSQLite {
+		explain = "EXPLAIN QUERY PLAN "
+	}
+	rows, err := db.DB.QueryContext(ctx, explain+db.translate(query), db.translateArgs(args)...)
+	if err != nil {
+		logger.WithError(err).Error("failed to explain slow query")
+		return
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		logger.WithError(err).Error("failed to explain slow query")
+		return
+	}
+	var plan []string
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for k := range values {
+			dest[k] = &values[k]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			logger.WithError(err).Error("failed to scan slow query plan")
+			return
+		}
+		line := make([]string, len(values))
+		for k := range values {
+			line[k] = values[k].String
+		}
+		plan = append(plan, strings.Join(line, " "))
+	}
+	if err := rows.Err(); err != nil {
+		logger.WithError(err).Error("failed to loop through slow query plan")
+		return
+	}
+	logger.F("plan", strings.Join(plan, "\n")).Warn("slow query plan")
+}
@@ -0,0 +1,75 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryName(t *testing.T) {
+	require.Equal(t, "insertUser", queryName(insertUser))
+	require.Equal(t, "selectUser", queryName(selectUser+" WHERE id = $1"+orderByCreatedAt))
+	require.Equal(t, "selectUserWithPassword", queryName(selectUserWithPassword+" WHERE login = $1"))
+	require.Equal(t, unnamedQuery, queryName("SELECT 1"))
+}
+
+func TestInstrumentation(t *testing.T) {
+	logger, hook := log.NewTest()
+	db := openSQLite(t)
+	defer db.Close()
+	reg := prometheus.NewRegistry()
+	RegisterMetrics(reg, "", db)
+	db.LogSlowQueries(logger, time.Nanosecond, true)
+
+	_, err := NewAuditStore(logger, db)
+	require.NoError(t, err)
+	_, err = NewOutboxStore(logger, db)
+	require.NoError(t, err)
+	users, err := NewUserStore(logger, db, testKeyring(t, "k1"))
+	require.NoError(t, err)
+	ctx := context.Background()
+	_, err = users.Add(ctx, db, "login", "password", "email", "user", nil)
+	require.NoError(t, err)
+	_, err = users.Add(ctx, db, "login", "password", "email", "user", nil)
+	require.IsType(t, &AlreadyExistsError{}, err)
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	counts := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			name := family.GetName() + "/" + metric.GetLabel()[0].GetValue()
+			counts[name] = float64(metric.GetHistogram().GetSampleCount()) + metric.GetCounter().GetValue()
+		}
+	}
+	require.Equal(t, 2.0, counts["db_query_duration_seconds/insertUser"])
+	require.Equal(t, 1.0, counts["db_query_duration_seconds/insertAuditEvent"])
+	require.Equal(t, 1.0, counts["db_query_errors_total/insertUser"])
+
+	var slow []string
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "slow query" && entry.Data["query"] == "insertUser" {
+			require.Equal(t, []string{"string", "string", "[]uint8", "[]uint8", "string", "[]uint8", "string", "string"}, entry.Data["args"])
+			slow = append(slow, entry.Message)
+		}
+	}
+	require.Len(t, slow, 2)
+
+	// The plans are logged in the background
+	planned := func() bool {
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "slow query plan" && entry.Data["query"] == "insertAuditEvent" {
+				return true
+			}
+		}
+		return false
+	}
+	for deadline := time.Now().Add(time.Second); !planned() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.True(t, planned())
+}
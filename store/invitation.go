@@ -0,0 +1,293 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/envelope"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/pkg/errors"
+)
+
+type Invitation struct {
+	log     log.Logger
+	db      *DB
+	keyring *envelope.Keyring // Seals the emails
+}
+
+// invitationPIIAdditionalData binds the sealed emails of the invitations to their column.
+var invitationPIIAdditionalData = []byte("invitations.pii")
+
+// NewInvitationStore must be called after NewCompanyStore and NewUserStore, the invitations
+// refer to both.
+func NewInvitationStore(log log.Logger, db *DB, keyring *envelope.Keyring) (*Invitation, error) {
+	if _, err := db.Exec(createTableInvitations); err != nil {
+		return nil, errors.Wrap(err, "failed to create invitations table")
+	}
+	return &Invitation{log: log, db: db, keyring: keyring}, nil
+}
+
+// NewInvitationToken returns a random token, which is only sent to the invitee. The invitations
+// get one which is never sent when they are added or resent, until Issue replaces it.
+func NewInvitationToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// HashInvitationToken returns the hash of the token which is stored, the token is random
+// enough not to need a salt.
+func HashInvitationToken(token string) []byte {
+	h := sha256.Sum256([]byte(token))
+	return h[:]
+}
+
+// sealedInvitation is an invitation as stored, with its email sealed.
+type sealedInvitation struct {
+	entity.Invitation
+	pii         []byte
+	dataKey     []byte
+	masterKeyID string
+}
+
+// dest returns the scan destinations of the invitationColumns.
+func (i *sealedInvitation) dest() []interface{} {
+	return []interface{}{
+		&i.ID, &i.CompanyID, &i.pii, &i.dataKey, &i.masterKeyID, &i.Role, &i.Status, &i.InvitedBy, &i.Sends, &i.UserID,
+		utcTime{&i.ExpiresAt}, utcTime{&i.CreatedAt}, utcTime{&i.UpdatedAt},
+	}
+}
+
+// open returns the invitation with its email decrypted, and its status at the time.
+func (i *sealedInvitation) open(keyring *envelope.Keyring) (entity.Invitation, error) {
+	invitation := i.Invitation
+	pii, err := openPII(keyring, i.masterKeyID, i.dataKey, i.pii, invitationPIIAdditionalData)
+	if err != nil {
+		return invitation, err
+	}
+	invitation.Email = pii.Email
+	if invitation.Status == entity.InvitationStatusPending && !invitation.ExpiresAt.After(time.Now()) {
+		invitation.Status = entity.InvitationStatusExpired
+	}
+	return invitation, nil
+}
+
+// getInvitation runs a query returning the invitationColumns of a single invitation, see
+// getOne.
+func (s *Invitation) getInvitation(ctx context.Context, querier Querier, query string, args ...interface{}) (entity.Invitation, error) {
+	var sealed sealedInvitation
+	if err := getOne(ctx, querier, query, args, sealed.dest()...); err != nil {
+		return entity.Invitation{}, err
+	}
+	invitation, err := sealed.open(s.keyring)
+	if err != nil {
+		log.G(ctx).F("id", sealed.ID).WithError(err).Error("failed to decrypt invitation")
+		return invitation, ErrGenericDBFailure
+	}
+	return invitation, nil
+}
+
+// Add invites the email to the company of the invitation until the ttl expires, its token is
+// issued when it's sent. It returns an AlreadyExistsError if the email has a pending invitation
+// to the company, even an expired one.
+func (s *Invitation) Add(ctx context.Context, querier Querier, invitation entity.Invitation, ttl time.Duration) (entity.Invitation, error) {
+	if invitation.Role == "" {
+		invitation.Role = entity.MembershipRoleMember
+	}
+	token, err := NewInvitationToken()
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to generate invitation token")
+		return entity.Invitation{}, ErrGenericDBFailure
+	}
+	pii, err := sealPIIFor(s.keyring, userPII{Email: invitation.Email}, invitationPIIAdditionalData)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to encrypt invitation")
+		return entity.Invitation{}, ErrGenericDBFailure
+	}
+
+	var inserted entity.Invitation
+	err = WithTx(ctx, querier, func(tx *Tx) error {
+		var sealed sealedInvitation
+		err := tx.QueryRowContext(ctx, insertInvitation, invitation.CompanyID, pii.pii, pii.dataKey, pii.masterKeyID, pii.emailIndex,
+			invitation.Role, HashInvitationToken(token), invitation.InvitedBy, ttl.Seconds()).Scan(sealed.dest()...)
+		if err == ErrNoRows {
+			return NewNotFoundError("company", invitation.CompanyID.String())
+		} else if code, constraint, _ := violation(err); code == ErrUniqViolation && constraint == "unq_invitations_pending" {
+			return NewAlreadyExistsError("invitation", invitation.Email)
+		} else if err != nil {
+			log.G(ctx).WithError(err).Error("failed to insert invitation in DB")
+			return ErrGenericDBFailure
+		}
+		inserted = sealed.Invitation
+		inserted.Email = invitation.Email
+		return recordEvent(ctx, tx, entity.AuditActionCreate, "invitation", inserted.ID.String(), nil, inserted)
+	})
+	return inserted, err
+}
+
+// eraseInvitations replaces the email of the invitations of an erased user with its placeholder,
+// and revokes the pending ones: the invitations it accepted, and the ones sent to its email. The
+// invitations it sent are renamed after its erased login. It must be called within the
+// transaction of the erasure.
+func eraseInvitations(ctx context.Context, querier Querier, keyring *envelope.Keyring, ID, email, login, erasedLogin string) error {
+	pii, err := sealPIIFor(keyring, userPII{Email: ErasedEmail(ID)}, invitationPIIAdditionalData)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to encrypt invitation")
+		return ErrGenericDBFailure
+	}
+	_, err = querier.ExecContext(ctx, eraseUserInvitations, keyring.BlindIndex(email), ID, pii.pii, pii.dataKey, pii.masterKeyID, pii.emailIndex)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to erase invitations in DB")
+		return ErrGenericDBFailure
+	}
+	if _, err = querier.ExecContext(ctx, renameInviter, login, erasedLogin); err != nil {
+		log.G(ctx).WithError(err).Error("failed to rename inviter in DB")
+		return ErrGenericDBFailure
+	}
+	return nil
+}
+
+// GetByID returns the invitation, whatever its status.
+func (s *Invitation) GetByID(ctx context.Context, querier Querier, ID string) (entity.Invitation, error) {
+	invitation, err := s.getInvitation(ctx, reader(ctx, querier), selectInvitations+" WHERE id = $1", ID)
+	if err == ErrNoRows {
+		return invitation, NewNotFoundError("invitation", ID)
+	}
+	return invitation, err
+}
+
+// List returns the invitations of a company matching the filter, the latest first.
+func (s *Invitation) List(ctx context.Context, querier Querier, filter entity.InvitationFilter) ([]entity.Invitation, error) {
+	args := []interface{}{filter.CompanyID}
+	where := " WHERE company_id = $1"
+	switch filter.Status {
+	case entity.InvitationStatusPending:
+		where += " AND status = 'pending' AND expires_at > CURRENT_TIMESTAMP"
+	case entity.InvitationStatusExpired:
+		where += " AND status = 'pending' AND expires_at <= CURRENT_TIMESTAMP"
+	case entity.InvitationStatusAccepted, entity.InvitationStatusRevoked:
+		args = append(args, filter.Status)
+		where += " AND status = $2"
+	}
+	args = append(args, filter.Limit, filter.Offset)
+	query := selectInvitations + where + fmt.Sprintf(" ORDER BY created_at DESC, id LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+	rows, err := reader(ctx, querier).QueryContext(ctx, query, args...)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to select invitations in DB")
+		return nil, ErrGenericDBFailure
+	}
+	defer rows.Close()
+
+	invitations := []entity.Invitation{}
+	for rows.Next() {
+		var sealed sealedInvitation
+		if err := rows.Scan(sealed.dest()...); err != nil {
+			log.G(ctx).WithError(err).Error("failed to scan invitation in DB")
+			return nil, ErrGenericDBFailure
+		}
+		invitation, err := sealed.open(s.keyring)
+		if err != nil {
+			log.G(ctx).F("id", sealed.ID).WithError(err).Error("failed to decrypt invitation")
+			return nil, ErrGenericDBFailure
+		}
+		invitations = append(invitations, invitation)
+	}
+	if err = rows.Err(); err != nil {
+		log.G(ctx).WithError(err).Error("failed to loop through invitations")
+		return nil, ErrGenericDBFailure
+	}
+	return invitations, nil
+}
+
+// Resend renews a pending invitation, even an expired one, until the ttl expires. Its previous
+// token can't be used anymore, the next one is issued when it's sent again.
+func (s *Invitation) Resend(ctx context.Context, querier Querier, ID string, ttl time.Duration) (entity.Invitation, error) {
+	token, err := NewInvitationToken()
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to generate invitation token")
+		return entity.Invitation{}, ErrGenericDBFailure
+	}
+	return s.update(ctx, querier, ID, entity.AuditActionUpdate, resendInvitation, HashInvitationToken(token), ttl.Seconds())
+}
+
+// Issue replaces the token of the nth send of a pending invitation which hasn't expired, just
+// before it's sent. It returns a NotFoundError if the invitation was resent, revoked or accepted
+// since, so that a stale send can't invalidate the token of the latest one. The token isn't
+// audited, it's not part of the invitation.
+func (s *Invitation) Issue(ctx context.Context, querier Querier, ID string, sends int, token string) (entity.Invitation, error) {
+	invitation, err := s.getInvitation(ctx, querier, issueInvitationToken, ID, HashInvitationToken(token), sends)
+	if err == ErrNoRows {
+		return invitation, NewNotFoundError("pending invitation", ID)
+	}
+	return invitation, err
+}
+
+// Revoke cancels a pending invitation, even an expired one.
+func (s *Invitation) Revoke(ctx context.Context, querier Querier, ID string) (entity.Invitation, error) {
+	return s.update(ctx, querier, ID, entity.AuditActionDelete, revokeInvitation)
+}
+
+// GetByToken returns the invitation to accept with the token, without locking it. It returns a
+// NotFoundError unless the invitation is pending and hasn't expired.
+func (s *Invitation) GetByToken(ctx context.Context, querier Querier, token string) (entity.Invitation, error) {
+	invitation, err := s.getInvitation(ctx, querier, selectInvitationToAccept, HashInvitationToken(token))
+	if err == ErrNoRows {
+		return invitation, NewNotFoundError("invitation", "token")
+	}
+	return invitation, err
+}
+
+// Claim returns and locks the invitation to accept with the token. It returns a NotFoundError
+// unless the invitation is pending and hasn't expired.
+func (s *Invitation) Claim(ctx context.Context, querier Querier, token string) (entity.Invitation, error) {
+	invitation, err := s.getInvitation(ctx, querier, selectInvitationToAcceptForUpdate, HashInvitationToken(token))
+	if err == ErrNoRows {
+		return invitation, NewNotFoundError("invitation", "token")
+	}
+	return invitation, err
+}
+
+// Accept records that the user accepted the pending invitation, which must have been claimed
+// in the same transaction. Adding the user to the company is up to the caller.
+func (s *Invitation) Accept(ctx context.Context, querier Querier, ID, userID string) (entity.Invitation, error) {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return entity.Invitation{}, NewNotFoundError("user", userID)
+	}
+	return s.update(ctx, querier, ID, entity.AuditActionUpdate, acceptInvitation, userUUID)
+}
+
+// update applies the query to a pending invitation, even an expired one, and audits it with
+// the action. The ID of the invitation is the first argument of the query.
+func (s *Invitation) update(ctx context.Context, querier Querier, ID, action, query string, args ...interface{}) (entity.Invitation, error) {
+	var after entity.Invitation
+	err := WithTx(ctx, querier, func(tx *Tx) error {
+		before, err := s.getInvitation(ctx, tx, selectInvitationForUpdate, ID)
+		if err == ErrNoRows || (err == nil && before.Status != entity.InvitationStatusPending && before.Status != entity.InvitationStatusExpired) {
+			return NewNotFoundError("pending invitation", ID)
+		} else if err != nil {
+			return err
+		}
+		if after, err = s.getInvitation(ctx, tx, query, append([]interface{}{ID}, args...)...); err != nil {
+			return err
+		}
+		return recordEvent(ctx, tx, action, "invitation", ID, before, after)
+	})
+	return after, err
+}
+
+func (s *Invitation) DeleteAll() error {
+	if _, err := s.db.Exec(deleteAllInvitations); err != nil {
+		return errors.Wrap(err, "failed to truncate invitations table")
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package store
+
+// The email is sealed like the personal data of the users, email_index is its blind index.
+// Only the hash of the token is stored. The expired invitations are the pending ones past
+// expires_at, a company has at most one pending invitation per email.
+const createTableInvitations = `
+CREATE TABLE IF NOT EXISTS invitations (
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	company_id UUID NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+	pii BYTEA NOT NULL,
+	data_key BYTEA NOT NULL,
+	master_key_id TEXT NOT NULL,
+	email_index BYTEA NOT NULL,
+	role TEXT NOT NULL CONSTRAINT chk_invitation_role CHECK (role IN ('owner', 'admin', 'member')),
+	token_hash BYTEA NOT NULL,
+	status TEXT DEFAULT 'pending' NOT NULL CONSTRAINT chk_invitation_status CHECK (status IN ('pending', 'accepted', 'revoked')),
+	invited_by TEXT NOT NULL,
+	sends INTEGER DEFAULT 1 NOT NULL,
+	user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+	expires_at timestamptz NOT NULL,
+	created_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	updated_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	CONSTRAINT unq_invitation_token UNIQUE (token_hash)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS unq_invitations_pending ON invitations (company_id, email_index) WHERE status = 'pending';
+
+CREATE INDEX IF NOT EXISTS idx_invitations_company_id ON invitations (company_id, created_at)`
+
+// invitationColumns must be kept in sync with sealedInvitation.dest
+const invitationColumns = `id, company_id, pii, data_key, master_key_id, role, status, invited_by, sends, user_id, expires_at, created_at, updated_at`
+
+// Soft deleted companies can't invite, in which case no row is inserted. $9 is the time to
+// live of the invitation, in seconds.
+const insertInvitation = `
+INSERT INTO invitations (company_id, pii, data_key, master_key_id, email_index, role, token_hash, invited_by, expires_at)
+SELECT id, $2, $3, $4, $5, $6, $7, $8, CURRENT_TIMESTAMP + make_interval(secs => $9)
+FROM companies WHERE id = $1 AND deleted_at IS NULL
+RETURNING ` + invitationColumns
+
+const selectInvitations = `
+SELECT ` + invitationColumns + ` FROM invitations`
+
+const selectInvitationForUpdate = `
+SELECT ` + invitationColumns + ` FROM invitations WHERE id = $1 FOR UPDATE`
+
+// Only the pending invitations which haven't expired can be accepted.
+const selectInvitationToAccept = `
+SELECT ` + invitationColumns + ` FROM invitations
+WHERE token_hash = $1 AND status = 'pending' AND expires_at > CURRENT_TIMESTAMP`
+
+const selectInvitationToAcceptForUpdate = selectInvitationToAccept + `
+FOR UPDATE`
+
+// The previous token of the invitation is replaced.
+const resendInvitation = `
+UPDATE invitations SET
+	token_hash = $2,
+	expires_at = CURRENT_TIMESTAMP + make_interval(secs => $3),
+	sends = sends + 1,
+	updated_at = CURRENT_TIMESTAMP
+WHERE id = $1
+RETURNING ` + invitationColumns
+
+// $3 is the number of sends of the invitation when its send was enqueued.
+const issueInvitationToken = `
+UPDATE invitations SET token_hash = $2
+WHERE id = $1 AND sends = $3 AND status = 'pending' AND expires_at > CURRENT_TIMESTAMP
+RETURNING ` + invitationColumns
+
+const revokeInvitation = `
+UPDATE invitations SET status = 'revoked', updated_at = CURRENT_TIMESTAMP
+WHERE id = $1
+RETURNING ` + invitationColumns
+
+const acceptInvitation = `
+UPDATE invitations SET status = 'accepted', user_id = $2, updated_at = CURRENT_TIMESTAMP
+WHERE id = $1
+RETURNING ` + invitationColumns
+
+// The invitations of an erased user get the placeholder $3 to $6 of its email, the pending ones
+// are revoked. $1 is the blind index of its email, $2 its ID.
+const eraseUserInvitations = `
+UPDATE invitations SET
+	pii = $3,
+	data_key = $4,
+	master_key_id = $5,
+	email_index = $6,
+	status = CASE WHEN status = 'pending' THEN 'revoked' ELSE status END,
+	updated_at = CURRENT_TIMESTAMP
+WHERE email_index = $1 OR user_id = $2
+`
+
+const renameInviter = `
+UPDATE invitations SET invited_by = $2 WHERE invited_by = $1
+`
+
+const deleteAllInvitations = `
+TRUNCATE TABLE invitations
+`
@@ -0,0 +1,169 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/pkg/errors"
+)
+
+type Job struct {
+	log log.Logger
+	db  *DB
+}
+
+func NewJobStore(log log.Logger, db *DB) (*Job, error) {
+	if _, err := db.Exec(createTableJobs); err != nil {
+		return nil, errors.Wrap(err, "failed to create jobs table")
+	}
+	return &Job{log: log, db: db}, nil
+}
+
+// jobDest returns the scan destinations of the jobColumns.
+func jobDest(job *entity.Job, payload *[]byte) []interface{} {
+	return []interface{}{
+		&job.ID, &job.Kind, payload, &job.UniqueKey, &job.Status, &job.Attempts, &job.MaxAttempts, utcTime{&job.RunAt},
+		&job.LastError, utcTime{&job.CreatedAt},
+	}
+}
+
+// Enqueue adds a pending job, it returns an AlreadyExistsError if its unique key is taken by a
+// job which is pending or running. The job is only claimed once the transaction of querier, if
+// any, is committed.
+func (s *Job) Enqueue(ctx context.Context, querier Querier, kind string, payload []byte, opts entity.JobOptions) (entity.Job, error) {
+	var delay time.Duration
+	if !opts.RunAt.IsZero() {
+		if delay = time.Until(opts.RunAt); delay < 0 {
+			delay = 0
+		}
+	}
+
+	var job entity.Job
+	var p []byte
+	err := getOne(ctx, querier, insertJob, []interface{}{kind, string(payload), opts.UniqueKey, opts.MaxAttempts, delay.Seconds()}, jobDest(&job, &p)...)
+	if err == ErrNoRows {
+		return job, NewAlreadyExistsError("job", opts.UniqueKey)
+	}
+	job.Payload = p
+	return job, err
+}
+
+// Claim returns up to limit jobs due to run, the oldest first, as running. They aren't claimed
+// again before the lease expires, unless they fail or are released.
+func (s *Job) Claim(ctx context.Context, querier Querier, limit int, lease time.Duration) ([]entity.Job, error) {
+	jobs, err := listJobs(ctx, querier, claimJobs, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	// RETURNING doesn't keep the order of the subquery.
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].RunAt.Equal(jobs[j].RunAt) {
+			return jobs[i].RunAt.Before(jobs[j].RunAt)
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs, nil
+}
+
+// Complete deletes a job which succeeded.
+func (s *Job) Complete(ctx context.Context, querier Querier, ID int64) error {
+	if _, err := querier.ExecContext(ctx, deleteJob, ID); err != nil {
+		log.G(ctx).WithError(err).Error("failed to delete job in DB")
+		return ErrGenericDBFailure
+	}
+	return nil
+}
+
+// Fail schedules the next attempt of the job after the delay, or moves it to the dead jobs if
+// dead is true.
+func (s *Job) Fail(ctx context.Context, querier Querier, ID int64, reason string, delay time.Duration, dead bool) error {
+	status := entity.JobStatusPending
+	if dead {
+		status = entity.JobStatusDead
+	}
+	if _, err := querier.ExecContext(ctx, failJob, ID, status, delay.Seconds(), reason); err != nil {
+		log.G(ctx).WithError(err).Error("failed to update job in DB")
+		return ErrGenericDBFailure
+	}
+	return nil
+}
+
+// Release makes a running job pending again right away, without counting its attempt. It's
+// meant for the jobs interrupted by a shutdown.
+func (s *Job) Release(ctx context.Context, querier Querier, ID int64) error {
+	if _, err := querier.ExecContext(ctx, releaseJob, ID); err != nil {
+		log.G(ctx).WithError(err).Error("failed to update job in DB")
+		return ErrGenericDBFailure
+	}
+	return nil
+}
+
+// List returns the jobs matching the filter, the next to run first.
+func (s *Job) List(ctx context.Context, querier Querier, filter entity.JobFilter) ([]entity.Job, error) {
+	conditions := map[string]interface{}{}
+	if filter.Status != "" {
+		conditions["status"] = filter.Status
+	}
+	if filter.Kind != "" {
+		conditions["kind"] = filter.Kind
+	}
+	where, args := buildWhere(conditions)
+	args = append(args, filter.Limit, filter.Offset)
+	query := selectJobs + where + fmt.Sprintf(" ORDER BY run_at, id LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+	return listJobs(ctx, reader(ctx, querier), query, args...)
+}
+
+// Retry makes a dead job pending again with no attempt, it runs as soon as possible. It returns
+// an AlreadyExistsError if its unique key was taken meanwhile.
+func (s *Job) Retry(ctx context.Context, querier Querier, ID int64) (entity.Job, error) {
+	var job entity.Job
+	var payload []byte
+	if err := querier.QueryRowContext(ctx, retryJob, ID).Scan(jobDest(&job, &payload)...); err == ErrNoRows {
+		return job, NewNotFoundError("dead job", strconv.FormatInt(ID, 10))
+	} else if code, constraint, _ := violation(err); code == ErrUniqViolation && constraint == "unq_jobs_unique_key" {
+		return job, NewAlreadyExistsError("job", strconv.FormatInt(ID, 10))
+	} else if err != nil {
+		log.G(ctx).WithError(err).Error("failed to retry job in DB")
+		return job, ErrGenericDBFailure
+	}
+	job.Payload = payload
+	return job, nil
+}
+
+func listJobs(ctx context.Context, querier Querier, query string, args ...interface{}) ([]entity.Job, error) {
+	rows, err := querier.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to select jobs in DB")
+		return nil, ErrGenericDBFailure
+	}
+	defer rows.Close()
+
+	var jobs []entity.Job
+	for rows.Next() {
+		var job entity.Job
+		var payload []byte
+		if err := rows.Scan(jobDest(&job, &payload)...); err != nil {
+			log.G(ctx).WithError(err).Error("failed to scan job in DB")
+			return nil, ErrGenericDBFailure
+		}
+		job.Payload = payload
+		jobs = append(jobs, job)
+	}
+	if err = rows.Err(); err != nil {
+		log.G(ctx).WithError(err).Error("failed to loop through jobs")
+		return nil, ErrGenericDBFailure
+	}
+	return jobs, nil
+}
+
+func (s *Job) DeleteAll() error {
+	if _, err := s.db.Exec(deleteAllJobs); err != nil {
+		return errors.Wrap(err, "failed to truncate jobs table")
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package store
+
+// The jobs which succeed are deleted. The unique keys only apply to the jobs which are pending
+// or running, run_at is the lease expiry of the running ones.
+const createTableJobs = `
+CREATE TABLE IF NOT EXISTS jobs (
+	id BIGSERIAL PRIMARY KEY,
+	kind TEXT NOT NULL,
+	payload JSONB NOT NULL,
+	unique_key TEXT,
+	status TEXT DEFAULT 'pending' NOT NULL CONSTRAINT chk_status CHECK (status IN ('pending', 'running', 'dead')),
+	attempts INTEGER DEFAULT 0 NOT NULL,
+	max_attempts INTEGER NOT NULL,
+	run_at timestamp WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	last_error TEXT DEFAULT '' NOT NULL,
+	created_at timestamp WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS unq_jobs_unique_key ON jobs (unique_key) WHERE status IN ('pending', 'running');
+
+CREATE INDEX IF NOT EXISTS idx_jobs_run_at ON jobs (run_at) WHERE status IN ('pending', 'running');
+
+-- The timestamps were stored in UTC without time zone, they are converted once.
+DO $$
+BEGIN
+	IF (SELECT data_type FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'jobs' AND column_name = 'run_at') = 'timestamp without time zone' THEN
+		ALTER TABLE jobs
+			ALTER COLUMN run_at TYPE timestamptz USING run_at AT TIME ZONE 'UTC',
+			ALTER COLUMN created_at TYPE timestamptz USING created_at AT TIME ZONE 'UTC';
+	END IF;
+END
+$$;
+`
+
+// jobColumns must be kept in sync with jobDest
+const jobColumns = `id, kind, payload, COALESCE(unique_key, ''), status, attempts, max_attempts, run_at, last_error, created_at`
+
+// A job isn't inserted if its unique key is taken, no row is returned then. $5 is the delay of
+// the job, in seconds.
+const insertJob = `
+INSERT INTO jobs (kind, payload, unique_key, max_attempts, run_at)
+VALUES ($1, $2, NULLIF($3, ''), $4, CURRENT_TIMESTAMP + make_interval(secs => $5))
+ON CONFLICT (unique_key) WHERE status IN ('pending', 'running') DO NOTHING
+RETURNING ` + jobColumns
+
+// The workers of several instances claim distinct jobs, the locked ones are skipped. The
+// running jobs whose lease expired are claimed again.
+const claimJobs = `
+UPDATE jobs SET status = 'running', attempts = attempts + 1, run_at = CURRENT_TIMESTAMP + make_interval(secs => $2)
+WHERE id IN (
+	SELECT id FROM jobs WHERE status IN ('pending', 'running') AND run_at <= CURRENT_TIMESTAMP
+	ORDER BY run_at, id LIMIT $1 FOR UPDATE SKIP LOCKED
+)
+RETURNING ` + jobColumns
+
+const deleteJob = `
+DELETE FROM jobs WHERE id = $1
+`
+
+const failJob = `
+UPDATE jobs SET status = $2, run_at = CURRENT_TIMESTAMP + make_interval(secs => $3), last_error = $4
+WHERE id = $1
+`
+
+// The interrupted attempt isn't counted.
+const releaseJob = `
+UPDATE jobs SET status = 'pending', attempts = attempts - 1, run_at = CURRENT_TIMESTAMP
+WHERE id = $1 AND status = 'running'
+`
+
+const selectJobs = `
+SELECT ` + jobColumns + ` FROM jobs`
+
+// A dead job whose unique key was taken meanwhile can't be retried.
+const retryJob = `
+UPDATE jobs SET status = 'pending', attempts = 0, run_at = CURRENT_TIMESTAMP
+WHERE id = $1 AND status = 'dead'
+RETURNING ` + jobColumns
+
+const deleteAllJobs = `
+TRUNCATE TABLE jobs
+`
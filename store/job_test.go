@@ -0,0 +1,78 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobs(t *testing.T) {
+	logger, _ := log.NewTest()
+	db := openSQLite(t)
+	defer db.Close()
+	jobs, err := NewJobStore(logger, db)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// A unique key is only taken by a pending or running job
+	unique, err := jobs.Enqueue(ctx, db, "email", []byte(`{"to":"bob"}`), entity.JobOptions{UniqueKey: "bob", MaxAttempts: 3})
+	require.NoError(t, err)
+	require.Equal(t, entity.JobStatusPending, unique.Status)
+	require.JSONEq(t, `{"to":"bob"}`, string(unique.Payload))
+	_, err = jobs.Enqueue(ctx, db, "email", []byte(`{}`), entity.JobOptions{UniqueKey: "bob"})
+	require.IsType(t, &AlreadyExistsError{}, err)
+	later, err := jobs.Enqueue(ctx, db, "email", []byte(`{}`), entity.JobOptions{RunAt: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	require.True(t, later.RunAt.After(time.Now().Add(59*time.Minute)))
+
+	// The scheduled jobs aren't claimed before they are due
+	claimed, err := jobs.Claim(ctx, db, 10, time.Hour)
+	require.NoError(t, err)
+	require.Len(t, claimed, 1)
+	require.Equal(t, unique.ID, claimed[0].ID)
+	require.Equal(t, entity.JobStatusRunning, claimed[0].Status)
+	require.Equal(t, 1, claimed[0].Attempts)
+	_, err = jobs.Enqueue(ctx, db, "email", []byte(`{}`), entity.JobOptions{UniqueKey: "bob"})
+	require.IsType(t, &AlreadyExistsError{}, err)
+
+	// A released job can be claimed again right away, the interrupted attempt isn't counted
+	require.NoError(t, jobs.Release(ctx, db, unique.ID))
+	claimed, err = jobs.Claim(ctx, db, 10, time.Hour)
+	require.NoError(t, err)
+	require.Len(t, claimed, 1)
+	require.Equal(t, 1, claimed[0].Attempts)
+
+	// A dead job frees its unique key, it can't be retried while the key is taken
+	require.NoError(t, jobs.Fail(ctx, db, unique.ID, "smtp down", 0, true))
+	claimed, err = jobs.Claim(ctx, db, 10, time.Hour)
+	require.NoError(t, err)
+	require.Empty(t, claimed)
+	dead, err := jobs.List(ctx, db, entity.JobFilter{Status: entity.JobStatusDead, Kind: "email", Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	require.Equal(t, "smtp down", dead[0].LastError)
+	require.Equal(t, "bob", dead[0].UniqueKey)
+
+	other, err := jobs.Enqueue(ctx, db, "email", []byte(`{}`), entity.JobOptions{UniqueKey: "bob"})
+	require.NoError(t, err)
+	_, err = jobs.Retry(ctx, db, unique.ID)
+	require.IsType(t, &AlreadyExistsError{}, err)
+	require.NoError(t, jobs.Complete(ctx, db, other.ID))
+
+	retried, err := jobs.Retry(ctx, db, unique.ID)
+	require.NoError(t, err)
+	require.Equal(t, entity.JobStatusPending, retried.Status)
+	require.Equal(t, 0, retried.Attempts)
+	_, err = jobs.Retry(ctx, db, unique.ID)
+	require.IsType(t, &NotFoundError{}, err)
+
+	all, err := jobs.List(ctx, db, entity.JobFilter{Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+	require.Equal(t, unique.ID, all[0].ID)
+	require.Equal(t, later.ID, all[1].ID)
+}
@@ -0,0 +1,180 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/google/uuid"
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+)
+
+// membershipDest returns the scan destinations of the membershipColumns.
+func membershipDest(membership *entity.Membership) []interface{} {
+	return []interface{}{&membership.CompanyID, &membership.UserID, &membership.Role, utcTime{&membership.CreatedAt}}
+}
+
+// MembershipID is the ID of the audit events of a membership, which doesn't have its own.
+func MembershipID(companyID, userID string) string {
+	return companyID + ":" + userID
+}
+
+// AddMember adds the user to the company. An empty role stands for entity.MembershipRoleMember.
+func (s *Company) AddMember(ctx context.Context, querier Querier, companyID, userID, role string) (entity.Membership, error) {
+	var membership entity.Membership
+	err := WithTx(ctx, querier, func(tx *Tx) error {
+		var company entity.Company
+		err := getOne(ctx, tx, selectCompanyForUpdate, []interface{}{companyID}, companyDest(&company)...)
+		if err == ErrNoRows {
+			return NewNotFoundError("company", companyID)
+		} else if err != nil {
+			return err
+		}
+
+		userUUID, err := uuid.Parse(userID)
+		if err != nil {
+			return NewNotFoundError("user", userID)
+		}
+		if membership, err = addUserInCompany(ctx, tx, userUUID, company.ID, role); err != nil {
+			return err
+		}
+		return recordEvent(ctx, tx, entity.AuditActionCreate, "membership", MembershipID(companyID, userID), nil, membership)
+	})
+	return membership, err
+}
+
+func (s *Company) UpdateMember(ctx context.Context, querier Querier, companyID, userID, role string) (entity.Membership, error) {
+	var before, after entity.Membership
+	err := WithTx(ctx, querier, func(tx *Tx) error {
+		if err := lockMembership(ctx, tx, companyID, userID, &before); err != nil {
+			return err
+		}
+		if err := getOne(ctx, tx, updateMembership, []interface{}{companyID, userID, role}, membershipDest(&after)...); err != nil {
+			return err
+		}
+		return recordEvent(ctx, tx, entity.AuditActionUpdate, "membership", MembershipID(companyID, userID), before, after)
+	})
+	return after, err
+}
+
+func (s *Company) RemoveMember(ctx context.Context, querier Querier, companyID, userID string) error {
+	return WithTx(ctx, querier, func(tx *Tx) error {
+		var before entity.Membership
+		if err := lockMembership(ctx, tx, companyID, userID, &before); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, deleteMembership, companyID, userID); err != nil {
+			log.G(ctx).WithError(err).Error("failed to delete user from company")
+			return ErrGenericDBFailure
+		}
+		return recordEvent(ctx, tx, entity.AuditActionDelete, "membership", MembershipID(companyID, userID), before, nil)
+	})
+}
+
+// GetMemberships returns the companies of a user along with its role in each of them.
+func (s *Company) GetMemberships(ctx context.Context, querier Querier, userID string) ([]entity.Membership, error) {
+	querier = reader(ctx, querier)
+	var ID string
+	err := getOne(ctx, querier, selectUserExists, []interface{}{userID}, &ID)
+	if err == ErrNoRows {
+		return nil, NewNotFoundError("user", userID)
+	} else if err != nil {
+		return nil, err
+	}
+
+	rows, err := querier.QueryContext(ctx, selectUserMemberships, userID)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to list user companies in DB")
+		return nil, ErrGenericDBFailure
+	}
+	defer rows.Close()
+
+	var memberships []entity.Membership
+	for rows.Next() {
+		membership := entity.Membership{Company: &entity.Company{}}
+		if err = rows.Scan(append(membershipDest(&membership), companyDest(membership.Company)...)...); err != nil {
+			log.G(ctx).WithError(err).Error("failed to scan user company in DB")
+			return nil, ErrGenericDBFailure
+		}
+		memberships = append(memberships, membership)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.G(ctx).WithError(err).Error("failed to loop through user companies")
+		return nil, ErrGenericDBFailure
+	}
+
+	return memberships, nil
+}
+
+// ForEachMembership calls fn for every membership between a company and a user that aren't
+// soft deleted, until fn returns an error.
+func (s *Company) ForEachMembership(ctx context.Context, querier Querier, fn func(entity.ImportMembership) error) error {
+	querier = reader(ctx, querier)
+	rows, err := querier.QueryContext(ctx, selectMembershipsExport)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to list memberships in DB")
+		return ErrGenericDBFailure
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var membership entity.ImportMembership
+		if err = rows.Scan(&membership.Company, &membership.User, &membership.Role); err != nil {
+			log.G(ctx).WithError(err).Error("failed to scan membership in DB")
+			return ErrGenericDBFailure
+		}
+		if err = fn(membership); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		log.G(ctx).WithError(err).Error("failed to loop through memberships list")
+		return ErrGenericDBFailure
+	}
+	return nil
+}
+
+// lockMembership reads the membership, after having checked that the company isn't soft deleted.
+func lockMembership(ctx context.Context, querier Querier, companyID, userID string, membership *entity.Membership) error {
+	var company entity.Company
+	err := getOne(ctx, querier, selectCompanyForUpdate, []interface{}{companyID}, companyDest(&company)...)
+	if err == ErrNoRows {
+		return NewNotFoundError("company", companyID)
+	} else if err != nil {
+		return err
+	}
+
+	err = getOne(ctx, querier, selectMembershipForUpdate, []interface{}{companyID, userID}, membershipDest(membership)...)
+	if err == ErrNoRows {
+		return NewNotFoundError("member", userID)
+	}
+	return err
+}
+
+// addUserInCompany must run in a transaction, which is rolled back if the company exceeds its
+// maximum of members.
+func addUserInCompany(ctx context.Context, querier Querier, userID, companyID uuid.UUID, role string) (entity.Membership, error) {
+	var membership entity.Membership
+	if role == "" {
+		role = entity.MembershipRoleMember
+	}
+	err := querier.QueryRowContext(ctx, insertUserInCompany, companyID, userID, role).Scan(membershipDest(&membership)...)
+	if err == nil {
+		return membership, checkUsage(ctx, querier, companyID.String(), entity.QuotaMembers)
+	}
+
+	if err == sql.ErrNoRows {
+		return membership, NewNotFoundError("user", userID.String())
+	}
+	// The user has been selected from its table, only the company can violate a foreign key.
+	if code, constraint, _ := violation(err); code == ErrFKViolation {
+		return membership, NewNotFoundError("company", companyID.String())
+	} else if code == ErrUniqViolation && constraint == "unq_set" {
+		return membership, NewDupUserInCompanyError(userID.String())
+	}
+
+	log.G(ctx).WithError(err).Error("failed to insert user in company")
+	return membership, ErrGenericDBFailure
+}
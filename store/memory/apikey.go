@@ -0,0 +1,103 @@
+package memory
+
+import (
+	"context"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+)
+
+type apiKeyRow struct {
+	entity.APIKey
+	keyHash string
+	seq     int64
+}
+
+type APIKey struct {
+	log log.Logger
+	db  *DB
+}
+
+func NewAPIKeyStore(log log.Logger, db *DB) *APIKey {
+	return &APIKey{log: log, db: db}
+}
+
+func (s *APIKey) DeleteAll() error {
+	return s.db.write(s.db, func(d *data) error {
+		d.apiKeys = make(map[uuid.UUID]apiKeyRow)
+		return nil
+	})
+}
+
+// Add creates a key of the company, unless it exceeds its maximum of API keys.
+func (s *APIKey) Add(ctx context.Context, querier store.Querier, companyID, name, key string) (entity.APIKey, error) {
+	var apiKey entity.APIKey
+	err := s.db.write(querier, func(d *data) error {
+		company, ok := d.company(companyID)
+		if !ok || company.DeletedAt != nil {
+			return store.NewNotFoundError("company", companyID)
+		}
+		if err := d.checkQuota(company.ID, entity.QuotaAPIKeys, d.usage(company.ID, entity.QuotaAPIKeys)+1); err != nil {
+			return err
+		}
+		apiKey = entity.APIKey{ID: uuid.New(), CompanyID: company.ID, Name: name, Prefix: store.APIKeyPrefix(key), CreatedAt: now()}
+		d.own(apiKeysTable)
+		d.apiKeys[apiKey.ID] = apiKeyRow{APIKey: apiKey, keyHash: string(store.HashAPIKey(key)), seq: d.nextSeq()}
+		return d.recordEvent(ctx, entity.AuditActionCreate, "api_key", apiKey.ID.String(), nil, apiKey)
+	})
+	apiKey.Key = key
+	return apiKey, err
+}
+
+// List returns the keys of the company, the oldest first.
+func (s *APIKey) List(ctx context.Context, querier store.Querier, companyID string) ([]entity.APIKey, error) {
+	var rows []apiKeyRow
+	s.db.read(querier, func(d *data) error {
+		id, _ := parseID(companyID)
+		for _, row := range d.apiKeys {
+			if row.CompanyID == id {
+				rows = append(rows, row)
+			}
+		}
+		return nil
+	})
+	sort.Slice(rows, func(i, j int) bool { return rows[i].seq < rows[j].seq })
+
+	keys := make([]entity.APIKey, len(rows))
+	for k, row := range rows {
+		keys[k] = row.APIKey
+	}
+	return keys, nil
+}
+
+// Authenticate returns the API key, unless it doesn't exist or its company is soft deleted.
+func (s *APIKey) Authenticate(ctx context.Context, querier store.Querier, key string) (entity.APIKey, error) {
+	var apiKey entity.APIKey
+	err := s.db.read(querier, func(d *data) error {
+		keyHash := string(store.HashAPIKey(key))
+		for _, row := range d.apiKeys {
+			if row.keyHash == keyHash && d.companies[row.CompanyID].DeletedAt == nil {
+				apiKey = row.APIKey
+				return nil
+			}
+		}
+		return store.NewNotFoundError("api key", "key")
+	})
+	return apiKey, err
+}
+
+func (s *APIKey) DeleteByID(ctx context.Context, querier store.Querier, companyID, ID string) error {
+	return s.db.write(querier, func(d *data) error {
+		id, ok := parseID(ID)
+		row, found := d.apiKeys[id]
+		if !ok || !found || row.CompanyID.String() != companyID {
+			return store.NewNotFoundError("api key", ID)
+		}
+		d.own(apiKeysTable)
+		delete(d.apiKeys, id)
+		return d.recordEvent(ctx, entity.AuditActionDelete, "api_key", ID, row.APIKey, nil)
+	})
+}
@@ -0,0 +1,311 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/pkg/textsearch"
+	"github.com/jordanp/goapp/store"
+)
+
+type Company struct {
+	log log.Logger
+	db  *DB
+}
+
+func NewCompanyStore(log log.Logger, db *DB) *Company {
+	return &Company{log: log, db: db}
+}
+
+func (s *Company) DeleteAll() error {
+	return s.db.write(s.db, func(d *data) error {
+		d.companies = make(map[uuid.UUID]entity.Company)
+		d.memberships = make(map[membershipKey]membershipRow)
+		d.invitations = make(map[uuid.UUID]invitationRow)
+		d.limits = make(map[uuid.UUID]entity.CompanyLimits)
+		d.requests = make(map[requestKey]int)
+		d.apiKeys = make(map[uuid.UUID]apiKeyRow)
+		return nil
+	})
+}
+
+// Add creates the company along with its members, whose CompanyID is ignored.
+func (s *Company) Add(ctx context.Context, querier store.Querier, name string, members []entity.Membership, metadata entity.Metadata) (entity.Company, error) {
+	var company entity.Company
+	err := s.db.write(querier, func(d *data) error {
+		var err error
+		company, err = d.addCompany(ctx, name, members, metadata)
+		return err
+	})
+	return company, err
+}
+
+// ForEach calls fn for every company, ordered by name, until fn returns an error. The
+// members of the companies aren't loaded.
+func (s *Company) ForEach(ctx context.Context, querier store.Querier, filter store.Filter, fn func(entity.Company) error) error {
+	var companies []entity.Company
+	s.db.read(querier, func(d *data) error {
+		for _, company := range d.companies {
+			if matches(filter, company.UpdatedAt, company.DeletedAt, company.Metadata) {
+				companies = append(companies, company)
+			}
+		}
+		return nil
+	})
+	sortCompanies(companies)
+
+	for _, company := range companies {
+		if err := fn(company); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteByID soft deletes the company. It can be restored, along with its members, until it's purged.
+func (s *Company) DeleteByID(ctx context.Context, querier store.Querier, ID string) error {
+	return s.db.write(querier, func(d *data) error {
+		company, ok := d.company(ID)
+		if !ok || company.DeletedAt != nil {
+			return store.NewNotFoundError("company", ID)
+		}
+		before := company
+		deletedAt := now()
+		company.DeletedAt = &deletedAt
+		company.UpdatedAt = deletedAt
+		d.own(companiesTable)
+		d.companies[company.ID] = company
+		return d.recordEvent(ctx, entity.AuditActionDelete, "company", ID, before, company)
+	})
+}
+
+// GetByID returns the company and its members. includeDeleted applies to both.
+func (s *Company) GetByID(ctx context.Context, querier store.Querier, ID string, includeDeleted bool) (entity.Company, error) {
+	var company entity.Company
+	err := s.db.read(querier, func(d *data) error {
+		var ok bool
+		company, ok = d.company(ID)
+		if !ok || (!includeDeleted && company.DeletedAt != nil) {
+			return store.NewNotFoundError("company", ID)
+		}
+
+		var memberships []membershipRow
+		for key, membership := range d.memberships {
+			if key.companyID == company.ID {
+				memberships = append(memberships, membership)
+			}
+		}
+		sort.Slice(memberships, func(i, j int) bool { return memberships[i].seq < memberships[j].seq })
+
+		for _, membership := range memberships {
+			row := d.users[membership.UserID]
+			if !includeDeleted && row.DeletedAt != nil {
+				continue
+			}
+			user := row.public()
+			user.CompanyRole = membership.Role
+			company.Users = append(company.Users, user)
+		}
+		return nil
+	})
+	return company, err
+}
+
+// Update applies the non nil fields of the patch. If version isn't zero, the update only
+// succeeds if it matches the current version of the company.
+func (s *Company) Update(ctx context.Context, querier store.Querier, ID string, patch entity.CompanyPatch, version int) (entity.Company, error) {
+	var company entity.Company
+	err := s.db.write(querier, func(d *data) error {
+		var ok bool
+		company, ok = d.company(ID)
+		if !ok || company.DeletedAt != nil {
+			return store.NewNotFoundError("company", ID)
+		}
+		if version != 0 && version != company.Version {
+			return store.NewVersionConflictError("company", ID, company.Version)
+		}
+		before := company
+
+		if patch.Name != nil {
+			company.Name = *patch.Name
+		}
+		if patch.Metadata != nil {
+			company.Metadata = metadata(patch.Metadata)
+		}
+		if err := d.checkUniqueCompany(company); err != nil {
+			return err
+		}
+		company.UpdatedAt = now()
+		company.Version++
+		d.own(companiesTable)
+		d.companies[company.ID] = company
+		return d.recordEvent(ctx, entity.AuditActionUpdate, "company", ID, before, company)
+	})
+	return company, err
+}
+
+func (s *Company) Restore(ctx context.Context, querier store.Querier, ID string) (entity.Company, error) {
+	var company entity.Company
+	err := s.db.write(querier, func(d *data) error {
+		var ok bool
+		company, ok = d.company(ID)
+		if !ok || company.DeletedAt == nil {
+			return store.NewNotFoundError("deleted company", ID)
+		}
+		before := company
+		company.DeletedAt = nil
+		company.UpdatedAt = now()
+		d.own(companiesTable)
+		d.companies[company.ID] = company
+		return d.recordEvent(ctx, entity.AuditActionRestore, "company", ID, before, company)
+	})
+	return company, err
+}
+
+// Purge hard deletes the companies that have been soft deleted for longer than the retention.
+func (s *Company) Purge(ctx context.Context, querier store.Querier, retention time.Duration) (int64, error) {
+	var n int64
+	err := s.db.write(querier, func(d *data) error {
+		cutoff := now().Add(-retention)
+		var purged []entity.Company
+		for _, company := range d.companies {
+			if company.DeletedAt != nil && company.DeletedAt.Before(cutoff) {
+				purged = append(purged, company)
+			}
+		}
+		sortCompanies(purged)
+
+		// The children which aren't purged become root companies, their moves are audited
+		var children []entity.Company
+		for _, company := range d.companies {
+			if company.ParentID == nil || (company.DeletedAt != nil && company.DeletedAt.Before(cutoff)) {
+				continue
+			}
+			if parent := d.companies[*company.ParentID]; parent.DeletedAt != nil && parent.DeletedAt.Before(cutoff) {
+				children = append(children, company)
+			}
+		}
+		sortCompanies(children)
+		for _, before := range children {
+			after := before
+			after.ParentID, after.UpdatedAt, after.Version = nil, now(), before.Version+1
+			d.own(companiesTable)
+			d.companies[after.ID] = after
+			if err := d.recordEvent(ctx, entity.AuditActionMove, "company", after.ID.String(), before, after); err != nil {
+				return err
+			}
+		}
+
+		if len(purged) > 0 {
+			d.own(companiesTable | membershipsTable | invitationsTable | apiKeysTable | requestsTable | limitsTable)
+		}
+		for _, company := range purged {
+			delete(d.companies, company.ID)
+			for key := range d.memberships {
+				if key.companyID == company.ID {
+					delete(d.memberships, key)
+				}
+			}
+			for ID, invitation := range d.invitations {
+				if invitation.CompanyID == company.ID {
+					delete(d.invitations, ID) // ON DELETE CASCADE
+				}
+			}
+			for ID, apiKey := range d.apiKeys {
+				if apiKey.CompanyID == company.ID {
+					delete(d.apiKeys, ID)
+				}
+			}
+			for key := range d.requests {
+				if key.companyID == company.ID {
+					delete(d.requests, key)
+				}
+			}
+			delete(d.limits, company.ID)
+			if err := d.recordEvent(ctx, entity.AuditActionPurge, "company", company.ID.String(), company, nil); err != nil {
+				return err
+			}
+		}
+		n = int64(len(purged))
+		return nil
+	})
+	return n, err
+}
+
+func (s *Company) Search(ctx context.Context, querier store.Querier, q entity.SearchQuery) ([]entity.SearchResult, error) {
+	var results []entity.SearchResult
+	s.db.read(querier, func(d *data) error {
+		for _, company := range d.liveCompanies() {
+			if rank, highlight, ok := textsearch.Match(q.Query, company.Name); ok {
+				results = append(results, entity.SearchResult{Kind: entity.SearchKindCompany, ID: company.ID, Label: company.Name, Highlight: highlight, Rank: rank})
+			}
+		}
+		return nil
+	})
+	return topResults(results, q.Limit), nil
+}
+
+func (d *data) addCompany(ctx context.Context, name string, members []entity.Membership, m entity.Metadata) (entity.Company, error) {
+	createdAt := now()
+	company := entity.Company{ID: uuid.New(), Name: name, CreatedAt: createdAt, UpdatedAt: createdAt, Version: 1, Metadata: metadata(m)}
+	if err := d.checkUniqueCompany(company); err != nil {
+		return entity.Company{}, err
+	}
+	d.own(companiesTable)
+	d.companies[company.ID] = company
+
+	insertedMembers := make([]entity.Membership, len(members))
+	for k := range members {
+		var err error
+		insertedMembers[k], err = d.addUserInCompany(members[k].UserID, company.ID, members[k].Role)
+		if err != nil {
+			return company, err
+		}
+	}
+
+	after := struct {
+		entity.Company
+		Members []entity.Membership `json:"members"`
+	}{company, insertedMembers}
+	return company, d.recordEvent(ctx, entity.AuditActionCreate, "company", company.ID.String(), nil, after)
+}
+
+// checkUniqueCompany enforces the unq_name constraint, which soft deleted companies are
+// subject to.
+func (d *data) checkUniqueCompany(company entity.Company) error {
+	for _, row := range d.companies {
+		if row.ID != company.ID && row.Name == company.Name {
+			return store.NewAlreadyExistsError("company", company.Name)
+		}
+	}
+	return nil
+}
+
+func (d *data) company(ID string) (entity.Company, bool) {
+	id, ok := parseID(ID)
+	if !ok {
+		return entity.Company{}, false
+	}
+	company, ok := d.companies[id]
+	return company, ok
+}
+
+// liveCompanies returns the companies which aren't soft deleted, ordered by name.
+func (d *data) liveCompanies() []entity.Company {
+	var companies []entity.Company
+	for _, company := range d.companies {
+		if company.DeletedAt == nil {
+			companies = append(companies, company)
+		}
+	}
+	sortCompanies(companies)
+	return companies
+}
+
+func sortCompanies(companies []entity.Company) {
+	sort.Slice(companies, func(i, j int) bool { return companies[i].Name < companies[j].Name })
+}
@@ -0,0 +1,148 @@
+package memory
+
+import (
+	"context"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/store"
+)
+
+// Move makes parentID the parent of the company, or makes it a root company if parentID is
+// empty. Its subtree moves along. It returns a CycleError if the parent is the company or one
+// of its descendants. If version isn't zero, the move only succeeds if it matches the current
+// version of the company.
+func (s *Company) Move(ctx context.Context, querier store.Querier, ID, parentID string, version int) (entity.Company, error) {
+	var company entity.Company
+	err := s.db.write(querier, func(d *data) error {
+		var ok bool
+		company, ok = d.company(ID)
+		if !ok || company.DeletedAt != nil {
+			return store.NewNotFoundError("company", ID)
+		}
+		if version != 0 && version != company.Version {
+			return store.NewVersionConflictError("company", ID, company.Version)
+		}
+		before := company
+
+		company.ParentID = nil
+		if parentID != "" {
+			parent, ok := d.company(parentID)
+			if !ok || parent.DeletedAt != nil {
+				return store.NewNotFoundError("parent company", parentID)
+			}
+			for ancestor, ok := parent, true; ok; ancestor, ok = d.parent(ancestor) {
+				if ancestor.ID == company.ID {
+					return store.NewCycleError(ID, parentID)
+				}
+			}
+			company.ParentID = &parent.ID
+		}
+		company.UpdatedAt = now()
+		company.Version++
+		d.own(companiesTable)
+		d.companies[company.ID] = company
+		return d.recordEvent(ctx, entity.AuditActionMove, "company", ID, before, company)
+	})
+	return company, err
+}
+
+// Ancestors returns the ancestors of the company, its parent first. Unless includeDeleted is
+// true, the company must not be soft deleted and the ancestors stop at the first soft deleted
+// one.
+func (s *Company) Ancestors(ctx context.Context, querier store.Querier, ID string, includeDeleted bool) ([]entity.Company, error) {
+	ancestors := []entity.Company{}
+	err := s.db.read(querier, func(d *data) error {
+		company, ok := d.company(ID)
+		if !ok || (!includeDeleted && company.DeletedAt != nil) {
+			return store.NewNotFoundError("company", ID)
+		}
+		for ancestor, ok := d.parent(company); ok && (includeDeleted || ancestor.DeletedAt == nil); ancestor, ok = d.parent(ancestor) {
+			ancestors = append(ancestors, ancestor)
+		}
+		return nil
+	})
+	return ancestors, err
+}
+
+// Descendants returns the descendants of the company level by level, each level ordered by
+// name. Unless includeDeleted is true, the company must not be soft deleted and the subtrees of
+// the soft deleted descendants are left out.
+func (s *Company) Descendants(ctx context.Context, querier store.Querier, ID string, includeDeleted bool) ([]entity.Company, error) {
+	descendants := []entity.Company{}
+	err := s.db.read(querier, func(d *data) error {
+		company, ok := d.company(ID)
+		if !ok || (!includeDeleted && company.DeletedAt != nil) {
+			return store.NewNotFoundError("company", ID)
+		}
+
+		parents := map[uuid.UUID]bool{company.ID: true}
+		for len(parents) > 0 {
+			var level []entity.Company
+			for _, child := range d.companies {
+				if child.ParentID != nil && parents[*child.ParentID] && (includeDeleted || child.DeletedAt == nil) {
+					level = append(level, child)
+				}
+			}
+			sortCompanies(level)
+			descendants = append(descendants, level...)
+
+			parents = make(map[uuid.UUID]bool, len(level))
+			for _, child := range level {
+				parents[child.ID] = true
+			}
+		}
+		return nil
+	})
+	return descendants, err
+}
+
+// EffectiveMembers returns the members of the company and the ones inherited from its
+// ancestors, the nearest first. includeDeleted applies to the companies and to the users.
+func (s *Company) EffectiveMembers(ctx context.Context, querier store.Querier, ID string, includeDeleted bool) ([]entity.EffectiveMember, error) {
+	members := []entity.EffectiveMember{}
+	err := s.db.read(querier, func(d *data) error {
+		company, ok := d.company(ID)
+		if !ok || (!includeDeleted && company.DeletedAt != nil) {
+			return store.NewNotFoundError("company", ID)
+		}
+
+		seen := make(map[uuid.UUID]bool)
+		for ancestor, ok := company, true; ok && (includeDeleted || ancestor.DeletedAt == nil); ancestor, ok = d.parent(ancestor) {
+			var memberships []membershipRow
+			for key, membership := range d.memberships {
+				if key.companyID == ancestor.ID {
+					memberships = append(memberships, membership)
+				}
+			}
+			sort.Slice(memberships, func(i, j int) bool { return memberships[i].seq < memberships[j].seq })
+
+			for _, membership := range memberships {
+				row := d.users[membership.UserID]
+				if seen[row.ID] || (!includeDeleted && row.DeletedAt != nil) {
+					continue // The nearest membership prevails
+				}
+				seen[row.ID] = true
+				member := entity.EffectiveMember{User: row.public()}
+				member.CompanyRole = membership.Role
+				if ancestor.ID != company.ID {
+					inheritedFrom := ancestor.ID
+					member.InheritedFrom = &inheritedFrom
+				}
+				members = append(members, member)
+			}
+		}
+		return nil
+	})
+	return members, err
+}
+
+// parent returns the parent of the company, if any.
+func (d *data) parent(company entity.Company) (entity.Company, bool) {
+	if company.ParentID == nil {
+		return entity.Company{}, false
+	}
+	parent, ok := d.companies[*company.ParentID]
+	return parent, ok
+}
@@ -0,0 +1,114 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+)
+
+type idempotencyKey struct {
+	actor, key string
+}
+
+// eraseIdempotentResponses deletes the keys of the requests made by the actor, and of the
+// responses which mention ID, like the SQL store.
+func (d *data) eraseIdempotentResponses(actor, ID string) {
+	for key, req := range d.idempotency {
+		if key.actor == actor || bytes.Contains(req.Body, []byte(ID)) {
+			d.own(idempotencyTable)
+			delete(d.idempotency, key)
+		}
+	}
+}
+
+type Idempotency struct {
+	log log.Logger
+	db  *DB
+}
+
+func NewIdempotencyStore(log log.Logger, db *DB) *Idempotency {
+	return &Idempotency{log: log, db: db}
+}
+
+// Begin takes the key of the actor for a request with the fingerprint, until the ttl expires.
+// started is false if the key was already taken, the request returned is the one which took it.
+// The key of a request still in progress after the lease is taken again.
+func (s *Idempotency) Begin(ctx context.Context, querier store.Querier, actor, key, fingerprint string, ttl, lease time.Duration) (req entity.IdempotentRequest, started bool, err error) {
+	err = s.db.write(querier, func(d *data) error {
+		t := now()
+		existing, ok := d.idempotency[idempotencyKey{actor, key}]
+		if ok && existing.ExpiresAt.After(t) && (existing.StatusCode != 0 || existing.CreatedAt.Add(lease).After(t)) {
+			req = existing
+			return nil
+		}
+		req = entity.IdempotentRequest{
+			Actor: actor, Key: key, Fingerprint: fingerprint, Header: map[string][]string{}, Body: []byte{},
+			CreatedAt: t, ExpiresAt: t.Add(ttl).Truncate(time.Microsecond),
+		}
+		d.own(idempotencyTable)
+		d.idempotency[idempotencyKey{actor, key}] = req
+		started = true
+		return nil
+	})
+	return req, started, err
+}
+
+// Complete stores the response of the request which took the key, the first response stored is
+// kept.
+func (s *Idempotency) Complete(ctx context.Context, querier store.Querier, actor, key string, statusCode int, header map[string][]string, body []byte) error {
+	return s.db.write(querier, func(d *data) error {
+		req, ok := d.idempotency[idempotencyKey{actor, key}]
+		if !ok || req.StatusCode != 0 {
+			return nil
+		}
+		req.StatusCode = statusCode
+		req.Header = make(map[string][]string, len(header))
+		for k, v := range header {
+			req.Header[k] = append([]string(nil), v...)
+		}
+		req.Body = append([]byte{}, body...)
+		d.own(idempotencyTable)
+		d.idempotency[idempotencyKey{actor, key}] = req
+		return nil
+	})
+}
+
+// Release frees the key of a request in progress, so that it can be retried. It's meant for the
+// requests which failed without a response worth replaying.
+func (s *Idempotency) Release(ctx context.Context, querier store.Querier, actor, key string) error {
+	return s.db.write(querier, func(d *data) error {
+		if req, ok := d.idempotency[idempotencyKey{actor, key}]; ok && req.StatusCode == 0 {
+			d.own(idempotencyTable)
+			delete(d.idempotency, idempotencyKey{actor, key})
+		}
+		return nil
+	})
+}
+
+// Purge deletes the expired keys and returns how many were.
+func (s *Idempotency) Purge(ctx context.Context, querier store.Querier) (int64, error) {
+	var n int64
+	err := s.db.write(querier, func(d *data) error {
+		t := now()
+		for k, req := range d.idempotency {
+			if !req.ExpiresAt.After(t) {
+				d.own(idempotencyTable)
+				delete(d.idempotency, k)
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (s *Idempotency) DeleteAll() error {
+	return s.db.write(s.db, func(d *data) error {
+		d.idempotency = make(map[idempotencyKey]entity.IdempotentRequest)
+		return nil
+	})
+}
@@ -0,0 +1,95 @@
+package memory
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+)
+
+type Importer struct {
+	log log.Logger
+	db  *DB
+}
+
+func NewImporter(log log.Logger, db *DB) *Importer {
+	return &Importer{log: log, db: db}
+}
+
+// Import has the same semantics as store.Importer.Import, each row is rolled back on its own
+// when it fails.
+func (s *Importer) Import(ctx context.Context, querier store.Querier, opts entity.ImportOptions, rows []entity.ImportRow) (entity.ImportReport, error) {
+	report := entity.ImportReport{
+		Kind:   opts.Kind,
+		Mode:   opts.Mode,
+		DryRun: opts.DryRun,
+		Total:  len(rows),
+		Errors: []entity.ImportError{},
+	}
+
+	err := s.db.write(querier, func(d *data) error {
+		before := d.savepoint()
+		for _, row := range rows {
+			rowErr := row.Err
+			if rowErr == nil {
+				savepoint := d.savepoint()
+				if rowErr = d.importRow(ctx, row); rowErr != nil {
+					*d = *savepoint
+				}
+			}
+			if rowErr != nil {
+				report.Failed++
+				report.Errors = append(report.Errors, entity.ImportError{Row: row.Row, Message: rowErr.Error()})
+				continue
+			}
+			report.Imported++
+		}
+
+		report.Committed = !opts.DryRun && (opts.Mode != entity.ImportModeAtomic || report.Failed == 0)
+		if !report.Committed {
+			*d = *before
+		}
+		return nil
+	})
+	return report, err
+}
+
+func (d *data) importRow(ctx context.Context, row entity.ImportRow) error {
+	switch {
+	case row.User != nil:
+		_, err := d.addUser(ctx, row.User.Login, row.User.Password, row.User.Email, row.User.Role, row.User.Metadata)
+		return err
+	case row.Company != nil:
+		_, err := d.addCompany(ctx, row.Company.Name, nil, row.Company.Metadata)
+		return err
+	case row.Membership != nil:
+		return d.importMembership(ctx, *row.Membership)
+	}
+	return errors.New("empty row")
+}
+
+func (d *data) importMembership(ctx context.Context, m entity.ImportMembership) error {
+	var company *entity.Company
+	for _, c := range d.companies {
+		if c.Name == m.Company && c.DeletedAt == nil {
+			c := c
+			company = &c
+			break
+		}
+	}
+	if company == nil {
+		return store.NewNotFoundError("company", m.Company)
+	}
+	user, ok := d.userByLogin(m.User)
+	if !ok {
+		return store.NewNotFoundError("user", m.User)
+	}
+
+	membership, err := d.addUserInCompany(user.ID, company.ID, m.Role)
+	if err != nil {
+		return err
+	}
+	return d.recordEvent(ctx, entity.AuditActionCreate, "membership", store.MembershipID(company.ID.String(), user.ID.String()), nil, membership)
+}
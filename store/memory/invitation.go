@@ -0,0 +1,234 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+)
+
+// invitationRow holds the status as stored, the expired status is computed by public.
+type invitationRow struct {
+	entity.Invitation
+	tokenHash string
+	seq       int64
+}
+
+func (r invitationRow) public() entity.Invitation {
+	invitation := r.Invitation
+	if invitation.Status == entity.InvitationStatusPending && !invitation.ExpiresAt.After(now()) {
+		invitation.Status = entity.InvitationStatusExpired
+	}
+	return invitation
+}
+
+// eraseInvitations replaces the email of the invitations of an erased user with its placeholder,
+// and revokes the pending ones, like the SQL store.
+func (d *data) eraseInvitations(ID uuid.UUID, email, login, erasedLogin string) {
+	t := now()
+	for key, row := range d.invitations {
+		if row.Email == email || (row.UserID != nil && *row.UserID == ID) {
+			row.Email = store.ErasedEmail(ID.String())
+			if row.Status == entity.InvitationStatusPending {
+				row.Status = entity.InvitationStatusRevoked
+			}
+			row.UpdatedAt = t
+		}
+		if row.InvitedBy == login {
+			row.InvitedBy = erasedLogin
+		}
+		d.own(invitationsTable)
+		d.invitations[key] = row
+	}
+}
+
+type Invitation struct {
+	log log.Logger
+	db  *DB
+}
+
+func NewInvitationStore(log log.Logger, db *DB) *Invitation {
+	return &Invitation{log: log, db: db}
+}
+
+func (s *Invitation) DeleteAll() error {
+	return s.db.write(s.db, func(d *data) error {
+		d.invitations = make(map[uuid.UUID]invitationRow)
+		return nil
+	})
+}
+
+// Add enforces the unq_invitations_pending constraint, the emails only match as a whole like
+// their blind index in the SQL store.
+func (s *Invitation) Add(ctx context.Context, querier store.Querier, invitation entity.Invitation, ttl time.Duration) (entity.Invitation, error) {
+	if invitation.Role == "" {
+		invitation.Role = entity.MembershipRoleMember
+	}
+	token, err := store.NewInvitationToken()
+	if err != nil {
+		return entity.Invitation{}, store.ErrGenericDBFailure
+	}
+	err = s.db.write(querier, func(d *data) error {
+		if company, ok := d.companies[invitation.CompanyID]; !ok || company.DeletedAt != nil {
+			return store.NewNotFoundError("company", invitation.CompanyID.String())
+		}
+		for _, row := range d.invitations {
+			if row.CompanyID == invitation.CompanyID && row.Email == invitation.Email && row.Status == entity.InvitationStatusPending {
+				return store.NewAlreadyExistsError("invitation", invitation.Email)
+			}
+		}
+		t := now()
+		invitation.ID, invitation.Status, invitation.Sends, invitation.UserID = uuid.New(), entity.InvitationStatusPending, 1, nil
+		invitation.ExpiresAt, invitation.CreatedAt, invitation.UpdatedAt = t.Add(ttl).Truncate(time.Microsecond), t, t
+		d.own(invitationsTable)
+		d.invitations[invitation.ID] = invitationRow{Invitation: invitation, tokenHash: string(store.HashInvitationToken(token)), seq: d.nextSeq()}
+		return d.recordEvent(ctx, entity.AuditActionCreate, "invitation", invitation.ID.String(), nil, invitation)
+	})
+	return invitation, err
+}
+
+func (s *Invitation) GetByID(ctx context.Context, querier store.Querier, ID string) (entity.Invitation, error) {
+	var invitation entity.Invitation
+	err := s.db.read(querier, func(d *data) error {
+		id, ok := parseID(ID)
+		row, found := d.invitations[id]
+		if !ok || !found {
+			return store.NewNotFoundError("invitation", ID)
+		}
+		invitation = row.public()
+		return nil
+	})
+	return invitation, err
+}
+
+func (d *data) invitationByToken(token string) (invitationRow, bool) {
+	tokenHash := string(store.HashInvitationToken(token))
+	for _, row := range d.invitations {
+		if row.tokenHash == tokenHash {
+			return row, true
+		}
+	}
+	return invitationRow{}, false
+}
+
+// List returns the invitations of a company matching the filter, the latest first.
+func (s *Invitation) List(ctx context.Context, querier store.Querier, filter entity.InvitationFilter) ([]entity.Invitation, error) {
+	invitations := []entity.Invitation{}
+	s.db.read(querier, func(d *data) error {
+		companyID, ok := parseID(filter.CompanyID)
+		if !ok {
+			return nil
+		}
+		var rows []invitationRow
+		for _, row := range d.invitations {
+			if row.CompanyID == companyID && (filter.Status == "" || row.public().Status == filter.Status) {
+				rows = append(rows, row)
+			}
+		}
+		sort.Slice(rows, func(i, j int) bool { return rows[i].seq > rows[j].seq })
+
+		for k := filter.Offset; k < len(rows) && k < filter.Offset+filter.Limit; k++ {
+			invitations = append(invitations, rows[k].public())
+		}
+		return nil
+	})
+	return invitations, nil
+}
+
+// Resend replaces the token of a pending invitation, even an expired one, with one which is
+// never sent.
+func (s *Invitation) Resend(ctx context.Context, querier store.Querier, ID string, ttl time.Duration) (entity.Invitation, error) {
+	token, err := store.NewInvitationToken()
+	if err != nil {
+		return entity.Invitation{}, store.ErrGenericDBFailure
+	}
+	return s.update(ctx, querier, ID, entity.AuditActionUpdate, func(row *invitationRow) {
+		t := now()
+		row.tokenHash = string(store.HashInvitationToken(token))
+		row.ExpiresAt = t.Add(ttl).Truncate(time.Microsecond)
+		row.Sends++
+		row.UpdatedAt = t
+	})
+}
+
+// Issue replaces the token of the nth send of a pending invitation which hasn't expired, without
+// auditing it.
+func (s *Invitation) Issue(ctx context.Context, querier store.Querier, ID string, sends int, token string) (entity.Invitation, error) {
+	var invitation entity.Invitation
+	err := s.db.write(querier, func(d *data) error {
+		id, ok := parseID(ID)
+		row, found := d.invitations[id]
+		if !ok || !found || row.Sends != sends || row.public().Status != entity.InvitationStatusPending {
+			return store.NewNotFoundError("pending invitation", ID)
+		}
+		row.tokenHash = string(store.HashInvitationToken(token))
+		d.own(invitationsTable)
+		d.invitations[id] = row
+		invitation = row.public()
+		return nil
+	})
+	return invitation, err
+}
+
+// Revoke cancels a pending invitation, even an expired one.
+func (s *Invitation) Revoke(ctx context.Context, querier store.Querier, ID string) (entity.Invitation, error) {
+	return s.update(ctx, querier, ID, entity.AuditActionDelete, func(row *invitationRow) {
+		row.Status = entity.InvitationStatusRevoked
+		row.UpdatedAt = now()
+	})
+}
+
+// GetByToken returns the invitation to accept with the token, unless it isn't pending or expired.
+func (s *Invitation) GetByToken(ctx context.Context, querier store.Querier, token string) (entity.Invitation, error) {
+	var invitation entity.Invitation
+	err := s.db.read(querier, func(d *data) error {
+		row, ok := d.invitationByToken(token)
+		if !ok || row.public().Status != entity.InvitationStatusPending {
+			return store.NewNotFoundError("invitation", "token")
+		}
+		invitation = row.public()
+		return nil
+	})
+	return invitation, err
+}
+
+// Claim is GetByToken, the transactions hold the lock of the DB.
+func (s *Invitation) Claim(ctx context.Context, querier store.Querier, token string) (entity.Invitation, error) {
+	return s.GetByToken(ctx, querier, token)
+}
+
+// Accept records that the user accepted the pending invitation.
+func (s *Invitation) Accept(ctx context.Context, querier store.Querier, ID, userID string) (entity.Invitation, error) {
+	userUUID, ok := parseID(userID)
+	if !ok {
+		return entity.Invitation{}, store.NewNotFoundError("user", userID)
+	}
+	return s.update(ctx, querier, ID, entity.AuditActionUpdate, func(row *invitationRow) {
+		row.Status = entity.InvitationStatusAccepted
+		row.UserID = &userUUID
+		row.UpdatedAt = now()
+	})
+}
+
+// update applies fn to a pending invitation, even an expired one, and audits it with the action.
+func (s *Invitation) update(ctx context.Context, querier store.Querier, ID, action string, fn func(row *invitationRow)) (entity.Invitation, error) {
+	var invitation entity.Invitation
+	err := s.db.write(querier, func(d *data) error {
+		id, ok := parseID(ID)
+		row, found := d.invitations[id]
+		if !ok || !found || row.Status != entity.InvitationStatusPending {
+			return store.NewNotFoundError("pending invitation", ID)
+		}
+		before := row.public()
+		fn(&row)
+		d.own(invitationsTable)
+		d.invitations[id] = row
+		invitation = row.public()
+		return d.recordEvent(ctx, action, "invitation", ID, before, invitation)
+	})
+	return invitation, err
+}
@@ -0,0 +1,197 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+)
+
+type Job struct {
+	log log.Logger
+	db  *DB
+}
+
+func NewJobStore(log log.Logger, db *DB) *Job {
+	return &Job{log: log, db: db}
+}
+
+// Enqueue adds a pending job, it returns an AlreadyExistsError if its unique key is taken by a
+// job which is pending or running.
+func (s *Job) Enqueue(ctx context.Context, querier store.Querier, kind string, payload []byte, opts entity.JobOptions) (entity.Job, error) {
+	var job entity.Job
+	err := s.db.write(querier, func(d *data) error {
+		if opts.UniqueKey != "" && d.jobIndex(func(job entity.Job) bool {
+			return job.UniqueKey == opts.UniqueKey && job.Status != entity.JobStatusDead
+		}) >= 0 {
+			return store.NewAlreadyExistsError("job", opts.UniqueKey)
+		}
+
+		t := now()
+		runAt := opts.RunAt.UTC().Truncate(time.Microsecond)
+		if runAt.Before(t) {
+			runAt = t
+		}
+		d.jobSeq++
+		job = entity.Job{
+			ID: d.jobSeq, Kind: kind, Payload: append([]byte(nil), payload...), UniqueKey: opts.UniqueKey,
+			Status: entity.JobStatusPending, MaxAttempts: opts.MaxAttempts, RunAt: runAt, CreatedAt: t,
+		}
+		d.jobs = append(d.jobs, job)
+		return nil
+	})
+	return job, err
+}
+
+// jobIndex returns the index of the first job matching fn, or -1.
+func (d *data) jobIndex(fn func(entity.Job) bool) int {
+	for k := range d.jobs {
+		if fn(d.jobs[k]) {
+			return k
+		}
+	}
+	return -1
+}
+
+// sortedJobs returns the indexes of the jobs, the next to run first.
+func (d *data) sortedJobs() []int {
+	indexes := make([]int, len(d.jobs))
+	for k := range indexes {
+		indexes[k] = k
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		a, b := d.jobs[indexes[i]], d.jobs[indexes[j]]
+		if !a.RunAt.Equal(b.RunAt) {
+			return a.RunAt.Before(b.RunAt)
+		}
+		return a.ID < b.ID
+	})
+	return indexes
+}
+
+// Claim returns up to limit jobs due to run, the oldest first, as running. They aren't claimed
+// again before the lease expires, unless they fail or are released.
+func (s *Job) Claim(ctx context.Context, querier store.Querier, limit int, lease time.Duration) ([]entity.Job, error) {
+	var jobs []entity.Job
+	err := s.db.write(querier, func(d *data) error {
+		t := now()
+		for _, k := range d.sortedJobs() {
+			if len(jobs) == limit {
+				break
+			}
+			if d.jobs[k].Status == entity.JobStatusDead || d.jobs[k].RunAt.After(t) {
+				continue
+			}
+			d.own(jobsTable)
+			job := &d.jobs[k]
+			job.Status = entity.JobStatusRunning
+			job.Attempts++
+			job.RunAt = t.Add(lease)
+			jobs = append(jobs, *job)
+		}
+		return nil
+	})
+	return jobs, err
+}
+
+// Complete deletes a job which succeeded.
+func (s *Job) Complete(ctx context.Context, querier store.Querier, ID int64) error {
+	return s.db.write(querier, func(d *data) error {
+		if k := d.jobIndex(func(job entity.Job) bool { return job.ID == ID }); k >= 0 {
+			d.jobs = append(d.jobs[:k:k], d.jobs[k+1:]...)
+		}
+		return nil
+	})
+}
+
+// Fail schedules the next attempt of the job after the delay, or moves it to the dead jobs if
+// dead is true.
+func (s *Job) Fail(ctx context.Context, querier store.Querier, ID int64, reason string, delay time.Duration, dead bool) error {
+	return s.updateJob(querier, ID, func(job *entity.Job) {
+		job.Status = entity.JobStatusPending
+		if dead {
+			job.Status = entity.JobStatusDead
+		}
+		job.RunAt = now().Add(delay)
+		job.LastError = reason
+	})
+}
+
+// Release makes a running job pending again right away, without counting its attempt.
+func (s *Job) Release(ctx context.Context, querier store.Querier, ID int64) error {
+	return s.updateJob(querier, ID, func(job *entity.Job) {
+		if job.Status == entity.JobStatusRunning {
+			job.Status = entity.JobStatusPending
+			job.Attempts--
+			job.RunAt = now()
+		}
+	})
+}
+
+func (s *Job) updateJob(querier store.Querier, ID int64, fn func(*entity.Job)) error {
+	return s.db.write(querier, func(d *data) error {
+		if k := d.jobIndex(func(job entity.Job) bool { return job.ID == ID }); k >= 0 {
+			d.own(jobsTable)
+			fn(&d.jobs[k])
+		}
+		return nil
+	})
+}
+
+// List returns the jobs matching the filter, the next to run first.
+func (s *Job) List(ctx context.Context, querier store.Querier, filter entity.JobFilter) ([]entity.Job, error) {
+	var jobs []entity.Job
+	s.db.read(querier, func(d *data) error {
+		for _, k := range d.sortedJobs() {
+			job := d.jobs[k]
+			if (filter.Status == "" || job.Status == filter.Status) && (filter.Kind == "" || job.Kind == filter.Kind) {
+				jobs = append(jobs, job)
+			}
+		}
+		return nil
+	})
+
+	if filter.Offset >= len(jobs) {
+		return nil, nil
+	}
+	jobs = jobs[filter.Offset:]
+	if len(jobs) > filter.Limit {
+		jobs = jobs[:filter.Limit]
+	}
+	return jobs, nil
+}
+
+// Retry makes a dead job pending again with no attempt, it runs as soon as possible. It returns
+// an AlreadyExistsError if its unique key was taken meanwhile.
+func (s *Job) Retry(ctx context.Context, querier store.Querier, ID int64) (entity.Job, error) {
+	var job entity.Job
+	err := s.db.write(querier, func(d *data) error {
+		k := d.jobIndex(func(job entity.Job) bool { return job.ID == ID && job.Status == entity.JobStatusDead })
+		if k < 0 {
+			return store.NewNotFoundError("dead job", strconv.FormatInt(ID, 10))
+		}
+		if key := d.jobs[k].UniqueKey; key != "" && d.jobIndex(func(job entity.Job) bool {
+			return job.UniqueKey == key && job.Status != entity.JobStatusDead
+		}) >= 0 {
+			return store.NewAlreadyExistsError("job", strconv.FormatInt(ID, 10))
+		}
+		d.own(jobsTable)
+		d.jobs[k].Status = entity.JobStatusPending
+		d.jobs[k].Attempts = 0
+		d.jobs[k].RunAt = now()
+		job = d.jobs[k]
+		return nil
+	})
+	return job, err
+}
+
+func (s *Job) DeleteAll() error {
+	return s.db.write(s.db, func(d *data) error {
+		d.jobs = nil
+		return nil
+	})
+}
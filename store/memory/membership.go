@@ -0,0 +1,157 @@
+package memory
+
+import (
+	"context"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/store"
+)
+
+// AddMember adds the user to the company. An empty role stands for entity.MembershipRoleMember.
+func (s *Company) AddMember(ctx context.Context, querier store.Querier, companyID, userID, role string) (entity.Membership, error) {
+	var membership entity.Membership
+	err := s.db.write(querier, func(d *data) error {
+		company, ok := d.company(companyID)
+		if !ok || company.DeletedAt != nil {
+			return store.NewNotFoundError("company", companyID)
+		}
+		userUUID, ok := parseID(userID)
+		if !ok {
+			return store.NewNotFoundError("user", userID)
+		}
+
+		var err error
+		if membership, err = d.addUserInCompany(userUUID, company.ID, role); err != nil {
+			return err
+		}
+		return d.recordEvent(ctx, entity.AuditActionCreate, "membership", store.MembershipID(companyID, userID), nil, membership)
+	})
+	return membership, err
+}
+
+func (s *Company) UpdateMember(ctx context.Context, querier store.Querier, companyID, userID, role string) (entity.Membership, error) {
+	var membership entity.Membership
+	err := s.db.write(querier, func(d *data) error {
+		row, err := d.membership(companyID, userID)
+		if err != nil {
+			return err
+		}
+		before := row.Membership
+		row.Role = role
+		d.own(membershipsTable)
+		d.memberships[membershipKey{row.CompanyID, row.UserID}] = row
+		membership = row.Membership
+		return d.recordEvent(ctx, entity.AuditActionUpdate, "membership", store.MembershipID(companyID, userID), before, membership)
+	})
+	return membership, err
+}
+
+func (s *Company) RemoveMember(ctx context.Context, querier store.Querier, companyID, userID string) error {
+	return s.db.write(querier, func(d *data) error {
+		row, err := d.membership(companyID, userID)
+		if err != nil {
+			return err
+		}
+		d.own(membershipsTable)
+		delete(d.memberships, membershipKey{row.CompanyID, row.UserID})
+		return d.recordEvent(ctx, entity.AuditActionDelete, "membership", store.MembershipID(companyID, userID), row.Membership, nil)
+	})
+}
+
+// GetMemberships returns the companies of a user along with its role in each of them.
+func (s *Company) GetMemberships(ctx context.Context, querier store.Querier, userID string) ([]entity.Membership, error) {
+	var memberships []entity.Membership
+	err := s.db.read(querier, func(d *data) error {
+		user, ok := d.user(userID)
+		if !ok || user.DeletedAt != nil {
+			return store.NewNotFoundError("user", userID)
+		}
+
+		for _, company := range d.liveCompanies() {
+			if row, ok := d.memberships[membershipKey{company.ID, user.ID}]; ok {
+				company := company
+				membership := row.Membership
+				membership.Company = &company
+				memberships = append(memberships, membership)
+			}
+		}
+		return nil
+	})
+	return memberships, err
+}
+
+// ForEachMembership calls fn for every membership between a company and a user that aren't
+// soft deleted, until fn returns an error.
+func (s *Company) ForEachMembership(ctx context.Context, querier store.Querier, fn func(entity.ImportMembership) error) error {
+	var memberships []entity.ImportMembership
+	s.db.read(querier, func(d *data) error {
+		for key, row := range d.memberships {
+			company, user := d.companies[key.companyID], d.users[key.userID]
+			if company.DeletedAt == nil && user.DeletedAt == nil {
+				memberships = append(memberships, entity.ImportMembership{Company: company.Name, User: user.Login, Role: row.Role})
+			}
+		}
+		return nil
+	})
+	sort.Slice(memberships, func(i, j int) bool {
+		if memberships[i].Company != memberships[j].Company {
+			return memberships[i].Company < memberships[j].Company
+		}
+		return memberships[i].User < memberships[j].User
+	})
+
+	for _, membership := range memberships {
+		if err := fn(membership); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// membership returns the membership, after having checked that the company isn't soft deleted.
+func (d *data) membership(companyID, userID string) (membershipRow, error) {
+	company, ok := d.company(companyID)
+	if !ok || company.DeletedAt != nil {
+		return membershipRow{}, store.NewNotFoundError("company", companyID)
+	}
+	userUUID, ok := parseID(userID)
+	if !ok {
+		return membershipRow{}, store.NewNotFoundError("member", userID)
+	}
+	row, ok := d.memberships[membershipKey{company.ID, userUUID}]
+	if !ok {
+		return membershipRow{}, store.NewNotFoundError("member", userID)
+	}
+	return row, nil
+}
+
+// addUserInCompany fails if the user doesn't exist or is soft deleted, or if the company has
+// its maximum of members.
+func (d *data) addUserInCompany(userID, companyID uuid.UUID, role string) (entity.Membership, error) {
+	if role == "" {
+		role = entity.MembershipRoleMember
+	}
+	if user, ok := d.users[userID]; !ok || user.DeletedAt != nil {
+		return entity.Membership{}, store.NewNotFoundError("user", userID.String())
+	}
+	if _, ok := d.companies[companyID]; !ok {
+		return entity.Membership{}, store.NewNotFoundError("company", companyID.String())
+	}
+	key := membershipKey{companyID, userID}
+	if _, ok := d.memberships[key]; ok {
+		return entity.Membership{}, store.NewDupUserInCompanyError(userID.String())
+	}
+	if err := d.checkQuota(companyID, entity.QuotaMembers, d.usage(companyID, entity.QuotaMembers)+1); err != nil {
+		return entity.Membership{}, err
+	}
+
+	row := membershipRow{
+		Membership: entity.Membership{CompanyID: companyID, UserID: userID, Role: role, CreatedAt: now()},
+		seq:        d.nextSeq(),
+	}
+	d.own(membershipsTable)
+	d.memberships[key] = row
+	return row.Membership, nil
+}
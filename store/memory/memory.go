@@ -0,0 +1,419 @@
+// Package memory implements the stores in memory, for demos and frontend development. Its
+// data is lost when the application stops.
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+)
+
+// DB holds the data shared by the stores. Mutations are applied to a copy of the tables they
+// change, which only replaces the data on success, so that failed mutations are rolled back like
+// transactions. The other tables are shared, a write doesn't copy the whole data.
+//
+// DB and Tx are the store.Querier of the stores in this package. They can't run SQL queries,
+// the embedded Querier is nil.
+type DB struct {
+	store.Querier
+	mu      sync.RWMutex
+	data    *data
+	changes store.ChangeHub
+}
+
+func NewDB() *DB {
+	return &DB{data: &data{
+		users:       make(map[uuid.UUID]userRow),
+		companies:   make(map[uuid.UUID]entity.Company),
+		memberships: make(map[membershipKey]membershipRow),
+		webhooks:    make(map[uuid.UUID]webhookRow),
+		idempotency: make(map[idempotencyKey]entity.IdempotentRequest),
+		invitations: make(map[uuid.UUID]invitationRow),
+		limits:      make(map[uuid.UUID]entity.CompanyLimits),
+		requests:    make(map[requestKey]int),
+		apiKeys:     make(map[uuid.UUID]apiKeyRow),
+		schemas:     make(map[string]entity.MetadataSchema),
+	}}
+}
+
+// Tx is a transaction begun by WithTx, it holds the copy of the data being mutated.
+type Tx struct {
+	store.Querier
+	data *data
+}
+
+// WithTx implements store.Transactor. The DB is locked until fn returns, so fn must only call
+// the stores with tx: the lock isn't reentrant, a store called with the DB from fn deadlocks.
+func (db *DB) WithTx(ctx context.Context, fn func(tx store.Querier) error) error {
+	return db.write(db, func(d *data) error {
+		return fn(&Tx{data: d})
+	})
+}
+
+// read and write run fn with the data of the transaction if querier is one, and lock the DB
+// otherwise.
+func (db *DB) read(querier store.Querier, fn func(d *data) error) error {
+	if tx, ok := querier.(*Tx); ok {
+		return fn(tx.data)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return fn(db.data)
+}
+
+func (db *DB) write(querier store.Querier, fn func(d *data) error) error {
+	if tx, ok := querier.(*Tx); ok {
+		return fn(tx.data)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	tx := db.data.begin()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	changes := tx.changes
+	tx.changes, tx.owned = nil, 0
+	db.data = tx
+	db.changes.Publish(changes...)
+	return nil
+}
+
+// Listen returns a listener of the changes committed from now on.
+func (db *DB) Listen() *store.Listener {
+	return db.changes.Listen()
+}
+
+// seq orders the records by creation, like the created_at and id columns of the SQL tables.
+type userRow struct {
+	entity.User
+	seq int64
+}
+
+// public returns the user without its password hash.
+func (r userRow) public() entity.User {
+	user := r.User
+	user.Password = ""
+	return user
+}
+
+type membershipKey struct {
+	companyID, userID uuid.UUID
+}
+
+type membershipRow struct {
+	entity.Membership
+	seq int64
+}
+
+type data struct {
+	seq         int64
+	eventSeq    int64
+	users       map[uuid.UUID]userRow
+	companies   map[uuid.UUID]entity.Company
+	memberships map[membershipKey]membershipRow
+	events      []entity.AuditEvent
+	outboxSeq   int64
+	outbox      []outboxRow
+	webhooks    map[uuid.UUID]webhookRow
+	deliverySeq int64
+	deliveries  []entity.WebhookDelivery
+	jobSeq      int64
+	jobs        []entity.Job
+	idempotency map[idempotencyKey]entity.IdempotentRequest
+	invitations map[uuid.UUID]invitationRow
+	limits      map[uuid.UUID]entity.CompanyLimits
+	requests    map[requestKey]int
+	apiKeys     map[uuid.UUID]apiKeyRow
+	schemas     map[string]entity.MetadataSchema
+	owned       table          // The tables copied by the transaction
+	changes     []store.Change // Published once committed, they aren't copied
+}
+
+// table identifies a table of the data, to copy it before the transaction mutates it.
+type table uint
+
+const (
+	usersTable table = 1 << iota
+	companiesTable
+	membershipsTable
+	eventsTable
+	outboxTable
+	webhooksTable
+	deliveriesTable
+	jobsTable
+	idempotencyTable
+	invitationsTable
+	limitsTable
+	requestsTable
+	apiKeysTable
+	schemasTable
+)
+
+// begin returns the data of a transaction, which shares the tables of d until it owns them.
+func (d *data) begin() *data {
+	tx := *d
+	tx.owned = 0
+	return &tx
+}
+
+// savepoint returns the data the transaction can be rolled back to, by assigning it to d. The
+// tables are owned again before they're mutated, since the savepoint shares them.
+func (d *data) savepoint() *data {
+	savepoint := *d
+	d.owned = 0
+	return &savepoint
+}
+
+// own copies the tables the transaction is about to mutate in place, unless it already did. A
+// row can be appended to a slice without owning it: the committed slice doesn't see the rows
+// past its length. The slices whose rows are deleted with a full slice expression are
+// reallocated, and so are the tables which are replaced as a whole.
+func (d *data) own(tables table) {
+	for t := usersTable; t <= schemasTable; t <<= 1 {
+		if tables&t == 0 || d.owned&t != 0 {
+			continue
+		}
+		d.owned |= t
+		switch t {
+		case usersTable:
+			users := make(map[uuid.UUID]userRow, len(d.users))
+			for k, v := range d.users {
+				users[k] = v
+			}
+			d.users = users
+		case companiesTable:
+			companies := make(map[uuid.UUID]entity.Company, len(d.companies))
+			for k, v := range d.companies {
+				companies[k] = v
+			}
+			d.companies = companies
+		case membershipsTable:
+			memberships := make(map[membershipKey]membershipRow, len(d.memberships))
+			for k, v := range d.memberships {
+				memberships[k] = v
+			}
+			d.memberships = memberships
+		case eventsTable:
+			d.events = append([]entity.AuditEvent(nil), d.events...)
+		case outboxTable:
+			d.outbox = append([]outboxRow(nil), d.outbox...)
+		case webhooksTable:
+			webhooks := make(map[uuid.UUID]webhookRow, len(d.webhooks))
+			for k, v := range d.webhooks {
+				webhooks[k] = v
+			}
+			d.webhooks = webhooks
+		case deliveriesTable:
+			d.deliveries = append([]entity.WebhookDelivery(nil), d.deliveries...)
+		case jobsTable:
+			d.jobs = append([]entity.Job(nil), d.jobs...)
+		case idempotencyTable:
+			idempotency := make(map[idempotencyKey]entity.IdempotentRequest, len(d.idempotency))
+			for k, v := range d.idempotency {
+				idempotency[k] = v
+			}
+			d.idempotency = idempotency
+		case invitationsTable:
+			invitations := make(map[uuid.UUID]invitationRow, len(d.invitations))
+			for k, v := range d.invitations {
+				invitations[k] = v
+			}
+			d.invitations = invitations
+		case limitsTable:
+			limits := make(map[uuid.UUID]entity.CompanyLimits, len(d.limits))
+			for k, v := range d.limits {
+				limits[k] = v
+			}
+			d.limits = limits
+		case requestsTable:
+			requests := make(map[requestKey]int, len(d.requests))
+			for k, v := range d.requests {
+				requests[k] = v
+			}
+			d.requests = requests
+		case apiKeysTable:
+			apiKeys := make(map[uuid.UUID]apiKeyRow, len(d.apiKeys))
+			for k, v := range d.apiKeys {
+				apiKeys[k] = v
+			}
+			d.apiKeys = apiKeys
+		case schemasTable:
+			schemas := make(map[string]entity.MetadataSchema, len(d.schemas))
+			for k, v := range d.schemas {
+				schemas[k] = v
+			}
+			d.schemas = schemas
+		}
+	}
+}
+
+func (d *data) nextSeq() int64 {
+	d.seq++
+	return d.seq
+}
+
+// now is truncated to the microsecond, the precision of the Postgres timestamps.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// matches tells whether a record updated at updatedAt and deleted at deletedAt, with the
+// metadata, passes the filter.
+func matches(filter store.Filter, updatedAt time.Time, deletedAt *time.Time, metadata entity.Metadata) bool {
+	return (filter.IncludeDeleted || deletedAt == nil) && !updatedAt.Before(filter.UpdatedSince) &&
+		store.MetadataContains(map[string]interface{}(metadata), map[string]interface{}(filter.Metadata))
+}
+
+// metadata returns the metadata as stored, the empty metadata is nil like in the SQL stores.
+func metadata(m entity.Metadata) entity.Metadata {
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+// parseID mimics Postgres, where an invalid UUID doesn't match any record.
+func parseID(ID string) (uuid.UUID, bool) {
+	id, err := uuid.Parse(ID)
+	return id, err == nil
+}
+
+// recordEvent must be called with the data of the mutation it describes, its personal data is
+// redacted like in the SQL store. The domain event of the mutation is published along with the
+// audit event, and the listeners of the changes are notified once it's committed.
+func (d *data) recordEvent(ctx context.Context, action, entityType, entityID string, before, after interface{}) error {
+	info := store.AuditInfoFromCtx(ctx)
+	before, after = store.WithoutPII(before), store.WithoutPII(after)
+	event := entity.AuditEvent{
+		CreatedAt: now(), Actor: info.Actor, Action: action, EntityType: entityType, EntityID: entityID,
+		RequestID: info.RequestID, ClientIP: info.ClientIP,
+	}
+	var err error
+	if event.Before, err = snapshot(before); err != nil {
+		log.G(ctx).WithError(err).Error("failed to marshal audit snapshot")
+		return store.ErrGenericDBFailure
+	}
+	if event.After, err = snapshot(after); err != nil {
+		log.G(ctx).WithError(err).Error("failed to marshal audit snapshot")
+		return store.ErrGenericDBFailure
+	}
+
+	d.eventSeq++
+	event.ID = d.eventSeq
+	d.events = append(d.events, event)
+	if change, ok := store.ChangeOf(action, entityType, entityID); ok {
+		d.changes = append(d.changes, change)
+	}
+
+	if after == nil {
+		return d.publishEvent(ctx, action, entityType, entityID, event.Before)
+	}
+	return d.publishEvent(ctx, action, entityType, entityID, event.After)
+}
+
+// redactEvents replaces the fields of the snapshots of an entity with placeholders, and renames
+// the actor of the events it made, like the SQL store when the entity is erased.
+func (d *data) redactEvents(entityType, entityID string, placeholders map[string]interface{}, actor, redactedActor string) error {
+	for k, event := range d.events {
+		if event.EntityType == entityType && event.EntityID == entityID {
+			var err error
+			if event.Before, err = redactSnapshot(event.Before, placeholders); err != nil {
+				return err
+			}
+			if event.After, err = redactSnapshot(event.After, placeholders); err != nil {
+				return err
+			}
+		}
+		if event.Actor == actor {
+			event.Actor = redactedActor
+		}
+		d.own(eventsTable)
+		d.events[k] = event
+	}
+	return nil
+}
+
+func redactSnapshot(b json.RawMessage, placeholders map[string]interface{}) (json.RawMessage, error) {
+	if b == nil {
+		return nil, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	for field, placeholder := range placeholders {
+		if _, ok := fields[field]; !ok {
+			continue
+		}
+		value, err := json.Marshal(placeholder)
+		if err != nil {
+			return nil, err
+		}
+		fields[field] = value
+	}
+	return json.Marshal(fields)
+}
+
+func snapshot(v interface{}) (json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+type Audit struct {
+	log log.Logger
+	db  *DB
+}
+
+func NewAuditStore(log log.Logger, db *DB) *Audit {
+	return &Audit{log: log, db: db}
+}
+
+// List returns the events matching the filter, most recent first.
+func (s *Audit) List(ctx context.Context, querier store.Querier, filter entity.AuditFilter) ([]entity.AuditEvent, error) {
+	var events []entity.AuditEvent
+	s.db.read(querier, func(d *data) error {
+		for k := len(d.events) - 1; k >= 0; k-- {
+			event := d.events[k]
+			if (filter.Actor != "" && event.Actor != filter.Actor) ||
+				(filter.Action != "" && event.Action != filter.Action) ||
+				(filter.EntityType != "" && event.EntityType != filter.EntityType) ||
+				(filter.EntityID != "" && event.EntityID != filter.EntityID) ||
+				(!filter.Since.IsZero() && event.CreatedAt.Before(filter.Since)) ||
+				(!filter.Until.IsZero() && !event.CreatedAt.Before(filter.Until)) {
+				continue
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+
+	if filter.Offset >= len(events) {
+		return nil, nil
+	}
+	events = events[filter.Offset:]
+	if len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
+
+func (s *Audit) DeleteAll() error {
+	return s.db.write(s.db, func(d *data) error {
+		d.events = nil
+		return nil
+	})
+}
+
+// sortUsers orders the users by creation.
+func sortUsers(rows []userRow) {
+	sort.Slice(rows, func(i, j int) bool { return rows[i].seq < rows[j].seq })
+}
@@ -0,0 +1,67 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+)
+
+type MetadataSchema struct {
+	log log.Logger
+	db  *DB
+}
+
+func NewMetadataSchemaStore(log log.Logger, db *DB) *MetadataSchema {
+	return &MetadataSchema{log: log, db: db}
+}
+
+func (s *MetadataSchema) DeleteAll() error {
+	return s.db.write(s.db, func(d *data) error {
+		d.schemas = make(map[string]entity.MetadataSchema)
+		return nil
+	})
+}
+
+// Get returns the schema of the metadata of the entity type, a NotFoundError if it has none.
+func (s *MetadataSchema) Get(ctx context.Context, querier store.Querier, entityType string) (entity.MetadataSchema, error) {
+	var schema entity.MetadataSchema
+	err := s.db.read(querier, func(d *data) error {
+		var ok bool
+		if schema, ok = d.schemas[entityType]; !ok {
+			return store.NewNotFoundError("metadata schema", entityType)
+		}
+		return nil
+	})
+	return schema, err
+}
+
+// Set creates or replaces the schema of the entity type, which must be valid.
+func (s *MetadataSchema) Set(ctx context.Context, querier store.Querier, entityType string, schema json.RawMessage) (entity.MetadataSchema, error) {
+	after := entity.MetadataSchema{EntityType: entityType, Schema: append(json.RawMessage(nil), schema...), UpdatedAt: now()}
+	err := s.db.write(querier, func(d *data) error {
+		before, ok := d.schemas[entityType]
+		d.own(schemasTable)
+		d.schemas[entityType] = after
+		if !ok {
+			return d.recordEvent(ctx, entity.AuditActionCreate, "metadata_schema", entityType, nil, after)
+		}
+		return d.recordEvent(ctx, entity.AuditActionUpdate, "metadata_schema", entityType, before, after)
+	})
+	return after, err
+}
+
+// Delete removes the schema of the entity type, its metadata isn't validated anymore.
+func (s *MetadataSchema) Delete(ctx context.Context, querier store.Querier, entityType string) error {
+	return s.db.write(querier, func(d *data) error {
+		before, ok := d.schemas[entityType]
+		if !ok {
+			return store.NewNotFoundError("metadata schema", entityType)
+		}
+		d.own(schemasTable)
+		delete(d.schemas, entityType)
+		return d.recordEvent(ctx, entity.AuditActionDelete, "metadata_schema", entityType, before, nil)
+	})
+}
@@ -0,0 +1,139 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+)
+
+type outboxRow struct {
+	entity.DomainEvent
+	availableAt time.Time
+	lastError   string
+}
+
+// publishEvent must be called with the data of the mutation, payload is its JSON snapshot.
+func (d *data) publishEvent(ctx context.Context, action, entityType, entityID string, payload json.RawMessage) error {
+	eventType, ok := entity.EventType(entityType, action)
+	if !ok {
+		return nil
+	}
+	d.outboxSeq++
+	occurredAt := now()
+	d.outbox = append(d.outbox, outboxRow{
+		DomainEvent: entity.DomainEvent{
+			ID: d.outboxSeq, Type: eventType, EntityType: entityType, EntityID: entityID,
+			OccurredAt: occurredAt, Payload: payload, RequestID: store.AuditInfoFromCtx(ctx).RequestID,
+		},
+		availableAt: occurredAt,
+	})
+	return nil
+}
+
+// redactDomainEvents replaces the fields of the payloads of the domain events of an entity with
+// placeholders, like the SQL store: the events pending publication and the deliveries of the
+// webhooks.
+func (d *data) redactDomainEvents(entityType, entityID string, placeholders map[string]interface{}) error {
+	for k, row := range d.outbox {
+		if row.EntityType != entityType || row.EntityID != entityID {
+			continue
+		}
+		payload, err := redactSnapshot(row.Payload, placeholders)
+		if err != nil {
+			return err
+		}
+		d.own(outboxTable)
+		d.outbox[k].Payload = payload
+	}
+
+	for k, delivery := range d.deliveries {
+		var event entity.DomainEvent
+		if err := json.Unmarshal(delivery.Payload, &event); err != nil {
+			return err
+		}
+		if event.EntityType != entityType || event.EntityID != entityID {
+			continue
+		}
+		var err error
+		if event.Payload, err = redactSnapshot(event.Payload, placeholders); err != nil {
+			return err
+		}
+		d.own(deliveriesTable)
+		if d.deliveries[k].Payload, err = json.Marshal(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type Outbox struct {
+	log log.Logger
+	db  *DB
+}
+
+func NewOutboxStore(log log.Logger, db *DB) *Outbox {
+	return &Outbox{log: log, db: db}
+}
+
+// Claim returns up to limit events due for delivery, in publication order. They aren't claimed
+// again before the lease expires, unless they are nacked.
+func (s *Outbox) Claim(ctx context.Context, querier store.Querier, limit int, lease time.Duration) ([]entity.DomainEvent, error) {
+	var events []entity.DomainEvent
+	err := s.db.write(querier, func(d *data) error {
+		t := now()
+		for k := range d.outbox {
+			if len(events) == limit {
+				break
+			}
+			if d.outbox[k].availableAt.After(t) {
+				continue
+			}
+			d.own(outboxTable)
+			row := &d.outbox[k]
+			row.Attempts++
+			row.availableAt = t.Add(lease)
+			events = append(events, row.DomainEvent)
+		}
+		return nil
+	})
+	return events, err
+}
+
+// Ack deletes a delivered event.
+func (s *Outbox) Ack(ctx context.Context, querier store.Querier, ID int64) error {
+	return s.db.write(querier, func(d *data) error {
+		for k := range d.outbox {
+			if d.outbox[k].ID == ID {
+				d.outbox = append(d.outbox[:k:k], d.outbox[k+1:]...)
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// Nack delays the next delivery of an event which failed with reason.
+func (s *Outbox) Nack(ctx context.Context, querier store.Querier, ID int64, delay time.Duration, reason string) error {
+	return s.db.write(querier, func(d *data) error {
+		for k := range d.outbox {
+			if d.outbox[k].ID == ID {
+				d.own(outboxTable)
+				d.outbox[k].availableAt = now().Add(delay)
+				d.outbox[k].lastError = reason
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Outbox) DeleteAll() error {
+	return s.db.write(s.db, func(d *data) error {
+		d.outbox = nil
+		return nil
+	})
+}
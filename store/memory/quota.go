@@ -0,0 +1,117 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/store"
+)
+
+// requestKey counts the requests of a company per UTC day, like the company_requests table.
+type requestKey struct {
+	companyID uuid.UUID
+	day       string
+}
+
+func quotaDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+func (s *Company) GetQuota(ctx context.Context, querier store.Querier, ID string) (entity.CompanyQuota, error) {
+	var quota entity.CompanyQuota
+	err := s.db.read(querier, func(d *data) error {
+		company, ok := d.company(ID)
+		if !ok {
+			return store.NewNotFoundError("company", ID)
+		}
+		quota.Limits = d.limits[company.ID]
+		quota.Usage.Members = d.usage(company.ID, entity.QuotaMembers)
+		quota.Usage.APIKeys = d.usage(company.ID, entity.QuotaAPIKeys)
+		quota.Usage.RequestsToday = d.requests[requestKey{company.ID, quotaDay(time.Now())}]
+		return nil
+	})
+	return quota, err
+}
+
+func (s *Company) SetLimits(ctx context.Context, querier store.Querier, ID string, limits entity.CompanyLimits) (entity.CompanyLimits, error) {
+	err := s.db.write(querier, func(d *data) error {
+		company, ok := d.company(ID)
+		if !ok || company.DeletedAt != nil {
+			return store.NewNotFoundError("company", ID)
+		}
+		before := d.limits[company.ID]
+		d.own(limitsTable)
+		d.limits[company.ID] = limits
+		return d.recordEvent(ctx, entity.AuditActionUpdate, "company_limits", ID, before, limits)
+	})
+	return limits, err
+}
+
+// CountRequest doesn't count the requests exceeding the requests per day of the company.
+func (s *Company) CountRequest(ctx context.Context, querier store.Querier, ID string) error {
+	return s.db.write(querier, func(d *data) error {
+		company, ok := d.company(ID)
+		if !ok {
+			return store.NewNotFoundError("company", ID)
+		}
+		key := requestKey{company.ID, quotaDay(time.Now())}
+		if err := d.checkQuota(company.ID, entity.QuotaRequestsPerDay, d.requests[key]+1); err != nil {
+			return err
+		}
+		d.own(requestsTable)
+		d.requests[key]++
+		return nil
+	})
+}
+
+func (s *Company) PurgeRequests(ctx context.Context, querier store.Querier, before time.Time) (int64, error) {
+	var n int64
+	err := s.db.write(querier, func(d *data) error {
+		day := quotaDay(before)
+		for key := range d.requests {
+			if key.day < day {
+				d.own(requestsTable)
+				delete(d.requests, key)
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+// usage counts the usage of the members and API keys quotas.
+func (d *data) usage(companyID uuid.UUID, quota string) int {
+	var n int
+	switch quota {
+	case entity.QuotaMembers:
+		for key := range d.memberships {
+			if key.companyID == companyID {
+				n++
+			}
+		}
+	case entity.QuotaAPIKeys:
+		for _, row := range d.apiKeys {
+			if row.CompanyID == companyID {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// checkQuota fails if usage would exceed the limit of the company.
+func (d *data) checkQuota(companyID uuid.UUID, quota string, usage int) error {
+	limits := d.limits[companyID]
+	limit := map[string]*int{
+		entity.QuotaMembers:        limits.MaxMembers,
+		entity.QuotaAPIKeys:        limits.MaxAPIKeys,
+		entity.QuotaRequestsPerDay: limits.RequestsPerDay,
+	}[quota]
+	if limit != nil && usage > *limit {
+		return store.NewQuotaExceededError(companyID.String(), quota, *limit)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+package memory
+
+import (
+	"sort"
+
+	"github.com/jordanp/goapp/entity"
+)
+
+// topResults orders the results by decreasing rank and keeps the best ones.
+func topResults(results []entity.SearchResult, limit int) []entity.SearchResult {
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Rank > results[j].Rank })
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
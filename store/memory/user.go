@@ -0,0 +1,342 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/pkg/textsearch"
+	"github.com/jordanp/goapp/store"
+)
+
+type User struct {
+	log log.Logger
+	db  *DB
+}
+
+func NewUserStore(log log.Logger, db *DB) *User {
+	return &User{log: log, db: db}
+}
+
+func (s *User) DeleteAll() error {
+	return s.db.write(s.db, func(d *data) error {
+		d.users = make(map[uuid.UUID]userRow)
+		d.memberships = make(map[membershipKey]membershipRow)
+		return nil
+	})
+}
+
+// GetByLogin is used to authenticate users, it's the only method returning the password hash.
+func (s *User) GetByLogin(ctx context.Context, querier store.Querier, login string) (entity.User, error) {
+	var user entity.User
+	err := s.db.read(querier, func(d *data) error {
+		row, ok := d.userByLogin(login)
+		if !ok {
+			return store.NewNotFoundError("user", login)
+		}
+		user = row.User
+		return nil
+	})
+	return user, err
+}
+
+func (s *User) GetByID(ctx context.Context, querier store.Querier, ID string, includeDeleted bool) (entity.User, error) {
+	var user entity.User
+	err := s.db.read(querier, func(d *data) error {
+		row, ok := d.user(ID)
+		if !ok || (!includeDeleted && row.DeletedAt != nil) {
+			return store.NewNotFoundError("user", ID)
+		}
+		user = row.public()
+		return nil
+	})
+	return user, err
+}
+
+// DeleteByID soft deletes the user. It can be restored until it's purged.
+func (s *User) DeleteByID(ctx context.Context, querier store.Querier, ID string) error {
+	return s.db.write(querier, func(d *data) error {
+		row, ok := d.user(ID)
+		if !ok || row.DeletedAt != nil {
+			return store.NewNotFoundError("user", ID)
+		}
+		before := row.public()
+		deletedAt := now()
+		row.DeletedAt = &deletedAt
+		row.UpdatedAt = deletedAt
+		d.own(usersTable)
+		d.users[row.ID] = row
+		return d.recordEvent(ctx, entity.AuditActionDelete, "user", ID, before, row.public())
+	})
+}
+
+func (s *User) Restore(ctx context.Context, querier store.Querier, ID string) (entity.User, error) {
+	var user entity.User
+	err := s.db.write(querier, func(d *data) error {
+		row, ok := d.user(ID)
+		if !ok || row.DeletedAt == nil || row.ErasedAt != nil {
+			return store.NewNotFoundError("deleted user", ID)
+		}
+		before := row.public()
+		row.DeletedAt = nil
+		row.UpdatedAt = now()
+		d.own(usersTable)
+		d.users[row.ID] = row
+		user = row.public()
+		return d.recordEvent(ctx, entity.AuditActionRestore, "user", ID, before, user)
+	})
+	return user, err
+}
+
+// Erase replaces the personal data of the user with placeholders, in its audit trail as well,
+// and deletes it for good. The deleted users can be erased too.
+func (s *User) Erase(ctx context.Context, querier store.Querier, ID string) (entity.User, error) {
+	var user entity.User
+	err := s.db.write(querier, func(d *data) error {
+		row, ok := d.user(ID)
+		if !ok || row.ErasedAt != nil {
+			return store.NewNotFoundError("user", ID)
+		}
+		login, email := row.Login, row.Email
+		erasedAt := now()
+		row.Login, row.Password, row.Email = store.ErasedLogin(ID), "", store.ErasedEmail(ID)
+		row.Metadata = nil // It may hold personal data
+		if row.DeletedAt == nil {
+			row.DeletedAt = &erasedAt
+		}
+		row.ErasedAt = &erasedAt
+		row.UpdatedAt = erasedAt
+		row.Version++
+		d.own(usersTable)
+		d.users[row.ID] = row
+
+		user = row.public()
+		placeholders := map[string]interface{}{"login": user.Login, "email": user.Email, "metadata": map[string]interface{}{}}
+		if err := d.redactEvents("user", ID, placeholders, login, user.Login); err != nil {
+			log.G(ctx).WithError(err).Error("failed to redact audit snapshots")
+			return store.ErrGenericDBFailure
+		}
+		if err := d.redactDomainEvents("user", ID, placeholders); err != nil {
+			log.G(ctx).WithError(err).Error("failed to redact domain events")
+			return store.ErrGenericDBFailure
+		}
+		d.eraseIdempotentResponses(login, ID)
+		d.eraseInvitations(row.ID, email, login, user.Login)
+		return d.recordEvent(ctx, entity.AuditActionErase, "user", ID, nil, user)
+	})
+	return user, err
+}
+
+// Purge hard deletes the users that have been soft deleted for longer than the retention.
+func (s *User) Purge(ctx context.Context, querier store.Querier, retention time.Duration) (int64, error) {
+	var n int64
+	err := s.db.write(querier, func(d *data) error {
+		cutoff := now().Add(-retention)
+		var purged []userRow
+		for _, row := range d.users {
+			if row.DeletedAt != nil && row.DeletedAt.Before(cutoff) {
+				purged = append(purged, row)
+			}
+		}
+		sortUsers(purged)
+
+		if len(purged) > 0 {
+			d.own(usersTable | membershipsTable | invitationsTable)
+		}
+		for _, row := range purged {
+			delete(d.users, row.ID)
+			for key := range d.memberships {
+				if key.userID == row.ID {
+					delete(d.memberships, key)
+				}
+			}
+			for ID, invitation := range d.invitations {
+				if invitation.UserID != nil && *invitation.UserID == row.ID {
+					invitation.UserID = nil // ON DELETE SET NULL
+					d.invitations[ID] = invitation
+				}
+			}
+			if err := d.recordEvent(ctx, entity.AuditActionPurge, "user", row.ID.String(), row.public(), nil); err != nil {
+				return err
+			}
+		}
+		n = int64(len(purged))
+		return nil
+	})
+	return n, err
+}
+
+func (s *User) GetAll(ctx context.Context, querier store.Querier, filter store.Filter) ([]entity.User, error) {
+	var users []entity.User
+	err := s.ForEach(ctx, querier, filter, func(user entity.User) error {
+		users = append(users, user)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// ForEach calls fn for every user, in creation order, until fn returns an error.
+func (s *User) ForEach(ctx context.Context, querier store.Querier, filter store.Filter, fn func(entity.User) error) error {
+	var rows []userRow
+	s.db.read(querier, func(d *data) error {
+		for _, row := range d.users {
+			if matches(filter, row.UpdatedAt, row.DeletedAt, row.Metadata) {
+				rows = append(rows, row)
+			}
+		}
+		return nil
+	})
+	sortUsers(rows)
+
+	for _, row := range rows {
+		if err := fn(row.public()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *User) Add(ctx context.Context, querier store.Querier, login, password, email, role string, metadata entity.Metadata) (entity.User, error) {
+	var user entity.User
+	err := s.db.write(querier, func(d *data) error {
+		var err error
+		user, err = d.addUser(ctx, login, password, email, role, metadata)
+		return err
+	})
+	return user, err
+}
+
+// Update applies the non nil fields of the patch. If version isn't zero, the update only
+// succeeds if it matches the current version of the user.
+func (s *User) Update(ctx context.Context, querier store.Querier, ID string, patch entity.UserPatch, version int) (entity.User, error) {
+	var user entity.User
+	err := s.db.write(querier, func(d *data) error {
+		row, ok := d.user(ID)
+		if !ok || row.DeletedAt != nil {
+			return store.NewNotFoundError("user", ID)
+		}
+		if version != 0 && version != row.Version {
+			return store.NewVersionConflictError("user", ID, row.Version)
+		}
+		before := row.public()
+
+		if patch.Login != nil {
+			row.Login = *patch.Login
+		}
+		if patch.Password != nil {
+			row.Password = *patch.Password
+		}
+		if patch.Email != nil {
+			row.Email = *patch.Email
+		}
+		if patch.Role != nil {
+			row.Role = *patch.Role
+		}
+		if patch.Metadata != nil {
+			row.Metadata = metadata(patch.Metadata)
+		}
+		if err := d.checkUniqueUser(row.User); err != nil {
+			return err
+		}
+		row.UpdatedAt = now()
+		row.Version++
+		d.own(usersTable)
+		d.users[row.ID] = row
+
+		user = row.public()
+		return d.recordEvent(ctx, entity.AuditActionUpdate, "user", ID, before, user)
+	})
+	return user, err
+}
+
+func (s *User) Search(ctx context.Context, querier store.Querier, q entity.SearchQuery) ([]entity.SearchResult, error) {
+	var results []entity.SearchResult
+	s.db.read(querier, func(d *data) error {
+		var rows []userRow
+		for _, row := range d.users {
+			if row.DeletedAt == nil {
+				rows = append(rows, row)
+			}
+		}
+		sortUsers(rows)
+
+		// The emails only match as a whole, like their blind index in the SQL store
+		for _, row := range rows {
+			rank, highlight, ok := textsearch.Match(q.Query, row.Login)
+			if row.Email == q.Query {
+				rank, ok = rank+1, true
+				if highlight == "" {
+					highlight = row.Login
+				}
+			}
+			if ok {
+				results = append(results, entity.SearchResult{Kind: entity.SearchKindUser, ID: row.ID, Label: row.Login, Highlight: highlight, Rank: rank})
+			}
+		}
+		return nil
+	})
+	return topResults(results, q.Limit), nil
+}
+
+// Reencrypt has nothing to encrypt, the in-memory users aren't stored.
+func (s *User) Reencrypt(ctx context.Context, querier store.Querier, limit int) (int, error) {
+	return 0, nil
+}
+
+// addUser inserts and audits a user, password must already be hashed.
+func (d *data) addUser(ctx context.Context, login, password, email, role string, m entity.Metadata) (entity.User, error) {
+	createdAt := now()
+	row := userRow{
+		User: entity.User{
+			ID: uuid.New(), Login: login, Password: password, Email: email, Role: role, CreatedAt: createdAt, UpdatedAt: createdAt, Version: 1,
+			Metadata: metadata(m),
+		},
+		seq: d.nextSeq(),
+	}
+	if err := d.checkUniqueUser(row.User); err != nil {
+		return entity.User{}, err
+	}
+	d.own(usersTable)
+	d.users[row.ID] = row
+	return row.public(), d.recordEvent(ctx, entity.AuditActionCreate, "user", row.ID.String(), nil, row.public())
+}
+
+// checkUniqueUser enforces the unq_login and unq_email constraints, which soft deleted users
+// are subject to.
+func (d *data) checkUniqueUser(user entity.User) error {
+	for _, row := range d.users {
+		if row.ID != user.ID && row.Login == user.Login {
+			return store.NewAlreadyExistsError("login", user.Login)
+		}
+	}
+	for _, row := range d.users {
+		if row.ID != user.ID && row.Email == user.Email {
+			return store.NewAlreadyExistsError("email", user.Email)
+		}
+	}
+	return nil
+}
+
+func (d *data) user(ID string) (userRow, bool) {
+	id, ok := parseID(ID)
+	if !ok {
+		return userRow{}, false
+	}
+	row, ok := d.users[id]
+	return row, ok
+}
+
+// userByLogin ignores the soft deleted users.
+func (d *data) userByLogin(login string) (userRow, bool) {
+	for _, row := range d.users {
+		if row.Login == login && row.DeletedAt == nil {
+			return row, true
+		}
+	}
+	return userRow{}, false
+}
@@ -0,0 +1,267 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+)
+
+type webhookRow struct {
+	entity.Webhook
+	seq int64
+}
+
+type Webhook struct {
+	log log.Logger
+	db  *DB
+}
+
+func NewWebhookStore(log log.Logger, db *DB) *Webhook {
+	return &Webhook{log: log, db: db}
+}
+
+func withoutSecret(webhook entity.Webhook) entity.Webhook {
+	webhook.Secret = ""
+	return webhook
+}
+
+// Add registers a webhook, the secret must not be empty.
+func (s *Webhook) Add(ctx context.Context, querier store.Querier, URL string, events []string, secret string) (entity.Webhook, error) {
+	webhook := entity.Webhook{
+		ID: uuid.New(), URL: URL, Events: append([]string(nil), events...), Secret: secret, CreatedAt: now(),
+	}
+	err := s.db.write(querier, func(d *data) error {
+		d.own(webhooksTable)
+		d.webhooks[webhook.ID] = webhookRow{Webhook: webhook, seq: d.nextSeq()}
+		return d.recordEvent(ctx, entity.AuditActionCreate, "webhook", webhook.ID.String(), nil, withoutSecret(webhook))
+	})
+	return webhook, err
+}
+
+// GetByID returns the webhook along with its secret.
+func (s *Webhook) GetByID(ctx context.Context, querier store.Querier, ID string) (entity.Webhook, error) {
+	var webhook entity.Webhook
+	err := s.db.read(querier, func(d *data) error {
+		id, ok := parseID(ID)
+		row, found := d.webhooks[id]
+		if !ok || !found {
+			return store.NewNotFoundError("webhook", ID)
+		}
+		webhook = row.Webhook
+		return nil
+	})
+	return webhook, err
+}
+
+// GetAll returns the webhooks along with their secret, in registration order.
+func (s *Webhook) GetAll(ctx context.Context, querier store.Querier) ([]entity.Webhook, error) {
+	var webhooks []entity.Webhook
+	s.db.read(querier, func(d *data) error {
+		webhooks = d.allWebhooks()
+		return nil
+	})
+	return webhooks, nil
+}
+
+func (d *data) allWebhooks() []entity.Webhook {
+	rows := make([]webhookRow, 0, len(d.webhooks))
+	for _, row := range d.webhooks {
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].seq < rows[j].seq })
+	webhooks := make([]entity.Webhook, len(rows))
+	for k := range rows {
+		webhooks[k] = rows[k].Webhook
+	}
+	return webhooks
+}
+
+// DeleteByID deletes the webhook along with its deliveries.
+func (s *Webhook) DeleteByID(ctx context.Context, querier store.Querier, ID string) error {
+	return s.db.write(querier, func(d *data) error {
+		id, ok := parseID(ID)
+		row, found := d.webhooks[id]
+		if !ok || !found {
+			return store.NewNotFoundError("webhook", ID)
+		}
+		d.own(webhooksTable)
+		delete(d.webhooks, id)
+		deliveries := d.deliveries[:0:0]
+		for _, delivery := range d.deliveries {
+			if delivery.WebhookID != id {
+				deliveries = append(deliveries, delivery)
+			}
+		}
+		d.deliveries = deliveries
+		return d.recordEvent(ctx, entity.AuditActionDelete, "webhook", ID, withoutSecret(row.Webhook), nil)
+	})
+}
+
+func (s *Webhook) DeleteAll() error {
+	return s.db.write(s.db, func(d *data) error {
+		d.webhooks = make(map[uuid.UUID]webhookRow)
+		d.deliveries = nil
+		return nil
+	})
+}
+
+// Enqueue creates a pending delivery of the event for every matching webhook, it returns their
+// number. The event is only delivered once to each webhook, even if it's enqueued again.
+func (s *Webhook) Enqueue(ctx context.Context, querier store.Querier, event entity.DomainEvent) (int, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to marshal webhook payload")
+		return 0, store.ErrGenericDBFailure
+	}
+
+	n := 0
+	err = s.db.write(querier, func(d *data) error {
+		n = 0
+		t := now()
+		for _, webhook := range d.allWebhooks() {
+			if !webhook.Matches(event.Type) {
+				continue
+			}
+			n++
+			if d.deliveryIndex(func(delivery entity.WebhookDelivery) bool {
+				return delivery.WebhookID == webhook.ID && delivery.EventID == event.ID
+			}) >= 0 {
+				continue
+			}
+			d.deliverySeq++
+			d.deliveries = append(d.deliveries, entity.WebhookDelivery{
+				ID: d.deliverySeq, WebhookID: webhook.ID, EventID: event.ID, EventType: event.Type, Payload: payload,
+				Status: entity.DeliveryStatusPending, NextAttemptAt: t, CreatedAt: t,
+			})
+		}
+		return nil
+	})
+	return n, err
+}
+
+// deliveryIndex returns the index of the first delivery matching fn, or -1.
+func (d *data) deliveryIndex(fn func(entity.WebhookDelivery) bool) int {
+	for k := range d.deliveries {
+		if fn(d.deliveries[k]) {
+			return k
+		}
+	}
+	return -1
+}
+
+// Claim returns up to limit pending deliveries due for an attempt, oldest first. They aren't
+// claimed again before the lease expires, unless they are marked as failed.
+func (s *Webhook) Claim(ctx context.Context, querier store.Querier, limit int, lease time.Duration) ([]entity.WebhookDelivery, error) {
+	var deliveries []entity.WebhookDelivery
+	err := s.db.write(querier, func(d *data) error {
+		t := now()
+		for k := range d.deliveries {
+			if len(deliveries) == limit {
+				break
+			}
+			if d.deliveries[k].Status != entity.DeliveryStatusPending || d.deliveries[k].NextAttemptAt.After(t) {
+				continue
+			}
+			d.own(deliveriesTable)
+			delivery := &d.deliveries[k]
+			delivery.Attempts++
+			delivery.NextAttemptAt = t.Add(lease)
+			deliveries = append(deliveries, *delivery)
+		}
+		return nil
+	})
+	return deliveries, err
+}
+
+func (s *Webhook) MarkDelivered(ctx context.Context, querier store.Querier, ID int64, responseStatus int) error {
+	return s.updateDelivery(querier, ID, func(delivery *entity.WebhookDelivery) {
+		deliveredAt := now()
+		delivery.Status = entity.DeliveryStatusDelivered
+		delivery.DeliveredAt = &deliveredAt
+		delivery.LastError = ""
+		delivery.ResponseStatus = responseStatus
+	})
+}
+
+// MarkFailed schedules the next attempt of the delivery after the delay, or moves it to the
+// dead letters if dead is true. responseStatus is 0 when the webhook didn't answer.
+func (s *Webhook) MarkFailed(ctx context.Context, querier store.Querier, ID int64, responseStatus int, reason string, delay time.Duration, dead bool) error {
+	return s.updateDelivery(querier, ID, func(delivery *entity.WebhookDelivery) {
+		delivery.Status = entity.DeliveryStatusPending
+		if dead {
+			delivery.Status = entity.DeliveryStatusDead
+		}
+		delivery.NextAttemptAt = now().Add(delay)
+		delivery.LastError = reason
+		delivery.ResponseStatus = responseStatus
+	})
+}
+
+func (s *Webhook) updateDelivery(querier store.Querier, ID int64, fn func(*entity.WebhookDelivery)) error {
+	return s.db.write(querier, func(d *data) error {
+		if k := d.deliveryIndex(func(delivery entity.WebhookDelivery) bool { return delivery.ID == ID }); k >= 0 {
+			d.own(deliveriesTable)
+			fn(&d.deliveries[k])
+		}
+		return nil
+	})
+}
+
+// ListDeliveries returns the deliveries of the webhook matching the filter, most recent first.
+func (s *Webhook) ListDeliveries(ctx context.Context, querier store.Querier, webhookID string, filter entity.DeliveryFilter) ([]entity.WebhookDelivery, error) {
+	var deliveries []entity.WebhookDelivery
+	err := s.db.read(querier, func(d *data) error {
+		id, ok := parseID(webhookID)
+		if _, found := d.webhooks[id]; !ok || !found {
+			return store.NewNotFoundError("webhook", webhookID)
+		}
+		for k := len(d.deliveries) - 1; k >= 0; k-- {
+			delivery := d.deliveries[k]
+			if delivery.WebhookID == id && (filter.Status == "" || delivery.Status == filter.Status) {
+				deliveries = append(deliveries, delivery)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if filter.Offset >= len(deliveries) {
+		return nil, nil
+	}
+	deliveries = deliveries[filter.Offset:]
+	if len(deliveries) > filter.Limit {
+		deliveries = deliveries[:filter.Limit]
+	}
+	return deliveries, nil
+}
+
+// Replay resets the attempts of a delivery, which is attempted again as soon as possible.
+func (s *Webhook) Replay(ctx context.Context, querier store.Querier, webhookID string, deliveryID int64) (entity.WebhookDelivery, error) {
+	var delivery entity.WebhookDelivery
+	err := s.db.write(querier, func(d *data) error {
+		id, _ := parseID(webhookID)
+		k := d.deliveryIndex(func(delivery entity.WebhookDelivery) bool {
+			return delivery.ID == deliveryID && delivery.WebhookID == id
+		})
+		if k < 0 {
+			return store.NewNotFoundError("delivery", fmt.Sprint(deliveryID))
+		}
+		d.own(deliveriesTable)
+		d.deliveries[k].Status = entity.DeliveryStatusPending
+		d.deliveries[k].Attempts = 0
+		d.deliveries[k].NextAttemptAt = now()
+		d.deliveries[k].DeliveredAt = nil
+		delivery = d.deliveries[k]
+		return nil
+	})
+	return delivery, err
+}
@@ -0,0 +1,185 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// metadataColumn scans the metadata column of the users and companies, the empty metadata is
+// scanned as nil.
+type metadataColumn struct {
+	m *entity.Metadata
+}
+
+func (c metadataColumn) Scan(src interface{}) error {
+	var b []byte
+	switch src := src.(type) {
+	case nil:
+		*c.m = nil
+		return nil
+	case []byte:
+		b = src
+	case string:
+		b = []byte(src)
+	default:
+		return errors.Errorf("unsupported metadata of type %T", src)
+	}
+	var m entity.Metadata
+	if err := json.Unmarshal(b, &m); err != nil {
+		return errors.Wrap(err, "invalid metadata")
+	}
+	if len(m) == 0 {
+		m = nil
+	}
+	*c.m = m
+	return nil
+}
+
+// metadataArg returns the query argument of the metadata, NULL leaves the column untouched in
+// the updates.
+func metadataArg(m entity.Metadata) (interface{}, error) {
+	if m == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// metadataCondition is the condition of a metadata filter, $%d is the JSON of the filter. The
+// containment is the operator of the GIN indexes of the metadata.
+const metadataCondition = "metadata @> $%d::jsonb"
+
+func (f Filter) metadataWhere(querySuffix string, parsedArgs []interface{}) (string, []interface{}) {
+	if len(f.Metadata) == 0 {
+		return querySuffix, parsedArgs
+	}
+	b, _ := json.Marshal(f.Metadata) // The metadata filters are decoded from JSON
+	parsedArgs = append(parsedArgs, string(b))
+	if querySuffix == "" {
+		querySuffix = " WHERE"
+	} else {
+		querySuffix += " AND"
+	}
+	return querySuffix + " " + fmt.Sprintf(metadataCondition, len(parsedArgs)), parsedArgs
+}
+
+// MetadataContains tells whether the JSON value doc contains sub, like the @> operator of
+// Postgres: the objects contain the keys of sub whose values they contain, the arrays contain
+// the elements of sub, and the other values are equal.
+func MetadataContains(doc, sub interface{}) bool {
+	switch sub := sub.(type) {
+	case map[string]interface{}:
+		doc, ok := doc.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for key, value := range sub {
+			if v, ok := doc[key]; !ok || !MetadataContains(v, value) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		doc, ok := doc.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, value := range sub {
+			var found bool
+			for _, v := range doc {
+				if found = MetadataContains(v, value); found {
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(doc, sub)
+}
+
+type MetadataSchema struct {
+	log log.Logger
+	db  *DB
+}
+
+func NewMetadataSchemaStore(log log.Logger, db *DB) (*MetadataSchema, error) {
+	if _, err := db.Exec(createTableMetadataSchemas); err != nil {
+		return nil, errors.Wrap(err, "failed to create metadata_schemas table")
+	}
+	return &MetadataSchema{log: log, db: db}, nil
+}
+
+// metadataSchemaDest returns the scan destinations of the metadataSchemaColumns.
+func metadataSchemaDest(schema *entity.MetadataSchema) []interface{} {
+	return []interface{}{&schema.EntityType, (*[]byte)(&schema.Schema), utcTime{&schema.UpdatedAt}}
+}
+
+// Get returns the schema of the metadata of the entity type, a NotFoundError if it has none.
+func (s *MetadataSchema) Get(ctx context.Context, querier Querier, entityType string) (entity.MetadataSchema, error) {
+	var schema entity.MetadataSchema
+	err := getOne(ctx, reader(ctx, querier), selectMetadataSchema, []interface{}{entityType}, metadataSchemaDest(&schema)...)
+	if err == ErrNoRows {
+		return schema, NewNotFoundError("metadata schema", entityType)
+	}
+	return schema, err
+}
+
+// Set creates or replaces the schema of the entity type, which must be valid.
+func (s *MetadataSchema) Set(ctx context.Context, querier Querier, entityType string, schema json.RawMessage) (entity.MetadataSchema, error) {
+	var before, after entity.MetadataSchema
+	err := WithTx(ctx, querier, func(tx *Tx) error {
+		action := entity.AuditActionUpdate
+		err := getOne(ctx, tx, selectMetadataSchemaForUpdate, []interface{}{entityType}, metadataSchemaDest(&before)...)
+		if err == ErrNoRows {
+			action = entity.AuditActionCreate
+		} else if err != nil {
+			return err
+		}
+
+		if err := getOne(ctx, tx, upsertMetadataSchema, []interface{}{entityType, string(schema)}, metadataSchemaDest(&after)...); err != nil {
+			return err
+		}
+		if action == entity.AuditActionCreate {
+			return recordEvent(ctx, tx, action, "metadata_schema", entityType, nil, after)
+		}
+		return recordEvent(ctx, tx, action, "metadata_schema", entityType, before, after)
+	})
+	return after, err
+}
+
+// Delete removes the schema of the entity type, its metadata isn't validated anymore.
+func (s *MetadataSchema) Delete(ctx context.Context, querier Querier, entityType string) error {
+	return WithTx(ctx, querier, func(tx *Tx) error {
+		var before entity.MetadataSchema
+		err := getOne(ctx, tx, selectMetadataSchemaForUpdate, []interface{}{entityType}, metadataSchemaDest(&before)...)
+		if err == ErrNoRows {
+			return NewNotFoundError("metadata schema", entityType)
+		} else if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, deleteMetadataSchema, entityType); err != nil {
+			log.G(ctx).WithError(err).Error("failed to delete metadata schema in DB")
+			return ErrGenericDBFailure
+		}
+		return recordEvent(ctx, tx, entity.AuditActionDelete, "metadata_schema", entityType, before, nil)
+	})
+}
+
+func (s *MetadataSchema) DeleteAll() error {
+	if _, err := s.db.Exec(deleteAllMetadataSchemas); err != nil {
+		return errors.Wrap(err, "failed to truncate metadata_schemas table")
+	}
+	return nil
+}
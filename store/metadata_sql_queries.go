@@ -0,0 +1,31 @@
+package store
+
+// The schemas of the metadata of the users and companies, an entity type without schema
+// accepts any metadata within the size limits.
+const createTableMetadataSchemas = `
+CREATE TABLE IF NOT EXISTS metadata_schemas (
+	entity_type TEXT PRIMARY KEY,
+	schema JSONB NOT NULL,
+	updated_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL
+)`
+
+// metadataSchemaColumns must be kept in sync with metadataSchemaDest
+const metadataSchemaColumns = `entity_type, schema, updated_at`
+
+const upsertMetadataSchema = `
+INSERT INTO metadata_schemas (entity_type, schema) VALUES ($1, $2)
+ON CONFLICT (entity_type) DO UPDATE SET schema = EXCLUDED.schema, updated_at = CURRENT_TIMESTAMP
+RETURNING ` + metadataSchemaColumns
+
+const selectMetadataSchema = `
+SELECT ` + metadataSchemaColumns + ` FROM metadata_schemas WHERE entity_type = $1`
+
+const selectMetadataSchemaForUpdate = `
+SELECT ` + metadataSchemaColumns + ` FROM metadata_schemas WHERE entity_type = $1 FOR UPDATE`
+
+const deleteMetadataSchema = `
+DELETE FROM metadata_schemas WHERE entity_type = $1`
+
+const deleteAllMetadataSchemas = `
+TRUNCATE TABLE metadata_schemas
+`
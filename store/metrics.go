@@ -0,0 +1,88 @@
+package store
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// statsCollector exports the connection pool stats of a DB and of its replicas, labeled
+// "primary" and "replica<k>".
+type statsCollector struct {
+	db *DB
+
+	maxOpen      *prometheus.Desc
+	open         *prometheus.Desc
+	inUse        *prometheus.Desc
+	idle         *prometheus.Desc
+	waitCount    *prometheus.Desc
+	waitDuration *prometheus.Desc
+}
+
+// RegisterMetrics registers the collector of the connection pool stats of the DB, the latency
+// and errors of its queries, and their retries, with the default registerer if promReg is nil. It must
+// be called before the DB is used.
+func RegisterMetrics(promReg prometheus.Registerer, namespace string, db *DB) {
+	if promReg == nil {
+		promReg = prometheus.DefaultRegisterer
+	}
+	db.instr.duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "db",
+		Name:      "query_duration_seconds",
+		Help:      "The latency of the queries.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"query"})
+	db.instr.errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "db",
+		Name:      "query_errors_total",
+		Help:      "The number of failed queries.",
+	}, []string{"query"})
+	db.instr.retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "db",
+		Name:      "retries_total",
+		Help:      "The number of queries and transactions retried after a transient error.",
+	}, []string{"operation"})
+	promReg.MustRegister(db.instr.duration, db.instr.errors, db.instr.retries)
+
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "db", name), help, []string{"db"}, nil)
+	}
+	promReg.MustRegister(&statsCollector{
+		db:           db,
+		maxOpen:      desc("max_open_connections", "The maximum number of open connections to the DB."),
+		open:         desc("open_connections", "The number of established connections, in use and idle."),
+		inUse:        desc("in_use_connections", "The number of connections in use."),
+		idle:         desc("idle_connections", "The number of idle connections."),
+		waitCount:    desc("wait_count_total", "The total number of connections waited for."),
+		waitDuration: desc("wait_duration_seconds_total", "The total time blocked waiting for a new connection."),
+	})
+}
+
+func (c *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.maxOpen
+	ch <- c.open
+	ch <- c.inUse
+	ch <- c.idle
+	ch <- c.waitCount
+	ch <- c.waitDuration
+}
+
+func (c *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collect(ch, c.db, "primary")
+	for k, r := range c.db.replicas {
+		c.collect(ch, r.DB, "replica"+strconv.Itoa(k))
+	}
+}
+
+func (c *statsCollector) collect(ch chan<- prometheus.Metric, db *DB, label string) {
+	stats := db.Stats()
+	ch <- prometheus.MustNewConstMetric(c.maxOpen, prometheus.GaugeValue, float64(stats.MaxOpenConnections), label)
+	ch <- prometheus.MustNewConstMetric(c.open, prometheus.GaugeValue, float64(stats.OpenConnections), label)
+	ch <- prometheus.MustNewConstMetric(c.inUse, prometheus.GaugeValue, float64(stats.InUse), label)
+	ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(stats.Idle), label)
+	ch <- prometheus.MustNewConstMetric(c.waitCount, prometheus.CounterValue, float64(stats.WaitCount), label)
+	ch <- prometheus.MustNewConstMetric(c.waitDuration, prometheus.CounterValue, stats.WaitDuration.Seconds(), label)
+}
@@ -0,0 +1,31 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterMetrics(t *testing.T) {
+	db := openSQLite(t)
+	defer db.Close()
+	require.NoError(t, db.Ping())
+
+	reg := prometheus.NewRegistry()
+	RegisterMetrics(reg, "goapp", db)
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, family := range families {
+		require.Len(t, family.GetMetric(), 1)
+		require.Equal(t, "primary", family.GetMetric()[0].GetLabel()[0].GetValue())
+		metric := family.GetMetric()[0]
+		values[family.GetName()] = metric.GetGauge().GetValue() + metric.GetCounter().GetValue()
+	}
+	require.Equal(t, 1.0, values["goapp_db_max_open_connections"])
+	require.Equal(t, 1.0, values["goapp_db_idle_connections"])
+	require.Equal(t, 0.0, values["goapp_db_in_use_connections"])
+	require.Contains(t, values, "goapp_db_wait_duration_seconds_total")
+}
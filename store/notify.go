@@ -0,0 +1,259 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/lib/pq"
+)
+
+// ChangesChannel is the Postgres channel notified of the committed changes of the users and
+// companies, so that the caches of every instance can be updated.
+const ChangesChannel = "goapp_changes"
+
+// The actions of the changes received by a Listener which don't describe a mutation.
+const (
+	// ChangeResync is received when changes may have been missed, the listeners must re-read
+	// everything.
+	ChangeResync = "resync"
+	// ChangeDisconnected is received when the listener loses its connection, changes are
+	// missed until it receives ChangeResync.
+	ChangeDisconnected = "disconnected"
+)
+
+// Change is a committed mutation of a user or a company. A change may be received even though
+// its mutation was rolled back, the listeners re-read the entity rather than trust the change.
+type Change struct {
+	Action     string `json:"action"`
+	EntityType string `json:"entity_type"`
+	EntityID   string `json:"entity_id"`
+}
+
+// ChangeOf returns the change of an audited mutation, ok is false if the entity type isn't
+// notified.
+func ChangeOf(action, entityType, entityID string) (change Change, ok bool) {
+	if entityType != "user" && entityType != "company" {
+		return Change{}, false
+	}
+	return Change{Action: action, EntityType: entityType, EntityID: entityID}, true
+}
+
+// notifyChange notifies the listeners of an audited mutation once the transaction of querier,
+// if any, is committed. Postgres notifies the listeners of every instance, the other drivers
+// only those of the DB.
+func notifyChange(ctx context.Context, querier Querier, action, entityType, entityID string) error {
+	change, ok := ChangeOf(action, entityType, entityID)
+	if !ok {
+		return nil
+	}
+	switch q := querier.(type) {
+	case *Tx:
+		if q.db.driverName != DriverPostgres {
+			q.changes = append(q.changes, change)
+			return nil
+		}
+	case *DB:
+		if q.driverName != DriverPostgres {
+			q.changes.Publish(change)
+			return nil
+		}
+	}
+
+	payload, err := json.Marshal(change)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to marshal change notification")
+		return ErrGenericDBFailure
+	}
+	if _, err = querier.ExecContext(ctx, pgNotifyChange, string(payload)); err != nil {
+		log.G(ctx).WithError(err).Error("failed to notify change in DB")
+		return ErrGenericDBFailure
+	}
+	return nil
+}
+
+// Listen returns a listener of the changes committed through the DB. With Postgres, the
+// changes committed by the other instances are only received by ListenPostgres.
+func (db *DB) Listen() *Listener {
+	return db.changes.Listen()
+}
+
+// Listener receives the changes on C, which is closed once the listener is closed. The changes
+// are queued until they are received, C must be drained.
+type Listener struct {
+	C     <-chan Change
+	close func()
+}
+
+// Close stops the listener, the queued changes are dropped.
+func (l *Listener) Close() {
+	l.close()
+}
+
+// maxQueuedChanges bounds the queue of a listener of a ChangeHub, the queued changes are
+// replaced by a resync when it's full.
+const maxQueuedChanges = 1000
+
+// ChangeHub publishes the changes to its listeners in process. The zero value is ready to use.
+type ChangeHub struct {
+	mu        sync.Mutex
+	listeners map[*hubListener]struct{}
+}
+
+type hubListener struct {
+	mu     sync.Mutex
+	queue  []Change
+	wake   chan struct{}
+	closed chan struct{}
+}
+
+// Listen returns a new listener of the changes published from now on.
+func (h *ChangeHub) Listen() *Listener {
+	l := &hubListener{wake: make(chan struct{}, 1), closed: make(chan struct{})}
+	h.mu.Lock()
+	if h.listeners == nil {
+		h.listeners = make(map[*hubListener]struct{})
+	}
+	h.listeners[l] = struct{}{}
+	h.mu.Unlock()
+
+	c := make(chan Change)
+	go l.forward(c)
+	var once sync.Once
+	return &Listener{C: c, close: func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.listeners, l)
+			h.mu.Unlock()
+			close(l.closed)
+		})
+	}}
+}
+
+// Publish queues the changes for every listener, it doesn't wait for them to be received.
+func (h *ChangeHub) Publish(changes ...Change) {
+	if len(changes) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for l := range h.listeners {
+		l.mu.Lock()
+		l.queue = append(l.queue, changes...)
+		if len(l.queue) > maxQueuedChanges {
+			l.queue = []Change{{Action: ChangeResync}}
+		}
+		l.mu.Unlock()
+		select {
+		case l.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (l *hubListener) forward(c chan<- Change) {
+	defer close(c)
+	for {
+		select {
+		case <-l.wake:
+		case <-l.closed:
+			return
+		}
+		l.mu.Lock()
+		queue := l.queue
+		l.queue = nil
+		l.mu.Unlock()
+		for _, change := range queue {
+			select {
+			case c <- change:
+			case <-l.closed:
+				return
+			}
+		}
+	}
+}
+
+// listenerPingInterval is how often the connection of a Postgres listener is checked, a
+// connection which died silently would miss the notifications until then.
+const listenerPingInterval = 90 * time.Second
+
+// ListenPostgres returns a listener of the changes committed by every instance, on a dedicated
+// connection to the Postgres DB of dataSourceName. The connection is re-established when it's
+// lost, ChangeDisconnected is received meanwhile, and ChangeResync once it's connected again.
+// ChangeResync is also received when the listener first connects, as the changes committed
+// before are missed.
+func ListenPostgres(log log.Logger, dataSourceName string) (*Listener, error) {
+	events := make(chan pq.ListenerEventType)
+	done := make(chan struct{})
+	pql := pq.NewListener(dataSourceName, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventDisconnected:
+			log.WithError(err).Warn("changes listener disconnected")
+		case pq.ListenerEventConnectionAttemptFailed:
+			log.WithError(err).Warn("changes listener failed to connect")
+			return
+		}
+		select {
+		case events <- event:
+		case <-done:
+		}
+	})
+	c := make(chan Change)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer close(c)
+		ticker := time.NewTicker(listenerPingInterval)
+		defer ticker.Stop()
+		for {
+			var change Change
+			select {
+			case n, ok := <-pql.Notify:
+				if !ok {
+					return
+				} else if n == nil { // Sent after a reconnection
+					change.Action = ChangeResync
+				} else if err := json.Unmarshal([]byte(n.Extra), &change); err != nil {
+					log.WithError(err).Error("invalid change notification")
+					continue
+				}
+			case event := <-events:
+				if event == pq.ListenerEventDisconnected {
+					change.Action = ChangeDisconnected
+				} else if event == pq.ListenerEventConnected {
+					change.Action = ChangeResync
+				} else {
+					continue // Reconnected, a nil notification follows
+				}
+			case <-ticker.C:
+				go pql.Ping() // Detects a dead connection, which is then re-established
+				continue
+			case <-done:
+				return
+			}
+
+			select {
+			case c <- change:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	l := &Listener{C: c, close: func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+			pql.Close()
+		})
+	}}
+	// Waits for the connection, the events are forwarded meanwhile
+	if err := pql.Listen(ChangesChannel); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
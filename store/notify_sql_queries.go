@@ -0,0 +1,5 @@
+package store
+
+// Postgres delivers the notification when the transaction is committed, and drops it if it's
+// rolled back.
+const pgNotifyChange = `SELECT pg_notify('` + ChangesChannel + `', $1)`
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/stretchr/testify/require"
+)
+
+func receive(t *testing.T, l *Listener) Change {
+	select {
+	case change := <-l.C:
+		return change
+	case <-time.After(time.Second):
+		t.Fatal("no change received")
+		return Change{}
+	}
+}
+
+func requireNoChange(t *testing.T, l *Listener) {
+	select {
+	case change := <-l.C:
+		t.Fatalf("unexpected change %+v", change)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestNotifyChanges(t *testing.T) {
+	logger, _ := log.NewTest()
+	db := openSQLite(t)
+	defer db.Close()
+	_, err := NewAuditStore(logger, db)
+	require.NoError(t, err)
+	_, err = NewOutboxStore(logger, db)
+	require.NoError(t, err)
+	users, err := NewUserStore(logger, db, testKeyring(t, "k1"))
+	require.NoError(t, err)
+	webhooks, err := NewWebhookStore(logger, db)
+	require.NoError(t, err)
+
+	l := db.Listen()
+	defer l.Close()
+	ctx := context.Background()
+	user, err := users.Add(ctx, db, "login", "password", "email", "user", nil)
+	require.NoError(t, err)
+	require.Equal(t, Change{Action: entity.AuditActionCreate, EntityType: "user", EntityID: user.ID.String()}, receive(t, l))
+
+	// Only the users and companies are notified
+	_, err = webhooks.Add(ctx, db, "http://localhost", []string{"*"}, "secret")
+	require.NoError(t, err)
+	requireNoChange(t, l)
+
+	// The changes of a transaction are received once it's committed, and dropped if it's
+	// rolled back
+	err = db.WithTx(ctx, func(tx Querier) error {
+		require.NoError(t, users.DeleteByID(ctx, tx, user.ID.String()))
+		requireNoChange(t, l)
+		return errors.New("rolled back")
+	})
+	require.EqualError(t, err, "rolled back")
+	requireNoChange(t, l)
+	err = db.WithTx(ctx, func(tx Querier) error {
+		return users.DeleteByID(ctx, tx, user.ID.String())
+	})
+	require.NoError(t, err)
+	require.Equal(t, Change{Action: entity.AuditActionDelete, EntityType: "user", EntityID: user.ID.String()}, receive(t, l))
+}
+
+func TestChangeHub(t *testing.T) {
+	var hub ChangeHub
+	l, closed := hub.Listen(), hub.Listen()
+	defer l.Close()
+	closed.Close()
+	_, ok := <-closed.C
+	require.False(t, ok)
+
+	for k := 0; k < maxQueuedChanges; k++ {
+		hub.Publish(Change{Action: entity.AuditActionUpdate, EntityType: "user", EntityID: "id"})
+	}
+	// The changes which weren't received yet are replaced by a resync once the queue is full
+	hub.Publish(Change{Action: entity.AuditActionDelete, EntityType: "user", EntityID: "id"})
+	hub.Publish(Change{Action: entity.AuditActionCreate, EntityType: "user", EntityID: "id"})
+	first := receive(t, l)
+	if first.Action != ChangeResync {
+		// The first change was forwarded before the queue was full
+		require.Equal(t, entity.AuditActionUpdate, first.Action)
+		require.Equal(t, ChangeResync, receive(t, l).Action)
+	}
+	require.Equal(t, entity.AuditActionCreate, receive(t, l).Action)
+	requireNoChange(t, l)
+}
@@ -0,0 +1,140 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// Outbox holds the domain events published by the mutations of the other stores, until they
+// are delivered.
+type Outbox struct {
+	log log.Logger
+	db  *DB
+}
+
+// NewOutboxStore must be called before the stores whose mutations publish domain events.
+func NewOutboxStore(log log.Logger, db *DB) (*Outbox, error) {
+	if _, err := db.Exec(createTableOutbox); err != nil {
+		return nil, errors.Wrap(err, "failed to create outbox table")
+	}
+	return &Outbox{log: log, db: db}, nil
+}
+
+// publishEvent writes the domain event of an audited mutation, if it has one, so that it's
+// only delivered if the transaction of the mutation is committed.
+func publishEvent(ctx context.Context, querier Querier, action, entityType, entityID string, before, after interface{}) error {
+	eventType, ok := entity.EventType(entityType, action)
+	if !ok {
+		return nil
+	}
+	if after == nil {
+		after = before
+	}
+	payload, err := snapshot(after)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to marshal domain event payload")
+		return ErrGenericDBFailure
+	}
+
+	info := AuditInfoFromCtx(ctx)
+	_, err = querier.ExecContext(ctx, insertOutboxEvent, eventType, entityType, entityID, payload, info.RequestID)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to insert domain event in DB")
+		return ErrGenericDBFailure
+	}
+	return nil
+}
+
+// redactDomainEvents replaces the fields of the payloads of the domain events of an entity with
+// placeholders, like redactEvents: the events pending publication and the deliveries of the
+// webhooks, whatever their status. It must be called within the transaction of the erasure.
+func redactDomainEvents(ctx context.Context, querier Querier, entityType, entityID string, placeholders map[string]interface{}) error {
+	err := redactPayloads(ctx, querier, "domain event payloads", selectOutboxPayloadsForUpdate, []interface{}{entityType, entityID}, updateOutboxPayload,
+		func(payload []byte) (interface{}, error) {
+			return redactSnapshot(payload, placeholders)
+		})
+	if err != nil {
+		return err
+	}
+
+	filter, _ := json.Marshal(map[string]string{"entity_type": entityType, "entity_id": entityID}) // Strings always marshal
+	return redactPayloads(ctx, querier, "webhook delivery payloads", selectDeliveryPayloadsForUpdate, []interface{}{string(filter)}, updateDeliveryPayload,
+		func(b []byte) (interface{}, error) {
+			var event map[string]json.RawMessage // The event is kept verbatim, but its payload
+			if err := json.Unmarshal(b, &event); err != nil {
+				return nil, err
+			}
+			if event["payload"] == nil {
+				return string(b), nil
+			}
+			payload, err := redactSnapshot(event["payload"], placeholders)
+			if err != nil {
+				return nil, err
+			}
+			event["payload"] = json.RawMessage(payload.(string))
+			return snapshot(event)
+		})
+}
+
+// Claim returns up to limit events due for delivery, in publication order. They aren't claimed
+// again before the lease expires, unless they are nacked.
+func (s *Outbox) Claim(ctx context.Context, querier Querier, limit int, lease time.Duration) ([]entity.DomainEvent, error) {
+	rows, err := querier.QueryContext(ctx, claimOutboxEvents, limit, lease.Seconds())
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to claim domain events in DB")
+		return nil, ErrGenericDBFailure
+	}
+	defer rows.Close()
+
+	var events []entity.DomainEvent
+	for rows.Next() {
+		var event entity.DomainEvent
+		var payload []byte
+		err = rows.Scan(&event.ID, utcTime{&event.OccurredAt}, &event.Type, &event.EntityType, &event.EntityID, &payload, &event.RequestID, &event.Attempts)
+		if err != nil {
+			log.G(ctx).WithError(err).Error("failed to scan domain event in DB")
+			return nil, ErrGenericDBFailure
+		}
+		event.Payload = payload
+		events = append(events, event)
+	}
+	if err = rows.Err(); err != nil {
+		log.G(ctx).WithError(err).Error("failed to loop through domain events")
+		return nil, ErrGenericDBFailure
+	}
+
+	// RETURNING doesn't keep the order of the subquery.
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events, nil
+}
+
+// Ack deletes a delivered event.
+func (s *Outbox) Ack(ctx context.Context, querier Querier, ID int64) error {
+	if _, err := querier.ExecContext(ctx, ackOutboxEvent, ID); err != nil {
+		log.G(ctx).WithError(err).Error("failed to delete domain event in DB")
+		return ErrGenericDBFailure
+	}
+	return nil
+}
+
+// Nack delays the next delivery of an event which failed with reason.
+func (s *Outbox) Nack(ctx context.Context, querier Querier, ID int64, delay time.Duration, reason string) error {
+	if _, err := querier.ExecContext(ctx, nackOutboxEvent, ID, delay.Seconds(), reason); err != nil {
+		log.G(ctx).WithError(err).Error("failed to reschedule domain event in DB")
+		return ErrGenericDBFailure
+	}
+	return nil
+}
+
+func (s *Outbox) DeleteAll() error {
+	if _, err := s.db.Exec(deleteAllOutboxEvents); err != nil {
+		return errors.Wrap(err, "failed to truncate outbox table")
+	}
+	return nil
+}
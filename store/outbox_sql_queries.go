@@ -0,0 +1,66 @@
+package store
+
+// The delivered events are deleted, available_at delays the next delivery of the others.
+const createTableOutbox = `
+CREATE TABLE IF NOT EXISTS outbox (
+	id BIGSERIAL PRIMARY KEY,
+	created_at timestamp WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	event_type TEXT NOT NULL,
+	entity_type TEXT NOT NULL,
+	entity_id TEXT NOT NULL,
+	payload JSONB NOT NULL,
+	request_id TEXT NOT NULL,
+	attempts INTEGER DEFAULT 0 NOT NULL,
+	available_at timestamp WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	last_error TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbox_available_at ON outbox (available_at);
+
+-- The timestamps were stored in UTC without time zone, they are converted once.
+DO $$
+BEGIN
+	IF (SELECT data_type FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'outbox' AND column_name = 'created_at') = 'timestamp without time zone' THEN
+		ALTER TABLE outbox
+			ALTER COLUMN created_at TYPE timestamptz USING created_at AT TIME ZONE 'UTC',
+			ALTER COLUMN available_at TYPE timestamptz USING available_at AT TIME ZONE 'UTC';
+	END IF;
+END
+$$;
+`
+
+const insertOutboxEvent = `
+INSERT INTO outbox (event_type, entity_type, entity_id, payload, request_id)
+VALUES ($1, $2, $3, $4, $5)
+`
+
+const outboxColumns = `id, created_at, event_type, entity_type, entity_id, payload, request_id, attempts`
+
+// The dispatchers of several instances claim distinct events, the locked ones are skipped.
+const claimOutboxEvents = `
+UPDATE outbox SET attempts = attempts + 1, available_at = CURRENT_TIMESTAMP + make_interval(secs => $2)
+WHERE id IN (
+	SELECT id FROM outbox WHERE available_at <= CURRENT_TIMESTAMP ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED
+)
+RETURNING ` + outboxColumns
+
+const ackOutboxEvent = `
+DELETE FROM outbox WHERE id = $1
+`
+
+const nackOutboxEvent = `
+UPDATE outbox SET available_at = CURRENT_TIMESTAMP + make_interval(secs => $2), last_error = $3 WHERE id = $1
+`
+
+// The events of an erased entity are redacted, see redactDomainEvents.
+const selectOutboxPayloadsForUpdate = `
+SELECT id, payload FROM outbox WHERE entity_type = $1 AND entity_id = $2 FOR UPDATE`
+
+const updateOutboxPayload = `
+UPDATE outbox SET payload = $2 WHERE id = $1
+`
+
+const deleteAllOutboxEvents = `
+TRUNCATE TABLE outbox
+`
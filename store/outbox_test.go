@@ -0,0 +1,61 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutbox(t *testing.T) {
+	logger, _ := log.NewTest()
+	db := openSQLite(t)
+	defer db.Close()
+	_, err := NewAuditStore(logger, db)
+	require.NoError(t, err)
+	outbox, err := NewOutboxStore(logger, db)
+	require.NoError(t, err)
+	users, err := NewUserStore(logger, db, testKeyring(t, "k1"))
+	require.NoError(t, err)
+
+	// The events are only published when the mutation is committed
+	ctx := WithAuditInfo(context.Background(), AuditInfo{Actor: "test", RequestID: "request"})
+	user, err := users.Add(ctx, db, "login", "password", "email", "user", nil)
+	require.NoError(t, err)
+	err = WithTx(ctx, db, func(tx *Tx) error {
+		if _, err := users.Add(ctx, tx, "rolledback", "password", "rolledback", "user", nil); err != nil {
+			return err
+		}
+		return errors.New("rollback")
+	})
+	require.EqualError(t, err, "rollback")
+	require.NoError(t, users.DeleteByID(ctx, db, user.ID.String()))
+
+	events, err := outbox.Claim(ctx, db, 10, time.Hour)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	created, deleted := events[0], events[1]
+	require.Equal(t, entity.EventUserCreated, created.Type)
+	require.Equal(t, entity.EventUserDeleted, deleted.Type)
+	require.Equal(t, user.ID.String(), created.EntityID)
+	require.Equal(t, "request", created.RequestID)
+	require.Equal(t, 1, created.Attempts)
+	require.Contains(t, string(created.Payload), `"login":"login"`)
+	require.Contains(t, string(deleted.Payload), "deleted_at")
+
+	// The claimed events are leased, until they are nacked
+	events, err = outbox.Claim(ctx, db, 10, time.Hour)
+	require.NoError(t, err)
+	require.Empty(t, events)
+	require.NoError(t, outbox.Ack(ctx, db, created.ID))
+	require.NoError(t, outbox.Nack(ctx, db, deleted.ID, 0, "unavailable"))
+	events, err = outbox.Claim(ctx, db, 10, time.Hour)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, deleted.ID, events[0].ID)
+	require.Equal(t, 2, events[0].Attempts)
+}
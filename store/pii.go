@@ -0,0 +1,143 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/envelope"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// userPII is the personal data of a user, sealed in the pii column with the data key of the
+// user. The personal data added to the users goes there, and gets a blind index in its own
+// column if it must be looked up.
+type userPII struct {
+	Email string `json:"email"`
+}
+
+// piiAdditionalData binds the sealed personal data to its column.
+var piiAdditionalData = []byte("users.pii")
+
+// RedactedEmail replaces the emails in the audit snapshots and in the payloads of the domain
+// events, which are stored in plaintext.
+const RedactedEmail = "[redacted]"
+
+// WithoutPII returns the snapshot v of a record without its personal data, which is only stored
+// sealed: the emails of the users and of the invitations. The other records are returned as is.
+func WithoutPII(v interface{}) interface{} {
+	switch v := v.(type) {
+	case entity.User:
+		v.Email = RedactedEmail
+		return v
+	case entity.Company:
+		if v.Users != nil {
+			users := make([]entity.User, len(v.Users))
+			for k, user := range v.Users {
+				user.Email = RedactedEmail
+				users[k] = user
+			}
+			v.Users = users
+		}
+		return v
+	case entity.Invitation:
+		v.Email = RedactedEmail
+		return v
+	}
+	return v
+}
+
+// sealedUser is a user as stored, with its personal data sealed.
+type sealedUser struct {
+	entity.User
+	email       sql.NullString // The plaintext email of the users stored before the encryption
+	pii         []byte
+	dataKey     []byte
+	masterKeyID sql.NullString
+}
+
+// dest returns the scan destinations of the userColumns.
+func (u *sealedUser) dest() []interface{} {
+	return []interface{}{&u.ID, &u.Login, &u.email, &u.pii, &u.dataKey, &u.masterKeyID, &u.Role,
+		utcTime{&u.CreatedAt}, utcTime{&u.UpdatedAt}, &u.Version, nullUTCTime{&u.DeletedAt}, nullUTCTime{&u.ErasedAt}, metadataColumn{&u.Metadata}}
+}
+
+// open returns the user with its personal data decrypted.
+func (u *sealedUser) open(keyring *envelope.Keyring) (entity.User, error) {
+	user := u.User
+	if !u.masterKeyID.Valid {
+		user.Email = u.email.String
+		return user, nil
+	}
+
+	pii, err := openPII(keyring, u.masterKeyID.String, u.dataKey, u.pii, piiAdditionalData)
+	if err != nil {
+		return user, err
+	}
+	user.Email = pii.Email
+	return user, nil
+}
+
+// getUser runs a query returning the userColumns of a single user, see getOne.
+func getUser(ctx context.Context, querier Querier, keyring *envelope.Keyring, query string, args []interface{}) (entity.User, error) {
+	var sealed sealedUser
+	if err := getOne(ctx, querier, query, args, sealed.dest()...); err != nil {
+		return entity.User{}, err
+	}
+	user, err := sealed.open(keyring)
+	if err != nil {
+		log.G(ctx).F("id", sealed.ID).WithError(err).Error("failed to decrypt user")
+		return user, ErrGenericDBFailure
+	}
+	return user, nil
+}
+
+// sealedPII is the personal data of a user sealed with a new data key, along with its blind
+// indexes.
+type sealedPII struct {
+	pii         []byte
+	dataKey     []byte
+	masterKeyID string
+	emailIndex  []byte
+}
+
+func sealPII(keyring *envelope.Keyring, pii userPII) (sealedPII, error) {
+	return sealPIIFor(keyring, pii, piiAdditionalData)
+}
+
+// sealPIIFor seals the personal data bound to the column of additionalData, the personal data
+// of the other tables is sealed like the one of the users.
+func sealPIIFor(keyring *envelope.Keyring, pii userPII, additionalData []byte) (sealedPII, error) {
+	b, err := json.Marshal(pii)
+	if err != nil {
+		return sealedPII{}, errors.Wrap(err, "failed to marshal personal data")
+	}
+	dataKey, err := keyring.NewDataKey()
+	if err != nil {
+		return sealedPII{}, err
+	}
+	sealed := sealedPII{dataKey: dataKey.Wrapped, masterKeyID: dataKey.MasterKeyID, emailIndex: keyring.BlindIndex(pii.Email)}
+	if sealed.pii, err = dataKey.Seal(b, additionalData); err != nil {
+		return sealedPII{}, err
+	}
+	return sealed, nil
+}
+
+// openPII decrypts the personal data sealed by sealPIIFor.
+func openPII(keyring *envelope.Keyring, masterKeyID string, wrappedKey, sealed, additionalData []byte) (userPII, error) {
+	var pii userPII
+	dataKey, err := keyring.Unwrap(masterKeyID, wrappedKey)
+	if err != nil {
+		return pii, err
+	}
+	b, err := dataKey.Open(sealed, additionalData)
+	if err != nil {
+		return pii, err
+	}
+	if err := json.Unmarshal(b, &pii); err != nil {
+		return pii, errors.Wrap(err, "invalid personal data")
+	}
+	return pii, nil
+}
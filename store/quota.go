@@ -0,0 +1,154 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+)
+
+// quotaDay is the day the requests are counted in, as stored in company_requests.
+func quotaDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// nullInt returns the limit as stored, NULL when it's unlimited.
+func nullInt(limit *int) sql.NullInt64 {
+	if limit == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(*limit), Valid: true}
+}
+
+// limitsDest scans the nullable limits, see limits.
+type limitsDest [3]sql.NullInt64
+
+func (d *limitsDest) dest() []interface{} {
+	return []interface{}{&d[0], &d[1], &d[2]}
+}
+
+func (d *limitsDest) limits() entity.CompanyLimits {
+	limit := func(n sql.NullInt64) *int {
+		if !n.Valid {
+			return nil
+		}
+		v := int(n.Int64)
+		return &v
+	}
+	return entity.CompanyLimits{MaxMembers: limit(d[0]), MaxAPIKeys: limit(d[1]), RequestsPerDay: limit(d[2])}
+}
+
+// GetQuota returns the limits of the company along with its current usage.
+func (s *Company) GetQuota(ctx context.Context, querier Querier, ID string) (entity.CompanyQuota, error) {
+	var quota entity.CompanyQuota
+	var limits limitsDest
+	dest := append(limits.dest(), &quota.Usage.Members, &quota.Usage.APIKeys, &quota.Usage.RequestsToday)
+	err := getOne(ctx, reader(ctx, querier), selectCompanyQuota, []interface{}{ID, quotaDay(time.Now())}, dest...)
+	if err == ErrNoRows {
+		return quota, NewNotFoundError("company", ID)
+	} else if err != nil {
+		return quota, err
+	}
+	quota.Limits = limits.limits()
+	return quota, nil
+}
+
+// SetLimits replaces the limits of the company, the usage exceeding the new limits is kept.
+func (s *Company) SetLimits(ctx context.Context, querier Querier, ID string, limits entity.CompanyLimits) (entity.CompanyLimits, error) {
+	err := WithTx(ctx, querier, func(tx *Tx) error {
+		var company entity.Company
+		err := getOne(ctx, tx, selectCompanyForUpdate, []interface{}{ID}, companyDest(&company)...)
+		if err == ErrNoRows {
+			return NewNotFoundError("company", ID)
+		} else if err != nil {
+			return err
+		}
+		var before limitsDest
+		err = getOne(ctx, tx, selectCompanyLimitsForUpdate, []interface{}{ID}, before.dest()...)
+		if err != nil && err != ErrNoRows {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, upsertCompanyLimits, ID, nullInt(limits.MaxMembers), nullInt(limits.MaxAPIKeys), nullInt(limits.RequestsPerDay))
+		if err != nil {
+			log.G(ctx).WithError(err).Error("failed to upsert company limits in DB")
+			return ErrGenericDBFailure
+		}
+		return recordEvent(ctx, tx, entity.AuditActionUpdate, "company_limits", ID, before.limits(), limits)
+	})
+	return limits, err
+}
+
+// CountRequest counts a request of the company today, unless it exceeds its requests per day.
+// The requests exceeding the limit aren't counted.
+func (s *Company) CountRequest(ctx context.Context, querier Querier, ID string) error {
+	return WithTx(ctx, querier, func(tx *Tx) error {
+		var requests int
+		err := tx.QueryRowContext(ctx, countCompanyRequest, ID, quotaDay(time.Now())).Scan(&requests)
+		if code, _, _ := violation(err); code == ErrFKViolation {
+			return NewNotFoundError("company", ID)
+		} else if err != nil {
+			log.G(ctx).WithError(err).Error("failed to count company request in DB")
+			return ErrGenericDBFailure
+		}
+		return checkQuota(ctx, tx, ID, entity.QuotaRequestsPerDay, requests)
+	})
+}
+
+// PurgeRequests deletes the requests counted before the day of before, and returns how many
+// daily counts were deleted.
+func (s *Company) PurgeRequests(ctx context.Context, querier Querier, before time.Time) (int64, error) {
+	res, err := querier.ExecContext(ctx, purgeCompanyRequests, quotaDay(before))
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to purge company requests in DB")
+		return 0, ErrGenericDBFailure
+	}
+	n, _ := res.RowsAffected()
+	return n, nil
+}
+
+// quotaUsage counts the usage of the quotas whose mutations are checked by checkUsage.
+var quotaUsage = map[string]string{
+	entity.QuotaMembers: countCompanyMembers,
+	entity.QuotaAPIKeys: countCompanyAPIKeys,
+}
+
+// checkUsage fails if the usage of the quota exceeds the limit of the company, it must be
+// called by the mutations adding to the usage once they are made, in their transaction.
+func checkUsage(ctx context.Context, querier Querier, companyID, quota string) error {
+	return checkQuota(ctx, querier, companyID, quota, -1)
+}
+
+// checkQuota fails if usage exceeds the limit of the company, the usage is counted if it's
+// negative. The limits of the company are locked, so that the concurrent mutations are checked
+// one after the other.
+func checkQuota(ctx context.Context, querier Querier, companyID, quota string, usage int) error {
+	var dest limitsDest
+	err := getOne(ctx, querier, selectCompanyLimitsForUpdate, []interface{}{companyID}, dest.dest()...)
+	if err == ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	limits := dest.limits()
+	limit := map[string]*int{
+		entity.QuotaMembers:        limits.MaxMembers,
+		entity.QuotaAPIKeys:        limits.MaxAPIKeys,
+		entity.QuotaRequestsPerDay: limits.RequestsPerDay,
+	}[quota]
+	if limit == nil {
+		return nil
+	}
+
+	if usage < 0 {
+		if err := getOne(ctx, querier, quotaUsage[quota], []interface{}{companyID}, &usage); err != nil {
+			return err
+		}
+	}
+	if usage > *limit {
+		return NewQuotaExceededError(companyID, quota, *limit)
+	}
+	return nil
+}
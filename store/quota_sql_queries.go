@@ -0,0 +1,58 @@
+package store
+
+// A company without limits is unlimited, as is a nil limit. The requests are counted per UTC
+// day, the past days are purged.
+const createTableCompanyLimits = `
+CREATE TABLE IF NOT EXISTS company_limits (
+	company_id UUID PRIMARY KEY REFERENCES companies(id) ON DELETE CASCADE,
+	max_members INTEGER,
+	max_api_keys INTEGER,
+	requests_per_day INTEGER,
+	updated_at timestamptz DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	CONSTRAINT chk_company_limits CHECK (max_members >= 0 AND max_api_keys >= 0 AND requests_per_day >= 0)
+);
+
+CREATE TABLE IF NOT EXISTS company_requests (
+	company_id UUID NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+	day DATE NOT NULL,
+	requests INTEGER NOT NULL,
+	PRIMARY KEY (company_id, day)
+)`
+
+const upsertCompanyLimits = `
+INSERT INTO company_limits (company_id, max_members, max_api_keys, requests_per_day) VALUES ($1, $2, $3, $4)
+ON CONFLICT (company_id) DO UPDATE SET
+	max_members = EXCLUDED.max_members,
+	max_api_keys = EXCLUDED.max_api_keys,
+	requests_per_day = EXCLUDED.requests_per_day,
+	updated_at = CURRENT_TIMESTAMP
+`
+
+// The lock serializes the mutations checked against the limits of a company.
+const selectCompanyLimitsForUpdate = `
+SELECT max_members, max_api_keys, requests_per_day FROM company_limits WHERE company_id = $1 FOR UPDATE`
+
+const countCompanyMembers = `
+SELECT count(*) FROM users_companies WHERE company_id = $1`
+
+const countCompanyAPIKeys = `
+SELECT count(*) FROM api_keys WHERE company_id = $1`
+
+// $2 is the current day.
+const selectCompanyQuota = `
+SELECT l.max_members, l.max_api_keys, l.requests_per_day,
+	(SELECT count(*) FROM users_companies WHERE company_id = c.id),
+	(SELECT count(*) FROM api_keys WHERE company_id = c.id),
+	COALESCE((SELECT requests FROM company_requests WHERE company_id = c.id AND day = $2), 0)
+FROM companies c LEFT JOIN company_limits l ON l.company_id = c.id
+WHERE c.id = $1`
+
+// The row of the day is locked until the transaction ends, the concurrent requests of the
+// company are counted one after the other.
+const countCompanyRequest = `
+INSERT INTO company_requests (company_id, day, requests) VALUES ($1, $2, 1)
+ON CONFLICT (company_id, day) DO UPDATE SET requests = company_requests.requests + 1
+RETURNING requests`
+
+const purgeCompanyRequests = `
+DELETE FROM company_requests WHERE day < $1`
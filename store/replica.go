@@ -0,0 +1,136 @@
+package store
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/jordanp/goapp/pkg/log"
+)
+
+// replicaPingTimeout bounds the health checks, a replica which doesn't answer in time is
+// considered down.
+const replicaPingTimeout = time.Second
+
+type replica struct {
+	*DB
+	healthy int32 // Accessed atomically, 1 if the last health check succeeded
+}
+
+func (r *replica) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+// UseReplicas routes the read-only store methods to the replicas, as long as they pass the
+// health checks run every checkInterval. The reads fall back to the primary DB when no replica
+// is healthy. The queries of the replicas are instrumented like those of the DB. It must be
+// called before the DB is used, Close closes the replicas.
+func (db *DB) UseReplicas(log log.Logger, replicas []*DB, checkInterval time.Duration) {
+	if len(replicas) == 0 {
+		return
+	}
+	for _, r := range replicas {
+		r.instr, r.retryPolicy = db.instr, db.retryPolicy
+		db.replicas = append(db.replicas, &replica{DB: r})
+	}
+	db.checkReplicas(log)
+
+	db.stopChecks = make(chan struct{})
+	ticker := time.NewTicker(checkInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				db.checkReplicas(log)
+			case <-db.stopChecks:
+				return
+			}
+		}
+	}()
+}
+
+func (db *DB) checkReplicas(log log.Logger) {
+	for k, r := range db.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), replicaPingTimeout)
+		err := r.PingContext(ctx)
+		cancel()
+
+		healthy := int32(1)
+		if err != nil {
+			healthy = 0
+		}
+		if atomic.SwapInt32(&r.healthy, healthy) != healthy {
+			if err != nil {
+				log.F("replica", k).WithError(err).Error("replica is down, its reads go to the primary")
+			} else {
+				log.F("replica", k).Info("replica is up")
+			}
+		}
+	}
+}
+
+// replica returns the next healthy replica, round robin, or nil if there is none.
+func (db *DB) replica() *DB {
+	n := uint32(len(db.replicas))
+	for k := uint32(0); k < n; k++ {
+		r := db.replicas[atomic.AddUint32(&db.nextReplica, 1)%n]
+		if r.isHealthy() {
+			return r.DB
+		}
+	}
+	return nil
+}
+
+// Close stops the health checks and closes the replicas along with the primary DB.
+func (db *DB) Close() error {
+	if db.stopChecks != nil {
+		close(db.stopChecks)
+	}
+	for _, r := range db.replicas {
+		r.DB.Close()
+	}
+	return db.DB.Close()
+}
+
+// reader returns the querier of the read-only store methods: a replica when the querier is a
+// DB with healthy replicas, unless ctx must read its own writes. Transactions always read
+// from the primary DB.
+func reader(ctx context.Context, querier Querier) Querier {
+	db, ok := querier.(*DB)
+	if !ok || len(db.replicas) == 0 || readsPrimary(ctx) {
+		return querier
+	}
+	if r := db.replica(); r != nil {
+		return r
+	}
+	return db
+}
+
+type ctxReadYourWrites struct{}
+
+// readYourWrites is set once a mutation has been committed with the context.
+type readYourWrites struct {
+	written int32 // Accessed atomically
+}
+
+// WithReadYourWrites returns a context whose reads go to the primary DB, which the replicas
+// may lag behind, either right away if primary is true or after its first committed mutation.
+func WithReadYourWrites(ctx context.Context, primary bool) context.Context {
+	rw := &readYourWrites{}
+	if primary {
+		rw.written = 1
+	}
+	return context.WithValue(ctx, ctxReadYourWrites{}, rw)
+}
+
+func readsPrimary(ctx context.Context) bool {
+	rw, ok := ctx.Value(ctxReadYourWrites{}).(*readYourWrites)
+	return ok && atomic.LoadInt32(&rw.written) == 1
+}
+
+func markWritten(ctx context.Context) {
+	if rw, ok := ctx.Value(ctxReadYourWrites{}).(*readYourWrites); ok {
+		atomic.StoreInt32(&rw.written, 1)
+	}
+}
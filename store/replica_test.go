@@ -0,0 +1,68 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/stretchr/testify/require"
+)
+
+func openSQLite(t *testing.T) *DB {
+	db, err := sql.Open(DriverSQLite, "file::memory:?_foreign_keys=1")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1) // Every connection to :memory: has its own DB
+	return NewDB(DriverSQLite, db)
+}
+
+func TestReplicas(t *testing.T) {
+	logger, _ := log.NewTest()
+	primary, replica := openSQLite(t), openSQLite(t)
+	defer primary.Close()
+
+	_, err := NewAuditStore(logger, primary)
+	require.NoError(t, err)
+	_, err = NewOutboxStore(logger, primary)
+	require.NoError(t, err)
+	users, err := NewUserStore(logger, primary, testKeyring(t, "k1"))
+	require.NoError(t, err)
+	_, err = NewUserStore(logger, replica, testKeyring(t, "k1"))
+	require.NoError(t, err)
+	primary.UseReplicas(logger, []*DB{replica}, time.Hour)
+
+	// The replica never catches up, the user is only found when reading from the primary
+	ctx := context.Background()
+	user, err := users.Add(ctx, primary, "login", "password", "email", "user", nil)
+	require.NoError(t, err)
+	_, err = users.GetByID(ctx, primary, user.ID.String(), false)
+	require.IsType(t, &NotFoundError{}, err)
+
+	ctx = WithReadYourWrites(context.Background(), true)
+	_, err = users.GetByID(ctx, primary, user.ID.String(), false)
+	require.NoError(t, err)
+
+	ctx = WithReadYourWrites(context.Background(), false)
+	_, err = users.GetByID(ctx, primary, user.ID.String(), false)
+	require.IsType(t, &NotFoundError{}, err)
+	email := "email2"
+	_, err = users.Update(ctx, primary, user.ID.String(), entity.UserPatch{Email: &email}, 0)
+	require.NoError(t, err)
+	_, err = users.GetByID(ctx, primary, user.ID.String(), false)
+	require.NoError(t, err)
+
+	// Transactions read from the primary
+	err = WithTx(context.Background(), primary, func(tx *Tx) error {
+		_, err := users.GetByID(context.Background(), tx, user.ID.String(), false)
+		return err
+	})
+	require.NoError(t, err)
+
+	// The reads fail over to the primary once the replica is down
+	require.NoError(t, replica.DB.Close())
+	primary.checkReplicas(logger)
+	_, err = users.GetByID(context.Background(), primary, user.ID.String(), false)
+	require.NoError(t, err)
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// RetryPolicy retries the operations failing with a transient error, see isTransient. The
+// delay before each retry is random, up to a limit doubling from BaseDelay to MaxDelay.
+type RetryPolicy struct {
+	MaxAttempts int // Including the first one, 1 disables the retries
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: 50 * time.Millisecond, MaxDelay: time.Second}
+
+// SetRetryPolicy sets the policy of the DB and of its replicas, which use DefaultRetryPolicy
+// otherwise. It must be called before the DB is used.
+func (db *DB) SetRetryPolicy(policy RetryPolicy) {
+	db.retryPolicy = policy
+	for _, r := range db.replicas {
+		r.retryPolicy = policy
+	}
+}
+
+// backoff returns the delay before the retry following the attempt, with a full jitter.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	limit := p.BaseDelay << uint(attempt-1)
+	if limit > p.MaxDelay || limit <= 0 {
+		limit = p.MaxDelay
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit)) + 1)
+}
+
+// retry calls fn until it succeeds, fails with an error which isn't transient, or the attempts
+// of the policy are exhausted. It gives up early when the deadline of ctx would expire before
+// the next attempt. operation names what's retried in the logs and metrics.
+func (db *DB) retry(ctx context.Context, operation string, fn func() (transient bool, err error)) error {
+	for attempt := 1; ; attempt++ {
+		transient, err := fn()
+		if err == nil || !transient || attempt >= db.retryPolicy.MaxAttempts {
+			return err
+		}
+
+		delay := db.retryPolicy.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+		log.G(ctx).F("operation", operation, "attempt", attempt, "delay", delay.String()).Warn("retrying after a transient DB error")
+		if db.instr.retries != nil {
+			db.instr.retries.WithLabelValues(operation).Inc()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// isTransient returns true if the operation failing with err may succeed if it's retried:
+// serialization failures, deadlocks, and connections lost or refused during a failover.
+func isTransient(err error) bool {
+	switch err := err.(type) {
+	case nil:
+		return false
+	case *pq.Error:
+		switch err.Code {
+		case "40001", // serialization_failure
+			"40P01", // deadlock_detected
+			"57P01", // admin_shutdown
+			"57P02", // crash_shutdown
+			"57P03": // cannot_connect_now
+			return true
+		}
+		return err.Code.Class() == "08" // connection_exception
+	case sqlite3.Error:
+		return err.Code == sqlite3.ErrBusy || err.Code == sqlite3.ErrLocked
+	case net.Error:
+		return true
+	}
+	return err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// isRejectedCommit returns true if the commit failing with err certainly wasn't applied, so that
+// the transaction can run again: the serialization failures and deadlocks detected at commit
+// time, and the busy databases of SQLite whose driver rolls back. After the other errors, such
+// as a connection lost, the commit may have succeeded and running the transaction again could
+// apply it twice.
+func isRejectedCommit(err error) bool {
+	switch err := err.(type) {
+	case *pq.Error:
+		return err.Code == "40001" || err.Code == "40P01" // serialization_failure, deadlock_detected
+	case sqlite3.Error:
+		return err.Code == sqlite3.ErrBusy
+	}
+	return false
+}
+
+// idempotent returns true for the queries which can be retried outside of a transaction.
+func idempotent(query string) bool {
+	fields := strings.Fields(query)
+	return len(fields) > 0 && strings.ToUpper(fields[0]) == "SELECT"
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsTransient(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		transient bool
+	}{
+		{nil, false},
+		{errors.New("boom"), false},
+		{&pq.Error{Code: "40001"}, true},
+		{&pq.Error{Code: "40P01"}, true},
+		{&pq.Error{Code: "57P01"}, true},
+		{&pq.Error{Code: "08006"}, true},
+		{&pq.Error{Code: "23505"}, false},
+		{sqlite3.Error{Code: sqlite3.ErrBusy}, true},
+		{sqlite3.Error{Code: sqlite3.ErrConstraint}, false},
+		{driver.ErrBadConn, true},
+		{io.ErrUnexpectedEOF, true},
+	} {
+		require.Equal(t, tc.transient, isTransient(tc.err), "%v", tc.err)
+	}
+}
+
+func TestIsRejectedCommit(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		rejected bool
+	}{
+		{&pq.Error{Code: "40001"}, true},
+		{&pq.Error{Code: "40P01"}, true},
+		{&pq.Error{Code: "57P01"}, false},
+		{&pq.Error{Code: "08006"}, false},
+		{sqlite3.Error{Code: sqlite3.ErrBusy}, true},
+		{driver.ErrBadConn, false},
+		{io.EOF, false},
+	} {
+		require.Equal(t, tc.rejected, isRejectedCommit(tc.err), "%v", tc.err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: 10 * time.Millisecond, MaxDelay: 25 * time.Millisecond}
+	for k := 0; k < 100; k++ {
+		require.InDelta(t, 5*time.Millisecond, policy.backoff(1), float64(5*time.Millisecond))
+		require.InDelta(t, 10*time.Millisecond, policy.backoff(2), float64(10*time.Millisecond))
+		require.InDelta(t, 12500*time.Microsecond, policy.backoff(4), float64(12500*time.Microsecond))
+	}
+	require.Equal(t, time.Duration(0), RetryPolicy{}.backoff(1))
+}
+
+func TestWithTxRetries(t *testing.T) {
+	db := openSQLite(t)
+	defer db.Close()
+	db.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond})
+	RegisterMetrics(prometheus.NewRegistry(), "goapp", db)
+	errTransient := errors.New("transient")
+
+	// A transaction failing with a transient error is run again
+	attempts := 0
+	err := WithTx(context.Background(), db, func(tx *Tx) error {
+		attempts++
+		if attempts == 1 {
+			tx.transient = true
+			return errTransient
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, attempts)
+	var retries dto.Metric
+	require.NoError(t, db.instr.retries.WithLabelValues("transaction").Write(&retries))
+	require.Equal(t, 1.0, retries.GetCounter().GetValue())
+
+	// Up to the maximum number of attempts
+	attempts = 0
+	err = WithTx(context.Background(), db, func(tx *Tx) error {
+		attempts++
+		tx.transient = true
+		return errTransient
+	})
+	require.Equal(t, errTransient, err)
+	require.Equal(t, 3, attempts)
+
+	// But not the other errors
+	attempts = 0
+	err = WithTx(context.Background(), db, func(tx *Tx) error {
+		attempts++
+		return errTransient
+	})
+	require.Equal(t, errTransient, err)
+	require.Equal(t, 1, attempts)
+
+	// Nor past the deadline of the context
+	db.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Hour, MaxDelay: time.Hour})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	attempts = 0
+	err = WithTx(ctx, db, func(tx *Tx) error {
+		attempts++
+		tx.transient = true
+		return errTransient
+	})
+	require.Equal(t, errTransient, err)
+	require.Equal(t, 1, attempts)
+}
@@ -0,0 +1,37 @@
+package store
+
+import (
+	"context"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+)
+
+// search runs one of the ranked search queries. Every search query must select, in
+// that order, the id, the label, the highlighted text and the rank of the matching rows. The
+// query and the limit are its first arguments, args follow them.
+func search(ctx context.Context, querier Querier, kind, query string, q entity.SearchQuery, args ...interface{}) ([]entity.SearchResult, error) {
+	rows, err := querier.QueryContext(ctx, query, append([]interface{}{q.Query, q.Limit}, args...)...)
+	if err != nil {
+		log.G(ctx).WithError(err).Errorf("failed to search %s in DB", kind)
+		return nil, ErrGenericDBFailure
+	}
+	defer rows.Close()
+
+	var results []entity.SearchResult
+	for rows.Next() {
+		result := entity.SearchResult{Kind: kind}
+		if err = rows.Scan(&result.ID, &result.Label, &result.Highlight, &result.Rank); err != nil {
+			log.G(ctx).WithError(err).Errorf("failed to scan %s search result", kind)
+			return nil, ErrGenericDBFailure
+		}
+		results = append(results, result)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.G(ctx).WithError(err).Errorf("failed to loop through %s search results", kind)
+		return nil, ErrGenericDBFailure
+	}
+
+	return results, nil
+}
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/jordanp/goapp/pkg/textsearch"
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteNow has the microsecond precision of the Postgres timestamps, CURRENT_TIMESTAMP only
+// has the second.
+const sqliteNow = `current_timestamp_us()`
+
+// sqliteTimeFormat is the format of the timestamps stored by SQLite.
+const sqliteTimeFormat = "2006-01-02 15:04:05.000000"
+
+// The SQLite driver provides current_timestamp_us, along with the search functions which stand
+// in for the full-text and trigram search of Postgres, and json_contains for its @> operator.
+func init() {
+	sql.Register(DriverSQLite, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			// The optional argument shifts the time by a number of seconds
+			now := func(seconds ...float64) string {
+				t := time.Now().UTC()
+				if len(seconds) > 0 {
+					t = t.Add(time.Duration(seconds[0] * float64(time.Second)))
+				}
+				return t.Format(sqliteTimeFormat)
+			}
+			if err := conn.RegisterFunc("current_timestamp_us", now, false); err != nil {
+				return err
+			}
+
+			rank := func(query string, fields ...string) float64 {
+				rank, _, _ := textsearch.Match(query, fields...)
+				return rank
+			}
+			headline := func(query string, fields ...string) string {
+				_, highlight, _ := textsearch.Match(query, fields...)
+				return highlight
+			}
+			if err := conn.RegisterFunc("search_rank", rank, true); err != nil {
+				return err
+			}
+			if err := conn.RegisterFunc("search_headline", headline, true); err != nil {
+				return err
+			}
+
+			contains := func(doc, sub string) bool {
+				var docValue, subValue interface{}
+				if json.Unmarshal([]byte(doc), &docValue) != nil || json.Unmarshal([]byte(sub), &subValue) != nil {
+					return false
+				}
+				return MetadataContains(docValue, subValue)
+			}
+			return conn.RegisterFunc("json_contains", contains, true)
+		},
+	})
+}
+
+// sqliteConstraints maps the columns reported by the SQLite unique violations to the names of
+// the Postgres constraints.
+var sqliteConstraints = map[string]string{
+	"users.login":       "unq_login",
+	"users.email_index": "unq_email",
+	"companies.name":    "unq_name",
+	"users_companies.company_id, users_companies.user_id": "unq_set",
+	"jobs.unique_key": "unq_jobs_unique_key",
+	"invitations.company_id, invitations.email_index": "unq_invitations_pending",
+	"invitations.token_hash":                          "unq_invitation_token",
+}
+
+// sqliteViolation returns the Postgres code of the constraint violated by err.
+func sqliteViolation(err sqlite3.Error) (code, constraint string, ok bool) {
+	switch err.ExtendedCode {
+	case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+		columns := strings.TrimPrefix(err.Error(), "UNIQUE constraint failed: ")
+		return ErrUniqViolation, sqliteConstraints[columns], true
+	case sqlite3.ErrConstraintForeignKey:
+		return ErrFKViolation, "", true // SQLite doesn't tell which foreign key
+	}
+	return "", "", false
+}
@@ -0,0 +1,352 @@
+package store
+
+// sqliteUUID generates a random (version 4) UUID, like gen_random_uuid.
+const sqliteUUID = `(lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' ||
+	substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + (abs(random()) % 4), 1) ||
+	substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6))))`
+
+// sqliteQueries are the SQLite versions of the queries relying on Postgres features. The
+// SQLite schema is created at once, it must be kept in sync with the Postgres migrations.
+var sqliteQueries = map[string]string{
+	createTableUsers: `
+CREATE TABLE IF NOT EXISTS users (
+	id TEXT PRIMARY KEY DEFAULT ` + sqliteUUID + `,
+	login VARCHAR(64) NOT NULL,
+	password VARCHAR(255) NOT NULL,
+	email VARCHAR(64),
+	pii BLOB,
+	data_key BLOB,
+	master_key_id TEXT,
+	email_index BLOB,
+	role TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT (` + sqliteNow + `) NOT NULL,
+	updated_at TIMESTAMP DEFAULT (` + sqliteNow + `) NOT NULL,
+	version INTEGER DEFAULT 1 NOT NULL,
+	deleted_at TIMESTAMP,
+	erased_at TIMESTAMP,
+	metadata TEXT DEFAULT '{}' NOT NULL,
+	-- SQLite checks the last unique constraint first, Postgres reports the login first
+	CONSTRAINT unq_email UNIQUE(email_index),
+	CONSTRAINT unq_login UNIQUE(login)
+);
+
+-- SQLite has no time zone, the timestamps are stored in UTC. The trigger can't change the row
+-- being updated, it updates it again.
+CREATE TRIGGER IF NOT EXISTS trg_users_updated_at AFTER UPDATE ON users FOR EACH ROW
+	WHEN NEW.updated_at IS OLD.updated_at
+		AND (OLD.login, OLD.password, OLD.email, OLD.pii, OLD.role, OLD.version, OLD.deleted_at, OLD.erased_at, OLD.metadata)
+		IS NOT (NEW.login, NEW.password, NEW.email, NEW.pii, NEW.role, NEW.version, NEW.deleted_at, NEW.erased_at, NEW.metadata)
+BEGIN
+	UPDATE users SET updated_at = ` + sqliteNow + ` WHERE id = NEW.id;
+END;
+
+CREATE INDEX IF NOT EXISTS idx_users_updated_at ON users (updated_at)`,
+
+	createTableCompanies: `
+CREATE TABLE IF NOT EXISTS companies (
+	id TEXT PRIMARY KEY DEFAULT ` + sqliteUUID + `,
+	name VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP DEFAULT (` + sqliteNow + `) NOT NULL,
+	updated_at TIMESTAMP DEFAULT (` + sqliteNow + `) NOT NULL,
+	version INTEGER DEFAULT 1 NOT NULL,
+	deleted_at TIMESTAMP,
+	parent_id TEXT REFERENCES companies(id) ON DELETE SET NULL,
+	metadata TEXT DEFAULT '{}' NOT NULL,
+	CONSTRAINT unq_name UNIQUE(name)
+);
+
+CREATE INDEX IF NOT EXISTS idx_companies_parent_id ON companies (parent_id);
+
+CREATE TRIGGER IF NOT EXISTS trg_companies_updated_at AFTER UPDATE ON companies FOR EACH ROW
+	WHEN NEW.updated_at IS OLD.updated_at
+		AND (OLD.name, OLD.version, OLD.deleted_at, OLD.parent_id, OLD.metadata)
+		IS NOT (NEW.name, NEW.version, NEW.deleted_at, NEW.parent_id, NEW.metadata)
+BEGIN
+	UPDATE companies SET updated_at = ` + sqliteNow + ` WHERE id = NEW.id;
+END;
+
+CREATE INDEX IF NOT EXISTS idx_companies_updated_at ON companies (updated_at);
+
+CREATE TABLE IF NOT EXISTS users_companies (
+	id TEXT PRIMARY KEY DEFAULT ` + sqliteUUID + `,
+	company_id TEXT REFERENCES companies(id) ON DELETE CASCADE,
+	user_id TEXT REFERENCES users(id) ON DELETE CASCADE,
+	role TEXT DEFAULT 'member' NOT NULL CONSTRAINT chk_role CHECK (role IN ('owner', 'admin', 'member')),
+	created_at TIMESTAMP DEFAULT (` + sqliteNow + `) NOT NULL,
+	CONSTRAINT unq_set UNIQUE(company_id,user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_users_companies_user_id ON users_companies (user_id)`,
+
+	createTableAuditEvents: `
+CREATE TABLE IF NOT EXISTS audit_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	created_at TIMESTAMP DEFAULT (` + sqliteNow + `) NOT NULL,
+	actor TEXT NOT NULL,
+	action TEXT NOT NULL,
+	entity_type TEXT NOT NULL,
+	entity_id TEXT NOT NULL,
+	before TEXT,
+	after TEXT,
+	request_id TEXT NOT NULL,
+	client_ip TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_entity ON audit_events (entity_type, entity_id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor ON audit_events (actor);
+CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON audit_events (created_at)`,
+
+	createTableOutbox: `
+CREATE TABLE IF NOT EXISTS outbox (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	created_at TIMESTAMP DEFAULT (` + sqliteNow + `) NOT NULL,
+	event_type TEXT NOT NULL,
+	entity_type TEXT NOT NULL,
+	entity_id TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	request_id TEXT NOT NULL,
+	attempts INTEGER DEFAULT 0 NOT NULL,
+	available_at TIMESTAMP DEFAULT (` + sqliteNow + `) NOT NULL,
+	last_error TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbox_available_at ON outbox (available_at)`,
+
+	createTableWebhooks: `
+CREATE TABLE IF NOT EXISTS webhooks (
+	id TEXT PRIMARY KEY DEFAULT ` + sqliteUUID + `,
+	url TEXT NOT NULL,
+	events TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT (` + sqliteNow + `) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	webhook_id TEXT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+	event_id INTEGER NOT NULL,
+	event_type TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	status TEXT DEFAULT 'pending' NOT NULL CONSTRAINT chk_status CHECK (status IN ('pending', 'delivered', 'dead')),
+	attempts INTEGER DEFAULT 0 NOT NULL,
+	next_attempt_at TIMESTAMP DEFAULT (` + sqliteNow + `) NOT NULL,
+	last_error TEXT DEFAULT '' NOT NULL,
+	response_status INTEGER DEFAULT 0 NOT NULL,
+	created_at TIMESTAMP DEFAULT (` + sqliteNow + `) NOT NULL,
+	delivered_at TIMESTAMP,
+	CONSTRAINT unq_webhook_event UNIQUE(webhook_id, event_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_pending ON webhook_deliveries (next_attempt_at) WHERE status = 'pending'`,
+
+	createTableJobs: `
+CREATE TABLE IF NOT EXISTS jobs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	kind TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	unique_key TEXT,
+	status TEXT DEFAULT 'pending' NOT NULL CONSTRAINT chk_status CHECK (status IN ('pending', 'running', 'dead')),
+	attempts INTEGER DEFAULT 0 NOT NULL,
+	max_attempts INTEGER NOT NULL,
+	run_at TIMESTAMP DEFAULT (` + sqliteNow + `) NOT NULL,
+	last_error TEXT DEFAULT '' NOT NULL,
+	created_at TIMESTAMP DEFAULT (` + sqliteNow + `) NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS unq_jobs_unique_key ON jobs (unique_key) WHERE status IN ('pending', 'running');
+
+CREATE INDEX IF NOT EXISTS idx_jobs_run_at ON jobs (run_at) WHERE status IN ('pending', 'running')`,
+
+	createTableIdempotencyKeys: `
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	actor TEXT NOT NULL,
+	idempotency_key TEXT NOT NULL,
+	fingerprint TEXT NOT NULL,
+	status_code INTEGER DEFAULT 0 NOT NULL,
+	header TEXT DEFAULT '{}' NOT NULL,
+	body BLOB DEFAULT x'' NOT NULL,
+	data_key BLOB,
+	master_key_id TEXT,
+	created_at TIMESTAMP DEFAULT (` + sqliteNow + `) NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (actor, idempotency_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys (expires_at)`,
+
+	createTableInvitations: `
+CREATE TABLE IF NOT EXISTS invitations (
+	id TEXT PRIMARY KEY DEFAULT ` + sqliteUUID + `,
+	company_id TEXT NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+	pii BLOB NOT NULL,
+	data_key BLOB NOT NULL,
+	master_key_id TEXT NOT NULL,
+	email_index BLOB NOT NULL,
+	role TEXT NOT NULL CONSTRAINT chk_invitation_role CHECK (role IN ('owner', 'admin', 'member')),
+	token_hash BLOB NOT NULL,
+	status TEXT DEFAULT 'pending' NOT NULL CONSTRAINT chk_invitation_status CHECK (status IN ('pending', 'accepted', 'revoked')),
+	invited_by TEXT NOT NULL,
+	sends INTEGER DEFAULT 1 NOT NULL,
+	user_id TEXT REFERENCES users(id) ON DELETE SET NULL,
+	expires_at TIMESTAMP NOT NULL,
+	created_at TIMESTAMP DEFAULT (` + sqliteNow + `) NOT NULL,
+	updated_at TIMESTAMP DEFAULT (` + sqliteNow + `) NOT NULL,
+	CONSTRAINT unq_invitation_token UNIQUE (token_hash)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS unq_invitations_pending ON invitations (company_id, email_index) WHERE status = 'pending';
+
+CREATE INDEX IF NOT EXISTS idx_invitations_company_id ON invitations (company_id, created_at)`,
+
+	createTableCompanyLimits: `
+CREATE TABLE IF NOT EXISTS company_limits (
+	company_id TEXT PRIMARY KEY REFERENCES companies(id) ON DELETE CASCADE,
+	max_members INTEGER,
+	max_api_keys INTEGER,
+	requests_per_day INTEGER,
+	updated_at TIMESTAMP DEFAULT (` + sqliteNow + `) NOT NULL,
+	CONSTRAINT chk_company_limits CHECK (max_members >= 0 AND max_api_keys >= 0 AND requests_per_day >= 0)
+);
+
+CREATE TABLE IF NOT EXISTS company_requests (
+	company_id TEXT NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+	day TEXT NOT NULL,
+	requests INTEGER NOT NULL,
+	PRIMARY KEY (company_id, day)
+)`,
+
+	createTableAPIKeys: `
+CREATE TABLE IF NOT EXISTS api_keys (
+	id TEXT PRIMARY KEY DEFAULT ` + sqliteUUID + `,
+	company_id TEXT NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	key_hash BLOB NOT NULL,
+	prefix TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT (` + sqliteNow + `) NOT NULL,
+	CONSTRAINT unq_api_key UNIQUE (key_hash)
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_company_id ON api_keys (company_id)`,
+
+	createTableMetadataSchemas: `
+CREATE TABLE IF NOT EXISTS metadata_schemas (
+	entity_type TEXT PRIMARY KEY,
+	schema TEXT NOT NULL,
+	updated_at TIMESTAMP DEFAULT (` + sqliteNow + `) NOT NULL
+)`,
+
+	// The foreign keys cascade the deletions to users_companies.
+	deleteAllUsers:           `DELETE FROM users`,
+	deleteAllCompanies:       `DELETE FROM companies`,
+	deleteAllAuditEvents:     `DELETE FROM audit_events`,
+	deleteAllOutboxEvents:    `DELETE FROM outbox`,
+	deleteAllWebhooks:        `DELETE FROM webhooks`,
+	deleteAllJobs:            `DELETE FROM jobs`,
+	deleteAllIdempotencyKeys: `DELETE FROM idempotency_keys`,
+	deleteAllInvitations:     `DELETE FROM invitations`,
+	deleteAllAPIKeys:         `DELETE FROM api_keys`,
+	deleteAllMetadataSchemas: `DELETE FROM metadata_schemas`,
+
+	// strftime only has the millisecond precision.
+	purgeUsers: `
+DELETE FROM users WHERE deleted_at < current_timestamp_us(-$1)
+RETURNING ` + userColumns,
+
+	selectPurgedCompanyChildrenForUpdate: `
+SELECT ` + companyColumns + ` FROM companies
+WHERE parent_id IN (SELECT id FROM companies WHERE deleted_at < current_timestamp_us(-$1))
+AND (deleted_at IS NULL OR deleted_at >= current_timestamp_us(-$1))
+ORDER BY name, id
+`,
+
+	purgeCompanies: `
+DELETE FROM companies WHERE deleted_at < current_timestamp_us(-$1)
+RETURNING ` + companyColumns,
+
+	// SQLite has a single writer, there is no row lock to skip.
+	claimOutboxEvents: `
+UPDATE outbox SET attempts = attempts + 1, available_at = strftime('%Y-%m-%d %H:%M:%f', 'now', '+' || $2 || ' seconds')
+WHERE id IN (SELECT id FROM outbox WHERE available_at <= CURRENT_TIMESTAMP ORDER BY id LIMIT $1)
+RETURNING ` + outboxColumns,
+
+	nackOutboxEvent: `
+UPDATE outbox SET available_at = strftime('%Y-%m-%d %H:%M:%f', 'now', '+' || $2 || ' seconds'), last_error = $3 WHERE id = $1
+`,
+
+	claimWebhookDeliveries: `
+UPDATE webhook_deliveries SET attempts = attempts + 1, next_attempt_at = strftime('%Y-%m-%d %H:%M:%f', 'now', '+' || $2 || ' seconds')
+WHERE id IN (
+	SELECT id FROM webhook_deliveries WHERE status = 'pending' AND next_attempt_at <= CURRENT_TIMESTAMP
+	ORDER BY id LIMIT $1
+)
+RETURNING ` + deliveryColumns,
+
+	markDeliveryFailed: `
+UPDATE webhook_deliveries SET status = $2, next_attempt_at = strftime('%Y-%m-%d %H:%M:%f', 'now', '+' || $3 || ' seconds'), last_error = $4, response_status = $5
+WHERE id = $1
+`,
+
+	insertJob: `
+INSERT INTO jobs (kind, payload, unique_key, max_attempts, run_at)
+VALUES ($1, $2, NULLIF($3, ''), $4, strftime('%Y-%m-%d %H:%M:%f', 'now', '+' || $5 || ' seconds'))
+ON CONFLICT (unique_key) WHERE status IN ('pending', 'running') DO NOTHING
+RETURNING ` + jobColumns,
+
+	claimJobs: `
+UPDATE jobs SET status = 'running', attempts = attempts + 1, run_at = strftime('%Y-%m-%d %H:%M:%f', 'now', '+' || $2 || ' seconds')
+WHERE id IN (
+	SELECT id FROM jobs WHERE status IN ('pending', 'running') AND run_at <= CURRENT_TIMESTAMP
+	ORDER BY run_at, id LIMIT $1
+)
+RETURNING ` + jobColumns,
+
+	failJob: `
+UPDATE jobs SET status = $2, run_at = strftime('%Y-%m-%d %H:%M:%f', 'now', '+' || $3 || ' seconds'), last_error = $4
+WHERE id = $1
+`,
+
+	deleteExpiredIdempotencyKey: `
+DELETE FROM idempotency_keys WHERE actor = $1 AND idempotency_key = $2 AND (
+	expires_at <= CURRENT_TIMESTAMP OR
+	(status_code = 0 AND created_at <= current_timestamp_us(-$3))
+)
+`,
+
+	insertIdempotencyKey: `
+INSERT INTO idempotency_keys (actor, idempotency_key, fingerprint, expires_at)
+VALUES ($1, $2, $3, current_timestamp_us($4))
+ON CONFLICT (actor, idempotency_key) DO NOTHING
+RETURNING ` + idempotencyColumns,
+
+	insertInvitation: `
+INSERT INTO invitations (company_id, pii, data_key, master_key_id, email_index, role, token_hash, invited_by, expires_at)
+SELECT id, $2, $3, $4, $5, $6, $7, $8, current_timestamp_us($9)
+FROM companies WHERE id = $1 AND deleted_at IS NULL
+RETURNING ` + invitationColumns,
+
+	resendInvitation: `
+UPDATE invitations SET
+	token_hash = $2,
+	expires_at = current_timestamp_us($3),
+	sends = sends + 1,
+	updated_at = CURRENT_TIMESTAMP
+WHERE id = $1
+RETURNING ` + invitationColumns,
+
+	// search_rank and search_headline are registered along with the driver.
+	searchUsers: `
+SELECT id, login, COALESCE(NULLIF(search_headline($1, login), ''), login), search_rank($1, login) + (email_index IS $3) AS rank
+FROM users
+WHERE deleted_at IS NULL AND rank > 0
+ORDER BY rank DESC
+LIMIT $2
+`,
+
+	searchCompanies: `
+SELECT id, name, search_headline($1, name), search_rank($1, name) AS rank
+FROM companies
+WHERE deleted_at IS NULL AND rank > 0
+ORDER BY rank DESC
+LIMIT $2
+`,
+}
@@ -3,10 +3,15 @@ package store
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/jordanp/goapp/entity"
 	"github.com/jordanp/goapp/pkg/log"
 	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
 )
 
@@ -21,56 +26,324 @@ var (
 	ErrNoRows           = sql.ErrNoRows
 )
 
+// Filter restricts the records returned by the listing methods of the stores.
+type Filter struct {
+	IncludeDeleted bool
+	// UpdatedSince keeps the records updated at or after it, unless it's zero. The deletions
+	// update the records, clients syncing the changes should include the deleted records.
+	// updated_at is the start of the transaction of the update, which may commit after a listing
+	// made later: clients syncing the changes must query again from a little before the latest
+	// updated_at they got, e.g. a minute, and ignore the records they already have.
+	UpdatedSince time.Time
+	// Metadata keeps the records whose metadata contains it, see MetadataContains.
+	Metadata entity.Metadata
+}
+
+// where returns the WHERE clause of the filter, see buildWhere.
+func (f Filter) where() (querySuffix string, parsedArgs []interface{}) {
+	where := map[string]interface{}{"deleted_at": nil}
+	if f.IncludeDeleted {
+		delete(where, "deleted_at")
+	}
+	querySuffix, parsedArgs = buildWhere(where)
+	if !f.UpdatedSince.IsZero() {
+		parsedArgs = append(parsedArgs, f.UpdatedSince)
+		if querySuffix == "" {
+			querySuffix = " WHERE"
+		} else {
+			querySuffix += " AND"
+		}
+		querySuffix += fmt.Sprintf(" updated_at >= $%d", len(parsedArgs))
+	}
+	return f.metadataWhere(querySuffix, parsedArgs)
+}
+
+// UserStore is implemented by User, and by the in-memory store of the memory package. Every
+// implementation must return the same typed errors.
+//
+// The methods run their queries with the querier, which is either the DB or a transaction of
+// it. The mutations are atomic on their own, and part of the transaction if there is one. The
+// read-only methods given the DB may read from one of its replicas.
+type UserStore interface {
+	// GetByLogin is the only method returning the password hash.
+	GetByLogin(ctx context.Context, querier Querier, login string) (entity.User, error)
+	GetByID(ctx context.Context, querier Querier, ID string, includeDeleted bool) (entity.User, error)
+	GetAll(ctx context.Context, querier Querier, filter Filter) ([]entity.User, error)
+	ForEach(ctx context.Context, querier Querier, filter Filter, fn func(entity.User) error) error
+	Add(ctx context.Context, querier Querier, login, password, email, role string, metadata entity.Metadata) (entity.User, error)
+	Update(ctx context.Context, querier Querier, ID string, patch entity.UserPatch, version int) (entity.User, error)
+	DeleteByID(ctx context.Context, querier Querier, ID string) error
+	Restore(ctx context.Context, querier Querier, ID string) (entity.User, error)
+	// Erase anonymizes the user and its audit trail, it can't be restored afterwards.
+	Erase(ctx context.Context, querier Querier, ID string) (entity.User, error)
+	Purge(ctx context.Context, querier Querier, retention time.Duration) (int64, error)
+	Search(ctx context.Context, querier Querier, q entity.SearchQuery) ([]entity.SearchResult, error)
+	// Reencrypt encrypts up to limit users with the current master key, it returns how many
+	// users it encrypted.
+	Reencrypt(ctx context.Context, querier Querier, limit int) (int, error)
+	DeleteAll() error
+}
+
+// CompanyStore is implemented by Company, and by the in-memory store of the memory package.
+type CompanyStore interface {
+	GetByID(ctx context.Context, querier Querier, ID string, includeDeleted bool) (entity.Company, error)
+	ForEach(ctx context.Context, querier Querier, filter Filter, fn func(entity.Company) error) error
+	Add(ctx context.Context, querier Querier, name string, members []entity.Membership, metadata entity.Metadata) (entity.Company, error)
+	Update(ctx context.Context, querier Querier, ID string, patch entity.CompanyPatch, version int) (entity.Company, error)
+	DeleteByID(ctx context.Context, querier Querier, ID string) error
+	Restore(ctx context.Context, querier Querier, ID string) (entity.Company, error)
+	Purge(ctx context.Context, querier Querier, retention time.Duration) (int64, error)
+	Search(ctx context.Context, querier Querier, q entity.SearchQuery) ([]entity.SearchResult, error)
+	DeleteAll() error
+
+	Move(ctx context.Context, querier Querier, ID, parentID string, version int) (entity.Company, error)
+	Ancestors(ctx context.Context, querier Querier, ID string, includeDeleted bool) ([]entity.Company, error)
+	Descendants(ctx context.Context, querier Querier, ID string, includeDeleted bool) ([]entity.Company, error)
+	EffectiveMembers(ctx context.Context, querier Querier, ID string, includeDeleted bool) ([]entity.EffectiveMember, error)
+
+	// CountRequest returns a QuotaExceededError once the company made its requests of the
+	// day, as AddMember does once the company has its maximum of members.
+	GetQuota(ctx context.Context, querier Querier, ID string) (entity.CompanyQuota, error)
+	SetLimits(ctx context.Context, querier Querier, ID string, limits entity.CompanyLimits) (entity.CompanyLimits, error)
+	CountRequest(ctx context.Context, querier Querier, ID string) error
+	PurgeRequests(ctx context.Context, querier Querier, before time.Time) (int64, error)
+
+	AddMember(ctx context.Context, querier Querier, companyID, userID, role string) (entity.Membership, error)
+	UpdateMember(ctx context.Context, querier Querier, companyID, userID, role string) (entity.Membership, error)
+	RemoveMember(ctx context.Context, querier Querier, companyID, userID string) error
+	GetMemberships(ctx context.Context, querier Querier, userID string) ([]entity.Membership, error)
+	ForEachMembership(ctx context.Context, querier Querier, fn func(entity.ImportMembership) error) error
+}
+
+type AuditStore interface {
+	List(ctx context.Context, querier Querier, filter entity.AuditFilter) ([]entity.AuditEvent, error)
+	DeleteAll() error
+}
+
+// OutboxStore is implemented by Outbox, and by the in-memory store of the memory package. The
+// events are written by the mutations of the other stores.
+type OutboxStore interface {
+	Claim(ctx context.Context, querier Querier, limit int, lease time.Duration) ([]entity.DomainEvent, error)
+	Ack(ctx context.Context, querier Querier, ID int64) error
+	Nack(ctx context.Context, querier Querier, ID int64, delay time.Duration, reason string) error
+	DeleteAll() error
+}
+
+// WebhookStore is implemented by Webhook, and by the in-memory store of the memory package.
+type WebhookStore interface {
+	Add(ctx context.Context, querier Querier, URL string, events []string, secret string) (entity.Webhook, error)
+	GetByID(ctx context.Context, querier Querier, ID string) (entity.Webhook, error)
+	GetAll(ctx context.Context, querier Querier) ([]entity.Webhook, error)
+	DeleteByID(ctx context.Context, querier Querier, ID string) error
+	DeleteAll() error
+
+	Enqueue(ctx context.Context, querier Querier, event entity.DomainEvent) (int, error)
+	Claim(ctx context.Context, querier Querier, limit int, lease time.Duration) ([]entity.WebhookDelivery, error)
+	MarkDelivered(ctx context.Context, querier Querier, ID int64, responseStatus int) error
+	MarkFailed(ctx context.Context, querier Querier, ID int64, responseStatus int, reason string, delay time.Duration, dead bool) error
+	ListDeliveries(ctx context.Context, querier Querier, webhookID string, filter entity.DeliveryFilter) ([]entity.WebhookDelivery, error)
+	Replay(ctx context.Context, querier Querier, webhookID string, deliveryID int64) (entity.WebhookDelivery, error)
+}
+
+// JobStore is implemented by Job, and by the in-memory store of the memory package.
+type JobStore interface {
+	Enqueue(ctx context.Context, querier Querier, kind string, payload []byte, opts entity.JobOptions) (entity.Job, error)
+	Claim(ctx context.Context, querier Querier, limit int, lease time.Duration) ([]entity.Job, error)
+	Complete(ctx context.Context, querier Querier, ID int64) error
+	Fail(ctx context.Context, querier Querier, ID int64, reason string, delay time.Duration, dead bool) error
+	Release(ctx context.Context, querier Querier, ID int64) error
+	List(ctx context.Context, querier Querier, filter entity.JobFilter) ([]entity.Job, error)
+	Retry(ctx context.Context, querier Querier, ID int64) (entity.Job, error)
+	DeleteAll() error
+}
+
+type IdempotencyStore interface {
+	Begin(ctx context.Context, querier Querier, actor, key, fingerprint string, ttl, lease time.Duration) (entity.IdempotentRequest, bool, error)
+	Complete(ctx context.Context, querier Querier, actor, key string, statusCode int, header map[string][]string, body []byte) error
+	Release(ctx context.Context, querier Querier, actor, key string) error
+	Purge(ctx context.Context, querier Querier) (int64, error)
+	DeleteAll() error
+}
+
+// InvitationStore is implemented by Invitation, and by the in-memory store of the memory
+// package. The invitations are looked up by the hash of their token.
+type InvitationStore interface {
+	Add(ctx context.Context, querier Querier, invitation entity.Invitation, ttl time.Duration) (entity.Invitation, error)
+	GetByID(ctx context.Context, querier Querier, ID string) (entity.Invitation, error)
+	List(ctx context.Context, querier Querier, filter entity.InvitationFilter) ([]entity.Invitation, error)
+	Resend(ctx context.Context, querier Querier, ID string, ttl time.Duration) (entity.Invitation, error)
+	Issue(ctx context.Context, querier Querier, ID string, sends int, token string) (entity.Invitation, error)
+	Revoke(ctx context.Context, querier Querier, ID string) (entity.Invitation, error)
+	GetByToken(ctx context.Context, querier Querier, token string) (entity.Invitation, error)
+	Claim(ctx context.Context, querier Querier, token string) (entity.Invitation, error)
+	Accept(ctx context.Context, querier Querier, ID, userID string) (entity.Invitation, error)
+	DeleteAll() error
+}
+
+// APIKeyStore is implemented by APIKey, and by the in-memory store of the memory package. The
+// keys are looked up by their hash.
+type APIKeyStore interface {
+	Add(ctx context.Context, querier Querier, companyID, name, key string) (entity.APIKey, error)
+	List(ctx context.Context, querier Querier, companyID string) ([]entity.APIKey, error)
+	Authenticate(ctx context.Context, querier Querier, key string) (entity.APIKey, error)
+	DeleteByID(ctx context.Context, querier Querier, companyID, ID string) error
+	DeleteAll() error
+}
+
+// MetadataSchemaStore is implemented by MetadataSchema, and by the in-memory store of the memory
+// package. The schemas are checked by the application, the stores keep them as is.
+type MetadataSchemaStore interface {
+	Get(ctx context.Context, querier Querier, entityType string) (entity.MetadataSchema, error)
+	Set(ctx context.Context, querier Querier, entityType string, schema json.RawMessage) (entity.MetadataSchema, error)
+	Delete(ctx context.Context, querier Querier, entityType string) error
+	DeleteAll() error
+}
+
+type ImportStore interface {
+	Import(ctx context.Context, querier Querier, opts entity.ImportOptions, rows []entity.ImportRow) (entity.ImportReport, error)
+}
+
+// Querier runs the queries of the store methods. It's either the DB, or a transaction begun by
+// WithTx so that the methods take part in it.
 type Querier interface {
 	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
 	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
-	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *Row
 }
 
+// Transactor is implemented by DB, and by the DB of the memory package.
+type Transactor interface {
+	Querier
+	// WithTx runs fn in a transaction, given to the store methods as their querier. The
+	// transaction is committed iff fn returns nil.
+	WithTx(ctx context.Context, fn func(tx Querier) error) error
+}
+
+// buildWhere builds an equality WHERE clause from the filter. A nil value matches NULL columns.
 func buildWhere(args map[string]interface{}) (querySuffix string, parsedArgs []interface{}) {
 	if len(args) == 0 {
 		return
 	}
 
-	querySuffix += " WHERE "
+	conditions := make([]string, 0, len(args))
 	parsedArgs = make([]interface{}, 0, len(args))
-	columnNo := 1
 	for columnName, columnValue := range args {
-		querySuffix += fmt.Sprintf("%s = $%d", columnName, columnNo)
-		parsedArgs = append(parsedArgs, columnValue)
-		if columnNo < len(args) {
-			querySuffix += " AND "
+		if columnValue == nil {
+			conditions = append(conditions, columnName+" IS NULL")
+			continue
 		}
-		columnNo++
+		parsedArgs = append(parsedArgs, columnValue)
+		conditions = append(conditions, fmt.Sprintf("%s = $%d", columnName, len(parsedArgs)))
 	}
+	querySuffix = " WHERE " + strings.Join(conditions, " AND ")
 
 	return
 }
 
-func deleteOne(ctx context.Context, db *sql.DB, query string, args []interface{}) error {
-	result, err := db.ExecContext(ctx, query, args...)
-	if err != nil {
-		if err2, ok := err.(*pq.Error); ok && err2.Code == ErrInvalidTextRepresentation {
-			return ErrNoRows
-		}
-		log.G(ctx).F(args).WithError(err).Error("failed to delete record")
+// WithTx runs fn in a transaction, which is rolled back if fn returns an error or panics, and
+// committed otherwise. If querier is already a transaction, fn runs in it instead, so that the
+// store methods calling WithTx can be composed in a single unit of work. The transaction is
+// retried as a whole when it fails with a transient error, following the retry policy of the
+// DB: fn may run several times, so it must have no side effect outside of tx. A failed commit
+// is retried only if it certainly wasn't applied, see isRejectedCommit.
+func WithTx(ctx context.Context, querier Querier, fn func(tx *Tx) error) error {
+	var db *DB
+	switch querier := querier.(type) {
+	case *Tx:
+		return fn(querier)
+	case *DB:
+		db = querier
+	default:
+		log.G(ctx).Errorf("can't begin a transaction from a %T", querier)
 		return ErrGenericDBFailure
 	}
 
-	if n, err := result.RowsAffected(); err != nil {
-		log.G(ctx).F(args).WithError(err).Error("failed to delete record")
-		return ErrGenericDBFailure
-	} else if n == 0 {
-		return ErrNoRows
-	} else {
-		log.G(ctx).F(args).Warnf("deleted %d records", n)
+	err := db.retry(ctx, "transaction", func() (bool, error) {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			log.G(ctx).WithError(err).Error("failed to begin transaction")
+			return isTransient(err), ErrGenericDBFailure
+		}
+		defer func() {
+			if p := recover(); p != nil {
+				tx.Rollback()
+				panic(p)
+			}
+		}()
+
+		if err := fn(tx); err != nil {
+			tx.Rollback()
+			return tx.transient, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.G(ctx).WithError(err).Error("failed to commit transaction")
+			return isRejectedCommit(err), ErrGenericDBFailure
+		}
+		db.changes.Publish(tx.changes...)
+		return false, nil
+	})
+	if err == nil {
+		markWritten(ctx)
 	}
+	return err
+}
 
-	return nil
+// purge hard deletes the records soft deleted for longer than the retention. The query must
+// return the deleted records, scan reads them back so that their deletion can be audited.
+func purge(ctx context.Context, querier Querier, query, entityType string, retention time.Duration, scan func(*sql.Rows) (ID string, record interface{}, err error)) (int64, error) {
+	var n int64
+	err := WithTx(ctx, querier, func(tx *Tx) error {
+		rows, err := tx.QueryContext(ctx, query, retention.Seconds())
+		if err != nil {
+			log.G(ctx).WithError(err).Error("failed to purge records")
+			return ErrGenericDBFailure
+		}
+		defer rows.Close()
+
+		var IDs []string
+		var records []interface{}
+		for rows.Next() {
+			ID, record, err := scan(rows)
+			if err != nil {
+				log.G(ctx).WithError(err).Error("failed to scan purged record")
+				return ErrGenericDBFailure
+			}
+			IDs = append(IDs, ID)
+			records = append(records, record)
+		}
+		if err = rows.Err(); err != nil {
+			log.G(ctx).WithError(err).Error("failed to loop through purged records")
+			return ErrGenericDBFailure
+		}
+		rows.Close() // The connection is busy until the rows are closed
+
+		for k := range IDs {
+			if err := recordEvent(ctx, tx, entity.AuditActionPurge, entityType, IDs[k], records[k], nil); err != nil {
+				return err
+			}
+		}
+		n = int64(len(IDs))
+		return nil
+	})
+	return n, err
+}
+
+// violation returns the Postgres code of the constraint violated by err, whatever the DB, along
+// with the name of the constraint when the DB reports it. ok is false if err doesn't come
+// from the DB.
+func violation(err error) (code, constraint string, ok bool) {
+	switch err := err.(type) {
+	case *pq.Error:
+		return string(err.Code), err.Constraint, true
+	case sqlite3.Error:
+		return sqliteViolation(err)
+	}
+	return "", "", false
 }
 
-func getOne(ctx context.Context, db *sql.DB, query string, args []interface{}, dest ...interface{}) error {
-	if err := db.QueryRowContext(ctx, query, args...).Scan(dest...); err != nil {
+func getOne(ctx context.Context, querier Querier, query string, args []interface{}, dest ...interface{}) error {
+	if err := querier.QueryRowContext(ctx, query, args...).Scan(dest...); err != nil {
 		if err == sql.ErrNoRows {
 			return ErrNoRows
 		}
@@ -109,3 +382,48 @@ func (e *AlreadyExistsError) Error() string {
 func NewAlreadyExistsError(kind string, ID string) *AlreadyExistsError {
 	return &AlreadyExistsError{Kind: kind, ID: ID}
 }
+
+type VersionConflictError struct {
+	Kind    string
+	ID      string
+	Version int
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("%s '%s' has been modified, current version is %d", e.Kind, e.ID, e.Version)
+}
+
+func NewVersionConflictError(kind string, ID string, version int) *VersionConflictError {
+	return &VersionConflictError{Kind: kind, ID: ID, Version: version}
+}
+
+// CycleError is returned when a company would be moved under itself or one of its
+// descendants.
+type CycleError struct {
+	ID       string
+	ParentID string
+}
+
+func (e *CycleError) Error() string {
+	return fmt.Sprintf("company '%s' can't be moved under '%s', which is the company or one of its descendants", e.ID, e.ParentID)
+}
+
+func NewCycleError(ID, parentID string) *CycleError {
+	return &CycleError{ID: ID, ParentID: parentID}
+}
+
+// QuotaExceededError is returned when a mutation, or a request, would exceed a limit of the
+// company. Quota is one of the entity.Quota* constants.
+type QuotaExceededError struct {
+	CompanyID string
+	Quota     string
+	Limit     int
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("company '%s' exceeded its quota of %d %s", e.CompanyID, e.Limit, strings.Replace(e.Quota, "_", " ", -1))
+}
+
+func NewQuotaExceededError(companyID, quota string, limit int) *QuotaExceededError {
+	return &QuotaExceededError{CompanyID: companyID, Quota: quota, Limit: limit}
+}
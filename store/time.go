@@ -0,0 +1,40 @@
+package store
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// utcTime scans a timestamp as a UTC time. Postgres returns the timestamptz in the time zone of
+// the session, which depends on the server configuration.
+type utcTime struct {
+	t *time.Time
+}
+
+func (u utcTime) Scan(src interface{}) error {
+	t, ok := src.(time.Time)
+	if !ok {
+		return errors.Errorf("unsupported timestamp of type %T", src)
+	}
+	*u.t = t.UTC()
+	return nil
+}
+
+// nullUTCTime scans a nullable timestamp as a UTC time, or nil.
+type nullUTCTime struct {
+	t **time.Time
+}
+
+func (u nullUTCTime) Scan(src interface{}) error {
+	if src == nil {
+		*u.t = nil
+		return nil
+	}
+	var t time.Time
+	if err := (utcTime{&t}).Scan(src); err != nil {
+		return err
+	}
+	*u.t = &t
+	return nil
+}
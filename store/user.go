@@ -3,28 +3,70 @@ package store
 import (
 	"context"
 	"database/sql"
+	"time"
 
 	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/envelope"
 	"github.com/jordanp/goapp/pkg/log"
-	"github.com/lib/pq"
 	"github.com/pkg/errors"
 )
 
+// User stores the personal data of the users encrypted, see userPII.
 type User struct {
-	log log.Logger
-	db  *sql.DB
+	log     log.Logger
+	db      *DB
+	keyring *envelope.Keyring
 }
 
 // https://medium.com/@beld_pro/postgres-with-golang-3b788d86f2ef
 // The store must return human friendly, safe error messages. Failure details must be logged but never
 // returned to the caller.
 
-func NewUserStore(log log.Logger, db *sql.DB) (*User, error) {
+func NewUserStore(log log.Logger, db *DB, keyring *envelope.Keyring) (*User, error) {
 	// Exec executes a query without returning any rows.
 	if _, err := db.Exec(createTableUsers); err != nil {
 		return nil, errors.Wrap(err, "failed to create users table")
 	}
-	return &User{log: log, db: db}, nil
+	if err := indexEmails(db, keyring); err != nil {
+		return nil, err
+	}
+	return &User{log: log, db: db, keyring: keyring}, nil
+}
+
+// indexEmails sets the blind index of the emails of the users stored before the encryption, so
+// that the emails of all the users are unique before they're encrypted by the reencrypt_users
+// job.
+func indexEmails(db *DB, keyring *envelope.Keyring) error {
+	ctx := context.Background()
+	return WithTx(ctx, db, func(tx *Tx) error {
+		rows, err := tx.QueryContext(ctx, selectUsersToIndex)
+		if err != nil {
+			return errors.Wrap(err, "failed to select users to index")
+		}
+		defer rows.Close()
+		emails := map[string]string{}
+		for rows.Next() {
+			var ID, email string
+			if err := rows.Scan(&ID, &email); err != nil {
+				return errors.Wrap(err, "failed to scan user to index")
+			}
+			emails[ID] = email
+		}
+		if err := rows.Err(); err != nil {
+			return errors.Wrap(err, "failed to loop through users to index")
+		}
+		rows.Close() // The connection is busy until the rows are closed
+
+		for ID, email := range emails {
+			if _, err := tx.ExecContext(ctx, indexUserEmail, ID, keyring.BlindIndex(email)); err != nil {
+				if code, _, _ := violation(err); code == ErrUniqViolation {
+					return errors.Errorf("the email of user '%s' is used by another user", ID)
+				}
+				return errors.Wrapf(err, "failed to index the email of user '%s'", ID)
+			}
+		}
+		return nil
+	})
 }
 
 func (s *User) DeleteAll() error {
@@ -34,68 +76,333 @@ func (s *User) DeleteAll() error {
 	return nil
 }
 
-func (s *User) GetByLogin(ctx context.Context, login string) (entity.User, error) {
-	var user entity.User
-	filter := map[string]interface{}{"login": login}
+// GetByLogin is used to authenticate users, it's the only method returning the password hash.
+// It reads from the primary DB so that new passwords can be used right away.
+func (s *User) GetByLogin(ctx context.Context, querier Querier, login string) (entity.User, error) {
+	var sealed sealedUser
+	filter := map[string]interface{}{"login": login, "deleted_at": nil}
 	querySuffix, parsedArgs := buildWhere(filter)
-	err := getOne(ctx, s.db, selectUser+querySuffix, parsedArgs, &user.ID, &user.Login, &user.Password, &user.Email, &user.Role, &user.CreatedAt)
+	err := getOne(ctx, querier, selectUserWithPassword+querySuffix, parsedArgs, append([]interface{}{&sealed.Password}, sealed.dest()...)...)
 	if err == ErrNoRows {
-		return user, NewNotFoundError("user", login)
+		return entity.User{}, NewNotFoundError("user", login)
+	} else if err != nil {
+		return entity.User{}, err
 	}
-	return user, err // err is either nil or ErrGenericDBFailure
+	user, err := sealed.open(s.keyring)
+	if err != nil {
+		log.G(ctx).F("id", sealed.ID).WithError(err).Error("failed to decrypt user")
+		return user, ErrGenericDBFailure
+	}
+	return user, nil
 }
 
-func (s *User) DeleteByID(ctx context.Context, id string) error {
-	filter := map[string]interface{}{"id": id}
+func (s *User) GetByID(ctx context.Context, querier Querier, ID string, includeDeleted bool) (entity.User, error) {
+	querier = reader(ctx, querier)
+	filter := map[string]interface{}{"id": ID, "deleted_at": nil}
+	if includeDeleted {
+		delete(filter, "deleted_at")
+	}
 	querySuffix, parsedArgs := buildWhere(filter)
-	err := deleteOne(ctx, s.db, deleteUser+querySuffix, parsedArgs)
+	user, err := getUser(ctx, querier, s.keyring, selectUser+querySuffix, parsedArgs)
 	if err == ErrNoRows {
-		return NewNotFoundError("user", id)
+		return user, NewNotFoundError("user", ID)
 	}
-	return err // Either nil or ErrGenericDBFailure
+	return user, err // err is either nil or ErrGenericDBFailure
+}
+
+// DeleteByID soft deletes the user. It can be restored until it's purged.
+func (s *User) DeleteByID(ctx context.Context, querier Querier, ID string) error {
+	return WithTx(ctx, querier, func(tx *Tx) error {
+		before, err := getUser(ctx, tx, s.keyring, selectUserForUpdate, []interface{}{ID})
+		if err == ErrNoRows {
+			return NewNotFoundError("user", ID)
+		} else if err != nil {
+			return err
+		}
+		after, err := getUser(ctx, tx, s.keyring, deleteUser, []interface{}{ID})
+		if err != nil {
+			return err
+		}
+		return recordEvent(ctx, tx, entity.AuditActionDelete, "user", ID, before, after)
+	})
+}
+
+func (s *User) Restore(ctx context.Context, querier Querier, ID string) (entity.User, error) {
+	var after entity.User
+	err := WithTx(ctx, querier, func(tx *Tx) error {
+		before, err := getUser(ctx, tx, s.keyring, selectDeletedUserForUpdate, []interface{}{ID})
+		if err == ErrNoRows {
+			return NewNotFoundError("deleted user", ID)
+		} else if err != nil {
+			return err
+		}
+		if after, err = getUser(ctx, tx, s.keyring, restoreUser, []interface{}{ID}); err != nil {
+			return err
+		}
+		return recordEvent(ctx, tx, entity.AuditActionRestore, "user", ID, before, after)
+	})
+	return after, err
+}
+
+// ErasedLogin and ErasedEmail are the placeholders of the personal data of the erased users,
+// they keep the logins and the emails unique.
+func ErasedLogin(ID string) string { return "erased-" + ID }
+func ErasedEmail(ID string) string { return "erased-" + ID + "@erased.invalid" }
+
+// Erase replaces the personal data of the user with placeholders, in its audit trail, its domain
+// events and its invitations as well, and deletes it for good. The idempotent responses which
+// may hold its personal data are deleted. The IDs are kept so that the memberships and the audit events still
+// refer to it. The deleted users can be erased too.
+func (s *User) Erase(ctx context.Context, querier Querier, ID string) (entity.User, error) {
+	var after entity.User
+	err := WithTx(ctx, querier, func(tx *Tx) error {
+		before, err := getUser(ctx, tx, s.keyring, selectUserToEraseForUpdate, []interface{}{ID})
+		if err == ErrNoRows {
+			return NewNotFoundError("user", ID)
+		} else if err != nil {
+			return err
+		}
+		pii, err := sealPII(s.keyring, userPII{Email: ErasedEmail(ID)})
+		if err != nil {
+			log.G(ctx).WithError(err).Error("failed to encrypt user")
+			return ErrGenericDBFailure
+		}
+		after, err = getUser(ctx, tx, s.keyring, eraseUser, []interface{}{ID, ErasedLogin(ID), pii.pii, pii.dataKey, pii.masterKeyID, pii.emailIndex})
+		if err != nil {
+			return err
+		}
+
+		placeholders := map[string]interface{}{"login": after.Login, "email": after.Email, "metadata": map[string]interface{}{}}
+		if err = redactEvents(ctx, tx, "user", ID, placeholders, before.Login, after.Login); err != nil {
+			return err
+		}
+		if err = redactDomainEvents(ctx, tx, "user", ID, placeholders); err != nil {
+			return err
+		}
+		if err = eraseIdempotentResponses(ctx, tx, s.keyring, before.Login, ID); err != nil {
+			return err
+		}
+		if err = eraseInvitations(ctx, tx, s.keyring, ID, before.Email, before.Login, after.Login); err != nil {
+			return err
+		}
+		// The snapshot before the erasure would keep the personal data
+		return recordEvent(ctx, tx, entity.AuditActionErase, "user", ID, nil, after)
+	})
+	return after, err
 }
 
-func (s *User) GetAll(ctx context.Context) ([]entity.User, error) {
-	rows, err := s.db.QueryContext(ctx, selectAllUsers)
+// Purge hard deletes the users that have been soft deleted for longer than the retention.
+func (s *User) Purge(ctx context.Context, querier Querier, retention time.Duration) (int64, error) {
+	return purge(ctx, querier, purgeUsers, "user", retention, func(rows *sql.Rows) (string, interface{}, error) {
+		var sealed sealedUser
+		if err := rows.Scan(sealed.dest()...); err != nil {
+			return "", nil, err
+		}
+		user, err := sealed.open(s.keyring)
+		return user.ID.String(), user, err
+	})
+}
+
+func (s *User) GetAll(ctx context.Context, querier Querier, filter Filter) ([]entity.User, error) {
+	var users []entity.User
+	err := s.ForEach(ctx, querier, filter, func(user entity.User) error {
+		users = append(users, user)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *User) Add(ctx context.Context, querier Querier, login, password, email, role string, metadata entity.Metadata) (entity.User, error) {
+	var user entity.User
+	err := WithTx(ctx, querier, func(tx *Tx) error {
+		var err error
+		user, err = addUser(ctx, tx, s.keyring, login, password, email, role, metadata)
+		return err
+	})
+	return user, err
+}
+
+// addUser inserts and audits a user, password must already be hashed.
+func addUser(ctx context.Context, querier Querier, keyring *envelope.Keyring, login, password, email, role string, metadata entity.Metadata) (entity.User, error) {
+	pii, err := sealPII(keyring, userPII{Email: email})
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to encrypt user")
+		return entity.User{}, ErrGenericDBFailure
+	}
+	if metadata == nil {
+		metadata = entity.Metadata{}
+	}
+	metadataJSON, err := metadataArg(metadata)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to marshal user metadata")
+		return entity.User{}, ErrGenericDBFailure
+	}
+	var sealed sealedUser
+	err = querier.QueryRowContext(ctx, insertUser, login, password, pii.pii, pii.dataKey, pii.masterKeyID, pii.emailIndex, role, metadataJSON).Scan(sealed.dest()...)
+	if err != nil {
+		if code, constraint, _ := violation(err); code == ErrUniqViolation {
+			if constraint == "unq_login" {
+				return entity.User{}, NewAlreadyExistsError("login", login)
+			} else if constraint == "unq_email" {
+				return entity.User{}, NewAlreadyExistsError("email", email)
+			}
+		}
+		log.G(ctx).WithError(err).Error("failed to insert user in DB")
+		return entity.User{}, ErrGenericDBFailure
+	}
+	user := sealed.User
+	user.Email = email
+	return user, recordEvent(ctx, querier, entity.AuditActionCreate, "user", user.ID.String(), nil, user)
+}
+
+// ForEach calls fn for every user, in creation order, until fn returns an error.
+func (s *User) ForEach(ctx context.Context, querier Querier, filter Filter, fn func(entity.User) error) error {
+	querier = reader(ctx, querier)
+	querySuffix, parsedArgs := filter.where()
+	rows, err := querier.QueryContext(ctx, selectUser+querySuffix+orderByCreatedAt, parsedArgs...)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("failed to list users in DB")
-		return nil, ErrGenericDBFailure
+		return ErrGenericDBFailure
 	}
 	defer rows.Close()
 
-	var users []entity.User
 	for rows.Next() {
-		var user entity.User
-		err = rows.Scan(&user.ID, &user.Login, &user.Email, &user.Role, &user.CreatedAt)
-		if err != nil {
+		var sealed sealedUser
+		if err = rows.Scan(sealed.dest()...); err != nil {
 			log.G(ctx).WithError(err).Error("failed to scan user in DB")
-			return nil, ErrGenericDBFailure
+			return ErrGenericDBFailure
+		}
+		user, err := sealed.open(s.keyring)
+		if err != nil {
+			log.G(ctx).F("id", sealed.ID).WithError(err).Error("failed to decrypt user")
+			return ErrGenericDBFailure
+		}
+		if err = fn(user); err != nil {
+			return err
 		}
-		users = append(users, user)
 	}
 
 	if err = rows.Err(); err != nil {
 		log.G(ctx).WithError(err).Error("failed to loop through users list")
-		return nil, ErrGenericDBFailure
+		return ErrGenericDBFailure
 	}
+	return nil
+}
 
-	return users, nil
+// Update applies the non nil fields of the patch. If version isn't zero, the update only
+// succeeds if it matches the current version of the user.
+func (s *User) Update(ctx context.Context, querier Querier, ID string, patch entity.UserPatch, version int) (entity.User, error) {
+	var after entity.User
+	err := WithTx(ctx, querier, func(tx *Tx) error {
+		before, err := getUser(ctx, tx, s.keyring, selectUserForUpdate, []interface{}{ID})
+		if err == ErrNoRows {
+			return NewNotFoundError("user", ID)
+		} else if err != nil {
+			return err
+		}
+		if version != 0 && version != before.Version {
+			return NewVersionConflictError("user", ID, before.Version)
+		}
+
+		// The nil interfaces leave the personal data untouched
+		var pii, dataKey, masterKeyID, emailIndex interface{}
+		if patch.Email != nil {
+			sealed, err := sealPII(s.keyring, userPII{Email: *patch.Email})
+			if err != nil {
+				log.G(ctx).WithError(err).Error("failed to encrypt user")
+				return ErrGenericDBFailure
+			}
+			pii, dataKey, masterKeyID, emailIndex = sealed.pii, sealed.dataKey, sealed.masterKeyID, sealed.emailIndex
+		}
+		metadata, err := metadataArg(patch.Metadata)
+		if err != nil {
+			log.G(ctx).WithError(err).Error("failed to marshal user metadata")
+			return ErrGenericDBFailure
+		}
+		var sealed sealedUser
+		err = tx.QueryRowContext(ctx, updateUser, ID, patch.Login, patch.Password, pii, dataKey, masterKeyID, emailIndex, patch.Role, metadata).Scan(sealed.dest()...)
+		if err != nil {
+			if code, constraint, _ := violation(err); code == ErrUniqViolation {
+				if constraint == "unq_login" {
+					return NewAlreadyExistsError("login", *patch.Login)
+				} else if constraint == "unq_email" {
+					return NewAlreadyExistsError("email", *patch.Email)
+				}
+			}
+			log.G(ctx).WithError(err).Error("failed to update user in DB")
+			return ErrGenericDBFailure
+		}
+		if after, err = sealed.open(s.keyring); err != nil {
+			log.G(ctx).F("id", ID).WithError(err).Error("failed to decrypt user")
+			return ErrGenericDBFailure
+		}
+		return recordEvent(ctx, tx, entity.AuditActionUpdate, "user", ID, before, after)
+	})
+	return after, err
 }
 
-func (s *User) Add(ctx context.Context, login, password, email, role string) (entity.User, error) {
-	var user entity.User
-	err := s.db.QueryRowContext(ctx, insertUser, login, password, email, role).Scan(&user.ID, &user.Login, &user.Email, &user.Role, &user.CreatedAt)
-	if err != nil {
-		if err2, ok := err.(*pq.Error); ok && err2.Code == ErrUniqViolation {
-			if err2.Constraint == "unq_login" {
-				return user, NewAlreadyExistsError("login", login)
-			} else if err2.Constraint == "unq_email" {
-				return user, NewAlreadyExistsError("email", email)
+func (s *User) Search(ctx context.Context, querier Querier, q entity.SearchQuery) ([]entity.SearchResult, error) {
+	querier = reader(ctx, querier)
+	return search(ctx, querier, entity.SearchKindUser, searchUsers, q, s.keyring.BlindIndex(q.Query))
+}
+
+// Reencrypt wraps the data keys of up to limit users with the current master key, and encrypts
+// the personal data of the users stored before the encryption. It returns how many users were
+// reencrypted, the master keys can be retired once there are none left.
+func (s *User) Reencrypt(ctx context.Context, querier Querier, limit int) (int, error) {
+	var n int
+	err := WithTx(ctx, querier, func(tx *Tx) error {
+		rows, err := tx.QueryContext(ctx, selectUsersToReencrypt, s.keyring.Current(), limit)
+		if err != nil {
+			log.G(ctx).WithError(err).Error("failed to select users to reencrypt")
+			return ErrGenericDBFailure
+		}
+		defer rows.Close()
+
+		var users []sealedUser
+		for rows.Next() {
+			var user sealedUser
+			if err = rows.Scan(&user.ID, &user.email, &user.dataKey, &user.masterKeyID); err != nil {
+				log.G(ctx).WithError(err).Error("failed to scan user to reencrypt")
+				return ErrGenericDBFailure
 			}
+			users = append(users, user)
 		}
-		log.G(ctx).WithError(err).Error("failed to insert user in DB")
-		return user, ErrGenericDBFailure
+		if err = rows.Err(); err != nil {
+			log.G(ctx).WithError(err).Error("failed to loop through users to reencrypt")
+			return ErrGenericDBFailure
+		}
+		rows.Close() // The connection is busy until the rows are closed
 
-	}
-	return user, nil
+		for _, user := range users {
+			var sealed sealedPII
+			if user.masterKeyID.Valid {
+				dataKey, err := s.keyring.Rewrap(user.masterKeyID.String, user.dataKey)
+				if err != nil {
+					log.G(ctx).F("id", user.ID).WithError(err).Error("failed to rewrap user data key")
+					return ErrGenericDBFailure
+				}
+				sealed.dataKey, sealed.masterKeyID = dataKey.Wrapped, dataKey.MasterKeyID
+			} else if sealed, err = sealPII(s.keyring, userPII{Email: user.email.String}); err != nil {
+				log.G(ctx).F("id", user.ID).WithError(err).Error("failed to encrypt user")
+				return ErrGenericDBFailure
+			}
+
+			// The nil interfaces leave the sealed personal data of the encrypted users untouched
+			var pii, emailIndex interface{}
+			if sealed.pii != nil {
+				pii, emailIndex = sealed.pii, sealed.emailIndex
+			}
+			if _, err := tx.ExecContext(ctx, reencryptUser, user.ID, pii, sealed.dataKey, sealed.masterKeyID, emailIndex); err != nil {
+				log.G(ctx).F("id", user.ID).WithError(err).Error("failed to reencrypt user")
+				return ErrGenericDBFailure
+			}
+		}
+		n = len(users)
+		return nil
+	})
+	return n, err
 }
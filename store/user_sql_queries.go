@@ -11,26 +11,188 @@ CREATE TABLE IF NOT EXISTS users (
 	created_at timestamp WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
     CONSTRAINT unq_login UNIQUE(login),
     CONSTRAINT unq_email UNIQUE(email)
-)`
+);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS updated_at timestamp WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS version INTEGER DEFAULT 1 NOT NULL;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at timestamp WITHOUT TIME ZONE;
+
+-- The personal data is sealed in pii, email is only read until the users stored before the
+-- encryption are encrypted by the reencrypt_users job. email_index is the blind index of the email.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS pii BYTEA;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS data_key BYTEA;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS master_key_id TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_index BYTEA;
+ALTER TABLE users ALTER COLUMN email DROP NOT NULL;
+-- The plaintext emails stay unique until they are all encrypted, the blind indexes of the users
+-- stored before the encryption are backfilled by NewUserStore.
+CREATE UNIQUE INDEX IF NOT EXISTS unq_legacy_email ON users (email);
+ALTER TABLE users DROP CONSTRAINT IF EXISTS unq_email;
+CREATE UNIQUE INDEX IF NOT EXISTS unq_email ON users (email_index);
+
+-- The erased users keep their ID, their personal data is replaced by placeholders.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS erased_at timestamp WITHOUT TIME ZONE;
+
+-- The timestamps were stored in UTC without time zone, they are converted once.
+DO $$
+BEGIN
+	IF (SELECT data_type FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'users' AND column_name = 'created_at') = 'timestamp without time zone' THEN
+		ALTER TABLE users
+			ALTER COLUMN created_at TYPE timestamptz USING created_at AT TIME ZONE 'UTC',
+			ALTER COLUMN updated_at TYPE timestamptz USING updated_at AT TIME ZONE 'UTC',
+			ALTER COLUMN deleted_at TYPE timestamptz USING deleted_at AT TIME ZONE 'UTC',
+			ALTER COLUMN erased_at TYPE timestamptz USING erased_at AT TIME ZONE 'UTC';
+	END IF;
+END
+$$;
+
+-- The attributes of the integrations, validated against the schema of the users. The GIN index
+-- serves the containment filters of the listings.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS metadata JSONB DEFAULT '{}' NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_users_metadata ON users USING GIN (metadata jsonb_path_ops);
+
+-- updated_at changes along with the columns the users can see, whoever updates them. The
+-- rewrapped data keys don't change the users.
+CREATE OR REPLACE FUNCTION set_updated_at() RETURNS trigger AS $$
+BEGIN
+	NEW.updated_at = CURRENT_TIMESTAMP;
+	RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS trg_users_updated_at ON users;
+CREATE TRIGGER trg_users_updated_at BEFORE UPDATE ON users FOR EACH ROW
+	WHEN ((OLD.login, OLD.password, OLD.email, OLD.pii, OLD.role, OLD.version, OLD.deleted_at, OLD.erased_at, OLD.metadata)
+		IS DISTINCT FROM (NEW.login, NEW.password, NEW.email, NEW.pii, NEW.role, NEW.version, NEW.deleted_at, NEW.erased_at, NEW.metadata))
+	EXECUTE PROCEDURE set_updated_at();
+CREATE INDEX IF NOT EXISTS idx_users_updated_at ON users (updated_at);
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+DROP INDEX IF EXISTS idx_users_fts;
+DROP INDEX IF EXISTS idx_users_email_trgm;
+CREATE INDEX IF NOT EXISTS idx_users_login_fts ON users USING GIN (to_tsvector('simple', login));
+CREATE INDEX IF NOT EXISTS idx_users_login_trgm ON users USING GIN (login gin_trgm_ops)`
+
+// userColumns must be kept in sync with sealedUser.dest
+const userColumns = `id, login, email, pii, data_key, master_key_id, role, created_at, updated_at, version, deleted_at, erased_at, metadata`
 
 const insertUser = `
-INSERT INTO users (login, password, email, role)
-VALUES ($1, $2, $3, $4)
-RETURNING id, login, email, role, created_at
-`
+INSERT INTO users (login, password, pii, data_key, master_key_id, email_index, role, metadata)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+RETURNING ` + userColumns
 
+// The mutations set updated_at along with the trigger, since SQLite doesn't return the changes
+// made by its triggers.
 const deleteUser = `
-DELETE FROM users
-`
+UPDATE users SET deleted_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+WHERE id = $1
+RETURNING ` + userColumns
+
+const restoreUser = `
+UPDATE users SET deleted_at = NULL, updated_at = CURRENT_TIMESTAMP
+WHERE id = $1
+RETURNING ` + userColumns
+
+const purgeUsers = `
+DELETE FROM users WHERE deleted_at < CURRENT_TIMESTAMP - make_interval(secs => $1)
+RETURNING ` + userColumns
+
+// The row locks serialize the concurrent mutations of a user, which are audited with
+// the snapshot read by these queries.
+const selectUserForUpdate = `
+SELECT ` + userColumns + ` FROM users WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`
+
+const selectDeletedUserForUpdate = `
+SELECT ` + userColumns + ` FROM users WHERE id = $1 AND deleted_at IS NOT NULL AND erased_at IS NULL FOR UPDATE`
+
+// The deleted users can be erased, until they are purged.
+const selectUserToEraseForUpdate = `
+SELECT ` + userColumns + ` FROM users WHERE id = $1 AND erased_at IS NULL FOR UPDATE`
 
 const selectUser = `
-SELECT id, login, password, email, role, created_at FROM users
-`
+SELECT ` + userColumns + ` FROM users`
 
-const selectAllUsers = `
-SELECT id, login, email, role, created_at FROM users ORDER BY created_at asc;
-`
+const selectUserWithPassword = `
+SELECT password, ` + userColumns + ` FROM users`
+
+const orderByCreatedAt = `
+ORDER BY created_at asc`
+
+// The personal data is sealed again with a new data key when it's updated, $4 to $7 are then
+// all set. The metadata $9 is replaced as a whole.
+const updateUser = `
+UPDATE users SET
+	login = COALESCE($2, login),
+	password = COALESCE($3, password),
+	pii = COALESCE($4, pii),
+	email = CASE WHEN $4 IS NULL THEN email END,
+	data_key = COALESCE($5, data_key),
+	master_key_id = COALESCE($6, master_key_id),
+	email_index = COALESCE($7, email_index),
+	role = COALESCE($8, role),
+	metadata = COALESCE($9, metadata),
+	updated_at = CURRENT_TIMESTAMP,
+	version = version + 1
+WHERE id = $1
+RETURNING ` + userColumns
+
+// eraseUser replaces the login $2 and the personal data $3 to $6 with placeholders, and deletes
+// the user for good: it can't be restored. The metadata may hold personal data, it's cleared.
+const eraseUser = `
+UPDATE users SET
+	login = $2,
+	password = '',
+	email = NULL,
+	pii = $3,
+	data_key = $4,
+	master_key_id = $5,
+	email_index = $6,
+	metadata = '{}',
+	deleted_at = COALESCE(deleted_at, CURRENT_TIMESTAMP),
+	erased_at = CURRENT_TIMESTAMP,
+	updated_at = CURRENT_TIMESTAMP,
+	version = version + 1
+WHERE id = $1
+RETURNING ` + userColumns
 
 const deleteAllUsers = `
 TRUNCATE TABLE users CASCADE
 `
+
+// The trigram clauses catch partial words and typos that the full-text query misses. The
+// emails are encrypted, they only match as a whole, through their blind index $3.
+const searchUsers = `
+SELECT id, login,
+	ts_headline('simple', login, query, 'StartSel=<mark>, StopSel=</mark>, HighlightAll=true'),
+	ts_rank(to_tsvector('simple', login), query) + similarity(login, $1) + CASE WHEN email_index = $3 THEN 1 ELSE 0 END AS rank
+FROM users, plainto_tsquery('simple', $1) query
+WHERE deleted_at IS NULL AND (to_tsvector('simple', login) @@ query OR login % $1 OR email_index = $3)
+ORDER BY rank DESC
+LIMIT $2
+`
+
+// The users whose data key isn't wrapped by the current master key $1, including those stored
+// before the encryption.
+const selectUsersToReencrypt = `
+SELECT id, email, data_key, master_key_id FROM users
+WHERE master_key_id IS NULL OR master_key_id <> $1
+ORDER BY id
+LIMIT $2
+FOR UPDATE`
+
+// The blind indexes of the users stored before the encryption, which are indexed by
+// NewUserStore before they are encrypted by the reencrypt_users job.
+const selectUsersToIndex = `
+SELECT id, email FROM users WHERE email IS NOT NULL AND email_index IS NULL
+FOR UPDATE`
+
+const indexUserEmail = `
+UPDATE users SET email_index = $2 WHERE id = $1
+`
+
+// The personal data and its blind index are only set for the users stored before the encryption,
+// the data keys of the others are rewrapped.
+const reencryptUser = `
+UPDATE users SET email = NULL, pii = COALESCE($2, pii), data_key = $3, master_key_id = $4, email_index = COALESCE($5, email_index)
+WHERE id = $1
+`
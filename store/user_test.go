@@ -0,0 +1,154 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/envelope"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/stretchr/testify/require"
+)
+
+// testKeyring returns a keyring with the master keys k1 to current, as after the rotations.
+func testKeyring(t *testing.T, current string) *envelope.Keyring {
+	keys := make(map[string][]byte)
+	for k := byte('1'); k <= current[1]; k++ {
+		keys["k"+string(k)] = bytes.Repeat([]byte{k}, envelope.KeySize)
+	}
+	keyring, err := envelope.NewKeyring(current, keys, bytes.Repeat([]byte{0}, envelope.KeySize))
+	require.NoError(t, err)
+	return keyring
+}
+
+func TestUserEncryption(t *testing.T) {
+	logger, _ := log.NewTest()
+	db := openSQLite(t)
+	defer db.Close()
+	_, err := NewAuditStore(logger, db)
+	require.NoError(t, err)
+	_, err = NewOutboxStore(logger, db)
+	require.NoError(t, err)
+	users, err := NewUserStore(logger, db, testKeyring(t, "k1"))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// The email is only stored sealed, its blind index keeps it unique
+	bob, err := users.Add(ctx, db, "bob", "password", "bob@goapp", "user", nil)
+	require.NoError(t, err)
+	require.Equal(t, "bob@goapp", bob.Email)
+	var email sql.NullString
+	var pii []byte
+	require.NoError(t, db.QueryRow(`SELECT email, pii FROM users WHERE login = 'bob'`).Scan(&email, &pii))
+	require.False(t, email.Valid)
+	require.NotContains(t, string(pii), "bob@goapp")
+	_, err = users.Add(ctx, db, "other", "password", "bob@goapp", "user", nil)
+	require.EqualError(t, err, "email 'bob@goapp' already exists")
+
+	user, err := users.GetByLogin(ctx, db, "bob")
+	require.NoError(t, err)
+	require.Equal(t, "bob@goapp", user.Email)
+	require.Equal(t, "password", user.Password)
+
+	// The emails only match as a whole
+	results, err := users.Search(ctx, db, entity.SearchQuery{Query: "bob@goapp", Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Equal(t, bob.ID, results[0].ID)
+	require.Equal(t, "bob", results[0].Highlight)
+	results, err = users.Search(ctx, db, entity.SearchQuery{Query: "goapp", Limit: 10})
+	require.NoError(t, err)
+	require.Empty(t, results)
+
+	// The previous email is free once updated
+	email.String = "robert@goapp"
+	user, err = users.Update(ctx, db, bob.ID.String(), entity.UserPatch{Email: &email.String}, 0)
+	require.NoError(t, err)
+	require.Equal(t, "robert@goapp", user.Email)
+	_, err = users.Add(ctx, db, "other", "password", "bob@goapp", "user", nil)
+	require.NoError(t, err)
+
+	// The users stored before the encryption are read as is until they are encrypted
+	_, err = db.Exec(`INSERT INTO users (login, password, email, role) VALUES ('legacy', 'password', 'legacy@goapp', 'user')`)
+	require.NoError(t, err)
+	legacy, err := users.GetByLogin(ctx, db, "legacy")
+	require.NoError(t, err)
+	require.Equal(t, "legacy@goapp", legacy.Email)
+
+	// Their emails are indexed by the store, so that they stay unique until they're encrypted
+	rotated, err := NewUserStore(logger, db, testKeyring(t, "k2"))
+	require.NoError(t, err)
+	_, err = rotated.Add(ctx, db, "other2", "password", "legacy@goapp", "user", nil)
+	require.EqualError(t, err, "email 'legacy@goapp' already exists")
+
+	// The rotated master key encrypts them, and rewraps the data keys of the others
+	n, err := rotated.Reencrypt(ctx, db, 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	n, err = rotated.Reencrypt(ctx, db, 2)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	n, err = rotated.Reencrypt(ctx, db, 2)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	require.NoError(t, db.QueryRow(`SELECT email FROM users WHERE login = 'legacy'`).Scan(&email))
+	require.False(t, email.Valid)
+	all, err := rotated.GetAll(ctx, db, Filter{})
+	require.NoError(t, err)
+	emails := make([]string, len(all))
+	for k := range all {
+		emails[k] = all[k].Email
+	}
+	require.Equal(t, []string{"robert@goapp", "bob@goapp", "legacy@goapp"}, emails)
+	_, err = rotated.Add(ctx, db, "other2", "password", "legacy@goapp", "user", nil)
+	require.EqualError(t, err, "email 'legacy@goapp' already exists")
+
+	// The retired master key can't decrypt them anymore
+	_, err = users.GetByID(ctx, db, legacy.ID.String(), false)
+	require.Equal(t, ErrGenericDBFailure, err)
+}
+
+func TestUpdatedAtTrigger(t *testing.T) {
+	logger, _ := log.NewTest()
+	db := openSQLite(t)
+	defer db.Close()
+	_, err := NewAuditStore(logger, db)
+	require.NoError(t, err)
+	_, err = NewOutboxStore(logger, db)
+	require.NoError(t, err)
+	users, err := NewUserStore(logger, db, testKeyring(t, "k1"))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	bob, err := users.Add(ctx, db, "bob", "password", "bob@goapp", "user", nil)
+	require.NoError(t, err)
+	require.Equal(t, time.UTC, bob.CreatedAt.Location())
+
+	// Rewrapping the data key doesn't change the user
+	users, err = NewUserStore(logger, db, testKeyring(t, "k2"))
+	require.NoError(t, err)
+	n, err := users.Reencrypt(ctx, db, 10)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	user, err := users.GetByID(ctx, db, bob.ID.String(), false)
+	require.NoError(t, err)
+	require.Equal(t, bob.UpdatedAt, user.UpdatedAt)
+
+	// The updates made outside of the store are tracked too
+	_, err = db.Exec(`UPDATE users SET role = 'admin' WHERE id = $1`, bob.ID.String())
+	require.NoError(t, err)
+	user, err = users.GetByID(ctx, db, bob.ID.String(), false)
+	require.NoError(t, err)
+	require.True(t, user.UpdatedAt.After(bob.UpdatedAt))
+
+	all, err := users.GetAll(ctx, db, Filter{UpdatedSince: user.UpdatedAt})
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	all, err = users.GetAll(ctx, db, Filter{UpdatedSince: user.UpdatedAt.Add(time.Microsecond)})
+	require.NoError(t, err)
+	require.Empty(t, all)
+}
@@ -0,0 +1,260 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/pkg/errors"
+)
+
+type Webhook struct {
+	log log.Logger
+	db  *DB
+}
+
+// NewWebhookStore must be called after NewAuditStore, the webhooks are audited.
+func NewWebhookStore(log log.Logger, db *DB) (*Webhook, error) {
+	if _, err := db.Exec(createTableWebhooks); err != nil {
+		return nil, errors.Wrap(err, "failed to create webhooks table")
+	}
+	return &Webhook{log: log, db: db}, nil
+}
+
+// webhookRow scans the space separated events of a webhook.
+type webhookRow struct {
+	entity.Webhook
+	events string
+}
+
+// webhookDest returns the scan destinations of the webhookColumns.
+func webhookDest(row *webhookRow) []interface{} {
+	return []interface{}{&row.ID, &row.URL, &row.events, &row.Secret, utcTime{&row.CreatedAt}}
+}
+
+func (row webhookRow) webhook() entity.Webhook {
+	webhook := row.Webhook
+	webhook.Events = strings.Fields(row.events)
+	return webhook
+}
+
+// deliveryDest returns the scan destinations of the deliveryColumns.
+func deliveryDest(delivery *entity.WebhookDelivery, payload *[]byte) []interface{} {
+	return []interface{}{
+		&delivery.ID, &delivery.WebhookID, &delivery.EventID, &delivery.EventType, payload, &delivery.Status, &delivery.Attempts,
+		utcTime{&delivery.NextAttemptAt}, &delivery.LastError, &delivery.ResponseStatus, utcTime{&delivery.CreatedAt}, nullUTCTime{&delivery.DeliveredAt},
+	}
+}
+
+// NewWebhookSecret returns a random secret, for the webhooks registered without one.
+func NewWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// withoutSecret is the snapshot of a webhook in the audit events.
+func withoutSecret(webhook entity.Webhook) entity.Webhook {
+	webhook.Secret = ""
+	return webhook
+}
+
+// Add registers a webhook, the secret must not be empty.
+func (s *Webhook) Add(ctx context.Context, querier Querier, URL string, events []string, secret string) (entity.Webhook, error) {
+	var webhook entity.Webhook
+	err := WithTx(ctx, querier, func(tx *Tx) error {
+		var row webhookRow
+		err := tx.QueryRowContext(ctx, insertWebhook, URL, strings.Join(events, " "), secret).Scan(webhookDest(&row)...)
+		if err != nil {
+			log.G(ctx).WithError(err).Error("failed to insert webhook in DB")
+			return ErrGenericDBFailure
+		}
+		webhook = row.webhook()
+		return recordEvent(ctx, tx, entity.AuditActionCreate, "webhook", webhook.ID.String(), nil, withoutSecret(webhook))
+	})
+	return webhook, err
+}
+
+// GetByID returns the webhook along with its secret.
+func (s *Webhook) GetByID(ctx context.Context, querier Querier, ID string) (entity.Webhook, error) {
+	var row webhookRow
+	err := getOne(ctx, querier, selectWebhooks+" WHERE id = $1", []interface{}{ID}, webhookDest(&row)...)
+	if err == ErrNoRows {
+		return row.Webhook, NewNotFoundError("webhook", ID)
+	}
+	return row.webhook(), err
+}
+
+// GetAll returns the webhooks along with their secret, in registration order.
+func (s *Webhook) GetAll(ctx context.Context, querier Querier) ([]entity.Webhook, error) {
+	rows, err := querier.QueryContext(ctx, selectWebhooks+" ORDER BY created_at, id")
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to select webhooks in DB")
+		return nil, ErrGenericDBFailure
+	}
+	defer rows.Close()
+
+	var webhooks []entity.Webhook
+	for rows.Next() {
+		var row webhookRow
+		if err := rows.Scan(webhookDest(&row)...); err != nil {
+			log.G(ctx).WithError(err).Error("failed to scan webhook in DB")
+			return nil, ErrGenericDBFailure
+		}
+		webhooks = append(webhooks, row.webhook())
+	}
+	if err = rows.Err(); err != nil {
+		log.G(ctx).WithError(err).Error("failed to loop through webhooks")
+		return nil, ErrGenericDBFailure
+	}
+	return webhooks, nil
+}
+
+// DeleteByID deletes the webhook along with its deliveries.
+func (s *Webhook) DeleteByID(ctx context.Context, querier Querier, ID string) error {
+	return WithTx(ctx, querier, func(tx *Tx) error {
+		var row webhookRow
+		err := getOne(ctx, tx, deleteWebhook, []interface{}{ID}, webhookDest(&row)...)
+		if err == ErrNoRows {
+			return NewNotFoundError("webhook", ID)
+		} else if err != nil {
+			return err
+		}
+		return recordEvent(ctx, tx, entity.AuditActionDelete, "webhook", ID, withoutSecret(row.webhook()), nil)
+	})
+}
+
+// Enqueue creates a pending delivery of the event for every matching webhook, it returns their
+// number. The event is only delivered once to each webhook, even if it's enqueued again.
+func (s *Webhook) Enqueue(ctx context.Context, querier Querier, event entity.DomainEvent) (int, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to marshal webhook payload")
+		return 0, ErrGenericDBFailure
+	}
+
+	n := 0
+	err = WithTx(ctx, querier, func(tx *Tx) error {
+		webhooks, err := s.GetAll(ctx, tx)
+		if err != nil {
+			return err
+		}
+		n = 0
+		for _, webhook := range webhooks {
+			if !webhook.Matches(event.Type) {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, insertWebhookDelivery, webhook.ID, event.ID, event.Type, string(payload)); err != nil {
+				log.G(ctx).WithError(err).Error("failed to insert webhook delivery in DB")
+				return ErrGenericDBFailure
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Claim returns up to limit pending deliveries due for an attempt, oldest first. They aren't
+// claimed again before the lease expires, unless they are marked as failed.
+func (s *Webhook) Claim(ctx context.Context, querier Querier, limit int, lease time.Duration) ([]entity.WebhookDelivery, error) {
+	deliveries, err := listDeliveries(ctx, querier, claimWebhookDeliveries, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	// RETURNING doesn't keep the order of the subquery.
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID < deliveries[j].ID })
+	return deliveries, nil
+}
+
+func (s *Webhook) MarkDelivered(ctx context.Context, querier Querier, ID int64, responseStatus int) error {
+	if _, err := querier.ExecContext(ctx, markDeliveryDelivered, ID, responseStatus); err != nil {
+		log.G(ctx).WithError(err).Error("failed to update webhook delivery in DB")
+		return ErrGenericDBFailure
+	}
+	return nil
+}
+
+// MarkFailed schedules the next attempt of the delivery after the delay, or moves it to the
+// dead letters if dead is true. responseStatus is 0 when the webhook didn't answer.
+func (s *Webhook) MarkFailed(ctx context.Context, querier Querier, ID int64, responseStatus int, reason string, delay time.Duration, dead bool) error {
+	status := entity.DeliveryStatusPending
+	if dead {
+		status = entity.DeliveryStatusDead
+	}
+	if _, err := querier.ExecContext(ctx, markDeliveryFailed, ID, status, delay.Seconds(), reason, responseStatus); err != nil {
+		log.G(ctx).WithError(err).Error("failed to update webhook delivery in DB")
+		return ErrGenericDBFailure
+	}
+	return nil
+}
+
+// ListDeliveries returns the deliveries of the webhook matching the filter, most recent first.
+func (s *Webhook) ListDeliveries(ctx context.Context, querier Querier, webhookID string, filter entity.DeliveryFilter) ([]entity.WebhookDelivery, error) {
+	if _, err := s.GetByID(ctx, querier, webhookID); err != nil {
+		return nil, err
+	}
+	query := selectWebhookDeliveries + " WHERE webhook_id = $1"
+	args := []interface{}{webhookID}
+	if filter.Status != "" {
+		args = append(args, filter.Status)
+		query += fmt.Sprintf(" AND status = $%d", len(args))
+	}
+	args = append(args, filter.Limit, filter.Offset)
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+	return listDeliveries(ctx, querier, query, args...)
+}
+
+// Replay resets the attempts of a delivery, which is attempted again as soon as possible.
+func (s *Webhook) Replay(ctx context.Context, querier Querier, webhookID string, deliveryID int64) (entity.WebhookDelivery, error) {
+	var delivery entity.WebhookDelivery
+	var payload []byte
+	err := getOne(ctx, querier, replayWebhookDelivery, []interface{}{deliveryID, webhookID}, deliveryDest(&delivery, &payload)...)
+	if err == ErrNoRows {
+		return delivery, NewNotFoundError("delivery", fmt.Sprint(deliveryID))
+	}
+	delivery.Payload = payload
+	return delivery, err
+}
+
+func listDeliveries(ctx context.Context, querier Querier, query string, args ...interface{}) ([]entity.WebhookDelivery, error) {
+	rows, err := querier.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.G(ctx).WithError(err).Error("failed to select webhook deliveries in DB")
+		return nil, ErrGenericDBFailure
+	}
+	defer rows.Close()
+
+	var deliveries []entity.WebhookDelivery
+	for rows.Next() {
+		var delivery entity.WebhookDelivery
+		var payload []byte
+		if err := rows.Scan(deliveryDest(&delivery, &payload)...); err != nil {
+			log.G(ctx).WithError(err).Error("failed to scan webhook delivery in DB")
+			return nil, ErrGenericDBFailure
+		}
+		delivery.Payload = payload
+		deliveries = append(deliveries, delivery)
+	}
+	if err = rows.Err(); err != nil {
+		log.G(ctx).WithError(err).Error("failed to loop through webhook deliveries")
+		return nil, ErrGenericDBFailure
+	}
+	return deliveries, nil
+}
+
+func (s *Webhook) DeleteAll() error {
+	if _, err := s.db.Exec(deleteAllWebhooks); err != nil {
+		return errors.Wrap(err, "failed to truncate webhooks table")
+	}
+	return nil
+}
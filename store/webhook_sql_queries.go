@@ -0,0 +1,111 @@
+package store
+
+// The secrets are stored in clear, they are needed to sign the deliveries. The events column
+// holds the space separated event filters.
+const createTableWebhooks = `
+CREATE EXTENSION IF NOT EXISTS pgcrypto;
+
+CREATE TABLE IF NOT EXISTS webhooks (
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	url TEXT NOT NULL,
+	events TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	created_at timestamp WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id BIGSERIAL PRIMARY KEY,
+	webhook_id UUID NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+	event_id BIGINT NOT NULL,
+	event_type TEXT NOT NULL,
+	payload JSONB NOT NULL,
+	status TEXT DEFAULT 'pending' NOT NULL CONSTRAINT chk_status CHECK (status IN ('pending', 'delivered', 'dead')),
+	attempts INTEGER DEFAULT 0 NOT NULL,
+	next_attempt_at timestamp WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	last_error TEXT DEFAULT '' NOT NULL,
+	response_status INTEGER DEFAULT 0 NOT NULL,
+	created_at timestamp WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+	delivered_at timestamp WITHOUT TIME ZONE,
+	CONSTRAINT unq_webhook_event UNIQUE(webhook_id, event_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_pending ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+
+-- The timestamps were stored in UTC without time zone, they are converted once.
+DO $$
+BEGIN
+	IF (SELECT data_type FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'webhooks' AND column_name = 'created_at') = 'timestamp without time zone' THEN
+		ALTER TABLE webhooks
+			ALTER COLUMN created_at TYPE timestamptz USING created_at AT TIME ZONE 'UTC';
+		ALTER TABLE webhook_deliveries
+			ALTER COLUMN next_attempt_at TYPE timestamptz USING next_attempt_at AT TIME ZONE 'UTC',
+			ALTER COLUMN created_at TYPE timestamptz USING created_at AT TIME ZONE 'UTC',
+			ALTER COLUMN delivered_at TYPE timestamptz USING delivered_at AT TIME ZONE 'UTC';
+	END IF;
+END
+$$;
+`
+
+// webhookColumns must be kept in sync with webhookDest
+const webhookColumns = `id, url, events, secret, created_at`
+
+const insertWebhook = `
+INSERT INTO webhooks (url, events, secret) VALUES ($1, $2, $3)
+RETURNING ` + webhookColumns
+
+const selectWebhooks = `
+SELECT ` + webhookColumns + ` FROM webhooks`
+
+const deleteWebhook = `
+DELETE FROM webhooks WHERE id = $1
+RETURNING ` + webhookColumns
+
+const deleteAllWebhooks = `
+TRUNCATE TABLE webhooks CASCADE
+`
+
+// deliveryColumns must be kept in sync with deliveryDest
+const deliveryColumns = `id, webhook_id, event_id, event_type, payload, status, attempts, next_attempt_at, last_error, response_status, created_at, delivered_at`
+
+// An event redelivered by the outbox isn't delivered twice to the same webhook.
+const insertWebhookDelivery = `
+INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload) VALUES ($1, $2, $3, $4)
+ON CONFLICT (webhook_id, event_id) DO NOTHING
+`
+
+// The deliverers of several instances claim distinct deliveries, the locked ones are skipped.
+const claimWebhookDeliveries = `
+UPDATE webhook_deliveries SET attempts = attempts + 1, next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => $2)
+WHERE id IN (
+	SELECT id FROM webhook_deliveries WHERE status = 'pending' AND next_attempt_at <= CURRENT_TIMESTAMP
+	ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED
+)
+RETURNING ` + deliveryColumns
+
+const markDeliveryDelivered = `
+UPDATE webhook_deliveries SET status = 'delivered', delivered_at = CURRENT_TIMESTAMP, last_error = '', response_status = $2
+WHERE id = $1
+`
+
+const markDeliveryFailed = `
+UPDATE webhook_deliveries SET status = $2, next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => $3), last_error = $4, response_status = $5
+WHERE id = $1
+`
+
+const selectWebhookDeliveries = `
+SELECT ` + deliveryColumns + ` FROM webhook_deliveries`
+
+const replayWebhookDelivery = `
+UPDATE webhook_deliveries SET status = 'pending', attempts = 0, next_attempt_at = CURRENT_TIMESTAMP, delivered_at = NULL
+WHERE id = $1 AND webhook_id = $2
+RETURNING ` + deliveryColumns
+
+// $1 is the JSON of the entity_type and entity_id of the events of an erased entity, see
+// redactDomainEvents. The deliveries aren't indexed by entity, the erasures are rare.
+const selectDeliveryPayloadsForUpdate = `
+SELECT id, payload FROM webhook_deliveries WHERE payload @> $1::jsonb FOR UPDATE`
+
+const updateDeliveryPayload = `
+UPDATE webhook_deliveries SET payload = $2 WHERE id = $1
+`
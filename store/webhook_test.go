@@ -0,0 +1,80 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookDeliveries(t *testing.T) {
+	logger, _ := log.NewTest()
+	db := openSQLite(t)
+	defer db.Close()
+	_, err := NewAuditStore(logger, db)
+	require.NoError(t, err)
+	_, err = NewOutboxStore(logger, db)
+	require.NoError(t, err)
+	webhooks, err := NewWebhookStore(logger, db)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	companies, err := webhooks.Add(ctx, db, "http://localhost/companies", []string{"company.*"}, "secret")
+	require.NoError(t, err)
+	_, err = webhooks.Add(ctx, db, "http://localhost/users", []string{entity.EventUserCreated}, "secret")
+	require.NoError(t, err)
+	got, err := webhooks.GetByID(ctx, db, companies.ID.String())
+	require.NoError(t, err)
+	require.Equal(t, []string{"company.*"}, got.Events)
+	require.Equal(t, "secret", got.Secret)
+
+	// An event enqueued twice is delivered once
+	event := entity.DomainEvent{ID: 42, Type: entity.EventCompanyCreated, EntityType: "company", EntityID: "id"}
+	for k := 0; k < 2; k++ {
+		n, err := webhooks.Enqueue(ctx, db, event)
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+	}
+	deliveries, err := webhooks.Claim(ctx, db, 10, time.Hour)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	delivery := deliveries[0]
+	require.Equal(t, companies.ID, delivery.WebhookID)
+	require.Equal(t, int64(42), delivery.EventID)
+	require.Contains(t, string(delivery.Payload), `"type":"company.created"`)
+	require.Equal(t, 1, delivery.Attempts)
+
+	// A dead delivery isn't claimed again, until it's replayed
+	require.NoError(t, webhooks.MarkFailed(ctx, db, delivery.ID, 503, "unavailable", 0, true))
+	deliveries, err = webhooks.Claim(ctx, db, 10, time.Hour)
+	require.NoError(t, err)
+	require.Empty(t, deliveries)
+	dead, err := webhooks.ListDeliveries(ctx, db, companies.ID.String(), entity.DeliveryFilter{Status: entity.DeliveryStatusDead, Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	require.Equal(t, 503, dead[0].ResponseStatus)
+	require.Equal(t, "unavailable", dead[0].LastError)
+
+	replayed, err := webhooks.Replay(ctx, db, companies.ID.String(), delivery.ID)
+	require.NoError(t, err)
+	require.Equal(t, entity.DeliveryStatusPending, replayed.Status)
+	require.Equal(t, 0, replayed.Attempts)
+	deliveries, err = webhooks.Claim(ctx, db, 10, time.Hour)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	require.NoError(t, webhooks.MarkDelivered(ctx, db, delivery.ID, 200))
+	delivered, err := webhooks.ListDeliveries(ctx, db, companies.ID.String(), entity.DeliveryFilter{Status: entity.DeliveryStatusDelivered, Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, delivered, 1)
+	require.NotNil(t, delivered[0].DeliveredAt)
+
+	// The deliveries are deleted along with their webhook
+	require.NoError(t, webhooks.DeleteByID(ctx, db, companies.ID.String()))
+	_, err = webhooks.ListDeliveries(ctx, db, companies.ID.String(), entity.DeliveryFilter{Limit: 10})
+	require.IsType(t, &NotFoundError{}, err)
+	_, err = webhooks.Replay(ctx, db, companies.ID.String(), delivery.ID)
+	require.IsType(t, &NotFoundError{}, err)
+}
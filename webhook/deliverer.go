@@ -0,0 +1,177 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jordanp/goapp/entity"
+	"github.com/jordanp/goapp/pkg/log"
+	"github.com/jordanp/goapp/store"
+)
+
+// Sink is the outbox sink of the webhooks, it enqueues a delivery of the event for every
+// matching webhook.
+type Sink struct {
+	Store   store.WebhookStore
+	Querier store.Querier
+}
+
+func (s Sink) Deliver(ctx context.Context, event entity.DomainEvent) error {
+	_, err := s.Store.Enqueue(ctx, s.Querier, event)
+	return err
+}
+
+const (
+	// lease hides the claimed deliveries from the other deliverers, it must exceed the time
+	// taken to deliver a batch or its deliveries may be attempted twice. The batches are sized
+	// so that all their deliveries can time out within half the lease.
+	lease           = 5 * time.Minute
+	deliveryTimeout = 10 * time.Second
+	batchSize       = int(lease / deliveryTimeout / 2)
+)
+
+// DefaultRetryPolicy gives up on a delivery after about a day.
+var DefaultRetryPolicy = store.RetryPolicy{MaxAttempts: 12, BaseDelay: 30 * time.Second, MaxDelay: 6 * time.Hour}
+
+// Deliverer polls the pending deliveries and posts them to their webhook. A delivery failing
+// with a network error or a non 2xx status is retried, the delay doubling from the BaseDelay
+// of the policy up to its MaxDelay. It's moved to the dead letters after MaxAttempts.
+type Deliverer struct {
+	log     log.Logger
+	store   store.WebhookStore
+	querier store.Querier
+	client  *http.Client
+	policy  store.RetryPolicy
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewDeliverer starts polling the deliveries every pollInterval, until Stop is called.
+func NewDeliverer(log log.Logger, webhookStore store.WebhookStore, querier store.Querier, client *http.Client, policy store.RetryPolicy, pollInterval time.Duration) *Deliverer {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Deliverer{
+		log:     log,
+		store:   webhookStore,
+		querier: querier,
+		client:  client,
+		policy:  policy,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(d.done)
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			d.deliverAll(ctx)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return d
+}
+
+// Stop cancels the deliveries in progress and waits for the deliverer to return. The
+// deliveries which were claimed but not attempted are claimed again once their lease expires.
+func (d *Deliverer) Stop() {
+	d.cancel()
+	<-d.done
+}
+
+func (d *Deliverer) deliverAll(ctx context.Context) {
+	ctx = log.WithLogger(ctx, d.log)
+	for ctx.Err() == nil {
+		deliveries, err := d.store.Claim(ctx, d.querier, batchSize, lease)
+		if err != nil {
+			return // Logged by the store
+		}
+		webhooks := make(map[uuid.UUID]entity.Webhook)
+		for _, delivery := range deliveries {
+			webhook, ok := webhooks[delivery.WebhookID]
+			if !ok {
+				if webhook, err = d.store.GetByID(ctx, d.querier, delivery.WebhookID.String()); err != nil {
+					continue // Deleted along with its deliveries, or logged by the store
+				}
+				webhooks[delivery.WebhookID] = webhook
+			}
+			d.deliver(ctx, webhook, delivery)
+		}
+		if len(deliveries) < batchSize {
+			return
+		}
+	}
+}
+
+func (d *Deliverer) deliver(ctx context.Context, webhook entity.Webhook, delivery entity.WebhookDelivery) {
+	logger := d.log.F("webhook", webhook.ID, "delivery", delivery.ID, "attempt", delivery.Attempts)
+	postCtx, cancel := context.WithTimeout(ctx, deliveryTimeout) // Whatever the timeout of the client
+	status, err := d.post(postCtx, webhook, delivery)
+	cancel()
+	if err == nil {
+		d.store.MarkDelivered(ctx, d.querier, delivery.ID, status)
+		return
+	}
+	if ctx.Err() != nil {
+		return // Stopped, the delivery is claimed again once its lease expires
+	}
+
+	dead := delivery.Attempts >= d.policy.MaxAttempts
+	delay := d.retryDelay(delivery.Attempts)
+	if dead {
+		logger.WithError(err).Warn("webhook delivery failed for the last time, moved to the dead letters")
+	} else {
+		logger.F("delay", delay.String()).WithError(err).Warn("webhook delivery failed")
+	}
+	d.store.MarkFailed(ctx, d.querier, delivery.ID, status, err.Error(), delay, dead)
+}
+
+// post returns the status of the response of the webhook, if it answered.
+func (d *Deliverer) post(ctx context.Context, webhook entity.Webhook, delivery entity.WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderWebhookID, webhook.ID.String())
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(HeaderEvent, delivery.EventType)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(webhook.Secret, timestamp, delivery.Payload))
+
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10)) // So that the connection is reused
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook answered %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// retryDelay doubles from the BaseDelay of the policy after every failed attempt, up to its
+// MaxDelay.
+func (d *Deliverer) retryDelay(attempts int) time.Duration {
+	delay := d.policy.BaseDelay
+	for k := 1; k < attempts && delay < d.policy.MaxDelay; k++ {
+		delay *= 2
+	}
+	if delay > d.policy.MaxDelay {
+		return d.policy.MaxDelay
+	}
+	return delay
+}
@@ -0,0 +1,50 @@
+// Package webhook delivers the domain events to the webhooks registered by the integrators.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The headers of the deliveries. The signature covers the timestamp and the body, so that a
+// receiver can reject the deliveries replayed by a third party.
+const (
+	HeaderWebhookID = "X-Webhook-ID"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+const signaturePrefix = "sha256="
+
+// Sign returns the signature header of a body sent at timestamp, in Unix seconds: the hex
+// HMAC-SHA256 of "<timestamp>.<body>" keyed by the secret, prefixed with "sha256=".
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature and timestamp headers of a delivery, the timestamp must be
+// within tolerance of now. It's meant for the receivers written in Go.
+func Verify(secret, timestamp, signature string, body []byte, tolerance time.Duration) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp")
+	}
+	if age := time.Since(time.Unix(ts, 0)); age > tolerance || age < -tolerance {
+		return errors.New("timestamp out of tolerance")
+	}
+	if !strings.HasPrefix(signature, signaturePrefix) || !hmac.Equal([]byte(signature), []byte(Sign(secret, ts, body))) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package webhook
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jordanp/goapp/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignature(t *testing.T) {
+	body := []byte(`{"id":1}`)
+	now := time.Now().Unix()
+	signature := Sign("secret", now, body)
+	require.Regexp(t, "^sha256=[0-9a-f]{64}$", signature)
+
+	timestamp := strconv.FormatInt(now, 10)
+	require.NoError(t, Verify("secret", timestamp, signature, body, time.Minute))
+	require.EqualError(t, Verify("other", timestamp, signature, body, time.Minute), "invalid signature")
+	require.EqualError(t, Verify("secret", timestamp, signature, []byte(`{"id":2}`), time.Minute), "invalid signature")
+
+	// The timestamp is signed, an old delivery can't be replayed with a new timestamp
+	old := now - 3600
+	require.EqualError(t, Verify("secret", strconv.FormatInt(old, 10), Sign("secret", old, body), body, time.Minute), "timestamp out of tolerance")
+	require.EqualError(t, Verify("secret", timestamp, Sign("secret", old, body), body, time.Minute), "invalid signature")
+}
+
+func TestRetryDelay(t *testing.T) {
+	d := &Deliverer{policy: store.RetryPolicy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: 5 * time.Second}}
+	require.Equal(t, time.Second, d.retryDelay(1))
+	require.Equal(t, 4*time.Second, d.retryDelay(3))
+	require.Equal(t, 5*time.Second, d.retryDelay(4))
+	require.Equal(t, 5*time.Second, d.retryDelay(100))
+}